@@ -0,0 +1,568 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
+)
+
+//AccountKeyType Klaytn账户密钥类型
+type AccountKeyType uint8
+
+const (
+	AccountKeyTypeNil              AccountKeyType = 0x00 //更新角色密钥时表示不修改
+	AccountKeyTypeLegacy           AccountKeyType = 0x01 //地址由私钥推导
+	AccountKeyTypePublic           AccountKeyType = 0x02 //单个公钥
+	AccountKeyTypeFail             AccountKeyType = 0x03 //禁止发送交易
+	AccountKeyTypeWeightedMultiSig AccountKeyType = 0x04 //加权多签
+	AccountKeyTypeRoleBased        AccountKeyType = 0x05 //按角色使用不同密钥
+
+	MaxWeightedMultiSigKeys = 10 //多签最多公钥数量
+)
+
+//AccountKeyRole 角色密钥的角色
+type AccountKeyRole int
+
+const (
+	RoleTransaction   AccountKeyRole = iota //发送交易
+	RoleAccountUpdate                       //更新账户密钥
+	RoleFeePayer                            //代付手续费
+)
+
+//WeightedPublicKey 多签中的公钥和权重
+type WeightedPublicKey struct {
+	Weight    uint64
+	PublicKey []byte //压缩公钥
+}
+
+//AccountKey Klaytn账户密钥
+type AccountKey struct {
+	Type      AccountKeyType
+	PublicKey []byte               //AccountKeyPublic的压缩公钥
+	Threshold uint64               //多签门限
+	Keys      []*WeightedPublicKey //多签公钥
+	Roles     []*AccountKey        //角色密钥，按RoleTransaction、RoleAccountUpdate、RoleFeePayer排列
+}
+
+//NewAccountKeyPublic 单公钥账户密钥
+func NewAccountKeyPublic(pub []byte) (*AccountKey, error) {
+	compressed, err := compressPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &AccountKey{Type: AccountKeyTypePublic, PublicKey: compressed}, nil
+}
+
+//NewAccountKeyWeightedMultiSig 加权多签账户密钥，签名的权重之和达到threshold才能通过
+func NewAccountKeyWeightedMultiSig(threshold uint64, keys ...*WeightedPublicKey) (*AccountKey, error) {
+	key := &AccountKey{Type: AccountKeyTypeWeightedMultiSig, Threshold: threshold}
+	for _, k := range keys {
+		compressed, err := compressPublicKey(k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		key.Keys = append(key.Keys, &WeightedPublicKey{Weight: k.Weight, PublicKey: compressed})
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//NewAccountKeyRoleBased 角色密钥，roles按RoleTransaction、RoleAccountUpdate、RoleFeePayer排列
+func NewAccountKeyRoleBased(roles ...*AccountKey) (*AccountKey, error) {
+	key := &AccountKey{Type: AccountKeyTypeRoleBased, Roles: roles}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *AccountKey) validate() error {
+	switch k.Type {
+	case AccountKeyTypeNil, AccountKeyTypeLegacy, AccountKeyTypeFail:
+	case AccountKeyTypePublic:
+		if len(k.PublicKey) != 33 {
+			return fmt.Errorf("invalid public key of account key")
+		}
+	case AccountKeyTypeWeightedMultiSig:
+		if len(k.Keys) == 0 || len(k.Keys) > MaxWeightedMultiSigKeys {
+			return fmt.Errorf("weighted multisig key should have 1 ~ %d keys", MaxWeightedMultiSigKeys)
+		}
+		total := uint64(0)
+		for i, key := range k.Keys {
+			if key.Weight == 0 {
+				return fmt.Errorf("weight of multisig key should be greater than 0")
+			}
+			for _, other := range k.Keys[:i] {
+				if bytes.Equal(other.PublicKey, key.PublicKey) {
+					return fmt.Errorf("duplicated public key in multisig key")
+				}
+			}
+			total += key.Weight
+		}
+		if k.Threshold == 0 || total < k.Threshold {
+			return fmt.Errorf("threshold %d of multisig key can not be reached by total weight %d", k.Threshold, total)
+		}
+	case AccountKeyTypeRoleBased:
+		if len(k.Roles) == 0 || len(k.Roles) > int(RoleFeePayer)+1 {
+			return fmt.Errorf("role based key should have 1 ~ %d roles", RoleFeePayer+1)
+		}
+		for _, role := range k.Roles {
+			if role == nil || role.Type == AccountKeyTypeRoleBased {
+				return fmt.Errorf("invalid role key")
+			}
+			if err := role.validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported account key type: %d", k.Type)
+	}
+	return nil
+}
+
+//RoleKey 交易角色使用的密钥，角色密钥缺少的角色使用RoleTransaction的密钥
+func (k *AccountKey) RoleKey(role AccountKeyRole) *AccountKey {
+	if k == nil || k.Type != AccountKeyTypeRoleBased {
+		return k
+	}
+	if int(role) < len(k.Roles) {
+		return k.Roles[role]
+	}
+	return k.Roles[RoleTransaction]
+}
+
+//SignerKeys 需要签名的公钥和门限，Legacy密钥返回nil，使用地址本身的私钥签名
+func (k *AccountKey) SignerKeys() (uint64, []*WeightedPublicKey) {
+	if k == nil {
+		return 0, nil
+	}
+	switch k.Type {
+	case AccountKeyTypePublic:
+		return 1, []*WeightedPublicKey{{Weight: 1, PublicKey: k.PublicKey}}
+	case AccountKeyTypeWeightedMultiSig:
+		return k.Threshold, k.Keys
+	}
+	return 0, nil
+}
+
+//Weight 已签名公钥的权重之和
+func (k *AccountKey) Weight(pubs ...[]byte) uint64 {
+	_, keys := k.SignerKeys()
+	total := uint64(0)
+	for _, key := range keys {
+		for _, pub := range pubs {
+			if compressed, err := compressPublicKey(pub); err == nil && bytes.Equal(compressed, key.PublicKey) {
+				total += key.Weight
+				break
+			}
+		}
+	}
+	return total
+}
+
+//MarshalBinary 账户密钥的RLP编码，用于AccountUpdate交易
+func (k *AccountKey) MarshalBinary() ([]byte, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+	var body interface{}
+	switch k.Type {
+	case AccountKeyTypeNil:
+		return []byte{0x80}, nil
+	case AccountKeyTypeLegacy, AccountKeyTypeFail:
+		body = []interface{}{}
+	case AccountKeyTypePublic:
+		body = k.PublicKey
+	case AccountKeyTypeWeightedMultiSig:
+		keys := make([]interface{}, 0, len(k.Keys))
+		for _, key := range k.Keys {
+			keys = append(keys, []interface{}{key.Weight, key.PublicKey})
+		}
+		body = []interface{}{k.Threshold, keys}
+	case AccountKeyTypeRoleBased:
+		roles := make([][]byte, 0, len(k.Roles))
+		for _, role := range k.Roles {
+			raw, err := role.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			roles = append(roles, raw)
+		}
+		body = roles
+	}
+	raw, err := rlp.EncodeToBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(k.Type)}, raw...), nil
+}
+
+//DecodeAccountKey 解码RLP编码的账户密钥
+func DecodeAccountKey(raw []byte) (*AccountKey, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("account key is empty")
+	}
+	if len(raw) == 1 && raw[0] == 0x80 {
+		return &AccountKey{Type: AccountKeyTypeNil}, nil
+	}
+	key := &AccountKey{Type: AccountKeyType(raw[0])}
+	body := raw[1:]
+	switch key.Type {
+	case AccountKeyTypeLegacy, AccountKeyTypeFail:
+		var empty []interface{}
+		if err := rlp.DecodeBytes(body, &empty); err != nil {
+			return nil, err
+		}
+	case AccountKeyTypePublic:
+		if err := rlp.DecodeBytes(body, &key.PublicKey); err != nil {
+			return nil, err
+		}
+	case AccountKeyTypeWeightedMultiSig:
+		var multisig struct {
+			Threshold uint64
+			Keys      []struct {
+				Weight    uint64
+				PublicKey []byte
+			}
+		}
+		if err := rlp.DecodeBytes(body, &multisig); err != nil {
+			return nil, err
+		}
+		key.Threshold = multisig.Threshold
+		for _, k := range multisig.Keys {
+			key.Keys = append(key.Keys, &WeightedPublicKey{Weight: k.Weight, PublicKey: k.PublicKey})
+		}
+	case AccountKeyTypeRoleBased:
+		var roles [][]byte
+		if err := rlp.DecodeBytes(body, &roles); err != nil {
+			return nil, err
+		}
+		for _, raw := range roles {
+			role, err := DecodeAccountKey(raw)
+			if err != nil {
+				return nil, err
+			}
+			key.Roles = append(key.Roles, role)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported account key type: %d", key.Type)
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//ParseAccountKey 解析klay_getAccountKey返回的JSON，公钥可以是{"x", "y"}或十六进制公钥
+func ParseAccountKey(result gjson.Result) (*AccountKey, error) {
+	//账户不存在时节点返回null，按Legacy处理
+	if !result.Exists() || result.Type == gjson.Null {
+		return &AccountKey{Type: AccountKeyTypeLegacy}, nil
+	}
+	key := &AccountKey{Type: AccountKeyType(result.Get("keyType").Uint())}
+	switch key.Type {
+	case AccountKeyTypeNil, AccountKeyTypeLegacy, AccountKeyTypeFail:
+	case AccountKeyTypePublic:
+		pub, err := parseJSONPublicKey(result.Get("key"))
+		if err != nil {
+			return nil, err
+		}
+		key.PublicKey = pub
+	case AccountKeyTypeWeightedMultiSig:
+		key.Threshold = result.Get("key.threshold").Uint()
+		for _, k := range result.Get("key.keys").Array() {
+			pub, err := parseJSONPublicKey(k.Get("key"))
+			if err != nil {
+				return nil, err
+			}
+			key.Keys = append(key.Keys, &WeightedPublicKey{Weight: k.Get("weight").Uint(), PublicKey: pub})
+		}
+	case AccountKeyTypeRoleBased:
+		for _, r := range result.Get("key").Array() {
+			role, err := ParseAccountKey(r)
+			if err != nil {
+				return nil, err
+			}
+			key.Roles = append(key.Roles, role)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported account key type: %d", key.Type)
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func parseJSONPublicKey(result gjson.Result) ([]byte, error) {
+	if result.IsObject() {
+		x := ethcom.FromHex(result.Get("x").String())
+		y := ethcom.FromHex(result.Get("y").String())
+		pub := make([]byte, 65)
+		pub[0] = 0x04
+		copy(pub[33-len(x):33], x)
+		copy(pub[65-len(y):], y)
+		return compressPublicKey(pub)
+	}
+	return compressPublicKey(ethcom.FromHex(result.String()))
+}
+
+//compressPublicKey 公钥统一为33字节压缩格式，支持压缩公钥、65字节和去掉04前缀的64字节公钥
+func compressPublicKey(pub []byte) ([]byte, error) {
+	switch len(pub) {
+	case 33:
+		if _, err := crypto.DecompressPubkey(pub); err != nil {
+			return nil, err
+		}
+		return pub, nil
+	case 64:
+		pub = append([]byte{0x04}, pub...)
+	}
+	key, err := crypto.UnmarshalPubkey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", hex.EncodeToString(pub))
+	}
+	return crypto.CompressPubkey(key), nil
+}
+
+//accountKeyFromExtParam 读取AccountUpdate交易的新密钥，支持RLP编码的十六进制和klay_getAccountKey格式的JSON
+func accountKeyFromExtParam(result gjson.Result) ([]byte, error) {
+	if !result.Exists() {
+		return nil, fmt.Errorf("accountKey is required")
+	}
+	var (
+		key *AccountKey
+		err error
+	)
+	if result.IsObject() {
+		key, err = ParseAccountKey(result)
+	} else {
+		key, err = DecodeAccountKey(ethcom.FromHex(result.String()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Type == AccountKeyTypeNil {
+		return nil, fmt.Errorf("account key can not be nil")
+	}
+	return key.MarshalBinary()
+}
+
+//txRole 交易类型对应的签名角色
+func txRole(txType KlaytnTxType) AccountKeyRole {
+	if txType.Base() == TxTypeAccountUpdate {
+		return RoleAccountUpdate
+	}
+	return RoleTransaction
+}
+
+// GetAccountKey 查询地址的账户密钥
+func (wm *WalletManager) GetAccountKey(address string) (*AccountKey, error) {
+	return wm.GetAccountKeyContext(context.Background(), address)
+}
+
+//GetAccountKeyContext 支持ctx超时和取消的GetAccountKey
+func (wm *WalletManager) GetAccountKeyContext(ctx context.Context, address string) (*AccountKey, error) {
+	params := []interface{}{
+		AppendOxToAddress(wm.CustomAddressDecodeFunc(address)),
+		"latest",
+	}
+	if wm.WalletClient == nil {
+		return nil, fmt.Errorf("wallet client is not initialized")
+	}
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getAccountKey", params)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAccountKey(*result)
+}
+
+//accountKeySignatures 按地址在链上的密钥生成待签名信息，按accountID分组。
+//多签密钥每个公钥一个待签名信息，公钥属于钱包内地址时记录在该地址的账户下，否则记录在addr的账户下由外部签名
+func (wm *WalletManager) accountKeySignatures(wrapper openwallet.WalletDAI, addr *openwallet.Address, txType KlaytnTxType, role AccountKeyRole, msg []byte, nonce uint64) (map[string][]*openwallet.KeySignature, error) {
+	newKeySignature := func(address *openwallet.Address) *openwallet.KeySignature {
+		return &openwallet.KeySignature{
+			EccType: wm.Config.CurveType,
+			Nonce:   "0x" + strconv.FormatUint(nonce, 16),
+			Address: address,
+			Message: hex.EncodeToString(msg),
+			RSV:     true,
+		}
+	}
+	single := map[string][]*openwallet.KeySignature{
+		addr.AccountID: {newKeySignature(addr)},
+	}
+
+	//以太坊类型交易只能由Legacy密钥的账户发送
+	if txType == TxTypeLegacy || txType == TxTypeEthereumDynamicFee {
+		return single, nil
+	}
+
+	accountKey, err := wm.GetAccountKey(addr.Address)
+	if err != nil {
+		if quorum_rpc.IsMethodNotFoundError(err) {
+			return single, nil
+		}
+		return nil, err
+	}
+	_, keys := accountKey.RoleKey(role).SignerKeys()
+	if len(keys) == 0 {
+		return single, nil
+	}
+
+	signatures := make(map[string][]*openwallet.KeySignature)
+	for _, key := range keys {
+		pubHex := hex.EncodeToString(key.PublicKey)
+		signer := addr
+		if !strings.EqualFold(strings.TrimPrefix(addr.PublicKey, "0x"), pubHex) {
+			owners, findErr := wrapper.GetAddressList(0, 1, "PublicKey", pubHex)
+			if findErr == nil && len(owners) > 0 {
+				signer = owners[0]
+			} else {
+				external := *addr
+				external.PublicKey = pubHex
+				external.HDPath = ""
+				signer = &external
+			}
+		}
+		signatures[signer.AccountID] = append(signatures[signer.AccountID], newKeySignature(signer))
+	}
+	return signatures, nil
+}
+
+//txKeySignatures 交易的全部待签名信息，包括发送者和手续费代付方
+func (wm *WalletManager) txKeySignatures(wrapper openwallet.WalletDAI, addr *openwallet.Address, fd *feeDelegation, txType KlaytnTxType, raw []byte, nonce uint64) (map[string][]*openwallet.KeySignature, error) {
+	msg, feePayerMsg, err := wm.txMessages(raw)
+	if err != nil {
+		return nil, err
+	}
+	signatures, err := wm.accountKeySignatures(wrapper, addr, txType, txRole(txType), msg, nonce)
+	if err != nil {
+		return nil, err
+	}
+	//代付方签名记录在代付地址所属的账户下，由该账户所在的钱包签名
+	if feePayerMsg != nil && fd != nil {
+		feePayerSignatures, err := wm.accountKeySignatures(wrapper, fd.Payer, txType, RoleFeePayer, feePayerMsg, nonce)
+		if err != nil {
+			return nil, err
+		}
+		mergeKeySignatures(signatures, feePayerSignatures)
+	}
+	return signatures, nil
+}
+
+//mergeKeySignatures 合并待签名信息
+func mergeKeySignatures(dst map[string][]*openwallet.KeySignature, src map[string][]*openwallet.KeySignature) {
+	for accountID, keySignatures := range src {
+		dst[accountID] = append(dst[accountID], keySignatures...)
+	}
+}
+
+//collectSignatures 交易单中对msg的全部签名，多签账户会有多个，按签名排序保证交易哈希稳定
+func collectSignatures(signatures map[string][]*openwallet.KeySignature, msg []byte) []*openwallet.KeySignature {
+	message := hex.EncodeToString(msg)
+	signed := make([]*openwallet.KeySignature, 0)
+	for _, keySignatures := range signatures {
+		for _, keySignature := range keySignatures {
+			if len(keySignature.Signature) == 0 {
+				continue
+			}
+			if strings.EqualFold(strings.TrimPrefix(keySignature.Message, "0x"), message) {
+				signed = append(signed, keySignature)
+			}
+		}
+	}
+	sort.Slice(signed, func(i, j int) bool {
+		return signed[i].Signature < signed[j].Signature
+	})
+	return signed
+}
+
+//signatureBytes 签名转为字节
+func signatureBytes(keySignatures []*openwallet.KeySignature) [][]byte {
+	sigs := make([][]byte, 0, len(keySignatures))
+	for _, keySignature := range keySignatures {
+		sigs = append(sigs, ethcom.FromHex(keySignature.Signature))
+	}
+	return sigs
+}
+
+//checkSignatureThreshold Klaytn类型交易按发送者和手续费代付方链上的角色密钥检查签名权重，
+//多签账户已签名公钥的权重之和未达到门限时节点会拒绝交易，在广播前返回错误
+func (wm *WalletManager) checkSignatureThreshold(raw []byte, signatures map[string][]*openwallet.KeySignature) error {
+	//以太坊类型交易只能由Legacy密钥的账户发送，只有一个签名
+	if !IsKlaytnTypedTx(raw) || IsDynamicFeeTx(raw) {
+		return nil
+	}
+	tx, err := DecodeKlaytnTx(raw)
+	if err != nil {
+		return err
+	}
+	msg, feePayerMsg, err := wm.txMessages(raw)
+	if err != nil {
+		return err
+	}
+	if err := wm.checkKeyWeight(tx.From, txRole(tx.Type), msg, collectSignatures(signatures, msg)); err != nil {
+		return err
+	}
+	if feePayerMsg != nil {
+		return wm.checkKeyWeight(tx.FeePayer, RoleFeePayer, feePayerMsg, collectSignatures(signatures, feePayerMsg))
+	}
+	return nil
+}
+
+//checkKeyWeight 从签名恢复公钥，累加地址在role角色密钥中的权重并与门限比较，Legacy密钥和不支持klay_getAccountKey的节点不检查
+func (wm *WalletManager) checkKeyWeight(address ethcom.Address, role AccountKeyRole, msg []byte, signed []*openwallet.KeySignature) error {
+	addr := wm.CustomAddressEncodeFunc(strings.ToLower(address.Hex()))
+	accountKey, err := wm.GetAccountKey(addr)
+	if err != nil {
+		if quorum_rpc.IsMethodNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	key := accountKey.RoleKey(role)
+	threshold, keys := key.SignerKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+	pubs := make([][]byte, 0, len(signed))
+	for _, keySignature := range signed {
+		pub, err := crypto.SigToPub(msg, ethcom.FromHex(keySignature.Signature))
+		if err != nil {
+			return err
+		}
+		pubs = append(pubs, crypto.FromECDSAPub(pub))
+	}
+	if weight := key.Weight(pubs...); weight < threshold {
+		return fmt.Errorf("signature weight %d of %s does not reach the threshold %d", weight, addr, threshold)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tidwall/gjson"
+)
+
+//testAccountKeyWrapper 按公钥查找钱包内地址
+type testAccountKeyWrapper struct {
+	openwallet.WalletDAIBase
+	addresses []*openwallet.Address
+}
+
+func (w *testAccountKeyWrapper) GetAddressList(offset, limit int, cols ...interface{}) ([]*openwallet.Address, error) {
+	for _, addr := range w.addresses {
+		if len(cols) == 2 && cols[0] == "PublicKey" && addr.PublicKey == cols[1] {
+			return []*openwallet.Address{addr}, nil
+		}
+	}
+	return nil, nil
+}
+
+func testJSONPublicKey(key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"x": hexutil.EncodeBig(key.PublicKey.X),
+		"y": hexutil.EncodeBig(key.PublicKey.Y),
+	}
+}
+
+func TestAccountKey_MarshalAndDecode(t *testing.T) {
+	k1, _ := crypto.GenerateKey()
+	k2, _ := crypto.GenerateKey()
+	public, err := NewAccountKeyPublic(crypto.FromECDSAPub(&k1.PublicKey))
+	if err != nil {
+		t.Fatalf("new public key failed, err: %v", err)
+	}
+	multisig, err := NewAccountKeyWeightedMultiSig(2,
+		&WeightedPublicKey{Weight: 1, PublicKey: crypto.CompressPubkey(&k1.PublicKey)},
+		&WeightedPublicKey{Weight: 1, PublicKey: crypto.FromECDSAPub(&k2.PublicKey)},
+	)
+	if err != nil {
+		t.Fatalf("new multisig key failed, err: %v", err)
+	}
+	roleBased, err := NewAccountKeyRoleBased(multisig, public)
+	if err != nil {
+		t.Fatalf("new role based key failed, err: %v", err)
+	}
+
+	keys := []*AccountKey{
+		{Type: AccountKeyTypeNil},
+		{Type: AccountKeyTypeLegacy},
+		{Type: AccountKeyTypeFail},
+		public,
+		multisig,
+		roleBased,
+	}
+	for _, key := range keys {
+		raw, err := key.MarshalBinary()
+		if err != nil {
+			t.Errorf("type %d marshal failed, err: %v", key.Type, err)
+			continue
+		}
+		decoded, err := DecodeAccountKey(raw)
+		if err != nil {
+			t.Errorf("type %d decode failed, err: %v", key.Type, err)
+			continue
+		}
+		reencoded, _ := decoded.MarshalBinary()
+		if !bytes.Equal(raw, reencoded) {
+			t.Errorf("type %d round trip mismatch", key.Type)
+		}
+	}
+
+	if raw, _ := (&AccountKey{Type: AccountKeyTypeLegacy}).MarshalBinary(); hex.EncodeToString(raw) != "01c0" {
+		t.Errorf("legacy key = %x, want 01c0", raw)
+	}
+	if _, err := NewAccountKeyWeightedMultiSig(3,
+		&WeightedPublicKey{Weight: 1, PublicKey: crypto.CompressPubkey(&k1.PublicKey)},
+		&WeightedPublicKey{Weight: 1, PublicKey: crypto.CompressPubkey(&k2.PublicKey)},
+	); err == nil {
+		t.Errorf("unreachable threshold should fail")
+	}
+}
+
+func TestParseAccountKey(t *testing.T) {
+	k1, _ := crypto.GenerateKey()
+	k2, _ := crypto.GenerateKey()
+	json := `{"keyType":5,"key":[` +
+		`{"keyType":4,"key":{"threshold":2,"keys":[` +
+		`{"weight":1,"key":{"x":"` + hexutil.EncodeBig(k1.PublicKey.X) + `","y":"` + hexutil.EncodeBig(k1.PublicKey.Y) + `"}},` +
+		`{"weight":1,"key":{"x":"` + hexutil.EncodeBig(k2.PublicKey.X) + `","y":"` + hexutil.EncodeBig(k2.PublicKey.Y) + `"}}]}},` +
+		`{"keyType":2,"key":{"x":"` + hexutil.EncodeBig(k1.PublicKey.X) + `","y":"` + hexutil.EncodeBig(k1.PublicKey.Y) + `"}}]}`
+
+	key, err := ParseAccountKey(gjson.Parse(json))
+	if err != nil {
+		t.Fatalf("parse failed, err: %v", err)
+	}
+	if key.Type != AccountKeyTypeRoleBased || len(key.Roles) != 2 {
+		t.Fatalf("unexpected account key: %+v", key)
+	}
+
+	threshold, keys := key.RoleKey(RoleTransaction).SignerKeys()
+	if threshold != 2 || len(keys) != 2 {
+		t.Errorf("transaction role threshold = %d, keys = %d", threshold, len(keys))
+	}
+	if key.RoleKey(RoleAccountUpdate).Type != AccountKeyTypePublic {
+		t.Errorf("account update role should be public key")
+	}
+	//缺少的角色使用RoleTransaction的密钥
+	if key.RoleKey(RoleFeePayer).Type != AccountKeyTypeWeightedMultiSig {
+		t.Errorf("fee payer role should fall back to transaction role")
+	}
+
+	multisig := key.RoleKey(RoleTransaction)
+	if w := multisig.Weight(crypto.FromECDSAPub(&k1.PublicKey)); w != 1 {
+		t.Errorf("weight of one signer = %d, want 1", w)
+	}
+	if w := multisig.Weight(crypto.CompressPubkey(&k1.PublicKey), crypto.CompressPubkey(&k2.PublicKey)); w != 2 {
+		t.Errorf("weight of two signers = %d, want 2", w)
+	}
+
+	if legacy, err := ParseAccountKey(gjson.Parse("null")); err != nil || legacy.Type != AccountKeyTypeLegacy {
+		t.Errorf("null account key should be legacy")
+	}
+}
+
+func TestAccountKeyFromExtParam(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	public, _ := NewAccountKeyPublic(crypto.FromECDSAPub(&key.PublicKey))
+	want, _ := public.MarshalBinary()
+
+	ext := gjson.Parse(`{"hex":"` + hexutil.Encode(want) + `","json":{"keyType":2,"key":"` + hexutil.Encode(crypto.FromECDSAPub(&key.PublicKey)) + `"},"nil":"0x80"}`)
+	for _, name := range []string{"hex", "json"} {
+		raw, err := accountKeyFromExtParam(ext.Get(name))
+		if err != nil || !bytes.Equal(raw, want) {
+			t.Errorf("%s account key = %x, err: %v", name, raw, err)
+		}
+	}
+	if _, err := accountKeyFromExtParam(ext.Get("nil")); err == nil {
+		t.Errorf("nil account key should fail")
+	}
+	if _, err := accountKeyFromExtParam(ext.Get("missing")); err == nil {
+		t.Errorf("missing account key should fail")
+	}
+}
+
+func TestWalletManager_SignRawTxMultiSig(t *testing.T) {
+	node := quorum_rpc.NewFakeNode(1001)
+	wm := testNewFakeWalletManager(node)
+
+	keys := make([]*ecdsa.PrivateKey, 3)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	from := crypto.PubkeyToAddress(keys[0].PublicKey)
+	node.Handle("klay_getAccountKey", func(params gjson.Result) (interface{}, error) {
+		weighted := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			weighted = append(weighted, map[string]interface{}{"weight": 1, "key": testJSONPublicKey(key)})
+		}
+		return map[string]interface{}{
+			"keyType": AccountKeyTypeWeightedMultiSig,
+			"key":     map[string]interface{}{"threshold": 2, "keys": weighted},
+		}, nil
+	})
+
+	addr := &openwallet.Address{
+		AccountID: "treasury",
+		Address:   "0x" + hex.EncodeToString(from.Bytes()),
+		PublicKey: hex.EncodeToString(crypto.CompressPubkey(&keys[0].PublicKey)),
+		HDPath:    "m/44'/88'/0'/0/0",
+	}
+	cosigner := &openwallet.Address{
+		AccountID: "cosigner",
+		Address:   crypto.PubkeyToAddress(keys[1].PublicKey).Hex(),
+		PublicKey: hex.EncodeToString(crypto.CompressPubkey(&keys[1].PublicKey)),
+		HDPath:    "m/44'/88'/0'/0/1",
+	}
+	wrapper := &testAccountKeyWrapper{addresses: []*openwallet.Address{addr, cosigner}}
+
+	to := ethcom.HexToAddress("0x8b1a3a9d6b2a6d0e0a3f9e5b2c7b7b1b7b7b7b7b")
+	raw, msg, err := wm.buildUnsignedTx(&unsignedTx{
+		Type:     TxTypeValueTransfer,
+		Nonce:    1,
+		From:     from,
+		To:       &to,
+		Value:    big.NewInt(1),
+		Gas:      21000,
+		GasPrice: big.NewInt(25000000000),
+	})
+	if err != nil {
+		t.Fatalf("build failed, err: %v", err)
+	}
+
+	signatures, err := wm.txKeySignatures(wrapper, addr, nil, TxTypeValueTransfer, raw, 1)
+	if err != nil {
+		t.Fatalf("key signatures failed, err: %v", err)
+	}
+	if len(signatures["treasury"]) != 2 || len(signatures["cosigner"]) != 1 {
+		t.Fatalf("each multisig key should have a key signature, got %d treasury, %d cosigner",
+			len(signatures["treasury"]), len(signatures["cosigner"]))
+	}
+	//不在钱包内的公钥由外部签名，没有衍生路径
+	if external := signatures["treasury"][1]; external.Address.HDPath != "" || external.Address.PublicKey == addr.PublicKey {
+		t.Errorf("external key signature should have no HD path")
+	}
+
+	//门限为2，只有一个公钥签名时不能提交
+	sig0, _ := crypto.Sign(msg, keys[0])
+	signatures["treasury"][0].Signature = hex.EncodeToString(sig0)
+	if _, _, _, err := wm.signRawTxWithKeySignatures(raw, signatures); err == nil {
+		t.Fatalf("partially signed 2-of-3 transaction should fail")
+	}
+	rawTx := &openwallet.RawTransaction{RawHex: hex.EncodeToString(raw), Signatures: signatures}
+	if err := NewTransactionDecoder(wm).VerifyRawTransaction(wrapper, rawTx); err == nil {
+		t.Fatalf("partially signed 2-of-3 transaction should not be verified")
+	}
+
+	//钱包内的两个公钥签名后即可提交
+	sig1, _ := crypto.Sign(msg, keys[1])
+	signatures["cosigner"][0].Signature = hex.EncodeToString(sig1)
+
+	signed, sender, nonce, err := wm.signRawTxWithKeySignatures(raw, signatures)
+	if err != nil || nonce != 1 {
+		t.Fatalf("sign failed, nonce: %d, err: %v", nonce, err)
+	}
+	if sender != addr.Address {
+		t.Errorf("sender = %s, want %s", sender, addr.Address)
+	}
+	if err := NewTransactionDecoder(wm).VerifyRawTransaction(wrapper, rawTx); err != nil {
+		t.Errorf("transaction signed by the threshold should be verified, err: %v", err)
+	}
+	tx, err := DecodeKlaytnTx(signed)
+	if err != nil {
+		t.Fatalf("decode failed, err: %v", err)
+	}
+	if len(tx.Signatures) != 2 {
+		t.Errorf("signed tx should have 2 signatures, got %d", len(tx.Signatures))
+	}
+}
+
+func TestAddressDecoder_RedeemScriptToAddress(t *testing.T) {
+	k1, _ := crypto.GenerateKey()
+	k2, _ := crypto.GenerateKey()
+	pubs := [][]byte{crypto.FromECDSAPub(&k1.PublicKey), crypto.FromECDSAPub(&k2.PublicKey)}
+
+	//公钥不能推导出多签地址，不能返回只由第一个公钥控制的地址
+	if addr, err := (&AddressDecoder{}).RedeemScriptToAddress(pubs, 2, false); err == nil {
+		t.Errorf("redeem script to address should not be supported, got %s", addr)
+	}
+}
@@ -1,6 +1,8 @@
 package quorum
 
 import (
+	"fmt"
+
 	"github.com/assetsadapterstore/klaytn-adapter/quorum_addrdec"
 )
 
@@ -18,9 +20,11 @@ func (decoder *AddressDecoder) PublicKeyToAddress(pub []byte, isTestnet bool) (s
 	return quorum_addrdec.Default.AddressEncode(pub)
 }
 
-//RedeemScriptToAddress 多重签名赎回脚本转地址
+//RedeemScriptToAddress 多重签名赎回脚本转地址，Klaytn的公钥不能推导出多签地址，不支持
 func (decoder *AddressDecoder) RedeemScriptToAddress(pubs [][]byte, required uint64, isTestnet bool) (string, error) {
-	return "", nil
+	return "", fmt.Errorf("klaytn does not derive a multisig address from public keys, " +
+		"install a weighted multisig key on an existing account by an AccountUpdate transaction " +
+		"(ExtParam {\"txType\": \"AccountUpdate\", \"accountKey\": ...}) and check it with klay_getAccountKey")
 }
 
 //WIFToPrivateKey WIF转私钥
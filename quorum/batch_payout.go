@@ -0,0 +1,231 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/common"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	ethcom "github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	//BATCH_TRANSFER_ABI_JSON 批量转账合约的接口，batchTransfer随交易转入KLAY后分发，
+	//batchTransferToken通过transferFrom从发送地址转出代币，需要先approve批量转账合约
+	BATCH_TRANSFER_ABI_JSON = `[{"constant":false,"inputs":[{"name":"recipients","type":"address[]"},{"name":"amounts","type":"uint256[]"}],"name":"batchTransfer","outputs":[],"payable":true,"stateMutability":"payable","type":"function"},{"constant":false,"inputs":[{"name":"token","type":"address"},{"name":"recipients","type":"address[]"},{"name":"amounts","type":"uint256[]"}],"name":"batchTransferToken","outputs":[],"payable":false,"stateMutability":"nonpayable","type":"function"}]`
+)
+
+var (
+	BATCH_TRANSFER_ABI, _ = abi.JSON(strings.NewReader(BATCH_TRANSFER_ABI_JSON))
+)
+
+//errMultipleRecipients 没有配置批量转账合约时，CreateRawTransaction不能构建多个接收地址的交易单
+const errMultipleRecipients = "multiple recipients need batchTransferContract, use BatchTransactionDecoder.CreateBatchRawTransaction to build one transaction per recipient"
+
+//BatchTransactionDecoder 可选的交易单解析器接口，GetTransactionDecoder返回的解析器实现此接口，
+//没有配置批量转账合约时，多个接收地址的交易单通过类型断言调用CreateBatchRawTransaction逐笔构建
+type BatchTransactionDecoder interface {
+	openwallet.TransactionDecoder
+
+	//CreateBatchRawTransaction 创建多个接收地址的转账，每笔交易的错误记录在RawTransactionWithError中
+	CreateBatchRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) ([]*openwallet.RawTransactionWithError, error)
+}
+
+var _ BatchTransactionDecoder = (*EthTransactionDecoder)(nil)
+
+//sortedRecipients 按地址排序的接收地址，保证构建顺序和nonce分配稳定
+func sortedRecipients(to map[string]string) []string {
+	recipients := make([]string, 0, len(to))
+	for address := range to {
+		recipients = append(recipients, address)
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+//batchTransferCall 多个接收地址的批量转账合约调用，返回合约地址、合计金额和调用数据
+func (decoder *EthTransactionDecoder) batchTransferCall(rawTx *openwallet.RawTransaction) (string, *big.Int, []byte, error) {
+	contract := decoder.wm.Config.BatchTransferContract
+	if len(contract) == 0 {
+		return "", nil, nil, fmt.Errorf(errMultipleRecipients)
+	}
+
+	decimals := decoder.wm.Decimal()
+	if rawTx.Coin.IsContract {
+		decimals = decoder.wm.tokenDecimals(rawTx.Coin.Contract)
+	}
+	var (
+		recipients = make([]ethcom.Address, 0, len(rawTx.To))
+		amounts    = make([]*big.Int, 0, len(rawTx.To))
+		total      = new(big.Int)
+	)
+	for _, to := range sortedRecipients(rawTx.To) {
+		amount := common.StringNumToBigIntWithExp(rawTx.To[to], decimals)
+		if amount.Sign() <= 0 {
+			return "", nil, nil, fmt.Errorf("the amount to %s should be greater than 0", to)
+		}
+		recipients = append(recipients, ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(to)))
+		amounts = append(amounts, amount)
+		total.Add(total, amount)
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if rawTx.Coin.IsContract {
+		token := ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(rawTx.Coin.Contract.Address))
+		data, err = BATCH_TRANSFER_ABI.Pack("batchTransferToken", token, recipients, amounts)
+	} else {
+		data, err = BATCH_TRANSFER_ABI.Pack("batchTransfer", recipients, amounts)
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return contract, total, data, nil
+}
+
+//batchSpent 逐笔构建批量转账时各地址已分配的金额和nonce，选择发送地址时从余额中扣除
+type batchSpent struct {
+	coin   map[string]*big.Int
+	token  map[string]*big.Int
+	nonces map[string]uint64
+}
+
+func newBatchSpent() *batchSpent {
+	return &batchSpent{
+		coin:   make(map[string]*big.Int),
+		token:  make(map[string]*big.Int),
+		nonces: make(map[string]uint64),
+	}
+}
+
+func spentAvailable(spent map[string]*big.Int, address string, balance *big.Int) *big.Int {
+	if used, ok := spent[address]; ok {
+		return new(big.Int).Sub(balance, used)
+	}
+	return balance
+}
+
+func addSpent(spent map[string]*big.Int, address string, amount *big.Int) {
+	if amount == nil {
+		return
+	}
+	if used, ok := spent[address]; ok {
+		spent[address] = new(big.Int).Add(used, amount)
+		return
+	}
+	spent[address] = new(big.Int).Set(amount)
+}
+
+//coinAvailable 扣除已分配后的主币余额，不是批量转账时原样返回
+func (s *batchSpent) coinAvailable(address string, balance *big.Int) *big.Int {
+	if s == nil {
+		return balance
+	}
+	return spentAvailable(s.coin, address, balance)
+}
+
+//tokenAvailable 扣除已分配后的代币余额，不是批量转账时原样返回
+func (s *batchSpent) tokenAvailable(address string, balance *big.Int) *big.Int {
+	if s == nil {
+		return balance
+	}
+	return spentAvailable(s.token, address, balance)
+}
+
+//nonce NonceComputeMode = 1时不在本地跟踪nonce，同一地址的后续交易在上一笔的基础上递增
+func (s *batchSpent) nonce(wm *WalletManager, address string) (*uint64, error) {
+	if s == nil || wm.Config.NonceComputeMode != 1 {
+		return nil, nil
+	}
+	if last, ok := s.nonces[address]; ok {
+		next := last + 1
+		return &next, nil
+	}
+	nonce, err := wm.GetTransactionCount(address)
+	if err != nil {
+		return nil, err
+	}
+	return &nonce, nil
+}
+
+//add 记录交易构建成功后地址分配的金额和nonce
+func (s *batchSpent) add(address string, coin, token *big.Int, nonce *uint64) {
+	if s == nil {
+		return
+	}
+	addSpent(s.coin, address, coin)
+	addSpent(s.token, address, token)
+	if nonce != nil {
+		s.nonces[address] = *nonce
+	}
+}
+
+//CreateBatchRawTransaction 创建多个接收地址的转账。配置了批量转账合约时构建一笔合约调用，
+//否则每个接收地址一笔交易，同一发送地址的交易使用连续的nonce，每笔交易的错误记录在RawTransactionWithError中
+func (decoder *EthTransactionDecoder) CreateBatchRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) ([]*openwallet.RawTransactionWithError, error) {
+	if len(rawTx.To) == 0 {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "recipients are empty")
+	}
+	if rawTx.Coin.IsContract && isNFTProtocol(tokenProtocol(rawTx.Coin.Contract)) && len(rawTx.To) > 1 {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "%s token does not support batch transfer", tokenProtocol(rawTx.Coin.Contract))
+	}
+
+	//只有一个接收地址，或通过批量转账合约一次转出
+	if len(rawTx.To) == 1 || len(decoder.wm.Config.BatchTransferContract) > 0 {
+		err := decoder.CreateRawTransaction(wrapper, rawTx)
+		return []*openwallet.RawTransactionWithError{{RawTx: rawTx, Error: openwallet.ConvertError(err)}}, nil
+	}
+
+	if rawTx.GetExtParam().Get("nonce").Exists() {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "nonce in ExtParam is not supported by multiple transactions")
+	}
+
+	var (
+		rawTxArray = make([]*openwallet.RawTransactionWithError, 0, len(rawTx.To))
+		spent      = newBatchSpent()
+	)
+	for _, to := range sortedRecipients(rawTx.To) {
+		payout := &openwallet.RawTransaction{
+			Coin:     rawTx.Coin,
+			Account:  rawTx.Account,
+			To:       map[string]string{to: rawTx.To[to]},
+			FeeRate:  rawTx.FeeRate,
+			ExtParam: rawTx.ExtParam,
+			Required: rawTx.Required,
+		}
+		var err error
+		if rawTx.Coin.IsContract {
+			err = decoder.createErc20TokenRawTransaction(wrapper, payout, spent)
+		} else {
+			err = decoder.createSimpleRawTransaction(wrapper, payout, nil, spent)
+		}
+		if err != nil {
+			decoder.wm.Log.Errorf("create payout to %s failed, err: %v", to, err)
+		}
+		rawTxArray = append(rawTxArray, &openwallet.RawTransactionWithError{
+			RawTx: payout,
+			Error: openwallet.ConvertError(err),
+		})
+	}
+	return rawTxArray, nil
+}
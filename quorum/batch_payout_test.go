@@ -0,0 +1,219 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func testNewBatchPayout(nonceComputeMode int64) (*quorum_rpc.FakeNode, *WalletManager, *testTokenWrapper) {
+	var (
+		rich = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		poor = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetBalance(rich, big.NewInt(2e18))
+	node.SetBalance(poor, big.NewInt(1e17))
+	node.SetNonce(rich, 4)
+
+	wm := testNewFakeWalletManager(node)
+	wm.Config.FixGasLimit = big.NewInt(21000)
+	wm.Config.FixGasPrice = big.NewInt(0)
+	wm.Config.OffsetsGasPrice = big.NewInt(0)
+	wm.Config.NonceComputeMode = nonceComputeMode
+	wrapper := &testTokenWrapper{addresses: []*openwallet.Address{
+		{AccountID: "payout", Address: poor},
+		{AccountID: "payout", Address: rich},
+	}}
+	return node, wm, wrapper
+}
+
+func TestTransactionDecoder_CreateBatchRawTransactionOffline(t *testing.T) {
+	var (
+		rich  = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		toA   = "0x1111111111111111111111111111111111111111"
+		toB   = "0x2222222222222222222222222222222222222222"
+		toC   = "0x3333333333333333333333333333333333333333"
+		toBig = "0x4444444444444444444444444444444444444444"
+	)
+
+	for _, mode := range []int64{0, 1} {
+		_, wm, wrapper := testNewBatchPayout(mode)
+		//应用通过GetTransactionDecoder的类型断言使用逐笔构建
+		decoder, ok := wm.GetTransactionDecoder().(BatchTransactionDecoder)
+		if !ok {
+			t.Fatalf("transaction decoder should implement BatchTransactionDecoder")
+		}
+		rawTx := &openwallet.RawTransaction{
+			Coin:    openwallet.Coin{Symbol: "KLAY"},
+			Account: &openwallet.AssetsAccount{AccountID: "payout"},
+			To:      map[string]string{toA: "0.8", toB: "0.8", toC: "0.05", toBig: "0.5"},
+		}
+
+		//没有批量转账合约时不再只取第一个接收地址，标准接口返回错误并提示逐笔构建
+		err := decoder.CreateRawTransaction(wrapper, rawTx)
+		if owErr := openwallet.ConvertError(err); owErr == nil || owErr.Code() != openwallet.ErrCreateRawTransactionFailed ||
+			!strings.Contains(owErr.Error(), "CreateBatchRawTransaction") {
+			t.Fatalf("mode %d: multiple recipients without batch contract should fail, got %v", mode, err)
+		}
+		if len(rawTx.RawHex) > 0 {
+			t.Fatalf("mode %d: no transaction should be built for multiple recipients", mode)
+		}
+
+		results, err := decoder.CreateBatchRawTransaction(wrapper, rawTx)
+		if err != nil {
+			t.Fatalf("mode %d: create batch raw transaction failed: %v", mode, err)
+		}
+		if len(results) != 4 {
+			t.Fatalf("mode %d: expected one transaction per recipient, got %d", mode, len(results))
+		}
+
+		//toA、toB由余额充足的地址连续nonce转出，toBig超出剩余余额，toC由余额少的地址转出
+		wantNonces := map[string]uint64{toA: 4, toB: 5, toC: 0}
+		for _, result := range results {
+			var to string
+			for k := range result.RawTx.To {
+				to = k
+			}
+			if to == toBig {
+				if result.Error == nil || result.Error.Code() != openwallet.ErrInsufficientBalanceOfAccount {
+					t.Errorf("mode %d: payout to %s should fail with insufficient balance, got %v", mode, to, result.Error)
+				}
+				continue
+			}
+			if result.Error != nil {
+				t.Errorf("mode %d: payout to %s failed: %v", mode, to, result.Error)
+				continue
+			}
+			tx := &types.Transaction{}
+			if err := rlp.DecodeBytes(ethcom.FromHex(result.RawTx.RawHex), tx); err != nil {
+				t.Fatalf("mode %d: decode payout to %s failed: %v", mode, to, err)
+			}
+			if tx.Nonce() != wantNonces[to] || !strings.EqualFold(tx.To().Hex(), to) {
+				t.Errorf("mode %d: payout to %s: nonce %d, to %s", mode, to, tx.Nonce(), tx.To().Hex())
+			}
+			if to != toC && !strings.HasPrefix(result.RawTx.TxFrom[0], rich+":") {
+				t.Errorf("mode %d: payout to %s should be sent by %s, got %v", mode, to, rich, result.RawTx.TxFrom)
+			}
+		}
+	}
+}
+
+func TestTransactionDecoder_BatchTransferContractOffline(t *testing.T) {
+	var (
+		contract = "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b"
+		toA      = "0x1111111111111111111111111111111111111111"
+		toB      = "0x2222222222222222222222222222222222222222"
+	)
+	_, wm, wrapper := testNewBatchPayout(0)
+	wm.Config.FixGasLimit = big.NewInt(100000)
+	wm.Config.BatchTransferContract = contract
+	decoder := NewTransactionDecoder(wm)
+
+	rawTx := &openwallet.RawTransaction{
+		Coin:    openwallet.Coin{Symbol: "KLAY"},
+		Account: &openwallet.AssetsAccount{AccountID: "payout"},
+		To:      map[string]string{toB: "0.2", toA: "0.3"},
+	}
+	results, err := decoder.CreateBatchRawTransaction(wrapper, rawTx)
+	if err != nil || len(results) != 1 || results[0].Error != nil {
+		t.Fatalf("create batch transfer call failed: %v, %+v", err, results)
+	}
+
+	tx := &types.Transaction{}
+	if err := rlp.DecodeBytes(ethcom.FromHex(rawTx.RawHex), tx); err != nil {
+		t.Fatalf("decode batch transfer call failed: %v", err)
+	}
+	wantData, _ := BATCH_TRANSFER_ABI.Pack("batchTransfer",
+		[]ethcom.Address{ethcom.HexToAddress(toA), ethcom.HexToAddress(toB)}, []*big.Int{big.NewInt(3e17), big.NewInt(2e17)})
+	if !strings.EqualFold(tx.To().Hex(), contract) || tx.Value().Cmp(big.NewInt(5e17)) != 0 || !bytes.Equal(tx.Data(), wantData) {
+		t.Errorf("unexpected batch transfer call: to %s, value %v", tx.To().Hex(), tx.Value())
+	}
+	if len(rawTx.TxTo) != 2 || rawTx.TxTo[0] != toA+":0.3" || rawTx.TxTo[1] != toB+":0.2" {
+		t.Errorf("every recipient should be recorded, got %v", rawTx.TxTo)
+	}
+	if rawTx.TxAmount != "-0.5" {
+		t.Errorf("tx amount = %s, want -0.5", rawTx.TxAmount)
+	}
+}
+
+func TestTransactionDecoder_BatchTransferTokenAllowanceOffline(t *testing.T) {
+	var (
+		contract = "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b"
+		token    = "0x9d2f4f1e5c5a4b1b3f2c8d5e6a7b8c9d0e1f2a3b"
+		rich     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		poor     = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+		toA      = "0x1111111111111111111111111111111111111111"
+		toB      = "0x2222222222222222222222222222222222222222"
+	)
+	node, wm, wrapper := testNewBatchPayout(0)
+	wm.Config.FixGasLimit = big.NewInt(100000)
+	wm.Config.BatchTransferContract = contract
+	decoder := NewTransactionDecoder(wm)
+
+	balanceOf := func(owner string) string {
+		data, _ := wm.EncodeABIParam(ERC20_ABI, "balanceOf", owner)
+		return hexutil.Encode(data)
+	}
+	allowance := func(owner string) string {
+		data, _ := wm.EncodeABIParam(ERC20_ABI, "allowance", owner, contract)
+		return hexutil.Encode(data)
+	}
+	node.SetCallResult(token, balanceOf(rich), "0x"+abiWord("3e8"))
+	node.SetCallResult(token, balanceOf(poor), "0x"+abiWord("0"))
+	//只授权了0.5个代币，转出合计5个
+	node.SetCallResult(token, allowance(rich), "0x"+abiWord("32"))
+
+	newRawTx := func() *openwallet.RawTransaction {
+		return &openwallet.RawTransaction{
+			Coin: openwallet.Coin{Symbol: "KLAY", IsContract: true, ContractID: "token",
+				Contract: openwallet.SmartContract{Address: token, Symbol: "KLAY", Token: "TKN", Decimals: 2}},
+			Account: &openwallet.AssetsAccount{AccountID: "payout"},
+			To:      map[string]string{toA: "2", toB: "3"},
+		}
+	}
+
+	rawTx := newRawTx()
+	err := decoder.CreateRawTransaction(wrapper, rawTx)
+	if owErr := openwallet.ConvertError(err); owErr == nil || !strings.Contains(owErr.Error(), "approve") {
+		t.Fatalf("insufficient allowance should fail with a clear error, got %v", err)
+	}
+
+	node.SetCallResult(token, allowance(rich), "0x"+abiWord("1f4"))
+	rawTx = newRawTx()
+	if err := decoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("create batch transfer token call failed: %v", err)
+	}
+	tx := &types.Transaction{}
+	if err := rlp.DecodeBytes(ethcom.FromHex(rawTx.RawHex), tx); err != nil {
+		t.Fatalf("decode batch transfer token call failed: %v", err)
+	}
+	wantData, _ := BATCH_TRANSFER_ABI.Pack("batchTransferToken", ethcom.HexToAddress(token),
+		[]ethcom.Address{ethcom.HexToAddress(toA), ethcom.HexToAddress(toB)}, []*big.Int{big.NewInt(200), big.NewInt(300)})
+	if !strings.EqualFold(tx.To().Hex(), contract) || tx.Value().Sign() != 0 || !bytes.Equal(tx.Data(), wantData) {
+		t.Errorf("unexpected batch transfer token call: to %s, value %v", tx.To().Hex(), tx.Value())
+	}
+}
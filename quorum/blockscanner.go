@@ -15,13 +15,16 @@
 package quorum
 
 import (
+	"encoding/json"
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
 	"github.com/blocktree/openwallet/v2/common"
 	"github.com/ethereum/go-ethereum/accounts/abi"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
-	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/tidwall/gjson"
 	"math/big"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/blocktree/openwallet/v2/openwallet"
 
@@ -42,6 +45,19 @@ type BlockScanner struct {
 	wm                   *WalletManager //钱包管理者
 	IsScanMemPool        bool           //是否扫描交易池
 	RescanLastBlockCount uint64         //重扫上N个区块数量
+
+	newHeadCH    chan json.RawMessage //websocket推送的新区块头
+	newHeadMu    sync.Mutex
+	newHeadQuit  chan struct{} //关闭后推送协程退出，nil表示推送未运行
+	pushedHeight uint64        //websocket推送的最新区块高度
+	taskRunning  int32         //扫描任务是否正在执行，推送和定时器不会同时扫描
+	scanning     int32         //是否扫描中，推送协程和定时器并发读取，代替BlockScannerBase.Scanning
+
+	prefetcher *blockPrefetcher //追块模式的区块预取器
+	logFilter  *logFilter       //日志模式的交易过滤器
+
+	memPoolMu  sync.Mutex
+	memPoolTxs map[string]*memPoolTx //已通知的交易池交易
 }
 
 //ExtractResult 扫描完成的提取结果
@@ -51,6 +67,8 @@ type ExtractResult struct {
 	TxID                string
 	BlockHeight         uint64
 	Success             bool
+	failReason          string //失败原因类型，记录在未扫记录中
+	failErr             error
 }
 
 //SaveResult 保存结果
@@ -70,9 +88,12 @@ func NewBlockScanner(wm *WalletManager) *BlockScanner {
 	bs.wm = wm
 	bs.IsScanMemPool = false
 	bs.RescanLastBlockCount = 0
+	bs.prefetcher = newBlockPrefetcher(&bs)
+	bs.logFilter = newLogFilter(&bs)
+	bs.memPoolTxs = make(map[string]*memPoolTx)
 
 	//设置扫描任务
-	bs.SetTask(bs.ScanBlockTask)
+	bs.SetTask(bs.pollBlockTask)
 
 	return &bs
 }
@@ -124,60 +145,147 @@ func (bs *BlockScanner) ScanBlock(height uint64) error {
 	return nil
 }
 
-//rescanFailedRecord 重扫失败记录
-func (bs *BlockScanner) RescanFailedRecord() {
-
-	var (
-		blockMap = make(map[uint64][]string)
-	)
-
-	list, err := bs.GetUnscanRecords()
+//Run 运行扫描，配置了websocket节点时订阅新区块，收到推送立即扫描
+func (bs *BlockScanner) Run() error {
+	err := bs.BlockScannerBase.Run()
 	if err != nil {
-		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
+		return err
 	}
+	bs.setScanning(true)
+	bs.startNewHeads()
+	return nil
+}
 
-	//组合成批处理
-	for _, r := range list {
+//Restart 继续扫描，恢复websocket推送
+func (bs *BlockScanner) Restart() error {
+	err := bs.BlockScannerBase.Restart()
+	if err != nil {
+		return err
+	}
+	bs.setScanning(true)
+	bs.startNewHeads()
+	return nil
+}
 
-		if _, exist := blockMap[r.BlockHeight]; !exist {
-			blockMap[r.BlockHeight] = make([]string, 0)
-		}
+//Stop 停止扫描，断开websocket并结束推送协程
+func (bs *BlockScanner) Stop() error {
+	bs.setScanning(false)
+	bs.stopNewHeads()
+	return bs.BlockScannerBase.Stop()
+}
 
-		if len(r.TxID) > 0 {
-			arr := blockMap[r.BlockHeight]
-			arr = append(arr, r.TxID)
+//Pause 暂停扫描，断开websocket并结束推送协程
+func (bs *BlockScanner) Pause() error {
+	bs.setScanning(false)
+	bs.stopNewHeads()
+	return bs.BlockScannerBase.Pause()
+}
 
-			blockMap[r.BlockHeight] = arr
-		}
+//setScanning 设置扫描状态
+func (bs *BlockScanner) setScanning(scanning bool) {
+	var v int32
+	if scanning {
+		v = 1
 	}
+	atomic.StoreInt32(&bs.scanning, v)
+	bs.Scanning = scanning
+}
 
-	for height, _ := range blockMap {
+//isScanning 是否扫描中，可在任意协程调用
+func (bs *BlockScanner) isScanning() bool {
+	return atomic.LoadInt32(&bs.scanning) == 1
+}
 
-		if height == 0 {
-			continue
+//startNewHeads 订阅新区块头并启动推送协程，由推送驱动扫描任务
+func (bs *BlockScanner) startNewHeads() {
+	wsClient := bs.wm.WSClient
+	if wsClient == nil {
+		return
+	}
+	bs.newHeadMu.Lock()
+	defer bs.newHeadMu.Unlock()
+	if bs.newHeadQuit != nil {
+		return
+	}
+	//订阅记录保存在wsClient中，重启后重连时自动恢复，只需订阅一次
+	if bs.newHeadCH == nil {
+		ch := make(chan json.RawMessage, 1)
+		err := wsClient.SubscribeNewHeads(ch)
+		if err != nil {
+			bs.wm.Log.Errorf("subscribe newHeads failed, err=%v", err)
+			return
 		}
+		bs.newHeadCH = ch
+	}
+	bs.newHeadQuit = make(chan struct{})
+	wsClient.Start()
 
-		bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", height)
+	go bs.consumeNewHeads(bs.newHeadCH, bs.newHeadQuit)
+}
 
-		block, err := bs.wm.GetBlockByNum(height, true)
-		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
-			continue
-		}
+//stopNewHeads 断开websocket并通知推送协程退出，扫描任务中调用Pause时不会阻塞
+func (bs *BlockScanner) stopNewHeads() {
+	wsClient := bs.wm.WSClient
+	if wsClient == nil {
+		return
+	}
+	bs.newHeadMu.Lock()
+	defer bs.newHeadMu.Unlock()
+	if bs.newHeadQuit == nil {
+		return
+	}
+	wsClient.Stop()
+	close(bs.newHeadQuit)
+	bs.newHeadQuit = nil
+	atomic.StoreUint64(&bs.pushedHeight, 0)
+}
 
-		batchErr := bs.BatchExtractTransaction(block.BlockHeight, block.Transactions)
-		if batchErr != nil {
-			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", batchErr)
-			continue
+//consumeNewHeads 推送协程，收到新区块头立即扫描，quit关闭后退出
+func (bs *BlockScanner) consumeNewHeads(heads <-chan json.RawMessage, quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case head := <-heads:
+			height, err := hexutil.DecodeUint64(gjson.GetBytes(head, "number").String())
+			if err != nil {
+				bs.wm.Log.Errorf("decode newHeads number failed, err=%v", err)
+				continue
+			}
+			atomic.StoreUint64(&bs.pushedHeight, height)
+			if bs.isScanning() {
+				bs.ScanBlockTask()
+			}
 		}
+	}
+}
+
+//pollBlockTask 定时扫描任务，websocket连接正常时由推送驱动，不再轮询
+func (bs *BlockScanner) pollBlockTask() {
+	if bs.wm.WSClient != nil && bs.wm.WSClient.Connected() {
+		return
+	}
+	bs.ScanBlockTask()
+}
 
-		//删除未扫记录
-		bs.DeleteUnscanRecord(height)
+//getMaxBlockHeight 最新区块高度，websocket连接正常时使用推送的高度
+func (bs *BlockScanner) getMaxBlockHeight() (uint64, error) {
+	if bs.wm.WSClient != nil && bs.wm.WSClient.Connected() {
+		if height := atomic.LoadUint64(&bs.pushedHeight); height > 0 {
+			return height, nil
+		}
 	}
+	return bs.wm.GetBlockNumber()
 }
 
 func (bs *BlockScanner) ScanBlockTask() {
 
+	//推送和定时器可能同时触发，只允许一个扫描任务执行
+	if !atomic.CompareAndSwapInt32(&bs.taskRunning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&bs.taskRunning, 0)
+
 	//获取本地区块高度
 	blockHeader, err := bs.GetScannedBlockHeader()
 	if err != nil {
@@ -190,12 +298,12 @@ func (bs *BlockScanner) ScanBlockTask() {
 	var previousHeight uint64 = 0
 	for {
 
-		if !bs.Scanning {
+		if !bs.isScanning() {
 			//区块扫描器已暂停，马上结束本次任务
 			return
 		}
 
-		maxBlockHeight, err := bs.wm.GetBlockNumber()
+		maxBlockHeight, err := bs.getMaxBlockHeight()
 		if err != nil {
 			bs.wm.Log.Errorf("get max height of eth failed, err=%v", err)
 			break
@@ -211,7 +319,8 @@ func (bs *BlockScanner) ScanBlockTask() {
 		curBlockHeight += 1
 		bs.wm.Log.Infof("block scanner try to scan block No.%v", curBlockHeight)
 
-		curBlock, err := bs.wm.GetBlockByNum(curBlockHeight, true)
+		//落后较多时并发预取区块，仍按高度顺序处理
+		curBlock, err := bs.prefetcher.GetBlock(curBlockHeight, maxBlockHeight)
 		if err != nil {
 			//bs.wm.Log.Errorf("EthGetBlockSpecByBlockNum failed, err = %v", err)
 			break
@@ -219,53 +328,51 @@ func (bs *BlockScanner) ScanBlockTask() {
 
 		isFork := false
 
+		if bs.bftMode() {
+			if curBlock.PreviousHash != curBlockHash {
+				bs.integrityAlarm(curBlock, curBlockHash)
+				return
+			}
+			//等待委员会确定区块
+			if err := bs.verifyFinality(curBlock); err != nil {
+				bs.wm.Log.Warningf("block scanner can not verify finality; unexpected error: %v", err)
+				break
+			}
+		}
+
 		if curBlock.PreviousHash != curBlockHash {
 			previousHeight = curBlockHeight - 1
 			bs.wm.Log.Infof("block has been fork on height: %v.", curBlockHeight)
 			bs.wm.Log.Infof("block height: %v local hash = %v ", previousHeight, curBlockHash)
 			bs.wm.Log.Infof("block height: %v mainnet hash = %v ", previousHeight, curBlock.PreviousHash)
 
-			bs.wm.Log.Infof("delete recharge records on block height: %v.", previousHeight)
-
-			//查询本地分叉的区块
-			forkBlock, _ := bs.GetLocalBlock(previousHeight)
-
-			bs.DeleteUnscanRecord(previousHeight)
-
-			curBlockHeight = previousHeight - 1 //倒退2个区块重新扫描
+			//预取的区块和日志可能属于被回滚的链
+			bs.prefetcher.Reset()
+			bs.logFilter.Reset()
 
-			curBlock, err = bs.GetLocalBlock(curBlockHeight)
+			//回退到共同祖先，通知每个孤块并撤销其中的交易
+			curBlock, err = bs.rollbackFork(curBlockHeight, curBlockHash)
 			if err != nil {
-				bs.wm.Log.Std.Error("block scanner can not get local block; unexpected error: %v", err)
-				bs.wm.Log.Info("block scanner prev block height:", curBlockHeight)
-
-				curBlock, err = bs.wm.GetBlockByNum(curBlockHeight, false)
-				if err != nil {
-					bs.wm.Log.Errorf("EthGetBlockSpecByBlockNum  failed, block number=%v, err=%v", curBlockHeight, err)
-					break
+				bs.wm.Log.Errorf("block scanner can not rollback fork; unexpected error: %v", err)
+				if err == errForkTooDeep {
+					bs.Pause()
 				}
-
-			}
-
-			curBlockHash = curBlock.BlockHash
-			bs.wm.Log.Infof("rescan block on height:%v, hash:%v.", curBlockHeight, curBlockHash)
-
-			err = bs.SaveLocalBlockHead(curBlock.BlockHeight, curBlock.BlockHash)
-			if err != nil {
-				bs.wm.Log.Errorf("save local block unscaned failed, err=%v", err)
 				break
 			}
 
-			isFork = true
-
-			if forkBlock != nil {
-
-				//通知分叉区块给观测者，异步处理
-				bs.newBlockNotify(forkBlock, isFork)
-			}
+			bs.wm.Log.Infof("rescan block on height:%v, hash:%v.", curBlock.BlockHeight+1, curBlock.BlockHash)
 
 		} else {
-			err = bs.BatchExtractTransaction(curBlock.BlockHeight, curBlock.Transactions)
+			txs := curBlock.Transactions
+			if bs.logMode() {
+				//日志模式只提取关注地址的交易
+				txs, err = bs.logFilter.FilterTransactions(curBlock, maxBlockHeight)
+				if err != nil {
+					bs.wm.Log.Errorf("block scanner can not filter transactions by logs; unexpected error: %v", err)
+					break
+				}
+			}
+			err = bs.BatchExtractTransaction(curBlock.BlockHeight, txs)
 			if err != nil {
 				bs.wm.Log.Errorf("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 				break
@@ -284,24 +391,59 @@ func (bs *BlockScanner) ScanBlockTask() {
 
 	}
 
+	//扫描交易池，通知未确认的交易
+	if bs.IsScanMemPool {
+		bs.ScanMemPool()
+	}
+
 	bs.RescanFailedRecord()
 }
 
-//newExtractDataNotify 发送通知
+//newExtractDataNotify 发送通知，通知失败的交易记录为未扫交易
 func (bs *BlockScanner) newExtractDataNotify(height uint64, extractDataList map[string][]*openwallet.TxExtractData, extractContractData map[string]*openwallet.SmartContractReceipt) error {
 
+	failures := bs.notifyExtractData(extractDataList, extractContractData)
+	for txid, failure := range failures {
+		err := bs.saveUnscanRecord(height, txid, UnscanReasonNotify, failure.err, failure.observers...)
+		if err != nil {
+			bs.wm.Log.Errorf("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+//notifyExtractData 通知观测者，observers不为空时只通知这些观测者，返回通知失败的交易及失败的观测者
+func (bs *BlockScanner) notifyExtractData(extractDataList map[string][]*openwallet.TxExtractData, extractContractData map[string]*openwallet.SmartContractReceipt, observers ...string) map[string]*notifyFailure {
+
+	bs.markMemPoolMined(extractDataList)
+
+	targets := make(map[string]bool, len(observers))
+	for _, id := range observers {
+		targets[id] = true
+	}
+	failures := make(map[string]*notifyFailure)
+	fail := func(txid, id string, err error) {
+		failure := failures[txid]
+		if failure == nil {
+			failure = &notifyFailure{}
+			failures[txid] = failure
+		}
+		failure.add(id, err)
+	}
+
 	for o, _ := range bs.Observers {
+		id := observerID(o)
+		if len(targets) > 0 && !targets[id] {
+			continue
+		}
 		for key, extractData := range extractDataList {
 			for _, data := range extractData {
 				err := o.BlockExtractDataNotify(key, data)
 				if err != nil {
-					//记录未扫区块
-					reason := fmt.Sprintf("ExtractData Notify failed: %s", bs.wm.Symbol())
-					err = bs.SaveUnscannedTransaction(height, reason)
-					if err != nil {
-						bs.wm.Log.Errorf("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
-						return err
-					}
+					bs.wm.Log.Errorf("transaction: %s extract data notify failed, err: %v", data.Transaction.TxID, err)
+					fail(data.Transaction.TxID, id, err)
 				}
 			}
 		}
@@ -309,18 +451,13 @@ func (bs *BlockScanner) newExtractDataNotify(height uint64, extractDataList map[
 		for key, data := range extractContractData {
 			err := o.BlockExtractSmartContractDataNotify(key, data)
 			if err != nil {
-				//记录未扫区块
-				reason := fmt.Sprintf("ExtractContractData Notify failed: %s", bs.wm.Symbol())
-				err = bs.SaveUnscannedTransaction(height, reason)
-				if err != nil {
-					bs.wm.Log.Errorf("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
-					return err
-				}
+				bs.wm.Log.Errorf("transaction: %s extract contract data notify failed, err: %v", data.TxID, err)
+				fail(data.TxID, id, err)
 			}
 		}
 	}
 
-	return nil
+	return failures
 }
 
 //BatchExtractTransaction 批量提取交易单
@@ -337,6 +474,9 @@ func (bs *BlockScanner) BatchExtractTransaction(height uint64, txs []*BlockTrans
 		return nil
 	}
 
+	//批量预取交易回执，失败的交易在提取时再单独获取
+	bs.prefetchReceipts(txs)
+
 	//生产通道
 	producer := make(chan ExtractResult)
 	defer close(producer)
@@ -360,11 +500,13 @@ func (bs *BlockScanner) BatchExtractTransaction(height uint64, txs []*BlockTrans
 				}
 
 			} else {
-				//记录未扫区块
-				unscanRecord := openwallet.NewUnscanRecord(height, "", "", bs.wm.Symbol())
-				bs.SaveUnscanRecord(unscanRecord)
-				bs.wm.Log.Std.Info("block height: %d extract failed.", height)
-				failed++ //标记保存失败数
+				//记录未扫交易，由RescanFailedRecord逐笔重试，区块继续扫描
+				bs.wm.Log.Std.Info("block height: %d transaction: %s extract failed, err: %v", height, gets.TxID, gets.failErr)
+				saveErr := bs.saveUnscanRecord(height, gets.TxID, gets.failReason, gets.failErr)
+				if saveErr != nil {
+					failed++ //标记保存失败数
+					bs.wm.Log.Std.Info("block height: %d, save unscan record failed, unexpected error: %v", height, saveErr)
+				}
 			}
 			//累计完成的线程数
 			done++
@@ -450,6 +592,71 @@ func (bs *BlockScanner) extractRuntime(producer chan ExtractResult, worker chan
 
 }
 
+//prefetchReceipts 批量获取交易回执，同一区块的交易优先一次获取区块的所有回执，
+//节点不支持时改为批量逐笔获取
+func (bs *BlockScanner) prefetchReceipts(txs []*BlockTransaction) {
+	pending := func() []string {
+		txids := make([]string, 0, len(txs))
+		for _, tx := range txs {
+			if tx.receipt == nil {
+				txids = append(txids, tx.Hash)
+			}
+		}
+		return txids
+	}
+
+	txids := pending()
+	if len(txids) == 0 {
+		return
+	}
+
+	if blockHash := sameBlockHash(txs); len(blockHash) > 0 && bs.wm.supportBlockReceipts() {
+		receipts, err := bs.wm.GetBlockReceipts(blockHash)
+		if err == nil {
+			for _, tx := range txs {
+				if receipt, ok := receipts[strings.ToLower(tx.Hash)]; ok && tx.receipt == nil {
+					tx.receipt = receipt
+				}
+			}
+			txids = pending()
+			if len(txids) == 0 {
+				return
+			}
+		} else if quorum_rpc.IsMethodNotFoundError(err) {
+			atomic.StoreInt32(&bs.wm.blockReceiptsUnsupported, 1)
+			bs.wm.Log.Infof("node does not support getBlockReceipts, get receipts by transaction")
+		} else {
+			bs.wm.Log.Warningf("get block[%s] receipts failed, err: %v", blockHash, err)
+		}
+	}
+
+	receipts, err := bs.wm.GetTransactionReceiptBatch(txids...)
+	if err != nil {
+		bs.wm.Log.Warningf("batch get transaction receipts failed, err: %v", err)
+		return
+	}
+
+	for _, tx := range txs {
+		if receipt, ok := receipts[tx.Hash]; ok {
+			tx.receipt = receipt
+		}
+	}
+}
+
+//sameBlockHash 交易都在同一区块时返回区块hash
+func sameBlockHash(txs []*BlockTransaction) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	blockHash := txs[0].BlockHash
+	for _, tx := range txs[1:] {
+		if !strings.EqualFold(tx.BlockHash, blockHash) {
+			return ""
+		}
+	}
+	return blockHash
+}
+
 // UpdateTxByReceipt
 func (bs *BlockScanner) UpdateTxByReceipt(tx *BlockTransaction) error {
 	//过滤掉未打包交易
@@ -457,11 +664,15 @@ func (bs *BlockScanner) UpdateTxByReceipt(tx *BlockTransaction) error {
 		return nil
 	}
 
-	//获取交易回执
-	txReceipt, err := bs.wm.GetTransactionReceipt(tx.Hash)
-	if err != nil {
-		bs.wm.Log.Errorf("get transaction receipt failed, err: %v", err)
-		return err
+	//获取交易回执，已批量预取的不再请求
+	txReceipt := tx.receipt
+	if txReceipt == nil {
+		var err error
+		txReceipt, err = bs.wm.GetTransactionReceipt(tx.Hash)
+		if err != nil {
+			bs.wm.Log.Errorf("get transaction receipt failed, err: %v", err)
+			return err
+		}
 	}
 	tx.receipt = txReceipt
 	tx.Gas = common.NewString(txReceipt.ETHReceipt.GasUsed).String()
@@ -471,59 +682,39 @@ func (bs *BlockScanner) UpdateTxByReceipt(tx *BlockTransaction) error {
 	return nil
 }
 
+//UpdateTxBlockTime 查询交易所在区块的时间戳，已从区块获取的不再请求
+func (bs *BlockScanner) UpdateTxBlockTime(tx *BlockTransaction) error {
+	if tx.BlockTime > 0 || tx.BlockHeight == 0 {
+		return nil
+	}
+	block, err := bs.wm.GetBlockByNum(tx.BlockHeight, false)
+	if err != nil {
+		bs.wm.Log.Errorf("get block: %d failed, err: %v", tx.BlockHeight, err)
+		return err
+	}
+	tx.BlockTime = block.BlockTime
+	return nil
+}
+
 // GetBalanceByAddress 获取地址余额
 func (bs *BlockScanner) GetBalanceByAddress(address ...string) ([]*openwallet.Balance, error) {
-	type addressBalance struct {
-		Address string
-		Index   uint64
-		Balance *openwallet.Balance
-	}
-
-	threadControl := make(chan int, 20)
-	defer close(threadControl)
-	resultChan := make(chan *addressBalance, 1024)
-	defer close(resultChan)
-	done := make(chan int, 1)
-	count := len(address)
-	resultBalance := make([]*openwallet.Balance, count)
-	resultSaveFailed := false
-	//save result
-	go func() {
-		for i := 0; i < count; i++ {
-			addr := <-resultChan
-			if addr.Balance != nil {
-				resultBalance[addr.Index] = addr.Balance
-			} else {
-				resultSaveFailed = true
-			}
-		}
-		done <- 1
-	}()
 
-	query := func(addr *addressBalance) {
-		threadControl <- 1
-		defer func() {
-			resultChan <- addr
-			<-threadControl
-		}()
-
-		balanceConfirmed, err := bs.wm.GetAddrBalance(addr.Address, "latest")
-		if err != nil {
-			bs.wm.Log.Error("get address[", addr.Address, "] balance failed, err=", err)
-			return
-		}
+	balances, err := bs.wm.GetAddrBalanceBatch("latest", address...)
+	if err != nil {
+		bs.wm.Log.Error("get addresses balance failed, err=", err)
+		return nil, fmt.Errorf("get balance of addresses failed. ")
+	}
 
-		balanceAll, err := bs.wm.GetAddrBalance(addr.Address, "latest")
-		if err != nil {
-			balanceAll = balanceConfirmed
-		}
+	resultBalance := make([]*openwallet.Balance, 0, len(address))
+	for i, balanceConfirmed := range balances {
 
+		balanceAll := balanceConfirmed
 		balanceUnconfirmed := big.NewInt(0)
 		balanceUnconfirmed.Sub(balanceAll, balanceConfirmed)
 
 		balance := &openwallet.Balance{
 			Symbol:  bs.wm.Symbol(),
-			Address: addr.Address,
+			Address: address[i],
 		}
 		confirmed := common.BigIntToDecimals(balanceConfirmed, bs.wm.Decimal())
 		all := common.BigIntToDecimals(balanceAll, bs.wm.Decimal())
@@ -532,21 +723,9 @@ func (bs *BlockScanner) GetBalanceByAddress(address ...string) ([]*openwallet.Ba
 		balance.Balance = all.String()
 		balance.UnconfirmBalance = unconfirmed.String()
 		balance.ConfirmBalance = confirmed.String()
-		addr.Balance = balance
+		resultBalance = append(resultBalance, balance)
 	}
 
-	for i, _ := range address {
-		addrbl := &addressBalance{
-			Address: address[i],
-			Index:   uint64(i),
-		}
-		go query(addrbl)
-	}
-
-	<-done
-	if resultSaveFailed {
-		return nil, fmt.Errorf("get balance of addresses failed. ")
-	}
 	return resultBalance, nil
 }
 
@@ -563,14 +742,28 @@ func (bs *BlockScanner) ExtractTransaction(tx *BlockTransaction) ExtractResult {
 	)
 
 	if tx.BlockNumber == "" {
-		result.Success = false
+		result.fail(UnscanReasonReceipt, fmt.Errorf("transaction: %s is not mined", tx.Hash))
 		return result
 	}
 
 	//获取交易回执
 	err := bs.UpdateTxByReceipt(tx)
 	if err != nil {
-		result.Success = false
+		result.fail(unscanReasonOf(err), err)
+		return result
+	}
+
+	//单独查询的交易没有区块时间
+	err = bs.UpdateTxBlockTime(tx)
+	if err != nil {
+		result.fail(unscanReasonOf(err), err)
+		return result
+	}
+
+	//追踪合约执行中的内部转账
+	err = bs.UpdateTxInternalTransfers(tx)
+	if err != nil {
+		result.fail(unscanReasonOf(err), err)
 		return result
 	}
 
@@ -619,6 +812,13 @@ func (bs *BlockScanner) extractBaseTransaction(tx *BlockTransaction, result *Ext
 	}
 }
 
+//internalRecord 只收到内部转账的地址所属的交易记录
+type internalRecord struct {
+	from  []string
+	to    []string
+	value *big.Int
+}
+
 //extractETHTransaction 提取主币交易单
 func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTransfer bool) map[string]*openwallet.TxExtractData {
 
@@ -627,7 +827,7 @@ func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTrans
 	to := tx.To
 	status := common.NewString(tx.Status).String()
 	reason := ""
-	nowUnix := time.Now().Unix()
+	nowUnix := int64(tx.BlockTime)
 	txType := uint64(0)
 
 	coin := openwallet.Coin{
@@ -641,6 +841,9 @@ func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTrans
 
 	ethAmount := tx.GetAmountEthString()
 	feeprice := tx.GetTxFeeEthString()
+	memo, isMemo := tx.GetMemo()
+	extParam := tx.GetExtParam()
+	direct := make(map[string]bool) //交易本身的发送方或接收方
 
 	targetResult := tx.FilterFunc(openwallet.ScanTargetParam{
 		ScanTarget:     from,
@@ -683,7 +886,7 @@ func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTrans
 		feeInput.Recharge.TxType = txType
 
 		ed.TxInputs = append(ed.TxInputs, feeInput)
-
+		direct[targetResult.SourceKey] = true
 	}
 
 	// 检查to地址是否合约
@@ -710,6 +913,8 @@ func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTrans
 		output.BlockHeight = tx.BlockHeight
 		output.BlockHash = tx.BlockHash
 		output.TxType = txType
+		output.IsMemo = isMemo
+		output.Memo = memo
 
 		ed := txExtractMap[targetResult2.SourceKey]
 		if ed == nil {
@@ -718,9 +923,61 @@ func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTrans
 		}
 
 		ed.TxOutputs = append(ed.TxOutputs, output)
+		direct[targetResult2.SourceKey] = true
 	}
 
-	for _, extractData := range txExtractMap {
+	//合约执行中的内部转账作为额外的输出，索引从1开始
+	toList := []string{to + ":" + ethAmount}
+	internals := make(map[string]*internalRecord)
+	for i, transfer := range tx.internalTxs {
+		amount := common.BigIntToDecimals(transfer.Value, bs.wm.Decimal()).String()
+		toList = append(toList, transfer.To+":"+amount)
+
+		targetResult3 := tx.FilterFunc(openwallet.ScanTargetParam{
+			ScanTarget:     transfer.To,
+			Symbol:         bs.wm.Symbol(),
+			ScanTargetType: openwallet.ScanTargetTypeAccountAddress})
+		if !targetResult3.Exist {
+			continue
+		}
+		output := &openwallet.TxOutPut{}
+		output.TxID = tx.Hash
+		output.Address = transfer.To
+		output.Amount = amount
+		output.Coin = coin
+		output.Index = uint64(i + 1)
+		output.Sid = openwallet.GenTxOutPutSID(tx.Hash, bs.wm.Symbol(), "", uint64(i+1))
+		output.CreateAt = nowUnix
+		output.BlockHeight = tx.BlockHeight
+		output.BlockHash = tx.BlockHash
+		output.TxType = txType
+
+		ed := txExtractMap[targetResult3.SourceKey]
+		if ed == nil {
+			ed = openwallet.NewBlockExtractData()
+			txExtractMap[targetResult3.SourceKey] = ed
+		}
+
+		ed.TxOutputs = append(ed.TxOutputs, output)
+
+		record := internals[targetResult3.SourceKey]
+		if record == nil {
+			record = &internalRecord{value: new(big.Int)}
+			internals[targetResult3.SourceKey] = record
+		}
+		record.from = append(record.from, transfer.From+":"+amount)
+		record.to = append(record.to, transfer.To+":"+amount)
+		record.value.Add(record.value, transfer.Value)
+	}
+
+	for sourceKey, extractData := range txExtractMap {
+
+		txFrom, txTo, txAmount := []string{from + ":" + ethAmount}, toList, ethAmount
+		if record := internals[sourceKey]; record != nil && !direct[sourceKey] {
+			//只收到内部转账时，交易记录的发送方和金额取自内部转账
+			txFrom, txTo = record.from, record.to
+			txAmount = common.BigIntToDecimals(record.value, bs.wm.Decimal()).String()
+		}
 
 		tx := &openwallet.Transaction{
 			Fees:        feeprice,
@@ -729,13 +986,16 @@ func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTrans
 			BlockHeight: tx.BlockHeight,
 			TxID:        tx.Hash,
 			Decimal:     bs.wm.Decimal(),
-			Amount:      ethAmount,
+			Amount:      txAmount,
 			ConfirmTime: nowUnix,
-			From:        []string{from + ":" + ethAmount},
-			To:          []string{to + ":" + ethAmount},
+			From:        txFrom,
+			To:          txTo,
 			Status:      status,
 			Reason:      reason,
 			TxType:      txType,
+			IsMemo:      isMemo,
+			Memo:        memo,
+			ExtParam:    extParam,
 		}
 
 		wxID := openwallet.GenTransactionWxID(tx)
@@ -749,23 +1009,43 @@ func (bs *BlockScanner) extractETHTransaction(tx *BlockTransaction, isTokenTrans
 //extractERC20Transaction
 func (bs *BlockScanner) extractERC20Transaction(tx *BlockTransaction, contractAddress string, tokenEvent []*TransferEvent) map[string]*openwallet.TxExtractData {
 
-	var (
-		tokenName     string
-		tokenSymbol   string
-		tokenDecimals uint8
-	)
-
-	nowUnix := time.Now().Unix()
+	nowUnix := int64(tx.BlockTime)
 	status := common.NewString(tx.Status).String()
 	reason := ""
 	txExtractMap := make(map[string]*openwallet.TxExtractData)
 	contractAddress = bs.wm.CustomAddressEncodeFunc(contractAddress)
 	contractId := openwallet.GenContractID(bs.wm.Symbol(), contractAddress)
 
-	bc := bind.NewBoundContract(ethcom.HexToAddress(contractAddress), ERC20_ABI, bs.wm.RawClient, bs.wm.RawClient, nil)
-	bc.Call(&bind.CallOpts{}, &tokenName, "name")
-	bc.Call(&bind.CallOpts{}, &tokenSymbol, "symbol")
-	bc.Call(&bind.CallOpts{}, &tokenDecimals, "decimals")
+	//同一合约的事件属于同一代币标准，NFT没有精度，tokenId记录在扩展参数中
+	protocol := tokenEvent[0].Protocol
+
+	var (
+		tokenName, tokenSymbol string
+		tokenDecimals          uint8
+		token                  *TokenMetadata
+		err                    error
+	)
+	if isNFTProtocol(protocol) {
+		token, err = bs.wm.TokenRegistry.GetNFT(contractAddress)
+	} else {
+		token, err = bs.wm.TokenRegistry.Get(contractAddress)
+	}
+	if err != nil {
+		bs.wm.Log.Errorf("get token[%s] metadata failed, err: %v", contractAddress, err)
+	} else {
+		tokenName, tokenSymbol, tokenDecimals = token.Name, token.Symbol, token.Decimals
+	}
+
+	extParam := ""
+	if isNFTProtocol(protocol) {
+		tokenDecimals = 0
+		tokenIDs := make([]string, 0, len(tokenEvent))
+		for _, te := range tokenEvent {
+			tokenIDs = append(tokenIDs, te.TokenID.String())
+		}
+		raw, _ := json.Marshal(map[string]interface{}{"tokenIds": tokenIDs})
+		extParam = string(raw)
+	}
 
 	coin := openwallet.Coin{
 		Symbol:     bs.wm.Symbol(),
@@ -776,17 +1056,17 @@ func (bs *BlockScanner) extractERC20Transaction(tx *BlockTransaction, contractAd
 			Symbol:     bs.wm.Symbol(),
 			Address:    contractAddress,
 			Token:      tokenSymbol,
-			Protocol:   "erc20",
+			Protocol:   protocol,
 			Name:       tokenName,
 			Decimals:   uint64(tokenDecimals),
 		},
 	}
 
 	//提取出账部分记录
-	from := bs.extractERC20Detail(tx, contractAddress, tokenEvent, true, txExtractMap)
+	from := bs.extractERC20Detail(tx, coin, tokenEvent, true, txExtractMap)
 
 	//提取入账部分记录
-	to := bs.extractERC20Detail(tx, contractAddress, tokenEvent, false, txExtractMap)
+	to := bs.extractERC20Detail(tx, coin, tokenEvent, false, txExtractMap)
 
 	for _, extractData := range txExtractMap {
 		tx := &openwallet.Transaction{
@@ -802,6 +1082,7 @@ func (bs *BlockScanner) extractERC20Transaction(tx *BlockTransaction, contractAd
 			Status:      status,
 			Reason:      reason,
 			TxType:      0,
+			ExtParam:    extParam,
 		}
 
 		wxID := openwallet.GenTransactionWxID(tx)
@@ -812,27 +1093,16 @@ func (bs *BlockScanner) extractERC20Transaction(tx *BlockTransaction, contractAd
 	return txExtractMap
 }
 
-//extractERC20Detail
-func (bs *BlockScanner) extractERC20Detail(tx *BlockTransaction, contractAddress string, tokenEvent []*TransferEvent, isInput bool, extractData map[string]*openwallet.TxExtractData) []string {
+//extractERC20Detail 提取代币转账的输入输出，coin与交易的代币信息相同，包括代币标准、符号和精度。
+//Recharge没有扩展参数，NFT的tokenId按事件顺序记录在交易ExtParam的tokenIds中，输入输出的Index即其位置
+func (bs *BlockScanner) extractERC20Detail(tx *BlockTransaction, coin openwallet.Coin, tokenEvent []*TransferEvent, isInput bool, extractData map[string]*openwallet.TxExtractData) []string {
 
 	var (
 		addrs  = make([]string, 0)
 		txType = uint64(0)
 	)
 
-	contractId := openwallet.GenContractID(bs.wm.Symbol(), contractAddress)
-	coin := openwallet.Coin{
-		Symbol:     bs.wm.Symbol(),
-		IsContract: true,
-		ContractID: contractId,
-		Contract: openwallet.SmartContract{
-			ContractID: contractId,
-			Address:    contractAddress,
-			Symbol:     bs.wm.Symbol(),
-		},
-	}
-
-	createAt := time.Now().Unix()
+	createAt := int64(tx.BlockTime)
 	for i, te := range tokenEvent {
 
 		address := ""
@@ -916,7 +1186,7 @@ func (bs *BlockScanner) extractSmartContractTransaction(tx *BlockTransaction, re
 		Contract:   *contract,
 	}
 
-	createAt := time.Now().Unix()
+	createAt := int64(tx.BlockTime)
 
 	//迭代每个日志，提取时间日志
 	events := make([]*openwallet.SmartContractEvent, 0)
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultCatchUpThreshold 落后最新区块超过此数量时进入追块模式
+	DefaultCatchUpThreshold = 100
+	//DefaultCatchUpMaxWindow 追块模式最多同时预取的区块数
+	DefaultCatchUpMaxWindow = 32
+
+	catchUpInitWindow    = 4               //追块模式初始的预取窗口
+	catchUpTargetLatency = 2 * time.Second //预取一个窗口的目标耗时，超过时缩小窗口
+)
+
+//blockPrefetcher 追块模式的区块预取器，并发获取一个窗口的区块及交易回执，再按高度顺序交给扫描任务，
+//只在扫描任务中使用，不需要加锁
+type blockPrefetcher struct {
+	bs       *BlockScanner
+	window   int
+	blocks   map[uint64]*EthBlock
+	catching bool
+}
+
+func newBlockPrefetcher(bs *BlockScanner) *blockPrefetcher {
+	return &blockPrefetcher{
+		bs:     bs,
+		window: catchUpInitWindow,
+		blocks: make(map[uint64]*EthBlock),
+	}
+}
+
+//catchingUp 是否进入追块模式，接近最新区块时回到逐块跟随
+func (p *blockPrefetcher) catchingUp(height, maxHeight uint64) bool {
+	threshold := p.bs.wm.Config.CatchUpThreshold
+	if threshold == 0 || p.bs.wm.Config.CatchUpMaxWindow <= 1 {
+		return false
+	}
+	return maxHeight > height+threshold
+}
+
+//GetBlock 获取区块及交易，追块模式下从预取窗口获取，窗口用完后预取下一个窗口
+func (p *blockPrefetcher) GetBlock(height, maxHeight uint64) (*EthBlock, error) {
+	catching := p.catchingUp(height, maxHeight)
+	if catching != p.catching {
+		p.catching = catching
+		if catching {
+			p.bs.wm.Log.Infof("block scanner is %d blocks behind, start catching up", maxHeight-height)
+		} else {
+			p.bs.wm.Log.Infof("block scanner is close to the latest block, stop catching up")
+		}
+	}
+	if !catching {
+		p.Reset()
+		return p.bs.wm.GetBlockByNum(height, true)
+	}
+
+	block, ok := p.blocks[height]
+	if !ok {
+		p.Reset()
+		p.fetchWindow(height, maxHeight)
+		block, ok = p.blocks[height]
+	}
+	if !ok {
+		//预取失败的区块单独获取
+		return p.bs.wm.GetBlockByNum(height, true)
+	}
+	delete(p.blocks, height)
+	return block, nil
+}
+
+//Reset 清空预取的区块，区块分叉时预取的区块可能已失效
+func (p *blockPrefetcher) Reset() {
+	if len(p.blocks) > 0 {
+		p.blocks = make(map[uint64]*EthBlock)
+	}
+}
+
+//fetchWindow 并发获取[from, from+window)的区块、交易回执及共识信息，根据耗时调整下一个窗口的大小
+func (p *blockPrefetcher) fetchWindow(from, maxHeight uint64) {
+	to := from + uint64(p.window) - 1
+	if to > maxHeight {
+		to = maxHeight
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+		start  = time.Now()
+	)
+	for height := from; height <= to; height++ {
+		wg.Add(1)
+		go func(height uint64) {
+			defer wg.Done()
+			block, err := p.bs.wm.GetBlockByNum(height, true)
+			if err == nil {
+				//日志模式只获取过滤后交易的回执
+				if !p.bs.logMode() {
+					p.bs.prefetchReceipts(block.Transactions)
+				}
+				if p.bs.bftMode() && p.bs.wm.supportConsensusInfo() {
+					block.consensus, _ = p.bs.wm.GetBlockConsensusInfo(height)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				p.bs.wm.Log.Warningf("prefetch block: %d failed, err: %v", height, err)
+				failed = true
+				return
+			}
+			p.blocks[height] = block
+		}(height)
+	}
+	wg.Wait()
+
+	p.adjustWindow(time.Since(start), failed)
+	p.bs.wm.Log.Debugf("prefetched blocks [%d, %d], next window: %d", from, to, p.window)
+}
+
+//adjustWindow 节点响应快时扩大窗口，响应慢或出错时减半
+func (p *blockPrefetcher) adjustWindow(elapsed time.Duration, failed bool) {
+	switch {
+	case failed || elapsed > catchUpTargetLatency:
+		p.window /= 2
+	case elapsed < catchUpTargetLatency/2:
+		p.window *= 2
+	}
+	if max := p.bs.wm.Config.CatchUpMaxWindow; p.window > max {
+		p.window = max
+	}
+	if p.window < 1 {
+		p.window = 1
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//testBlockchainDAI 内存中的区块链数据
+type testBlockchainDAI struct {
+	openwallet.BlockchainDAIBase
+	mu      sync.Mutex
+	current *openwallet.BlockHeader
+	blocks  map[uint64]*openwallet.BlockHeader
+	unscans map[string]*openwallet.UnscanRecord
+}
+
+func newTestBlockchainDAI() *testBlockchainDAI {
+	return &testBlockchainDAI{
+		blocks:  make(map[uint64]*openwallet.BlockHeader),
+		unscans: make(map[string]*openwallet.UnscanRecord),
+	}
+}
+
+func (dai *testBlockchainDAI) SaveCurrentBlockHead(header *openwallet.BlockHeader) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	dai.current = header
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetCurrentBlockHead(symbol string) (*openwallet.BlockHeader, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	if dai.current == nil {
+		return nil, fmt.Errorf("current block head not found")
+	}
+	return dai.current, nil
+}
+
+func (dai *testBlockchainDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	dai.blocks[header.Height] = header
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetLocalBlockHeadByHeight(height uint64, symbol string) (*openwallet.BlockHeader, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	header, ok := dai.blocks[height]
+	if !ok {
+		return nil, fmt.Errorf("local block: %d not found", height)
+	}
+	return header, nil
+}
+
+func (dai *testBlockchainDAI) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	dai.unscans[record.ID] = record
+	return nil
+}
+
+func (dai *testBlockchainDAI) DeleteUnscanRecordByHeight(height uint64, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	for id, record := range dai.unscans {
+		if record.BlockHeight == height {
+			delete(dai.unscans, id)
+		}
+	}
+	return nil
+}
+
+func (dai *testBlockchainDAI) DeleteUnscanRecordByID(id string, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	delete(dai.unscans, id)
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetUnscanRecords(symbol string) ([]*openwallet.UnscanRecord, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	list := make([]*openwallet.UnscanRecord, 0, len(dai.unscans))
+	for _, record := range dai.unscans {
+		list = append(list, record)
+	}
+	return list, nil
+}
+
+//testBlockObserver 按顺序记录扫描通知
+type testBlockObserver struct {
+	mu        sync.Mutex
+	headers   []*openwallet.BlockHeader
+	extracted []*openwallet.TxExtractData
+}
+
+func (o *testBlockObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.headers = append(o.headers, header)
+	return nil
+}
+
+//waitHeaders 区块通知是异步发送的，等待收到n个区块通知
+func (o *testBlockObserver) waitHeaders(n int) []*openwallet.BlockHeader {
+	for i := 0; i < 100; i++ {
+		o.mu.Lock()
+		if len(o.headers) >= n {
+			o.mu.Unlock()
+			break
+		}
+		o.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*openwallet.BlockHeader{}, o.headers...)
+}
+
+func (o *testBlockObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.extracted = append(o.extracted, data)
+	return nil
+}
+
+func (o *testBlockObserver) BlockExtractSmartContractDataNotify(sourceKey string, data *openwallet.SmartContractReceipt) error {
+	return nil
+}
+
+//testNewFakeBlockScanner 从指定高度开始扫描模拟节点，只关注to地址
+func testNewFakeBlockScanner(node *quorum_rpc.FakeNode, scannedHeight uint64, to string) (*BlockScanner, *testBlockObserver, *testBlockchainDAI) {
+	wm := testNewFakeWalletManager(node)
+	bs := wm.Blockscanner.(*BlockScanner)
+	dai := newTestBlockchainDAI()
+	bs.SetBlockchainDAI(dai)
+	observer := &testBlockObserver{}
+	bs.AddObserver(observer)
+	bs.SetBlockScanTargetFuncV2(func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		if target.ScanTargetType == openwallet.ScanTargetTypeAccountAddress && target.ScanTarget == to {
+			return openwallet.ScanTargetResult{SourceKey: "receiver", Exist: true}
+		}
+		return openwallet.ScanTargetResult{}
+	})
+	block, _ := wm.GetBlockByNum(scannedHeight, false)
+	bs.SaveLocalBlockHead(block.BlockHeight, block.BlockHash)
+	bs.setScanning(true)
+	return bs, observer, dai
+}
+
+func TestBlockScanner_CatchUpOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	for i := 1; i <= 60; i++ {
+		node.AddBlock(&quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(int64(i)), Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000})
+	}
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.wm.Config.CatchUpThreshold = 10
+	bs.wm.Config.CatchUpMaxWindow = 8
+
+	bs.ScanBlockTask()
+
+	headers := observer.waitHeaders(59)
+	if len(headers) != 59 {
+		t.Fatalf("notified blocks = %d, want 59", len(headers))
+	}
+	for i, header := range headers {
+		if header.Height != uint64(i+2) {
+			t.Fatalf("block notify %d height = %d, want %d", i, header.Height, i+2)
+		}
+	}
+	if len(observer.extracted) != 59 {
+		t.Fatalf("extracted txs = %d, want 59", len(observer.extracted))
+	}
+	for i, data := range observer.extracted {
+		if data.Transaction.BlockHeight != uint64(i+2) {
+			t.Fatalf("extract notify %d height = %d, want %d", i, data.Transaction.BlockHeight, i+2)
+		}
+	}
+	if bs.prefetcher.catching || len(bs.prefetcher.blocks) > 0 {
+		t.Errorf("scanner should follow the tip after catching up")
+	}
+	if bs.prefetcher.window <= catchUpInitWindow {
+		t.Errorf("window should grow on a fast node, got %d", bs.prefetcher.window)
+	}
+}
@@ -63,6 +63,7 @@ func (bs *BlockScanner) SaveLocalBlock(blockHeader *EthBlock) error {
 		Hash:              blockHeader.BlockHash,
 		Previousblockhash: blockHeader.PreviousHash,
 		Height:            blockHeader.BlockHeight,
+		Time:              blockHeader.BlockTime,
 		Symbol:            bs.wm.Symbol(),
 	}
 
@@ -85,6 +86,7 @@ func (bs *BlockScanner) GetLocalBlock(height uint64) (*EthBlock, error) {
 		BlockHeader: BlockHeader{
 			BlockHash:   header.Hash,
 			BlockHeight: header.Height,
+			BlockTime:   header.Time,
 		},
 	}
 
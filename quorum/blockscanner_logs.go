@@ -0,0 +1,271 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+//扫描模式
+const (
+	ScanModeBlock = "block" //提取区块内的每一笔交易
+	ScanModeLogs  = "logs"  //通过klay_getLogs只提取关注地址的代币转账，主币交易仍按区块过滤
+)
+
+const (
+	//DefaultLogScanRange 日志模式一次查询的区块数
+	DefaultLogScanRange = 100
+
+	logScanAddressChunk = 100 //一次查询放入主题的地址数上限
+)
+
+//ParseScanMode 解析扫描模式，为空时使用block
+func ParseScanMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", ScanModeBlock:
+		return ScanModeBlock, nil
+	case ScanModeLogs:
+		return ScanModeLogs, nil
+	}
+	return "", fmt.Errorf("unknown scan mode: %s", mode)
+}
+
+//FilterLog klay_getLogs返回的日志
+type FilterLog struct {
+	Address     string   `json:"address"`
+	Topics      []string `json:"topics"`
+	Data        string   `json:"data"`
+	BlockNumber string   `json:"blockNumber"`
+	BlockHash   string   `json:"blockHash"`
+	TxHash      string   `json:"transactionHash"`
+	Removed     bool     `json:"removed"`
+}
+
+//GetLogs 获取区块范围内的日志
+//@param addresses: 合约地址，为空时不限合约
+//@param topics: 每个位置的可选主题，nil表示不限
+func (wm *WalletManager) GetLogs(fromBlock, toBlock uint64, addresses []string, topics [][]string) ([]*FilterLog, error) {
+	return wm.GetLogsContext(context.Background(), fromBlock, toBlock, addresses, topics)
+}
+
+//GetLogsContext 支持ctx超时和取消的GetLogs
+func (wm *WalletManager) GetLogsContext(ctx context.Context, fromBlock, toBlock uint64, addresses []string, topics [][]string) ([]*FilterLog, error) {
+	filter := map[string]interface{}{
+		"fromBlock": hexutil.EncodeUint64(fromBlock),
+		"toBlock":   hexutil.EncodeUint64(toBlock),
+	}
+	if len(addresses) > 0 {
+		filter["address"] = addresses
+	}
+	if len(topics) > 0 {
+		filterTopics := make([]interface{}, len(topics))
+		for i, values := range topics {
+			if len(values) > 0 {
+				filterTopics[i] = values
+			}
+		}
+		filter["topics"] = filterTopics
+	}
+
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getLogs", []interface{}{filter})
+	if err != nil {
+		return nil, err
+	}
+
+	logs := make([]*FilterLog, 0)
+	if err := json.Unmarshal([]byte(result.Raw), &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+//logFilter 日志模式的交易过滤器，按区块范围查询关注地址的代币转账日志，只在扫描任务中查询。
+//关注地址和已查询的日志都由mu保护，设置关注地址时可以和扫描任务并发
+type logFilter struct {
+	bs *BlockScanner
+
+	mu        sync.Mutex
+	addresses []string //关注的地址，已补齐为主题
+
+	from, to uint64                       //已查询的区块范围
+	txs      map[uint64]map[string]string //区块高度 -> 交易hash -> 区块hash
+}
+
+func newLogFilter(bs *BlockScanner) *logFilter {
+	return &logFilter{bs: bs}
+}
+
+//logMode 是否使用日志模式扫描
+func (bs *BlockScanner) logMode() bool {
+	return bs.wm.Config.ScanMode == ScanModeLogs
+}
+
+//SetLogScanAddresses 设置日志模式关注的地址，代币转入或转出这些地址的交易才会被提取，
+//LoadAssetsConfig按logScanAddresses设置，之后关注地址变化时再调用
+func (bs *BlockScanner) SetLogScanAddresses(addresses ...string) {
+	topics := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		address = strings.ToLower(strings.TrimPrefix(AppendOxToAddress(bs.wm.CustomAddressDecodeFunc(address)), "0x"))
+		topics = append(topics, "0x"+strings.Repeat("0", 64-len(address))+address)
+	}
+	bs.logFilter.mu.Lock()
+	defer bs.logFilter.mu.Unlock()
+	bs.logFilter.addresses = topics
+	bs.logFilter.reset()
+}
+
+//Reset 清空已查询的日志，区块分叉或关注地址变化时需重新查询
+func (f *logFilter) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reset()
+}
+
+func (f *logFilter) reset() {
+	f.from, f.to = 0, 0
+	f.txs = nil
+}
+
+//FilterTransactions 过滤区块中需要提取的交易：日志中有关注地址代币转账的交易，ScanTargetFuncV2关注的地址发送或接收的交易，
+//以及调用关注合约的交易，没有设置关注地址时返回错误。
+//内部转账不产生日志，交易的发送和接收地址也不是关注地址，需要追踪内部转账时使用区块模式
+func (f *logFilter) FilterTransactions(block *EthBlock, maxHeight uint64) ([]*BlockTransaction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	addresses := f.addresses
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no address is set for log scan mode, set logScanAddresses or call SetLogScanAddresses")
+	}
+
+	height := block.BlockHeight
+	if f.txs == nil || height < f.from || height > f.to {
+		to := height + f.bs.wm.Config.LogScanRange - 1
+		if f.bs.wm.Config.LogScanRange == 0 || to < height {
+			to = height
+		}
+		if to > maxHeight {
+			to = maxHeight
+		}
+		if err := f.fetch(height, to, addresses); err != nil {
+			return nil, err
+		}
+	}
+
+	matched := f.txs[height]
+	for _, blockHash := range matched {
+		if !strings.EqualFold(blockHash, block.BlockHash) {
+			//查询日志后区块已变化，重新查询此区块
+			if err := f.fetch(height, height, addresses); err != nil {
+				return nil, err
+			}
+			matched = f.txs[height]
+			break
+		}
+	}
+
+	txs := make([]*BlockTransaction, 0)
+	for _, tx := range block.Transactions {
+		if _, ok := matched[strings.ToLower(tx.Hash)]; ok || f.isTargetTransaction(tx) {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
+
+//isTargetTransaction 主币交易的发送或接收地址是否被关注，或者交易调用了关注的合约，
+//合约调用交易按区块模式提取合约事件
+func (f *logFilter) isTargetTransaction(tx *BlockTransaction) bool {
+	for _, address := range []string{tx.From, tx.To} {
+		if len(address) == 0 {
+			continue
+		}
+		result := f.bs.ScanTargetFuncV2(openwallet.ScanTargetParam{
+			ScanTarget:     f.bs.wm.CustomAddressEncodeFunc(address),
+			Symbol:         f.bs.wm.Symbol(),
+			ScanTargetType: openwallet.ScanTargetTypeAccountAddress})
+		if result.Exist {
+			return true
+		}
+	}
+	if len(tx.To) == 0 {
+		return false
+	}
+	result := f.bs.ScanTargetFuncV2(openwallet.ScanTargetParam{
+		ScanTarget:     strings.ToLower(tx.To),
+		Symbol:         f.bs.wm.Symbol(),
+		ScanTargetType: openwallet.ScanTargetTypeContractAddress})
+	return result.Exist
+}
+
+//fetch 查询[from, to]内关注地址的代币转账日志，调用者持有mu，
+//KIP7/KIP17的Transfer地址在主题1、2，KIP37的TransferSingle/TransferBatch在主题2、3
+func (f *logFilter) fetch(from, to uint64, addresses []string) error {
+	var (
+		transfer = transferEventID.Hex()
+		kip37    = []string{transferSingleEventID.Hex(), transferBatchEventID.Hex()}
+		txs      = make(map[uint64]map[string]string)
+	)
+
+	contracts := make([]string, 0, len(f.bs.wm.Config.LogScanContracts))
+	for _, contract := range f.bs.wm.Config.LogScanContracts {
+		contracts = append(contracts, AppendOxToAddress(f.bs.wm.CustomAddressDecodeFunc(contract)))
+	}
+
+	for start := 0; start < len(addresses); start += logScanAddressChunk {
+		end := start + logScanAddressChunk
+		if end > len(addresses) {
+			end = len(addresses)
+		}
+		chunk := addresses[start:end]
+
+		queries := [][][]string{
+			{{transfer}, chunk},
+			{append([]string{transfer}, kip37...), nil, chunk},
+			{kip37, nil, nil, chunk},
+		}
+		for _, topics := range queries {
+			logs, err := f.bs.wm.GetLogs(from, to, contracts, topics)
+			if err != nil {
+				f.bs.wm.Log.Errorf("get logs of blocks [%d, %d] failed, err: %v", from, to, err)
+				return err
+			}
+			for _, log := range logs {
+				if log.Removed {
+					continue
+				}
+				height, err := hexutil.DecodeUint64(log.BlockNumber)
+				if err != nil {
+					return err
+				}
+				if txs[height] == nil {
+					txs[height] = make(map[string]string)
+				}
+				txs[height][strings.ToLower(log.TxHash)] = log.BlockHash
+			}
+		}
+	}
+
+	f.from, f.to, f.txs = from, to, txs
+	f.bs.wm.Log.Debugf("log scan blocks [%d, %d], matched blocks: %d", from, to, len(txs))
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestBlockScanner_LogScanModeOffline(t *testing.T) {
+	var (
+		from     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to       = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		other    = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+		contract = "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b"
+	)
+	tokenTx := func(to string) *quorum_rpc.FakeTx {
+		return &quorum_rpc.FakeTx{From: from, To: contract, Gas: 100000, GasPrice: big.NewInt(25000000000), GasUsed: 50000,
+			Logs: []*quorum_rpc.FakeLog{{
+				Address: contract,
+				Topics:  []string{transferEventID.Hex(), "0x" + abiWord(from[2:]), "0x" + abiWord(to[2:])},
+				Data:    "0x" + abiWord("64"),
+			}}}
+	}
+	coinTx := func(to string) *quorum_rpc.FakeTx {
+		return &quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(5), Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000}
+	}
+	node := quorum_rpc.NewFakeNode(1001)
+	node.AddBlock()
+	node.AddBlock(tokenTx(to))
+	node.AddBlock(tokenTx(other))
+	node.AddBlock(coinTx(to))
+	node.AddBlock(coinTx(other))
+
+	//全区块模式的通知作为对照
+	bs, full, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.ScanBlockTask()
+	if len(full.extracted) != 2 {
+		t.Fatalf("block mode notifications = %d, want 2", len(full.extracted))
+	}
+
+	requests := node.RequestCount("klay_getBlockReceipts")
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.wm.Config.ScanMode = ScanModeLogs
+	bs.wm.Config.LogScanContracts = []string{contract}
+	bs.SetLogScanAddresses(to)
+	bs.ScanBlockTask()
+
+	if height, _, _ := bs.GetLocalBlockHead(); height != 5 {
+		t.Fatalf("scanned height = %d, want 5", height)
+	}
+	if len(observer.extracted) != len(full.extracted) {
+		t.Fatalf("logs mode notifications = %d, want %d", len(observer.extracted), len(full.extracted))
+	}
+	for i, data := range observer.extracted {
+		want := full.extracted[i]
+		if data.Transaction.TxID != want.Transaction.TxID || data.Transaction.WxID != want.Transaction.WxID ||
+			data.TxOutputs[0].Amount != want.TxOutputs[0].Amount || data.TxOutputs[0].Sid != want.TxOutputs[0].Sid {
+			t.Errorf("notification %d differs from block mode: %+v, want %+v", i, data.Transaction, want.Transaction)
+		}
+	}
+	//只获取匹配交易所在区块的回执，一次查询覆盖全部区块
+	if n := node.RequestCount("klay_getBlockReceipts") - requests; n != 2 {
+		t.Errorf("block receipts requests = %d, want 2", n)
+	}
+	if n := node.RequestCount("klay_getLogs"); n != 3 {
+		t.Errorf("get logs requests = %d, want 3", n)
+	}
+}
+
+func TestLogFilter_ContractTargetOffline(t *testing.T) {
+	var (
+		from     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		other    = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+		contract = "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b"
+	)
+	bs := testNewFakeWalletManager(quorum_rpc.NewFakeNode(1001)).Blockscanner.(*BlockScanner)
+	bs.SetBlockScanTargetFuncV2(func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		if target.ScanTargetType == openwallet.ScanTargetTypeContractAddress && target.ScanTarget == contract {
+			return openwallet.ScanTargetResult{Exist: true}
+		}
+		return openwallet.ScanTargetResult{}
+	})
+
+	//调用关注合约的交易没有关注地址的日志，也需要提取合约事件
+	if !bs.logFilter.isTargetTransaction(&BlockTransaction{From: from, To: contract}) {
+		t.Errorf("transaction calling a watched contract should be extracted")
+	}
+	if bs.logFilter.isTargetTransaction(&BlockTransaction{From: from, To: other}) {
+		t.Errorf("transaction of other addresses should be skipped")
+	}
+}
+
+func TestLoadAssetsConfig_LogScanAddressesOffline(t *testing.T) {
+	address := "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+
+	//日志模式没有关注地址时加载配置失败，不退化为提取全部交易
+	c, _ := config.NewConfigData("ini", []byte("serverAPI = http://127.0.0.1:1\nscanMode = logs\n"))
+	if err := NewWalletManager().LoadAssetsConfig(c); err == nil {
+		t.Fatalf("logs mode without logScanAddresses should fail")
+	}
+
+	//配置的关注地址传给扫描器
+	dir, err := ioutil.TempDir("", "logscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wm := NewWalletManager()
+	c, _ = config.NewConfigData("ini", []byte("serverAPI = http://127.0.0.1:1\nchainID = 1001\ndataDir = "+dir+
+		"\nscanMode = logs\nlogScanAddresses = "+address+"\n"))
+	wm.LoadAssetsConfig(c)
+	bs := wm.Blockscanner.(*BlockScanner)
+	if len(bs.logFilter.addresses) != 1 || bs.logFilter.addresses[0] != "0x"+abiWord(address[2:]) {
+		t.Errorf("log scan addresses = %v", bs.logFilter.addresses)
+	}
+}
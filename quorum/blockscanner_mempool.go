@@ -0,0 +1,219 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//交易池交易的状态，记录在通知的Transaction.ExtParam的mempool字段
+const (
+	MemPoolStatusPending = "pending" //在交易池中等待打包，BlockHeight为0
+	MemPoolStatusMined   = "mined"   //已打包，由区块扫描发送确认的通知
+	MemPoolStatusDropped = "dropped" //已被交易池丢弃，Status为失败
+)
+
+//memPoolSIDPrefix 交易池记录的Sid和WxID前缀，与打包后区块扫描的确认记录区分
+const memPoolSIDPrefix = "mempool"
+
+//memPoolTx 已通知的交易池交易
+type memPoolTx struct {
+	extractData map[string][]*openwallet.TxExtractData //未确认通知，丢弃时再次通知，无关的交易为空
+	mined       bool                                   //已打包，等待区块扫描
+}
+
+//GetTxPoolPending 获取交易池中可打包的交易
+func (wm *WalletManager) GetTxPoolPending() ([]*BlockTransaction, error) {
+	return wm.GetTxPoolPendingContext(context.Background())
+}
+
+//GetTxPoolPendingContext 支持ctx超时和取消的GetTxPoolPending
+func (wm *WalletManager) GetTxPoolPendingContext(ctx context.Context) ([]*BlockTransaction, error) {
+	result, err := wm.WalletClient.CallContext(ctx, "txpool_content", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	txs := make([]*BlockTransaction, 0)
+	for _, nonces := range result.Get("pending").Map() {
+		for _, raw := range nonces.Map() {
+			var tx BlockTransaction
+			if err := json.Unmarshal([]byte(raw.Raw), &tx); err != nil {
+				return nil, err
+			}
+			tx.From = wm.CustomAddressEncodeFunc(tx.From)
+			tx.To = wm.CustomAddressEncodeFunc(tx.To)
+			txs = append(txs, &tx)
+		}
+	}
+	return txs, nil
+}
+
+//ScanMemPool 扫描交易池，通知未确认的交易，交易打包后由区块扫描发送确认通知，被丢弃时发送失败通知
+func (bs *BlockScanner) ScanMemPool() {
+	txs, err := bs.wm.GetTxPoolPending()
+	if err != nil {
+		bs.wm.Log.Errorf("get txpool content failed, err: %v", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	inPool := make(map[string]bool, len(txs))
+	for _, tx := range txs {
+		txid := strings.ToLower(tx.Hash)
+		inPool[txid] = true
+
+		bs.memPoolMu.Lock()
+		_, exist := bs.memPoolTxs[txid]
+		bs.memPoolMu.Unlock()
+		if exist {
+			continue
+		}
+
+		extractData := bs.extractPendingTransaction(tx, now)
+		bs.memPoolMu.Lock()
+		bs.memPoolTxs[txid] = &memPoolTx{extractData: extractData}
+		bs.memPoolMu.Unlock()
+
+		bs.memPoolNotify(extractData)
+	}
+
+	//离开交易池的交易，已打包的等待区块扫描，查询不到的视为被丢弃
+	bs.memPoolMu.Lock()
+	left := make(map[string]*memPoolTx)
+	for txid, ptx := range bs.memPoolTxs {
+		if !inPool[txid] && !ptx.mined {
+			left[txid] = ptx
+		}
+	}
+	bs.memPoolMu.Unlock()
+
+	for txid, ptx := range left {
+		if len(ptx.extractData) > 0 {
+			tx, err := bs.wm.GetTransactionByHash(txid)
+			if err != nil {
+				bs.wm.Log.Warningf("get transaction: %s failed, err: %v", txid, err)
+				continue
+			}
+			if len(tx.BlockNumber) > 0 {
+				bs.memPoolMu.Lock()
+				ptx.mined = true
+				bs.memPoolMu.Unlock()
+				continue
+			}
+			if len(tx.Hash) > 0 {
+				//其他节点的交易池仍有此交易
+				continue
+			}
+			bs.wm.Log.Infof("transaction: %s is dropped from txpool", txid)
+			bs.memPoolNotify(droppedExtractData(ptx.extractData))
+		}
+		bs.memPoolMu.Lock()
+		delete(bs.memPoolTxs, txid)
+		bs.memPoolMu.Unlock()
+	}
+}
+
+//extractPendingTransaction 提取交易池中的主币交易，没有回执，不提取代币和合约事件
+func (bs *BlockScanner) extractPendingTransaction(tx *BlockTransaction, seenAt int64) map[string][]*openwallet.TxExtractData {
+	//没有回执时以gas上限计算手续费
+	gas, _ := strconv.ParseUint(strings.TrimPrefix(tx.Gas, "0x"), 16, 64)
+	tx.Gas = strconv.FormatUint(gas, 10)
+	tx.BlockTime = uint64(seenAt)
+	tx.decimal = bs.wm.Decimal()
+	tx.FilterFunc = bs.ScanTargetFuncV2
+
+	result := make(map[string][]*openwallet.TxExtractData)
+	for sourceKey, data := range bs.extractETHTransaction(tx, false) {
+		data.Transaction.Status = ""
+		data.Transaction.ConfirmTime = 0
+		data.Transaction.SubmitTime = seenAt
+		data.Transaction.SetExtParam("mempool", MemPoolStatusPending)
+		pendingSIDs(data)
+		result[sourceKey] = append(result[sourceKey], data)
+	}
+	return result
+}
+
+//pendingSIDs 交易池记录使用独立的Sid和WxID，不会与打包后的确认记录重复，丢弃时的失败通知沿用交易池记录的
+func pendingSIDs(data *openwallet.TxExtractData) {
+	for _, input := range data.TxInputs {
+		input.Sid = openwallet.GenRechargeSID(input.TxID, input.Coin.Symbol, input.Coin.ContractID, input.Index, memPoolSIDPrefix+"_input")
+	}
+	for _, output := range data.TxOutputs {
+		output.Sid = openwallet.GenRechargeSID(output.TxID, output.Coin.Symbol, output.Coin.ContractID, output.Index, memPoolSIDPrefix+"_output")
+	}
+	tx := data.Transaction
+	tx.WxID = openwallet.GenTransactionWxID2(memPoolSIDPrefix+"_"+tx.TxID, tx.Coin.Symbol, tx.Coin.ContractID)
+}
+
+//droppedExtractData 被丢弃交易的失败通知
+func droppedExtractData(extractData map[string][]*openwallet.TxExtractData) map[string][]*openwallet.TxExtractData {
+	result := make(map[string][]*openwallet.TxExtractData)
+	for sourceKey, list := range extractData {
+		for _, data := range list {
+			dropped := *data
+			tx := *data.Transaction
+			tx.Status = openwallet.TxStatusFail
+			tx.Reason = "transaction is dropped from txpool"
+			tx.SetExtParam("mempool", MemPoolStatusDropped)
+			dropped.Transaction = &tx
+			result[sourceKey] = append(result[sourceKey], &dropped)
+		}
+	}
+	return result
+}
+
+//markMemPoolMined 区块扫描到曾通知过的交易池交易时，标记为已打包并停止跟踪
+func (bs *BlockScanner) markMemPoolMined(extractData map[string][]*openwallet.TxExtractData) {
+	bs.memPoolMu.Lock()
+	defer bs.memPoolMu.Unlock()
+
+	if len(bs.memPoolTxs) == 0 {
+		return
+	}
+	for _, list := range extractData {
+		for _, data := range list {
+			txid := strings.ToLower(data.Transaction.TxID)
+			ptx, ok := bs.memPoolTxs[txid]
+			if !ok {
+				continue
+			}
+			if len(ptx.extractData) > 0 {
+				data.Transaction.SetExtParam("mempool", MemPoolStatusMined)
+			}
+			delete(bs.memPoolTxs, txid)
+		}
+	}
+}
+
+//memPoolNotify 通知交易池交易，未确认的交易没有区块高度，失败时不记录未扫记录
+func (bs *BlockScanner) memPoolNotify(extractData map[string][]*openwallet.TxExtractData) {
+	for o := range bs.Observers {
+		for key, list := range extractData {
+			for _, data := range list {
+				if err := o.BlockExtractDataNotify(key, data); err != nil {
+					bs.wm.Log.Errorf("txpool transaction: %s notify failed, err: %v", data.Transaction.TxID, err)
+				}
+			}
+		}
+	}
+}
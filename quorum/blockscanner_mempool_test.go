@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+func TestBlockScanner_ScanMemPoolOffline(t *testing.T) {
+	var (
+		from  = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to    = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		other = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+	)
+	newTx := func(to string, nonce uint64) *quorum_rpc.FakeTx {
+		return &quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(5), Nonce: nonce,
+			Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000}
+	}
+	node := quorum_rpc.NewFakeNode(1001)
+	node.AddBlock()
+	mined := newTx(to, 0)
+	node.AddPendingTx(mined)
+	node.AddPendingTx(newTx(other, 1))
+	dropped := node.AddPendingTx(newTx(to, 2))
+
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.IsScanMemPool = true
+	status := func(data *openwallet.TxExtractData) string {
+		return gjson.Get(data.Transaction.ExtParam, "mempool").String()
+	}
+
+	bs.ScanBlockTask()
+	if len(observer.extracted) != 2 {
+		t.Fatalf("pending notifications = %d, want 2", len(observer.extracted))
+	}
+	for _, data := range observer.extracted {
+		if status(data) != MemPoolStatusPending || data.Transaction.BlockHeight != 0 || data.TxOutputs[0].Address != to {
+			t.Errorf("unexpected pending notification: %+v", data.Transaction)
+		}
+	}
+
+	//一笔被打包，一笔被丢弃
+	node.AddBlock(mined)
+	node.DropPendingTx(dropped)
+	bs.ScanBlockTask()
+	bs.ScanBlockTask()
+	if len(observer.extracted) != 4 {
+		t.Fatalf("notifications = %d, want 4", len(observer.extracted))
+	}
+	pending := make(map[string]*openwallet.TxExtractData)
+	for _, data := range observer.extracted[:2] {
+		pending[data.Transaction.TxID] = data
+	}
+	for _, data := range observer.extracted[2:] {
+		//交易池记录与确认记录的Sid和WxID不同，丢弃通知沿用交易池记录的
+		sameSID := data.TxOutputs[0].Sid == pending[data.Transaction.TxID].TxOutputs[0].Sid
+		sameWxID := data.Transaction.WxID == pending[data.Transaction.TxID].Transaction.WxID
+		switch data.Transaction.TxID {
+		case mined.Hash:
+			if sameSID || sameWxID {
+				t.Errorf("confirmed record should not reuse the pending sid or wxid")
+			}
+			if status(data) != MemPoolStatusMined || data.Transaction.BlockHeight != 2 || data.Transaction.Status != openwallet.TxStatusSuccess {
+				t.Errorf("unexpected mined notification: %+v", data.Transaction)
+			}
+		case dropped:
+			if !sameSID || !sameWxID {
+				t.Errorf("dropped notification should update the pending record")
+			}
+			if status(data) != MemPoolStatusDropped || data.Transaction.Status != openwallet.TxStatusFail {
+				t.Errorf("unexpected dropped notification: %+v", data.Transaction)
+			}
+		default:
+			t.Errorf("unexpected notification: %+v", data.Transaction)
+		}
+	}
+	if len(bs.memPoolTxs) != 1 {
+		t.Errorf("only the unrelated pending transaction should be tracked, got %d", len(bs.memPoolTxs))
+	}
+}
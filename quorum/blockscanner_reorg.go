@@ -0,0 +1,124 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	//MaxRollbackDepth 分叉回滚最多回退的区块数，超过时停止扫描等待人工处理
+	MaxRollbackDepth = 128
+)
+
+var errForkTooDeep = fmt.Errorf("fork is deeper than %d blocks", MaxRollbackDepth)
+
+//BlockRetractNotificationObject 可选的观测者接口，区块回滚时通知撤销孤块中的交易，
+//观测者同时实现此接口时才会收到通知
+type BlockRetractNotificationObject interface {
+
+	//BlockRetractNotify 孤块交易撤销通知
+	//@param header: 被回滚的区块，Fork为true
+	//@param txids: 孤块包含的交易，节点已丢弃孤块时为空，需按区块高度撤销
+	BlockRetractNotify(header *openwallet.BlockHeader, txids []string) error
+}
+
+//rollbackFork 回滚分叉，从forkHeight的父区块开始向前比较本地区块和主链区块，直到找到共同祖先，
+//每个孤块高度都通知分叉和需撤销的交易，返回共同祖先区块
+func (bs *BlockScanner) rollbackFork(forkHeight uint64, localHash string) (*EthBlock, error) {
+	var (
+		orphans  = make([]*EthBlock, 0)
+		ancestor *EthBlock
+	)
+
+	for height := forkHeight - 1; ; height-- {
+		chainBlock, err := bs.wm.GetBlockByNum(height, false)
+		if err != nil {
+			return nil, err
+		}
+
+		local, err := bs.GetLocalBlock(height)
+		if err != nil && height == forkHeight-1 {
+			//只记录了区块高度的本地区块
+			local = &EthBlock{BlockHeader: BlockHeader{BlockHash: localHash, BlockHeight: height}}
+		} else if err != nil {
+			//本地没有记录的区块无法比较，以主链区块作为共同祖先
+			bs.wm.Log.Warningf("local block: %d not found, rollback stops here", height)
+			ancestor = chainBlock
+			break
+		}
+
+		if strings.EqualFold(local.BlockHash, chainBlock.BlockHash) || height == 0 {
+			ancestor = chainBlock
+			break
+		}
+
+		orphans = append(orphans, local)
+		if len(orphans) > MaxRollbackDepth {
+			bs.wm.Log.Errorf("block fork at height: %d is deeper than %d blocks, block scanner is stopped", forkHeight, MaxRollbackDepth)
+			return nil, errForkTooDeep
+		}
+	}
+
+	bs.wm.Log.Infof("block fork at height: %d, common ancestor: %d, orphaned blocks: %d", forkHeight, ancestor.BlockHeight, len(orphans))
+
+	err := bs.SaveLocalBlockHead(ancestor.BlockHeight, ancestor.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	//从高到低撤销孤块
+	for _, orphan := range orphans {
+		bs.wm.Log.Infof("retract orphaned block: %d, hash: %s", orphan.BlockHeight, orphan.BlockHash)
+		bs.DeleteUnscanRecord(orphan.BlockHeight)
+		bs.retractNotify(orphan, bs.orphanTxIDs(orphan))
+		bs.newBlockNotify(orphan, true)
+	}
+
+	return ancestor, nil
+}
+
+//orphanTxIDs 孤块包含的交易，节点已丢弃孤块时返回空
+func (bs *BlockScanner) orphanTxIDs(orphan *EthBlock) []string {
+	block, err := bs.wm.GetBlockByHash(orphan.BlockHash, true)
+	if err != nil {
+		bs.wm.Log.Warningf("get orphaned block: %s failed, err: %v", orphan.BlockHash, err)
+		return []string{}
+	}
+	txids := make([]string, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		txids = append(txids, tx.Hash)
+	}
+	return txids
+}
+
+//retractNotify 通知实现了BlockRetractNotificationObject的观测者撤销孤块交易
+func (bs *BlockScanner) retractNotify(orphan *EthBlock, txids []string) {
+	header := orphan.CreateOpenWalletBlockHeader()
+	header.Fork = true
+	header.Symbol = bs.wm.Config.Symbol
+	for o := range bs.Observers {
+		retract, ok := o.(BlockRetractNotificationObject)
+		if !ok {
+			continue
+		}
+		if err := retract.BlockRetractNotify(header, txids); err != nil {
+			bs.wm.Log.Errorf("block: %d retract notify failed, err: %v", orphan.BlockHeight, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//testRetractObserver 同时记录孤块交易撤销通知的观测者
+type testRetractObserver struct {
+	testBlockObserver
+	retracted map[uint64][]string
+}
+
+func (o *testRetractObserver) BlockRetractNotify(header *openwallet.BlockHeader, txids []string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.retracted[header.Height] = txids
+	return nil
+}
+
+func TestBlockScanner_DeepReorgOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	newTx := func(value int64) *quorum_rpc.FakeTx {
+		return &quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(value), Gas: 21000, GasUsed: 21000}
+	}
+	node := quorum_rpc.NewFakeNode(1001)
+	orphans := make(map[uint64]string)
+	for i := int64(1); i <= 6; i++ {
+		block := node.AddBlock(newTx(i))
+		if block.Number >= 4 {
+			orphans[block.Number] = block.Transactions[0].Hash
+		}
+	}
+
+	bs, _, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.wm.Config.ConsensusMode = ConsensusModeProbabilistic
+	observer := &testRetractObserver{retracted: make(map[uint64][]string)}
+	bs.AddObserver(observer)
+	bs.ScanBlockTask()
+	if headers := observer.waitHeaders(5); len(headers) != 5 {
+		t.Fatalf("notified blocks = %d, want 5", len(headers))
+	}
+
+	//区块4~6被替换为新分支4~7
+	node.Rewind(3)
+	for i := int64(1); i <= 4; i++ {
+		node.AddBlock(newTx(100 + i))
+	}
+	bs.ScanBlockTask()
+
+	headers := observer.waitHeaders(5 + 3 + 4)
+	forked := make([]uint64, 0)
+	rescanned := make([]uint64, 0)
+	for _, header := range headers[5:] {
+		if header.Fork {
+			forked = append(forked, header.Height)
+		} else {
+			rescanned = append(rescanned, header.Height)
+		}
+	}
+	if len(forked) != 3 || forked[0] != 6 || forked[2] != 4 {
+		t.Errorf("fork notifications = %v, want [6 5 4]", forked)
+	}
+	if len(rescanned) != 4 || rescanned[0] != 4 || rescanned[3] != 7 {
+		t.Errorf("rescanned blocks = %v, want [4 5 6 7]", rescanned)
+	}
+	for height, txid := range orphans {
+		if txids := observer.retracted[height]; len(txids) != 1 || txids[0] != txid {
+			t.Errorf("block %d retracted txs = %v, want %s", height, txids, txid)
+		}
+	}
+	if height, _, _ := bs.GetLocalBlockHead(); height != 7 {
+		t.Errorf("local block head = %d, want 7", height)
+	}
+}
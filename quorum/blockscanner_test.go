@@ -16,11 +16,28 @@
 package quorum
 
 import (
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+	"math/big"
+	"strings"
 	"testing"
 )
 
+//testNewFakeWalletManager 连接模拟节点的钱包管理器，测试不依赖真实节点
+func testNewFakeWalletManager(node *quorum_rpc.FakeNode) *WalletManager {
+	wm := NewWalletManager()
+	wm.Config.ChainID = node.ChainID
+	wm.WalletClient = &quorum_rpc.Client{BaseURL: "fake", Transport: node}
+	return wm
+}
+
+//abiWord 32字节ABI编码的十六进制
+func abiWord(hex string) string {
+	return strings.Repeat("0", 64-len(hex)) + hex
+}
+
 func TestWalletManager_EthGetTransactionByHash(t *testing.T) {
 	wm := testNewWalletManager()
 	txid := "0x1d7aec3d108222a4707c53228129c16cb7b356ea24262f137edf98cffb611cbf"
@@ -107,3 +124,116 @@ func TestBlockScanner_ExtractTransactionAndReceiptData(t *testing.T) {
 		log.Std.Notice("data.ContractTransaction: %+v", keyData)
 	}
 }
+
+func TestBlockScanner_ExtractTransactionOffline(t *testing.T) {
+	var (
+		from     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to       = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		contract = "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	//name() = symbol() = "FUQI", decimals() = 2
+	node.SetCallResult(contract, "0x06fdde03", "0x"+abiWord("20")+abiWord("4")+"46555149"+strings.Repeat("0", 56))
+	node.SetCallResult(contract, "0x95d89b41", "0x"+abiWord("20")+abiWord("4")+"46555149"+strings.Repeat("0", 56))
+	node.SetCallResult(contract, "0x313ce567", "0x"+abiWord("2"))
+	block := node.AddBlock(&quorum_rpc.FakeTx{
+		From:     from,
+		To:       contract,
+		Gas:      100000,
+		GasPrice: big.NewInt(25000000000),
+		GasUsed:  50000,
+		Logs: []*quorum_rpc.FakeLog{{
+			Address: contract,
+			Topics: []string{
+				"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef",
+				"0x" + abiWord(from[2:]),
+				"0x" + abiWord(to[2:]),
+			},
+			Data: "0x" + abiWord("64"),
+		}},
+	})
+	wm := testNewFakeWalletManager(node)
+
+	scanTargetFunc := func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		if target.ScanTarget == to {
+			return openwallet.ScanTargetResult{SourceKey: "receiver", Exist: true}
+		}
+		return openwallet.ScanTargetResult{}
+	}
+	result, _, err := wm.GetBlockScanner().ExtractTransactionAndReceiptData(block.Transactions[0].Hash, scanTargetFunc)
+	if err != nil {
+		t.Fatalf("ExtractTransactionAndReceiptData failed, err=%v", err)
+	}
+	data := result["receiver"]
+	if len(data) != 1 || len(data[0].TxOutputs) != 1 {
+		t.Fatalf("unexpected extract data: %+v", data)
+	}
+	if output := data[0].TxOutputs[0]; output.Amount != "100" || output.Address != to {
+		t.Errorf("unexpected output: %+v", output)
+	}
+	if contract := data[0].Transaction.Coin.Contract; contract.Token != "FUQI" || contract.Decimals != 2 {
+		t.Errorf("unexpected token: %+v", contract)
+	}
+
+	//交易和区块头使用区块时间
+	blockTime := int64(block.Timestamp)
+	if data[0].Transaction.ConfirmTime != blockTime || data[0].TxOutputs[0].CreateAt != blockTime {
+		t.Errorf("confirm time = %d, create at = %d, want %d",
+			data[0].Transaction.ConfirmTime, data[0].TxOutputs[0].CreateAt, blockTime)
+	}
+	ethBlock, err := wm.GetBlockByNum(block.Number, true)
+	if err != nil {
+		t.Fatalf("GetBlockByNum failed, err=%v", err)
+	}
+	if ethBlock.CreateOpenWalletBlockHeader().Time != block.Timestamp || ethBlock.Transactions[0].BlockTime != block.Timestamp {
+		t.Errorf("block time = %d, want %d", ethBlock.BlockTime, block.Timestamp)
+	}
+}
+
+func TestBlockScanner_PrefetchReceiptsOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	newNode := func() (*quorum_rpc.FakeNode, uint64) {
+		node := quorum_rpc.NewFakeNode(1001)
+		txs := make([]*quorum_rpc.FakeTx, 0)
+		for i := 1; i <= 3; i++ {
+			txs = append(txs, &quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(int64(i)), Gas: 21000, GasUsed: 21000})
+		}
+		return node, node.AddBlock(txs...).Number
+	}
+	prefetch := func(wm *WalletManager, height uint64) {
+		block, err := wm.GetBlockByNum(height, true)
+		if err != nil {
+			t.Fatalf("GetBlockByNum failed, err=%v", err)
+		}
+		wm.Blockscanner.(*BlockScanner).prefetchReceipts(block.Transactions)
+		for _, tx := range block.Transactions {
+			if tx.receipt == nil || tx.receipt.ETHReceipt.GasUsed != 21000 {
+				t.Errorf("tx[%s] receipt not prefetched", tx.Hash)
+			}
+		}
+	}
+
+	//一次获取区块的所有回执
+	node, height := newNode()
+	wm := testNewFakeWalletManager(node)
+	prefetch(wm, height)
+	if node.RequestCount("klay_getBlockReceipts") != 1 || node.RequestCount("klay_getTransactionReceipt") != 0 {
+		t.Errorf("receipts should be fetched by block")
+	}
+
+	//节点不支持时逐笔获取，之后不再尝试
+	node, height = newNode()
+	node.Handle("klay_getBlockReceipts", func(params gjson.Result) (interface{}, error) {
+		return nil, &quorum_rpc.RPCError{Code: quorum_rpc.CodeMethodNotFound, Message: "method not found"}
+	})
+	wm = testNewFakeWalletManager(node)
+	prefetch(wm, height)
+	prefetch(wm, height)
+	if node.RequestCount("klay_getBlockReceipts") != 1 || node.RequestCount("klay_getTransactionReceipt") != 6 {
+		t.Errorf("receipts should fall back to per transaction calls, block calls: %d, tx calls: %d",
+			node.RequestCount("klay_getBlockReceipts"), node.RequestCount("klay_getTransactionReceipt"))
+	}
+}
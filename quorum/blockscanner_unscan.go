@@ -0,0 +1,286 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+//未扫交易的失败原因类型
+const (
+	UnscanReasonReceipt = "receipt" //获取交易、回执等链上数据失败
+	UnscanReasonNotify  = "notify"  //通知观测者失败
+	UnscanReasonDecode  = "decode"  //解析节点返回的数据失败
+)
+
+const (
+	//DefaultUnscanMaxAttempts 未扫交易默认最多重试的次数，超过后移入死信列表
+	DefaultUnscanMaxAttempts = 10
+	//DefaultUnscanRetryInterval 未扫交易首次重试的间隔，之后每次加倍
+	DefaultUnscanRetryInterval = 30 * time.Second
+
+	maxUnscanRetryInterval = time.Hour //重试间隔的上限
+)
+
+//UnscanReason 未扫交易的结构化失败原因，以json保存在UnscanRecord.Reason
+type UnscanReason struct {
+	Type      string `json:"type"`      //失败原因类型
+	Error     string `json:"error"`     //最近一次的错误
+	Attempts  int    `json:"attempts"`  //已重试的次数
+	NextRetry int64  `json:"nextRetry"` //下次重试的时间戳
+	Dead      bool   `json:"dead"`      //重试次数用完，已移入死信列表，不再自动重试
+
+	Observers []string `json:"observers,omitempty"` //通知失败的观测者，重试时只通知这些观测者，为空时通知全部
+}
+
+//ObserverIdentifier 可选的观测者接口，返回观测者的唯一标识，用于通知失败后只重试失败的观测者，
+//没有实现时以观测者的类型名作为标识
+type ObserverIdentifier interface {
+	ObserverID() string
+}
+
+//observerID 观测者的标识
+func observerID(o openwallet.BlockScanNotificationObject) string {
+	if identifier, ok := o.(ObserverIdentifier); ok {
+		return identifier.ObserverID()
+	}
+	return fmt.Sprintf("%T", o)
+}
+
+//notifyFailure 一笔交易通知失败的观测者及最近一次的错误
+type notifyFailure struct {
+	observers []string
+	err       error
+}
+
+func (f *notifyFailure) add(id string, err error) {
+	f.err = err
+	for _, observer := range f.observers {
+		if observer == id {
+			return
+		}
+	}
+	f.observers = append(f.observers, id)
+}
+
+//ParseUnscanReason 解析未扫记录的失败原因，旧版本的按区块记录的原因作为错误信息
+func ParseUnscanReason(record *openwallet.UnscanRecord) *UnscanReason {
+	var reason UnscanReason
+	if err := json.Unmarshal([]byte(record.Reason), &reason); err != nil {
+		return &UnscanReason{Error: record.Reason}
+	}
+	return &reason
+}
+
+//unscanReasonOf 按错误判断失败原因类型
+func unscanReasonOf(err error) string {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return UnscanReasonDecode
+	}
+	switch err {
+	case hexutil.ErrEmptyString, hexutil.ErrSyntax, hexutil.ErrMissingPrefix, hexutil.ErrOddLength,
+		hexutil.ErrEmptyNumber, hexutil.ErrLeadingZero, hexutil.ErrUint64Range, hexutil.ErrBig256Range:
+		return UnscanReasonDecode
+	}
+	return UnscanReasonReceipt
+}
+
+//fail 标记提取失败
+func (result *ExtractResult) fail(reason string, err error) {
+	result.Success = false
+	result.failReason = reason
+	result.failErr = err
+}
+
+//retryInterval 第attempts次重试前的等待时间
+func (bs *BlockScanner) retryInterval(attempts int) time.Duration {
+	interval := bs.wm.Config.UnscanRetryInterval
+	for i := 0; i < attempts && interval < maxUnscanRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxUnscanRetryInterval {
+		interval = maxUnscanRetryInterval
+	}
+	return interval
+}
+
+//saveUnscanRecord 记录一笔未扫交易，同一交易已有记录时重新开始计算重试次数，observers为通知失败的观测者
+func (bs *BlockScanner) saveUnscanRecord(height uint64, txid, reasonType string, err error, observers ...string) error {
+	reason := &UnscanReason{
+		Type:      reasonType,
+		NextRetry: time.Now().Add(bs.retryInterval(0)).Unix(),
+		Observers: observers,
+	}
+	if err != nil {
+		reason.Error = err.Error()
+	}
+	record := openwallet.NewUnscanRecord(height, txid, "", bs.wm.Symbol())
+	return bs.saveUnscanReason(record, reason)
+}
+
+func (bs *BlockScanner) saveUnscanReason(record *openwallet.UnscanRecord, reason *UnscanReason) error {
+	raw, err := json.Marshal(reason)
+	if err != nil {
+		return err
+	}
+	record.Reason = string(raw)
+	return bs.SaveUnscanRecord(record)
+}
+
+//RescanFailedRecord 重扫未扫记录，到了重试时间的交易通过RecoverUnscannedTransactions逐笔重新提取和通知，
+//旧版本按区块记录的重扫整个区块
+func (bs *BlockScanner) RescanFailedRecord() {
+
+	list, err := bs.GetUnscanRecords()
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, record := range list {
+		reason := ParseUnscanReason(record)
+		if reason.Dead || reason.NextRetry > now {
+			continue
+		}
+		if len(record.TxID) == 0 {
+			bs.rescanBlockRecord(record)
+			continue
+		}
+		bs.rescanTransactionRecord(record, reason)
+	}
+}
+
+//rescanBlockRecord 重扫没有交易单号的区块记录，区块内再次失败的交易逐笔记录
+func (bs *BlockScanner) rescanBlockRecord(record *openwallet.UnscanRecord) {
+	if record.BlockHeight == 0 {
+		bs.DeleteUnscanRecordByID(record.ID)
+		return
+	}
+
+	bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", record.BlockHeight)
+
+	block, err := bs.wm.GetBlockByNum(record.BlockHeight, true)
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
+		return
+	}
+
+	batchErr := bs.BatchExtractTransaction(block.BlockHeight, block.Transactions)
+	if batchErr != nil {
+		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", batchErr)
+		return
+	}
+
+	bs.DeleteUnscanRecordByID(record.ID)
+}
+
+//rescanTransactionRecord 重扫一笔未扫交易，成功后删除记录，失败时累计重试次数
+func (bs *BlockScanner) rescanTransactionRecord(record *openwallet.UnscanRecord, reason *UnscanReason) {
+
+	bs.wm.Log.Std.Info("block scanner rescanning transaction: %s, attempts: %d ...", record.TxID, reason.Attempts+1)
+
+	txs, err := bs.wm.RecoverUnscannedTransactions([]*openwallet.UnscanRecord{record})
+	if err != nil {
+		bs.retryFailed(record, reason, unscanReasonOf(err), err)
+		return
+	}
+	tx := txs[0]
+	if len(tx.Hash) == 0 {
+		bs.retryFailed(record, reason, UnscanReasonReceipt, fmt.Errorf("transaction: %s not found", record.TxID))
+		return
+	}
+	if tx.BlockHeight == 0 {
+		tx.BlockHeight = record.BlockHeight
+	}
+	tx.FilterFunc = bs.ScanTargetFuncV2
+
+	result := bs.ExtractTransaction(tx)
+	if !result.Success {
+		bs.retryFailed(record, reason, result.failReason, result.failErr)
+		return
+	}
+
+	//上次通知失败时只重试失败的观测者，避免已成功的观测者收到重复通知
+	failures := bs.notifyExtractData(result.extractData, result.extractContractData, reason.Observers...)
+	for _, failure := range failures {
+		reason.Observers = failure.observers
+		bs.retryFailed(record, reason, UnscanReasonNotify, failure.err)
+		return
+	}
+
+	bs.DeleteUnscanRecordByID(record.ID)
+}
+
+//retryFailed 累计重试次数，用完时移入死信列表
+func (bs *BlockScanner) retryFailed(record *openwallet.UnscanRecord, reason *UnscanReason, reasonType string, err error) {
+	reason.Attempts++
+	reason.Type = reasonType
+	if err != nil {
+		reason.Error = err.Error()
+	}
+	if reason.Attempts >= bs.wm.Config.UnscanMaxAttempts {
+		reason.Dead = true
+		bs.wm.Log.Errorf("transaction: %s failed %d times, moved to dead letter list, reason: %s, err: %s",
+			record.TxID, reason.Attempts, reason.Type, reason.Error)
+	} else {
+		reason.NextRetry = time.Now().Add(bs.retryInterval(reason.Attempts)).Unix()
+		bs.wm.Log.Warningf("transaction: %s rescan failed, attempts: %d, reason: %s, err: %s",
+			record.TxID, reason.Attempts, reason.Type, reason.Error)
+	}
+	if saveErr := bs.saveUnscanReason(record, reason); saveErr != nil {
+		bs.wm.Log.Errorf("transaction: %s save unscan record failed, err: %v", record.TxID, saveErr)
+	}
+}
+
+//GetDeadLetterRecords 获取重试次数用完、不再自动重试的未扫记录
+func (bs *BlockScanner) GetDeadLetterRecords() ([]*openwallet.UnscanRecord, error) {
+	list, err := bs.GetUnscanRecords()
+	if err != nil {
+		return nil, err
+	}
+	dead := make([]*openwallet.UnscanRecord, 0)
+	for _, record := range list {
+		if ParseUnscanReason(record).Dead {
+			dead = append(dead, record)
+		}
+	}
+	return dead, nil
+}
+
+//RetryDeadLetterRecord 将死信列表中的记录放回重试，重新计算重试次数
+func (bs *BlockScanner) RetryDeadLetterRecord(id string) error {
+	list, err := bs.GetUnscanRecords()
+	if err != nil {
+		return err
+	}
+	for _, record := range list {
+		if record.ID != id {
+			continue
+		}
+		reason := ParseUnscanReason(record)
+		reason.Dead = false
+		reason.Attempts = 0
+		reason.NextRetry = 0
+		return bs.saveUnscanReason(record, reason)
+	}
+	return fmt.Errorf("unscan record: %s not found", id)
+}
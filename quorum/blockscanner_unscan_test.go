@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+//testFailingObserver 通知失败的观测者
+type testFailingObserver struct {
+	testBlockObserver
+	failing bool
+	calls   int
+}
+
+func (o *testFailingObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.calls++
+	if o.failing {
+		return fmt.Errorf("observer is down")
+	}
+	return o.testBlockObserver.BlockExtractDataNotify(sourceKey, data)
+}
+
+func testUnscanRecords(t *testing.T, bs *BlockScanner) map[string]*UnscanReason {
+	list, err := bs.GetUnscanRecords()
+	if err != nil {
+		t.Fatalf("get unscan records failed: %v", err)
+	}
+	reasons := make(map[string]*UnscanReason)
+	for _, record := range list {
+		reasons[record.TxID] = ParseUnscanReason(record)
+	}
+	return reasons
+}
+
+func TestBlockScanner_UnscanReceiptOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.AddBlock()
+	tx := &quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(5), Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000}
+	node.AddBlock(tx)
+
+	receiptDown := func(params gjson.Result) (interface{}, error) {
+		return nil, fmt.Errorf("receipt is not available")
+	}
+	node.Handle("klay_getBlockReceipts", receiptDown)
+	node.Handle("klay_getTransactionReceipt", receiptDown)
+
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.wm.Config.UnscanRetryInterval = 0
+	bs.ScanBlockTask()
+
+	//区块继续扫描，失败的交易单独记录，扫描结束时已重试一次
+	if height, _, _ := bs.GetLocalBlockHead(); height != 2 {
+		t.Fatalf("scanner should go on after a failed transaction, height: %d", height)
+	}
+	reasons := testUnscanRecords(t, bs)
+	if reason := reasons[tx.Hash]; len(reasons) != 1 || reason == nil || reason.Type != UnscanReasonReceipt || reason.Attempts != 1 {
+		t.Fatalf("unexpected unscan records: %+v", reasons)
+	}
+
+	//节点恢复后逐笔重扫
+	node.Handle("klay_getBlockReceipts", nil)
+	node.Handle("klay_getTransactionReceipt", nil)
+	bs.RescanFailedRecord()
+	if len(observer.extracted) != 1 || observer.extracted[0].Transaction.TxID != tx.Hash {
+		t.Fatalf("recovered transaction should be notified, got %d", len(observer.extracted))
+	}
+	if reasons := testUnscanRecords(t, bs); len(reasons) != 0 {
+		t.Errorf("unscan record should be deleted, got %+v", reasons)
+	}
+}
+
+func TestBlockScanner_UnscanDeadLetterOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.AddBlock()
+	tx := &quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(5), Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000}
+	node.AddBlock(tx)
+
+	bs, _, _ := testNewFakeBlockScanner(node, 1, to)
+	observer := &testFailingObserver{failing: true}
+	bs.Observers = map[openwallet.BlockScanNotificationObject]bool{observer: true}
+	bs.wm.Config.UnscanRetryInterval = 0
+	bs.wm.Config.UnscanMaxAttempts = 3
+
+	//扫描结束时已重试一次
+	bs.ScanBlockTask()
+	if reason := testUnscanRecords(t, bs)[tx.Hash]; reason == nil || reason.Type != UnscanReasonNotify || reason.Attempts != 1 {
+		t.Fatalf("notify failure should be recorded, got %+v", reason)
+	}
+
+	bs.RescanFailedRecord()
+	if reason := testUnscanRecords(t, bs)[tx.Hash]; reason.Attempts != 2 || reason.Dead {
+		t.Fatalf("unexpected reason after second retry: %+v", reason)
+	}
+	bs.RescanFailedRecord()
+	if reason := testUnscanRecords(t, bs)[tx.Hash]; reason.Attempts != 3 || !reason.Dead {
+		t.Fatalf("record should be moved to dead letter list: %+v", reason)
+	}
+
+	//死信不再自动重试
+	calls := observer.calls
+	bs.RescanFailedRecord()
+	if observer.calls != calls {
+		t.Errorf("dead letter record should not be retried")
+	}
+	dead, _ := bs.GetDeadLetterRecords()
+	if len(dead) != 1 || dead[0].TxID != tx.Hash {
+		t.Fatalf("dead letter records = %d, want 1", len(dead))
+	}
+
+	observer.failing = false
+	if err := bs.RetryDeadLetterRecord(dead[0].ID); err != nil {
+		t.Fatalf("retry dead letter record failed: %v", err)
+	}
+	bs.RescanFailedRecord()
+	if len(observer.extracted) != 1 || len(testUnscanRecords(t, bs)) != 0 {
+		t.Errorf("dead letter record should be recovered after manual retry")
+	}
+}
+
+func TestBlockScanner_UnscanNotifyFailedObserverOnlyOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.AddBlock()
+	tx := &quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(5), Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000}
+	node.AddBlock(tx)
+
+	bs, healthy, _ := testNewFakeBlockScanner(node, 1, to)
+	failing := &testFailingObserver{failing: true}
+	bs.Observers = map[openwallet.BlockScanNotificationObject]bool{healthy: true, failing: true}
+	bs.wm.Config.UnscanRetryInterval = 0
+
+	//扫描结束时已重试一次，只记录并重试失败的观测者
+	bs.ScanBlockTask()
+	reason := testUnscanRecords(t, bs)[tx.Hash]
+	if reason == nil || reason.Type != UnscanReasonNotify || !reflect.DeepEqual(reason.Observers, []string{observerID(failing)}) {
+		t.Fatalf("failed observer should be recorded, got %+v", reason)
+	}
+	if len(healthy.extracted) != 1 || failing.calls != 2 {
+		t.Fatalf("healthy observer notified %d times, failing observer called %d times", len(healthy.extracted), failing.calls)
+	}
+
+	failing.failing = false
+	bs.RescanFailedRecord()
+	if len(healthy.extracted) != 1 {
+		t.Errorf("healthy observer should not receive duplicates, got %d", len(healthy.extracted))
+	}
+	if len(failing.extracted) != 1 || len(testUnscanRecords(t, bs)) != 0 {
+		t.Errorf("failed observer should be recovered, got %d", len(failing.extracted))
+	}
+}
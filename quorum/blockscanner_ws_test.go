@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+//testHeadService 模拟节点的klay_subscribe newHeads，推送固定高度
+type testHeadService struct {
+	height uint64
+}
+
+func (s *testHeadService) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, _ := rpc.NotifierFromContext(ctx)
+	sub := notifier.CreateSubscription()
+	go func() {
+		for {
+			select {
+			case <-sub.Err():
+				return
+			case <-time.After(10 * time.Millisecond):
+				notifier.Notify(sub.ID, map[string]string{"number": hexutil.EncodeUint64(s.height)})
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func TestBlockScanner_NewHeadsStopOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	for i := 1; i <= 3; i++ {
+		node.AddBlock(&quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(int64(i)), Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000})
+	}
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.setScanning(false)
+	height, err := bs.wm.GetBlockNumber()
+	if err != nil {
+		t.Fatalf("GetBlockNumber unexpected error: %v", err)
+	}
+
+	server := rpc.NewServer()
+	server.RegisterName("klay", &testHeadService{height: height})
+	httpServer := httptest.NewServer(server.WebsocketHandler([]string{"*"}))
+	defer httpServer.Close()
+	defer server.Stop()
+
+	bs.wm.WSClient = quorum_rpc.NewWSClient("ws"+strings.TrimPrefix(httpServer.URL, "http"), "klay")
+	bs.wm.WSClient.ReconnectInterval = 10 * time.Millisecond
+
+	waitConnected := func(connected bool) {
+		for i := 0; bs.wm.WSClient.Connected() != connected; i++ {
+			if i > 500 {
+				t.Fatalf("websocket connected = %v, want %v", !connected, connected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := bs.Run(); err != nil {
+		t.Fatalf("Run unexpected error: %v", err)
+	}
+	waitConnected(true)
+	want := int(height - 1)
+	if headers := observer.waitHeaders(want); len(headers) != want {
+		t.Fatalf("notified blocks = %d, want %d", len(headers), want)
+	}
+
+	//暂停后断开websocket，推送协程退出
+	if err := bs.Pause(); err != nil {
+		t.Fatalf("Pause unexpected error: %v", err)
+	}
+	if bs.isScanning() || bs.Scanning || bs.newHeadQuit != nil {
+		t.Errorf("new heads should be stopped after Pause")
+	}
+	waitConnected(false)
+
+	//恢复后重新连接，不会重复订阅
+	if err := bs.Restart(); err != nil {
+		t.Fatalf("Restart unexpected error: %v", err)
+	}
+	waitConnected(true)
+	if !bs.isScanning() || bs.newHeadQuit == nil {
+		t.Errorf("new heads should be running after Restart")
+	}
+
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("Stop unexpected error: %v", err)
+	}
+	if bs.isScanning() || bs.newHeadQuit != nil {
+		t.Errorf("new heads should be stopped after Stop")
+	}
+	waitConnected(false)
+	if headers := observer.waitHeaders(0); len(headers) != want {
+		t.Errorf("notified blocks = %d after Stop, want %d", len(headers), want)
+	}
+}
@@ -0,0 +1,427 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+//已广播交易的状态
+const (
+	BroadcastStatusPending = "pending" //已广播，等待打包和确认
+	BroadcastStatusMined   = "mined"   //已打包并达到确认数，执行成功
+	BroadcastStatusFailed  = "failed"  //已打包并达到确认数，执行失败
+	BroadcastStatusDropped = "dropped" //被相同nonce的交易替换，或重新广播次数用完仍不在交易池
+)
+
+const (
+	//DefaultBroadcastConfirmations 默认的确认数，Klaytn的BFT区块打包即确定
+	DefaultBroadcastConfirmations = 1
+	//DefaultBroadcastPollInterval 默认的轮询间隔
+	DefaultBroadcastPollInterval = 10 * time.Second
+	//DefaultBroadcastMaxRebroadcasts 交易掉出交易池后默认最多重新广播的次数
+	DefaultBroadcastMaxRebroadcasts = 5
+)
+
+//TrackedTransaction 追踪中的已广播交易
+type TrackedTransaction struct {
+	TxID          string `json:"txid"`
+	From          string `json:"from"`
+	Nonce         uint64 `json:"nonce"`
+	RawTx         string `json:"rawTx"`         //已签名的原始交易，掉出交易池时重新广播
+	Replaces      string `json:"replaces"`      //加速或取消替换的原交易
+	Status        string `json:"status"`        //当前状态
+	Notified      string `json:"notified"`      //已成功通知的状态
+	BlockHeight   uint64 `json:"blockHeight"`   //打包的区块高度，未打包为0
+	BlockHash     string `json:"blockHash"`     //打包的区块hash
+	Confirmations uint64 `json:"confirmations"` //已有的确认数
+	Rebroadcasts  int    `json:"rebroadcasts"`  //已重新广播的次数
+	ReplacedBy    string `json:"replacedBy"`    //替换本交易的交易，dropped时可能有值
+	SubmitTime    int64  `json:"submitTime"`
+	UpdateAt      int64  `json:"updateAt"`
+}
+
+//isFinal 是否最终状态，通知后不再追踪
+func (tx *TrackedTransaction) isFinal() bool {
+	return tx.Status != BroadcastStatusPending
+}
+
+//BroadcastObserver 已广播交易的状态观测者
+type BroadcastObserver interface {
+
+	//BroadcastStatusNotify 交易状态变化通知，返回错误时下一轮轮询再次通知
+	//@param tx: 交易的副本
+	BroadcastStatusNotify(tx *TrackedTransaction) error
+}
+
+//BroadcastTracker 已广播交易的追踪器，持久化到数据目录，轮询交易直到达到确认数，
+//交易掉出交易池时重新广播已签名的原始交易，被相同nonce的其他交易替换时通知dropped
+type BroadcastTracker struct {
+	Path string //持久化文件，为空时只保存在内存
+
+	wm        *WalletManager
+	mu        sync.Mutex
+	txs       map[string]*TrackedTransaction
+	observers map[BroadcastObserver]bool
+	quit      chan struct{}
+	polling   sync.Mutex //同一时间只有一轮轮询
+}
+
+//NewBroadcastTracker 创建内存中的追踪器
+func NewBroadcastTracker(wm *WalletManager) *BroadcastTracker {
+	return &BroadcastTracker{
+		wm:        wm,
+		txs:       make(map[string]*TrackedTransaction),
+		observers: make(map[BroadcastObserver]bool),
+	}
+}
+
+//Open 从文件加载追踪中的交易，文件不存在时创建空的追踪器
+func (t *BroadcastTracker) Open(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	txs := make(map[string]*TrackedTransaction)
+	if err := json.Unmarshal(data, &txs); err != nil {
+		return err
+	}
+	for txid, tx := range txs {
+		t.txs[strings.ToLower(txid)] = tx
+	}
+	return nil
+}
+
+//save 写入持久化文件，调用者需持有锁
+func (t *BroadcastTracker) save() error {
+	if len(t.Path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.txs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.Path), os.ModePerm); err != nil {
+		return err
+	}
+	//先写临时文件再替换，避免进程中断时留下损坏的文件
+	tmp := t.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.Path)
+}
+
+//AddObserver 添加状态观测者
+func (t *BroadcastTracker) AddObserver(obj BroadcastObserver) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observers[obj] = true
+}
+
+//RemoveObserver 移除状态观测者
+func (t *BroadcastTracker) RemoveObserver(obj BroadcastObserver) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.observers, obj)
+}
+
+//Track 追踪已广播的交易并通知pending
+//@param rawTx: 已签名的原始交易
+//@param replaces: 被本交易替换的原交易，没有时为空
+func (t *BroadcastTracker) Track(txid, from string, nonce uint64, rawTx []byte, replaces string) {
+	now := time.Now().Unix()
+	tx := &TrackedTransaction{
+		TxID:       txid,
+		From:       from,
+		Nonce:      nonce,
+		RawTx:      hexutil.Encode(rawTx),
+		Replaces:   replaces,
+		Status:     BroadcastStatusPending,
+		SubmitTime: now,
+		UpdateAt:   now,
+	}
+
+	t.mu.Lock()
+	t.txs[strings.ToLower(txid)] = tx
+	if err := t.save(); err != nil {
+		t.wm.Log.Errorf("save broadcast transaction: %s failed, err: %v", txid, err)
+	}
+	t.mu.Unlock()
+
+	t.notify([]*TrackedTransaction{tx})
+}
+
+//Get 查询追踪中的交易，已通知最终状态的交易不再追踪
+func (t *BroadcastTracker) Get(txid string) (*TrackedTransaction, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx, ok := t.txs[strings.ToLower(txid)]
+	if !ok {
+		return nil, false
+	}
+	copied := *tx
+	return &copied, true
+}
+
+//List 追踪中的交易，按广播时间排序
+func (t *BroadcastTracker) List() []*TrackedTransaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*TrackedTransaction, 0, len(t.txs))
+	for _, tx := range t.txs {
+		copied := *tx
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].SubmitTime != list[j].SubmitTime {
+			return list[i].SubmitTime < list[j].SubmitTime
+		}
+		return list[i].TxID < list[j].TxID
+	})
+	return list
+}
+
+//Start 按配置的间隔在后台轮询
+func (t *BroadcastTracker) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.quit != nil {
+		return
+	}
+	interval := t.wm.Config.BroadcastPollInterval
+	if interval <= 0 {
+		interval = DefaultBroadcastPollInterval
+	}
+	quit := make(chan struct{})
+	t.quit = quit
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.Poll()
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+//Stop 停止后台轮询
+func (t *BroadcastTracker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.quit != nil {
+		close(t.quit)
+		t.quit = nil
+	}
+}
+
+//Poll 轮询一次全部追踪中的交易，更新状态并通知，最终状态通知成功后不再追踪
+func (t *BroadcastTracker) Poll() {
+	t.polling.Lock()
+	defer t.polling.Unlock()
+
+	//按广播顺序检查，替换交易在原交易之后，原交易检查时仍能找到替换它的交易
+	list := t.List()
+	if len(list) == 0 {
+		return
+	}
+
+	height, err := t.wm.GetBlockNumber()
+	if err != nil {
+		t.wm.Log.Errorf("broadcast tracker get block number failed, err: %v", err)
+		return
+	}
+	for _, tx := range list {
+		if !tx.isFinal() {
+			t.check(tx, height, list)
+		}
+	}
+
+	t.mu.Lock()
+	for _, tx := range list {
+		//轮询期间可能被重新Track
+		if current, ok := t.txs[strings.ToLower(tx.TxID)]; ok && current.SubmitTime == tx.SubmitTime {
+			tx.Notified = current.Notified
+			t.txs[strings.ToLower(tx.TxID)] = tx
+		}
+	}
+	if err := t.save(); err != nil {
+		t.wm.Log.Errorf("save broadcast transactions failed, err: %v", err)
+	}
+	t.mu.Unlock()
+
+	t.notify(list)
+}
+
+//check 检查一笔交易的状态
+func (t *BroadcastTracker) check(tx *TrackedTransaction, height uint64, list []*TrackedTransaction) {
+	wm := t.wm
+	chainTx, err := wm.GetTransactionByHash(tx.TxID)
+	if err != nil {
+		wm.Log.Errorf("broadcast tracker get transaction: %s failed, err: %v", tx.TxID, err)
+		return
+	}
+
+	//已打包，达到确认数后按回执确定结果
+	if len(chainTx.Hash) > 0 && chainTx.BlockHeight > 0 {
+		tx.BlockHeight = chainTx.BlockHeight
+		tx.BlockHash = chainTx.BlockHash
+		tx.Confirmations = 0
+		if height >= tx.BlockHeight {
+			tx.Confirmations = height - tx.BlockHeight + 1
+		}
+		if tx.Confirmations < wm.Config.BroadcastConfirmations {
+			return
+		}
+		receipt, err := wm.GetTransactionReceipt(tx.TxID)
+		if err != nil {
+			wm.Log.Errorf("broadcast tracker get transaction: %s receipt failed, err: %v", tx.TxID, err)
+			return
+		}
+		status := BroadcastStatusMined
+		if receipt.ETHReceipt.Status != 1 {
+			status = BroadcastStatusFailed
+		}
+		t.setStatus(tx, status)
+		return
+	}
+
+	//区块回滚后交易回到交易池或被丢弃
+	tx.BlockHeight, tx.BlockHash, tx.Confirmations = 0, "", 0
+	if len(chainTx.Hash) > 0 {
+		return
+	}
+
+	//不在交易池，nonce已被使用或有替换交易时不再重新广播
+	mined, err := wm.GetTransactionCount(tx.From)
+	if err != nil {
+		wm.Log.Errorf("broadcast tracker get address: %s nonce failed, err: %v", tx.From, err)
+		return
+	}
+	if replacedBy := t.replacement(tx, list); len(replacedBy) > 0 || mined > tx.Nonce {
+		tx.ReplacedBy = replacedBy
+		t.setStatus(tx, BroadcastStatusDropped)
+		return
+	}
+	if tx.Rebroadcasts >= wm.Config.BroadcastMaxRebroadcasts {
+		t.setStatus(tx, BroadcastStatusDropped)
+		return
+	}
+	tx.Rebroadcasts++
+	tx.UpdateAt = time.Now().Unix()
+	if _, err := wm.SendRawTransaction(tx.RawTx); err != nil && !quorum_rpc.IsKnownTransactionError(err) {
+		wm.Log.Warningf("rebroadcast transaction: %s failed, attempts: %d, err: %v", tx.TxID, tx.Rebroadcasts, err)
+		return
+	}
+	wm.Log.Infof("transaction: %s is not in the pool, rebroadcast attempts: %d", tx.TxID, tx.Rebroadcasts)
+}
+
+//replacement 替换交易的txid，优先使用同一地址同一nonce之后广播的追踪交易，其次是NonceManager记录的替换交易
+func (t *BroadcastTracker) replacement(tx *TrackedTransaction, list []*TrackedTransaction) string {
+	var replacedBy string
+	for _, other := range list {
+		if other.TxID == tx.TxID || other.Nonce != tx.Nonce || !strings.EqualFold(other.From, tx.From) {
+			continue
+		}
+		if other.SubmitTime >= tx.SubmitTime && other.Status != BroadcastStatusDropped {
+			replacedBy = other.TxID
+		}
+	}
+	if len(replacedBy) > 0 {
+		return replacedBy
+	}
+	txids := t.wm.NonceManager.Replacements(tx.From, tx.Nonce)
+	if len(txids) > 0 && !strings.EqualFold(txids[len(txids)-1], tx.TxID) {
+		return txids[len(txids)-1]
+	}
+	return ""
+}
+
+func (t *BroadcastTracker) setStatus(tx *TrackedTransaction, status string) {
+	if tx.Status == status {
+		return
+	}
+	t.wm.Log.Infof("broadcast transaction: %s status: %s -> %s", tx.TxID, tx.Status, status)
+	tx.Status = status
+	tx.UpdateAt = time.Now().Unix()
+}
+
+//notify 通知未通知的状态，全部观测者通知成功后记录，最终状态通知成功后不再追踪
+func (t *BroadcastTracker) notify(list []*TrackedTransaction) {
+	t.mu.Lock()
+	observers := make([]BroadcastObserver, 0, len(t.observers))
+	for o := range t.observers {
+		observers = append(observers, o)
+	}
+	t.mu.Unlock()
+
+	changed := false
+	for _, tx := range list {
+		if tx.Status == tx.Notified {
+			continue
+		}
+		success := true
+		for _, o := range observers {
+			copied := *tx
+			if err := o.BroadcastStatusNotify(&copied); err != nil {
+				t.wm.Log.Errorf("broadcast transaction: %s status: %s notify failed, err: %v", tx.TxID, tx.Status, err)
+				success = false
+			}
+		}
+		if !success {
+			continue
+		}
+
+		t.mu.Lock()
+		key := strings.ToLower(tx.TxID)
+		if current, ok := t.txs[key]; ok && current.SubmitTime == tx.SubmitTime && current.Status == tx.Status {
+			current.Notified = tx.Status
+			if current.isFinal() {
+				delete(t.txs, key)
+			}
+			changed = true
+		}
+		t.mu.Unlock()
+	}
+
+	if changed {
+		t.mu.Lock()
+		if err := t.save(); err != nil {
+			t.wm.Log.Errorf("save broadcast transactions failed, err: %v", err)
+		}
+		t.mu.Unlock()
+	}
+}
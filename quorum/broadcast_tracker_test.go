@@ -0,0 +1,210 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/astaxie/beego/config"
+)
+
+//testBroadcastObserver 记录每笔交易收到的状态
+type testBroadcastObserver struct {
+	mu       sync.Mutex
+	statuses map[string][]string
+	last     map[string]*TrackedTransaction
+	fail     bool
+}
+
+func (o *testBroadcastObserver) BroadcastStatusNotify(tx *TrackedTransaction) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.fail {
+		return fmt.Errorf("observer is down")
+	}
+	o.statuses[tx.TxID] = append(o.statuses[tx.TxID], tx.Status)
+	o.last[tx.TxID] = tx
+	return nil
+}
+
+func testNewBroadcastTracker(t *testing.T, node *quorum_rpc.FakeNode) (*BroadcastTracker, *testBroadcastObserver, string) {
+	dir, err := ioutil.TempDir("", "broadcasts")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	wm := testNewFakeWalletManager(node)
+	wm.Config.TrackBroadcasts = true
+	wm.Config.BroadcastConfirmations = 2
+	wm.Config.BroadcastMaxRebroadcasts = 1
+	path := filepath.Join(dir, "broadcasts.json")
+	if err := wm.BroadcastTracker.Open(path); err != nil {
+		t.Fatalf("open broadcast tracker failed: %v", err)
+	}
+	observer := &testBroadcastObserver{statuses: make(map[string][]string), last: make(map[string]*TrackedTransaction)}
+	wm.BroadcastTracker.AddObserver(observer)
+	return wm.BroadcastTracker, observer, path
+}
+
+func TestBroadcastTracker_ConfirmationsOffline(t *testing.T) {
+	from := "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+	node := quorum_rpc.NewFakeNode(1001)
+	tracker, observer, path := testNewBroadcastTracker(t, node)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	ok := &quorum_rpc.FakeTx{From: from, Nonce: 0, Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000}
+	failed := &quorum_rpc.FakeTx{From: from, Nonce: 1, Gas: 21000, GasPrice: big.NewInt(25000000000), GasUsed: 21000, Failed: true}
+	node.AddPendingTx(ok)
+	node.AddPendingTx(failed)
+	tracker.Track(ok.Hash, from, 0, []byte{1}, "")
+	tracker.Track(failed.Hash, from, 1, []byte{2}, "")
+
+	//在交易池中保持pending
+	tracker.Poll()
+	if len(node.SentTransactions()) != 0 {
+		t.Errorf("pending transactions should not be rebroadcast")
+	}
+
+	//打包后等到确认数
+	node.AddBlock(ok, failed)
+	node.SetNonce(from, 2)
+	tracker.Poll()
+	if tx, _ := tracker.Get(ok.Hash); tx.Status != BroadcastStatusPending || tx.Confirmations != 1 || tx.BlockHeight != 1 {
+		t.Errorf("unexpected tracked transaction before confirmations: %+v", tx)
+	}
+	node.AddBlock()
+	tracker.Poll()
+
+	if want := []string{BroadcastStatusPending, BroadcastStatusMined}; !reflect.DeepEqual(observer.statuses[ok.Hash], want) {
+		t.Errorf("statuses = %v, want %v", observer.statuses[ok.Hash], want)
+	}
+	if want := []string{BroadcastStatusPending, BroadcastStatusFailed}; !reflect.DeepEqual(observer.statuses[failed.Hash], want) {
+		t.Errorf("statuses = %v, want %v", observer.statuses[failed.Hash], want)
+	}
+	if len(tracker.List()) != 0 {
+		t.Errorf("notified transactions should not be tracked, got %d", len(tracker.List()))
+	}
+}
+
+func TestBroadcastTracker_RebroadcastAndReplacedOffline(t *testing.T) {
+	from := "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+	node := quorum_rpc.NewFakeNode(1001)
+	tracker, observer, path := testNewBroadcastTracker(t, node)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	var (
+		lost        = "0x" + strings.Repeat("11", 32)
+		original    = "0x" + strings.Repeat("22", 32)
+		replacement = &quorum_rpc.FakeTx{From: from, Nonce: 1, Gas: 21000, GasPrice: big.NewInt(30000000000), GasUsed: 21000}
+	)
+	node.AddPendingTx(replacement)
+	tracker.Track(lost, from, 0, []byte{0xaa}, "")
+	tracker.Track(original, from, 1, []byte{0xbb}, "")
+	tracker.Track(replacement.Hash, from, 1, []byte{0xcc}, original)
+
+	//观测者不可用时状态保留，下一轮再次通知
+	observer.fail = true
+	tracker.Poll()
+	if sent := node.SentTransactions(); !reflect.DeepEqual(sent, []string{"0xaa"}) {
+		t.Errorf("only the lost transaction should be rebroadcast, got %v", sent)
+	}
+	if tx, _ := tracker.Get(original); tx.Status != BroadcastStatusDropped || tx.ReplacedBy != replacement.Hash {
+		t.Errorf("original should be replaced, got %+v", tx)
+	}
+
+	//重启后从文件恢复
+	wm := testNewFakeWalletManager(node)
+	wm.Config.BroadcastConfirmations = 1
+	wm.Config.BroadcastMaxRebroadcasts = 1
+	if err := wm.BroadcastTracker.Open(path); err != nil {
+		t.Fatalf("reopen broadcast tracker failed: %v", err)
+	}
+	if len(wm.BroadcastTracker.List()) != 3 {
+		t.Fatalf("tracked transactions should be persisted, got %d", len(wm.BroadcastTracker.List()))
+	}
+	observer.fail = false
+	wm.BroadcastTracker.AddObserver(observer)
+
+	//nonce已被使用后不再重新广播
+	node.AddBlock(replacement)
+	node.SetNonce(from, 2)
+	wm.BroadcastTracker.Poll()
+	if want := []string{BroadcastStatusPending, BroadcastStatusDropped}; !reflect.DeepEqual(observer.statuses[lost], want) {
+		t.Errorf("lost statuses = %v, want %v", observer.statuses[lost], want)
+	}
+	if want := []string{BroadcastStatusPending, BroadcastStatusDropped}; !reflect.DeepEqual(observer.statuses[original], want) || observer.last[original].ReplacedBy != replacement.Hash {
+		t.Errorf("original statuses = %v, want %v", observer.statuses[original], want)
+	}
+	if want := []string{BroadcastStatusPending, BroadcastStatusMined}; !reflect.DeepEqual(observer.statuses[replacement.Hash], want) {
+		t.Errorf("replacement statuses = %v, want %v", observer.statuses[replacement.Hash], want)
+	}
+	if len(wm.BroadcastTracker.List()) != 0 {
+		t.Errorf("notified transactions should not be tracked")
+	}
+}
+
+func TestWalletManager_StartStopOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, _ := config.NewConfigData("ini", []byte("serverAPIs = http://127.0.0.1:1;http://127.0.0.1:2\nchainID = 1001\ndataDir = "+dir+
+		"\ntrackBroadcasts = true\nnodeHealthCheckInterval = 3600\n"))
+
+	wm := NewWalletManager()
+	tracking := func() bool {
+		wm.BroadcastTracker.mu.Lock()
+		defer wm.BroadcastTracker.mu.Unlock()
+		return wm.BroadcastTracker.quit != nil
+	}
+	checking := func() bool {
+		return wm.WalletClient.Pool.HealthChecking()
+	}
+
+	//加载配置不启动后台任务
+	if err := wm.LoadAssetsConfig(c); err != nil {
+		t.Fatalf("load assets config failed: %v", err)
+	}
+	if tracking() || checking() {
+		t.Fatalf("LoadAssetsConfig should not start background tasks")
+	}
+	wm.Start()
+	wm.Start()
+	if !tracking() || !checking() {
+		t.Fatalf("Start should start the broadcast tracker and node health check")
+	}
+
+	//重新加载配置时停止已启动的任务，旧客户端的健康检查不会泄漏
+	old := wm.WalletClient
+	wm.LoadAssetsConfig(c)
+	if tracking() || checking() || old.Pool.HealthChecking() {
+		t.Fatalf("reloading config should stop background tasks")
+	}
+	wm.Start()
+	wm.Stop()
+	if tracking() || checking() {
+		t.Errorf("Stop should stop background tasks")
+	}
+}
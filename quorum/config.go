@@ -20,6 +20,7 @@ import (
 	"math/big"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
@@ -47,16 +48,95 @@ type WalletConfig struct {
 	FixGasPrice *big.Int
 	//补偿gasPrice值
 	OffsetsGasPrice *big.Int
-	//nonce计算方式, 0: auto-increment nonce, 1: latest nonce
+	//nonce计算方式, 0: NonceManager本地分配并以pending nonce校准, 1: latest nonce
 	NonceComputeMode int64
+	//替换交易池中相同nonce的交易时gasPrice的最低涨幅百分比
+	TxPriceBump uint64
 	//Broadcast node RPC API
 	BroadcastAPI string
+	//多节点钱包服务API，包含ServerAPI
+	ServerAPIs []string
+	//节点落后最高节点的区块数超过此值，移出节点池
+	NodeMaxBlockLag uint64
+	//节点健康检查间隔
+	NodeHealthCheckInterval time.Duration
+	//单次RPC调用超时
+	RPCTimeout time.Duration
+	//幂等读请求网络错误时的重试次数
+	RPCMaxRetries int
+	//重试初始等待时间，每次翻倍
+	RPCRetryBackoff time.Duration
+	//websocket节点API，配置后通过订阅新区块驱动扫描
+	ServerWS string
+	//默认交易类型，RawTransaction的ExtParam可通过txType覆盖
+	TxType KlaytnTxType
+	//汇总代币时由手续费账户代付手续费，默认关闭，先向地址转入手续费
+	FeeDelegation bool
+	//代币元数据缓存的刷新间隔，0表示不刷新
+	TokenMetadataTTL time.Duration
+	//落后最新区块超过此数量时进入追块模式，并发预取区块，0表示关闭
+	CatchUpThreshold uint64
+	//追块模式最多同时预取的区块数
+	CatchUpMaxWindow int
+	//共识模式，bft: 校验区块确定性，父区块不一致时停止扫描；probabilistic: 分叉时回滚重扫
+	ConsensusMode string
+	//扫描交易池，通知未确认的交易
+	ScanMemPool bool
+	//追踪合约调用交易的内部转账，需要节点开启debug接口
+	TraceInternalTransfers bool
+	//未扫交易最多重试的次数，超过后移入死信列表
+	UnscanMaxAttempts int
+	//未扫交易首次重试的间隔，之后每次加倍
+	UnscanRetryInterval time.Duration
+	//扫描模式，block: 提取区块内每一笔交易；logs: 通过klay_getLogs只提取关注地址的代币转账、主币交易和关注合约的调用，内部转账需要使用block
+	ScanMode string
+	//日志模式关注的合约地址，为空时不限合约
+	LogScanContracts []string
+	//日志模式关注的地址，日志模式必须设置
+	LogScanAddresses []string
+	//日志模式一次查询的区块数
+	LogScanRange uint64
+	//追踪已广播的交易，轮询到达到确认数，掉出交易池时重新广播
+	TrackBroadcasts bool
+	//已广播交易需要的确认数
+	BroadcastConfirmations uint64
+	//已广播交易的轮询间隔
+	BroadcastPollInterval time.Duration
+	//交易掉出交易池后最多重新广播的次数
+	BroadcastMaxRebroadcasts int
+	//动态手续费交易估算的maxFeePerGas上限，0表示不限
+	MaxFeePerGas *big.Int
+	//动态手续费交易估算的maxPriorityFeePerGas上限，0表示不限
+	MaxPriorityFeePerGas *big.Int
+	//估算maxFeePerGas时baseFee的百分比倍数，maxFeePerGas = baseFee * BaseFeeMultiplier / 100 + maxPriorityFeePerGas
+	BaseFeeMultiplier uint64
+	//批量转账合约地址，配置后多个接收地址的交易单通过一次合约调用转出
+	BatchTransferContract string
+	//已构建未广播的nonce超过此时间后释放，0表示不释放
+	NonceReservationTTL time.Duration
 }
 
 func NewConfig(symbol string) *WalletConfig {
 	c := WalletConfig{}
 	c.Symbol = symbol
 	c.CurveType = CurveType
+	c.FeeDelegation = false
+	c.TokenMetadataTTL = DefaultTokenMetadataTTL
+	c.CatchUpThreshold = DefaultCatchUpThreshold
+	c.CatchUpMaxWindow = DefaultCatchUpMaxWindow
+	c.ConsensusMode = ConsensusModeBFT
+	c.UnscanMaxAttempts = DefaultUnscanMaxAttempts
+	c.UnscanRetryInterval = DefaultUnscanRetryInterval
+	c.ScanMode = ScanModeBlock
+	c.LogScanRange = DefaultLogScanRange
+	c.TxPriceBump = DefaultTxPriceBump
+	c.BroadcastConfirmations = DefaultBroadcastConfirmations
+	c.BroadcastPollInterval = DefaultBroadcastPollInterval
+	c.BroadcastMaxRebroadcasts = DefaultBroadcastMaxRebroadcasts
+	c.MaxFeePerGas = big.NewInt(0)
+	c.MaxPriorityFeePerGas = big.NewInt(0)
+	c.BaseFeeMultiplier = DefaultBaseFeeMultiplier
+	c.NonceReservationTTL = DefaultNonceReservationTTL
 	return &c
 }
 
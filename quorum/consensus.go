@@ -0,0 +1,150 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	//ConsensusModeBFT Istanbul BFT共识，区块被委员会签名后立即确定，不会回滚
+	ConsensusModeBFT = "bft"
+	//ConsensusModeProbabilistic 概率确定的共识，发现分叉时回滚重扫
+	ConsensusModeProbabilistic = "probabilistic"
+)
+
+//ParseConsensusMode 解析共识模式，为空时使用BFT
+func ParseConsensusMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", ConsensusModeBFT:
+		return ConsensusModeBFT, nil
+	case ConsensusModeProbabilistic:
+		return ConsensusModeProbabilistic, nil
+	}
+	return "", fmt.Errorf("unknown consensus mode: %s", mode)
+}
+
+//BlockConsensusInfo 区块的BFT共识信息
+type BlockConsensusInfo struct {
+	BlockHash  string   `json:"hash"`
+	Proposer   string   `json:"proposer"`
+	Committee  []string `json:"committee"`
+	Committers []string `json:"committers"` //提交签名的委员会成员，旧版本节点不返回
+}
+
+//QuorumSize 确定区块需要的委员会签名数，超过委员会的2/3
+func (info *BlockConsensusInfo) QuorumSize() int {
+	return (2*len(info.Committee) + 2) / 3
+}
+
+//Finalized 区块是否已被委员会确定，节点没有返回committers时以委员会非空为准
+func (info *BlockConsensusInfo) Finalized() bool {
+	if len(info.Committee) == 0 {
+		return false
+	}
+	if info.Committers == nil {
+		return true
+	}
+	members := make(map[string]bool, len(info.Committee))
+	for _, member := range info.Committee {
+		members[strings.ToLower(member)] = true
+	}
+	signed := 0
+	for _, committer := range info.Committers {
+		committer = strings.ToLower(committer)
+		if members[committer] {
+			signed++
+			delete(members, committer)
+		}
+	}
+	return signed >= info.QuorumSize()
+}
+
+//GetBlockConsensusInfo 获取区块的BFT共识信息
+func (wm *WalletManager) GetBlockConsensusInfo(height uint64) (*BlockConsensusInfo, error) {
+	return wm.GetBlockConsensusInfoContext(context.Background(), height)
+}
+
+//GetBlockConsensusInfoContext 支持ctx超时和取消的GetBlockConsensusInfo
+func (wm *WalletManager) GetBlockConsensusInfoContext(ctx context.Context, height uint64) (*BlockConsensusInfo, error) {
+	method := strings.ToLower(wm.Config.Symbol) + "_getBlockWithConsensusInfoByNumber"
+	result, err := wm.WalletClient.CallContext(ctx, method, []interface{}{hexutil.EncodeUint64(height)})
+	if err != nil {
+		return nil, err
+	}
+	if result.Type != gjson.JSON {
+		return nil, fmt.Errorf("block: %d consensus info not found", height)
+	}
+	var info BlockConsensusInfo
+	if err := json.Unmarshal([]byte(result.Raw), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+//bftMode 是否使用BFT共识模式扫描
+func (bs *BlockScanner) bftMode() bool {
+	return bs.wm.Config.ConsensusMode == ConsensusModeBFT
+}
+
+//supportConsensusInfo 节点是否支持getBlockWithConsensusInfoByNumber
+func (wm *WalletManager) supportConsensusInfo() bool {
+	return atomic.LoadInt32(&wm.consensusInfoUnsupported) == 0
+}
+
+//verifyFinality BFT模式下确认区块已被委员会签名确定，未确定时等待下次扫描。
+//节点不支持查询共识信息时只记录一次日志，区块的确定性只由调用者的父区块hash检查保证
+func (bs *BlockScanner) verifyFinality(block *EthBlock) error {
+	if !bs.wm.supportConsensusInfo() {
+		return nil
+	}
+	info := block.consensus
+	if info == nil {
+		var err error
+		info, err = bs.wm.GetBlockConsensusInfo(block.BlockHeight)
+		if quorum_rpc.IsMethodNotFoundError(err) {
+			if atomic.CompareAndSwapInt32(&bs.wm.consensusInfoUnsupported, 0, 1) {
+				bs.wm.Log.Warningf("node does not support getBlockWithConsensusInfoByNumber, BFT finality is checked by parent hash only")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !strings.EqualFold(info.BlockHash, block.BlockHash) {
+		return fmt.Errorf("block: %d hash: %s differs from consensus info hash: %s", block.BlockHeight, block.BlockHash, info.BlockHash)
+	}
+	if !info.Finalized() {
+		return fmt.Errorf("block: %d is not finalized, committers: %d, quorum: %d", block.BlockHeight, len(info.Committers), info.QuorumSize())
+	}
+	return nil
+}
+
+//integrityAlarm BFT共识下区块不会分叉，父区块hash不一致说明节点数据异常，停止扫描等待人工处理
+func (bs *BlockScanner) integrityAlarm(block *EthBlock, localHash string) {
+	bs.wm.Log.Errorf("node integrity alarm: block: %d parent hash: %s, local block: %d hash: %s, "+
+		"BFT blocks are final and never roll back, block scanner is stopped, please check the node",
+		block.BlockHeight, block.PreviousHash, block.BlockHeight-1, localHash)
+	bs.Pause()
+}
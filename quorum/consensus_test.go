@@ -0,0 +1,110 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/tidwall/gjson"
+)
+
+func TestBlockConsensusInfo_Finalized(t *testing.T) {
+	committee := quorum_rpc.FakeCommittee
+	tests := []struct {
+		committers []string
+		finalized  bool
+	}{
+		{nil, true},
+		{committee, true},
+		{committee[:3], true},
+		{committee[:2], false},
+		{[]string{committee[0], committee[0], committee[1]}, false},
+		{[]string{committee[0], committee[1], "0x2000000000000000000000000000000000000000"}, false},
+	}
+	for i, test := range tests {
+		info := &BlockConsensusInfo{Committee: committee, Committers: test.committers}
+		if info.Finalized() != test.finalized {
+			t.Errorf("case %d finalized = %v, want %v", i, info.Finalized(), test.finalized)
+		}
+	}
+	if (&BlockConsensusInfo{}).Finalized() {
+		t.Errorf("block without committee should not be finalized")
+	}
+}
+
+func TestBlockScanner_BFTOffline(t *testing.T) {
+	var (
+		from = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	blocks := []*quorum_rpc.FakeBlock{node.AddBlock()}
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, node.AddBlock(&quorum_rpc.FakeTx{From: from, To: to, Gas: 21000, GasUsed: 21000}))
+	}
+
+	//第3个区块只有一半委员会签名，扫描停在第2个区块
+	node.Handle("klay_getBlockWithConsensusInfoByNumber", func(params gjson.Result) (interface{}, error) {
+		height, _ := hexutil.DecodeUint64(params.Get("0").String())
+		block := blocks[height-1]
+		committers := quorum_rpc.FakeCommittee
+		if height == 3 {
+			committers = committers[:2]
+		}
+		return map[string]interface{}{
+			"hash":       block.Hash,
+			"committee":  quorum_rpc.FakeCommittee,
+			"committers": committers,
+		}, nil
+	})
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.ScanBlockTask()
+	if headers := observer.waitHeaders(1); len(headers) != 1 || headers[0].Height != 2 {
+		t.Fatalf("scanner should stop before the unfinalized block, notified: %d", len(headers))
+	}
+	if height, _, _ := bs.GetLocalBlockHead(); height != 2 || !bs.Scanning {
+		t.Errorf("scanner should wait at height 2, got %d", height)
+	}
+
+	//父区块hash不一致时停止扫描，不回滚
+	bs, observer, _ = testNewFakeBlockScanner(node, 1, to)
+	staleHash := "0x" + strings.Repeat("ab", 32)
+	bs.SaveLocalBlockHead(1, staleHash)
+	bs.ScanBlockTask()
+	if bs.Scanning || len(observer.waitHeaders(0)) != 0 {
+		t.Errorf("scanner should stop on parent hash mismatch")
+	}
+	if height, hash, _ := bs.GetLocalBlockHead(); height != 1 || hash != staleHash {
+		t.Errorf("local block head should not be rolled back, got %d %s", height, hash)
+	}
+
+	//节点不支持共识信息时只检查父区块hash，继续扫描
+	node.Handle("klay_getBlockWithConsensusInfoByNumber", func(params gjson.Result) (interface{}, error) {
+		return nil, &quorum_rpc.RPCError{Code: quorum_rpc.CodeMethodNotFound, Message: "the method klay_getBlockWithConsensusInfoByNumber does not exist/is not available"}
+	})
+	requests := node.RequestCount("klay_getBlockWithConsensusInfoByNumber")
+	bs, observer, _ = testNewFakeBlockScanner(node, 1, to)
+	bs.ScanBlockTask()
+	if height, _, _ := bs.GetLocalBlockHead(); height != 4 || len(observer.waitHeaders(3)) != 3 {
+		t.Errorf("scanner should fall back to parent hash check, got height %d", height)
+	}
+	if n := node.RequestCount("klay_getBlockWithConsensusInfoByNumber") - requests; n != 1 {
+		t.Errorf("unsupported consensus info should not be requested for every block, requests: %d", n)
+	}
+}
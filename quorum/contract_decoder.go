@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
 	"github.com/blocktree/go-owcrypt"
 	"github.com/blocktree/openwallet/v2/common"
 	"github.com/blocktree/openwallet/v2/log"
@@ -15,6 +16,7 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
 	"math/big"
 	"strconv"
 	"strings"
@@ -55,78 +57,35 @@ type AddrBalanceInf interface {
 }
 
 func (decoder *EthContractDecoder) GetTokenBalanceByAddress(contract openwallet.SmartContract, address ...string) ([]*openwallet.TokenBalance, error) {
-	threadControl := make(chan int, 20)
-	defer close(threadControl)
-	resultChan := make(chan *openwallet.TokenBalance, 1024)
-	defer close(resultChan)
-	done := make(chan int, 1)
-	var tokenBalanceList []*openwallet.TokenBalance
-	count := len(address)
-
-	go func() {
-		//		log.Debugf("in save thread.")
-		for i := 0; i < count; i++ {
-			balance := <-resultChan
-			if balance != nil {
-				tokenBalanceList = append(tokenBalanceList, balance)
-			}
-			//log.Debugf("got one balance.")
-		}
-		done <- 1
-	}()
 
-	queryBalance := func(address string) {
-		threadControl <- 1
-		var balance *openwallet.TokenBalance
-		defer func() {
-			resultChan <- balance
-			<-threadControl
-		}()
+	balances, err := decoder.wm.ERC20GetAddressBalanceBatch(contract.Address, address...)
+	if err != nil {
+		log.Errorf("get token balance of addresses failed, err: %v", err)
+		return nil, err
+	}
 
-		//		log.Debugf("in query thread.")
-		balanceConfirmed, err := decoder.wm.ERC20GetAddressBalance(address, contract.Address)
-		if err != nil {
-			return
-		}
+	tokenDecimals := decoder.wm.tokenDecimals(contract)
+	tokenBalanceList := make([]*openwallet.TokenBalance, 0, len(address))
+	for i, balanceConfirmed := range balances {
 		balanceUnconfirmed := big.NewInt(0)
 		balanceAll := balanceConfirmed
-		bstr := common.BigIntToDecimals(balanceAll, int32(contract.Decimals))
-		if err != nil {
-			return
-		}
-
-		cbstr := common.BigIntToDecimals(balanceConfirmed, int32(contract.Decimals))
-		if err != nil {
-			return
-		}
+		bstr := common.BigIntToDecimals(balanceAll, tokenDecimals)
+		cbstr := common.BigIntToDecimals(balanceConfirmed, tokenDecimals)
+		ucbstr := common.BigIntToDecimals(balanceUnconfirmed, tokenDecimals)
 
-		ucbstr := common.BigIntToDecimals(balanceUnconfirmed, int32(contract.Decimals))
-		if err != nil {
-			return
-		}
-
-		balance = &openwallet.TokenBalance{
+		balance := &openwallet.TokenBalance{
 			Contract: &contract,
 			Balance: &openwallet.Balance{
-				Address:          address,
+				Address:          address[i],
 				Symbol:           contract.Symbol,
 				Balance:          bstr.String(),
 				ConfirmBalance:   cbstr.String(),
 				UnconfirmBalance: ucbstr.String(),
 			},
 		}
+		tokenBalanceList = append(tokenBalanceList, balance)
 	}
 
-	for i := range address {
-		go queryBalance(address[i])
-	}
-
-	<-done
-
-	if len(tokenBalanceList) != count {
-		log.Error("unknown errors occurred .")
-		return nil, errors.New("unknown errors occurred ")
-	}
 	return tokenBalanceList, nil
 }
 
@@ -242,11 +201,10 @@ func (decoder *EthContractDecoder) CallSmartContractABI(wrapper openwallet.Walle
 }
 
 //创建原始交易单
-func (decoder *EthContractDecoder) CreateSmartContractRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.SmartContractRawTransaction) *openwallet.Error {
+func (decoder *EthContractDecoder) CreateSmartContractRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.SmartContractRawTransaction) (buildErr *openwallet.Error) {
 
 	var (
-		keySignList = make([]*openwallet.KeySignature, 0)
-		fee *txFeeInfo
+		fee    *txFeeInfo
 		feeErr error
 	)
 
@@ -285,13 +243,29 @@ func (decoder *EthContractDecoder) CreateSmartContractRawTransaction(wrapper ope
 		}
 	}
 
+	//JSON格式的调用参数可通过txType指定交易类型
+	var extParam gjson.Result
+	if rawTx.RawType == openwallet.TxRawTypeJSON {
+		extParam = gjson.Parse(rawTx.Raw)
+	}
+	txType, err := decoder.wm.txTypeFromExtParam(extParam)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawSmartContractTransactionFailed, err.Error())
+	}
+
+	//JSON格式的调用参数可通过feePayer指定手续费代付地址，调用地址只需支付自己承担的手续费
+	fd, err := feeDelegationFromExtParam(wrapper, extParam)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawSmartContractTransactionFailed, err.Error())
+	}
+
 	//检查调用地址是否有足够手续费
 	coinBalance, err := decoder.wm.GetAddrBalance(strings.ToLower(callMsg.From.String()), "latest")
 	if err != nil {
 		return openwallet.Errorf(openwallet.ErrCreateRawSmartContractTransactionFailed, err.Error())
 	}
 
-	if coinBalance.Cmp(fee.Fee) < 0 {
+	if coinBalance.Cmp(fd.senderFee(fee.Fee)) < 0 {
 		coinBalance := common.BigIntToDecimals(coinBalance, decoder.wm.Decimal())
 		return openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance.String())
 	}
@@ -304,38 +278,72 @@ func (decoder *EthContractDecoder) CreateSmartContractRawTransaction(wrapper ope
 		return openwallet.NewError(openwallet.ErrAccountNotAddress, err.Error())
 	}
 
-	nonce := decoder.wm.GetAddressNonce(wrapper, strings.ToLower(callMsg.From.String()))
-	signer := types.NewEIP155Signer(big.NewInt(int64(decoder.wm.Config.ChainID)))
+	//分配nonce，构建失败时释放
+	from := strings.ToLower(callMsg.From.String())
+	nonce, err := decoder.wm.NonceManager.Reserve(from)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrNonceInvaild, "get address nonce failed, err: %v", err)
+	}
+	defer func() {
+		if buildErr != nil {
+			decoder.wm.NonceManager.Release(from, nonce)
+		}
+	}()
 	gasLimit := fee.GasLimit.Uint64()
 
+	//合约调用不能使用主币转账类型
+	if base := txType.Base(); base == TxTypeValueTransfer || base == TxTypeValueTransferMemo {
+		txType = TxTypeSmartContractExecution | txType&feeDelegationMask
+	}
+
 	//构建合约交易
-	tx := types.NewTransaction(nonce, callMsg.To,
-		amount, gasLimit, fee.GasPrice, data)
+	to := callMsg.To
+	utx := &unsignedTx{
+		Type:     txType,
+		Nonce:    nonce,
+		From:     callMsg.From,
+		To:       &to,
+		Value:    amount,
+		Gas:      gasLimit,
+		GasPrice: fee.GasPrice,
+		Data:     data,
+		ExtParam: extParam,
+	}
+	if txType.Base() == TxTypeSmartContractDeploy {
+		utx.To = nil
+	}
+
+	//转为手续费代付交易，代付方余额需要足够支付其承担的手续费
+	fd.apply(decoder.wm, utx)
+	if payerErr := fd.checkPayerBalance(decoder.wm, fee.Fee); payerErr != nil {
+		return payerErr
+	}
+
+	//动态手续费交易，gasPrice作为maxFeePerGas
+	if utx.Type == TxTypeEthereumDynamicFee {
+		gasTip, tipErr := decoder.wm.dynamicFeeTip(fee)
+		if tipErr != nil {
+			return openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, tipErr.Error())
+		}
+		utx.GasTip = gasTip
+	}
 
-	rawHex, err := rlp.EncodeToBytes(tx)
+	rawHex, _, err := decoder.wm.buildUnsignedTx(utx)
 	if err != nil {
 		decoder.wm.Log.Error("Transaction RLP encode failed, err:", err)
 		return openwallet.Errorf(openwallet.ErrCreateRawSmartContractTransactionFailed, err.Error())
 	}
 
-	msg := signer.Hash(tx)
-
-	if rawTx.Signatures == nil {
-		rawTx.Signatures = make(map[string][]*openwallet.KeySignature)
-	}
-
-	signature := openwallet.KeySignature{
-		EccType: decoder.wm.Config.CurveType,
-		Nonce:   "0x" + strconv.FormatUint(nonce, 16),
-		Address: addr,
-		Message: hex.EncodeToString(msg[:]),
-		RSV:     true,
+	//按链上账户密钥生成待签名信息，多签账户每个公钥一条
+	keySignatures, err := decoder.wm.txKeySignatures(wrapper, addr, fd, utx.Type, rawHex, nonce)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawSmartContractTransactionFailed, err.Error())
 	}
-	keySignList = append(keySignList, &signature)
 
 	rawTx.Raw = hex.EncodeToString(rawHex)
 	rawTx.RawType = openwallet.TxRawTypeHex
-	rawTx.Signatures[rawTx.Account.AccountID] = keySignList
+	rawTx.Signatures = make(map[string][]*openwallet.KeySignature)
+	mergeKeySignatures(rawTx.Signatures, keySignatures)
 	rawTx.FeeRate = gasprice.String()
 	rawTx.Fees = totalFeeDecimal.String()
 	rawTx.TxFrom = strings.ToLower(callMsg.From.String())
@@ -351,21 +359,23 @@ func (decoder *EthContractDecoder) SubmitSmartContractRawTransaction(wrapper ope
 	err := decoder.VerifyRawTransaction(wrapper, rawTx)
 
 	from := rawTx.TxFrom
-	sig := rawTx.Signatures[rawTx.Account.AccountID][0].Signature
 
-	signer := types.NewEIP155Signer(big.NewInt(int64(decoder.wm.Config.ChainID)))
-	tx := &types.Transaction{}
-	var decodeErr error
+	var (
+		rawBytes  []byte
+		decodeErr error
+	)
 	//解析原始交易单
 	switch rawTx.RawType {
 	case openwallet.TxRawTypeHex:
-		rawBytes := hexutil.MustDecode(AppendOxToAddress(rawTx.Raw))
-		decodeErr = rlp.DecodeBytes(rawBytes, tx)
+		rawBytes, decodeErr = hexutil.Decode(AppendOxToAddress(rawTx.Raw))
 	case openwallet.TxRawTypeJSON:
+		tx := &types.Transaction{}
 		decodeErr = tx.UnmarshalJSON([]byte(rawTx.Raw))
+		if decodeErr == nil {
+			rawBytes, decodeErr = rlp.EncodeToBytes(tx)
+		}
 	case openwallet.TxRawTypeBase64:
-		rawBytes, _ := base64.StdEncoding.DecodeString(rawTx.Raw)
-		decodeErr = rlp.DecodeBytes(rawBytes, tx)
+		rawBytes, decodeErr = base64.StdEncoding.DecodeString(rawTx.Raw)
 	}
 
 	if decodeErr != nil {
@@ -373,28 +383,25 @@ func (decoder *EthContractDecoder) SubmitSmartContractRawTransaction(wrapper ope
 		return nil, openwallet.Errorf(openwallet.ErrSubmitRawSmartContractTransactionFailed, decodeErr.Error())
 	}
 
-	tx, err = tx.WithSignature(signer, ethcom.FromHex(sig))
+	//以太坊兼容交易和Klaytn类型交易都在这里加入发送者、多签公钥和代付方的签名
+	rawTxPara, _, txNonce, err := decoder.wm.signRawTxWithKeySignatures(rawBytes, rawTx.Signatures)
 	if err != nil {
 		decoder.wm.Log.Std.Error("tx with signature failed, err=%v ", err)
 		return nil, openwallet.Errorf(openwallet.ErrSubmitRawSmartContractTransactionFailed, "tx with signature failed. ")
 	}
 
-	rawTxPara, err := rlp.EncodeToBytes(tx)
-	if err != nil {
-		decoder.wm.Log.Std.Error("encode tx to rlp failed, err=%v ", err)
-		return nil, openwallet.Errorf(openwallet.ErrSubmitRawSmartContractTransactionFailed, "encode tx to rlp failed. ")
-	}
-
 	txid, err := decoder.wm.SendRawTransaction(hexutil.Encode(rawTxPara))
 	if err != nil {
 		decoder.wm.Log.Std.Error("sent raw tx faild, err=%v", err)
-		//交易失败重置地址nonce
-		decoder.wm.UpdateAddressNonce(wrapper, from, 0)
-		return nil, openwallet.Errorf(openwallet.ErrSubmitRawSmartContractTransactionFailed, "sent raw tx faild. unexpected error: %v", err)
+		//nonce错误时重置本地分配，节点拒绝时释放nonce，网络错误时保留分配
+		decoder.wm.NonceManager.MarkFailed(from, txNonce, err)
+		return nil, openwallet.Errorf(quorum_rpc.OpenwalletErrorCode(err, openwallet.ErrSubmitRawSmartContractTransactionFailed), "sent raw tx faild. unexpected error: %v", err)
 	}
 
-	//交易成功，地址nonce+1并记录到缓存
-	decoder.wm.UpdateAddressNonce(wrapper, from, tx.Nonce()+1)
+	decoder.wm.NonceManager.MarkBroadcast(from, txNonce, txid)
+	if decoder.wm.Config.TrackBroadcasts {
+		decoder.wm.BroadcastTracker.Track(txid, from, txNonce, rawTxPara, "")
+	}
 
 	rawTx.TxID = txid
 	rawTx.IsSubmit = true
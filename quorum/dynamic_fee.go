@@ -0,0 +1,386 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	//DefaultBaseFeeMultiplier 估算maxFeePerGas时baseFee的默认百分比倍数，可承受基础手续费翻倍
+	DefaultBaseFeeMultiplier = 200
+	//DefaultFeeHistoryBlocks 节点不支持maxPriorityFeePerGas时，通过feeHistory统计小费的区块数
+	DefaultFeeHistoryBlocks = 20
+
+	ethTxTypeDynamicFee       = 0x02   //以太坊EIP-2718交易类型
+	ethereumDynamicFeeTypeInt = 0x7802 //节点返回的Klaytn以太坊动态手续费交易类型编码
+)
+
+//DynamicFeeTx 以太坊EIP-1559动态手续费交易，Klaytn原始交易为 0x78 || 0x02 || rlp(fields)
+type DynamicFeeTx struct {
+	ChainID   *big.Int
+	Nonce     uint64
+	GasTipCap *big.Int //maxPriorityFeePerGas
+	GasFeeCap *big.Int //maxFeePerGas
+	Gas       uint64
+	To        *ethcom.Address //部署合约时为nil
+	Value     *big.Int
+	Data      []byte
+	V         *big.Int //yParity，0或1
+	R         *big.Int
+	S         *big.Int
+}
+
+//IsDynamicFeeTx 原始交易是否Klaytn封装的以太坊动态手续费交易
+func IsDynamicFeeTx(raw []byte) bool {
+	return len(raw) > 1 && raw[0] == byte(TxTypeEthereumDynamicFee) && raw[1] == ethTxTypeDynamicFee
+}
+
+//bigOrZero nil按0编码
+func bigOrZero(v *big.Int) *big.Int {
+	if v == nil {
+		return new(big.Int)
+	}
+	return v
+}
+
+//fields 参与签名的字段，不支持accessList，固定为空列表
+func (tx *DynamicFeeTx) fields() []interface{} {
+	var to []byte
+	if tx.To != nil {
+		to = tx.To.Bytes()
+	}
+	return []interface{}{
+		bigOrZero(tx.ChainID),
+		tx.Nonce,
+		bigOrZero(tx.GasTipCap),
+		bigOrZero(tx.GasFeeCap),
+		tx.Gas,
+		to,
+		bigOrZero(tx.Value),
+		tx.Data,
+		[]interface{}{},
+	}
+}
+
+//envelope 0x02 || rlp(fields)，withSignature为true时包含签名
+func (tx *DynamicFeeTx) envelope(withSignature bool) ([]byte, error) {
+	fields := tx.fields()
+	if withSignature {
+		fields = append(fields, bigOrZero(tx.V), bigOrZero(tx.R), bigOrZero(tx.S))
+	}
+	payload, err := rlp.EncodeToBytes(fields)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{ethTxTypeDynamicFee}, payload...), nil
+}
+
+//SigHash 发送者待签名的消息哈希 keccak256(0x02 || rlp(fields))
+func (tx *DynamicFeeTx) SigHash() ethcom.Hash {
+	payload, _ := tx.envelope(false)
+	return crypto.Keccak256Hash(payload)
+}
+
+//WithSignature 加入65字节的签名[R || S || V]
+func (tx *DynamicFeeTx) WithSignature(sig []byte) error {
+	if len(sig) != 65 {
+		return fmt.Errorf("wrong size for signature: got %d, want 65", len(sig))
+	}
+	if sig[64] > 1 {
+		return fmt.Errorf("invalid signature recovery id: %d", sig[64])
+	}
+	tx.R = new(big.Int).SetBytes(sig[:32])
+	tx.S = new(big.Int).SetBytes(sig[32:64])
+	tx.V = new(big.Int).SetUint64(uint64(sig[64]))
+	return nil
+}
+
+//MarshalBinary Klaytn原始交易编码，未签名时签名字段为0
+func (tx *DynamicFeeTx) MarshalBinary() ([]byte, error) {
+	payload, err := tx.envelope(true)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(TxTypeEthereumDynamicFee)}, payload...), nil
+}
+
+//Hash 交易哈希，与以太坊一致，不包含Klaytn的0x78前缀
+func (tx *DynamicFeeTx) Hash() (ethcom.Hash, error) {
+	payload, err := tx.envelope(true)
+	if err != nil {
+		return ethcom.Hash{}, err
+	}
+	return crypto.Keccak256Hash(payload), nil
+}
+
+//DecodeDynamicFeeTx 解码Klaytn封装的以太坊动态手续费交易
+func DecodeDynamicFeeTx(raw []byte) (*DynamicFeeTx, error) {
+	if !IsDynamicFeeTx(raw) {
+		return nil, fmt.Errorf("not an ethereum dynamic fee transaction")
+	}
+	var items []rlp.RawValue
+	if err := rlp.DecodeBytes(raw[2:], &items); err != nil {
+		return nil, fmt.Errorf("decode dynamic fee tx failed, err: %v", err)
+	}
+	if len(items) != 12 {
+		return nil, fmt.Errorf("decode dynamic fee tx failed, expected 12 fields, got %d", len(items))
+	}
+	var (
+		tx         = &DynamicFeeTx{}
+		to         []byte
+		accessList []rlp.RawValue
+	)
+	targets := []interface{}{&tx.ChainID, &tx.Nonce, &tx.GasTipCap, &tx.GasFeeCap, &tx.Gas, &to, &tx.Value, &tx.Data, &accessList, &tx.V, &tx.R, &tx.S}
+	for i, target := range targets {
+		if err := rlp.DecodeBytes(items[i], target); err != nil {
+			return nil, fmt.Errorf("decode dynamic fee tx field %d failed, err: %v", i, err)
+		}
+	}
+	if len(accessList) > 0 {
+		return nil, fmt.Errorf("dynamic fee tx with access list is not supported")
+	}
+	if len(to) > 0 {
+		addr := ethcom.BytesToAddress(to)
+		tx.To = &addr
+	}
+	return tx, nil
+}
+
+//buildDynamicFeeTx 构建未签名的动态手续费交易和待签名的消息哈希
+func (wm *WalletManager) buildDynamicFeeTx(utx *unsignedTx) ([]byte, []byte, error) {
+	if utx.FeePayer != nil {
+		return nil, nil, fmt.Errorf("%v does not support fee delegation", utx.Type)
+	}
+	if utx.GasTip == nil {
+		return nil, nil, fmt.Errorf("maxPriorityFeePerGas is required for %v", utx.Type)
+	}
+	if utx.GasTip.Cmp(utx.GasPrice) > 0 {
+		return nil, nil, fmt.Errorf("maxPriorityFeePerGas: %s is higher than maxFeePerGas: %s", utx.GasTip.String(), utx.GasPrice.String())
+	}
+	tx := &DynamicFeeTx{
+		ChainID:   new(big.Int).SetUint64(wm.Config.ChainID),
+		Nonce:     utx.Nonce,
+		GasTipCap: utx.GasTip,
+		GasFeeCap: utx.GasPrice,
+		Gas:       utx.Gas,
+		To:        utx.To,
+		Value:     utx.Value,
+		Data:      utx.Data,
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := tx.SigHash()
+	return raw, msg[:], nil
+}
+
+//FeeHistory klay_feeHistory的结果
+type FeeHistory struct {
+	OldestBlock   uint64
+	BaseFeePerGas []*big.Int //包含下一个区块的基础手续费，比区块数多一个
+	GasUsedRatio  []float64
+	Reward        [][]*big.Int //每个区块按percentiles统计的小费
+}
+
+//dynamicFeeEnabled 默认交易类型是否动态手续费交易
+func (wm *WalletManager) dynamicFeeEnabled() bool {
+	return wm.Config.TxType == TxTypeEthereumDynamicFee
+}
+
+//GetBaseFee 最新区块的基础手续费单价，Magma硬分叉前返回nil
+func (wm *WalletManager) GetBaseFee() (*big.Int, error) {
+	return wm.GetBaseFeeContext(context.Background())
+}
+
+//GetBaseFeeContext 支持ctx超时和取消的GetBaseFee
+func (wm *WalletManager) GetBaseFeeContext(ctx context.Context) (*big.Int, error) {
+	block, err := wm.getBlockContext(ctx, "_getBlockByNumber", "latest", false)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.BaseFeePerGas) == 0 {
+		return nil, nil
+	}
+	baseFee, err := hexutil.DecodeBig(block.BaseFeePerGas)
+	if err != nil {
+		return nil, fmt.Errorf("convert base fee[%v] format to bigint failed, err = %v", block.BaseFeePerGas, err)
+	}
+	return baseFee, nil
+}
+
+//GetMaxPriorityFeePerGas 节点建议的小费单价
+func (wm *WalletManager) GetMaxPriorityFeePerGas() (*big.Int, error) {
+	return wm.GetMaxPriorityFeePerGasContext(context.Background())
+}
+
+//GetMaxPriorityFeePerGasContext 支持ctx超时和取消的GetMaxPriorityFeePerGas
+func (wm *WalletManager) GetMaxPriorityFeePerGasContext(ctx context.Context) (*big.Int, error) {
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_maxPriorityFeePerGas", []interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	tip, err := hexutil.DecodeBig(result.String())
+	if err != nil {
+		return nil, fmt.Errorf("convert max priority fee[%v] format to bigint failed, err = %v", result.String(), err)
+	}
+	return tip, nil
+}
+
+//GetFeeHistory 查询最近blockCount个区块的基础手续费和按percentiles统计的小费
+func (wm *WalletManager) GetFeeHistory(blockCount uint64, percentiles []float64) (*FeeHistory, error) {
+	return wm.GetFeeHistoryContext(context.Background(), blockCount, percentiles)
+}
+
+//GetFeeHistoryContext 支持ctx超时和取消的GetFeeHistory
+func (wm *WalletManager) GetFeeHistoryContext(ctx context.Context, blockCount uint64, percentiles []float64) (*FeeHistory, error) {
+	params := []interface{}{
+		hexutil.EncodeUint64(blockCount),
+		"latest",
+		percentiles,
+	}
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_feeHistory", params)
+	if err != nil {
+		return nil, err
+	}
+	history := &FeeHistory{}
+	history.OldestBlock, err = hexutil.DecodeUint64(result.Get("oldestBlock").String())
+	if err != nil {
+		return nil, fmt.Errorf("decode fee history oldest block failed, err: %v", err)
+	}
+	for _, v := range result.Get("baseFeePerGas").Array() {
+		baseFee, err := hexutil.DecodeBig(v.String())
+		if err != nil {
+			return nil, fmt.Errorf("decode fee history base fee failed, err: %v", err)
+		}
+		history.BaseFeePerGas = append(history.BaseFeePerGas, baseFee)
+	}
+	for _, v := range result.Get("gasUsedRatio").Array() {
+		history.GasUsedRatio = append(history.GasUsedRatio, v.Float())
+	}
+	for _, block := range result.Get("reward").Array() {
+		var rewards []*big.Int
+		for _, v := range block.Array() {
+			reward, err := hexutil.DecodeBig(v.String())
+			if err != nil {
+				return nil, fmt.Errorf("decode fee history reward failed, err: %v", err)
+			}
+			rewards = append(rewards, reward)
+		}
+		history.Reward = append(history.Reward, rewards)
+	}
+	return history, nil
+}
+
+//feeHistoryTip 以最近区块小费中位数的中位数作为建议小费
+func (wm *WalletManager) feeHistoryTip(ctx context.Context) (*big.Int, error) {
+	history, err := wm.GetFeeHistoryContext(ctx, DefaultFeeHistoryBlocks, []float64{50})
+	if err != nil {
+		return nil, err
+	}
+	rewards := make([]*big.Int, 0, len(history.Reward))
+	for _, block := range history.Reward {
+		if len(block) > 0 {
+			rewards = append(rewards, block[0])
+		}
+	}
+	if len(rewards) == 0 {
+		return big.NewInt(0), nil
+	}
+	sort.Slice(rewards, func(i, j int) bool {
+		return rewards[i].Cmp(rewards[j]) < 0
+	})
+	return new(big.Int).Set(rewards[len(rewards)/2]), nil
+}
+
+//capDynamicFee 按配置的上限限制maxFeePerGas和maxPriorityFeePerGas，小费不超过maxFeePerGas
+func (wm *WalletManager) capDynamicFee(tip, maxFee *big.Int) (*big.Int, *big.Int) {
+	tip, maxFee = new(big.Int).Set(tip), new(big.Int).Set(maxFee)
+	if feeCap := wm.Config.MaxFeePerGas; feeCap != nil && feeCap.Sign() > 0 && maxFee.Cmp(feeCap) > 0 {
+		maxFee.Set(feeCap)
+	}
+	if tipCap := wm.Config.MaxPriorityFeePerGas; tipCap != nil && tipCap.Sign() > 0 && tip.Cmp(tipCap) > 0 {
+		tip.Set(tipCap)
+	}
+	if tip.Cmp(maxFee) > 0 {
+		tip.Set(maxFee)
+	}
+	return tip, maxFee
+}
+
+//GetDynamicFeeEstimated 估算动态手续费交易的maxPriorityFeePerGas和maxFeePerGas
+func (wm *WalletManager) GetDynamicFeeEstimated() (*big.Int, *big.Int, error) {
+	return wm.GetDynamicFeeEstimatedContext(context.Background())
+}
+
+//GetDynamicFeeEstimatedContext 支持ctx超时和取消的GetDynamicFeeEstimated
+func (wm *WalletManager) GetDynamicFeeEstimatedContext(ctx context.Context) (*big.Int, *big.Int, error) {
+	baseFee, err := wm.GetBaseFeeContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if baseFee == nil {
+		return nil, nil, fmt.Errorf("baseFeePerGas is not found in the latest block, dynamic fee is not enabled")
+	}
+	tip, err := wm.GetMaxPriorityFeePerGasContext(ctx)
+	if err != nil {
+		if !quorum_rpc.IsMethodNotFoundError(err) {
+			return nil, nil, err
+		}
+		//节点不支持时通过feeHistory估算
+		tip, err = wm.feeHistoryTip(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	//先限制小费再计算maxFeePerGas
+	tip, _ = wm.capDynamicFee(tip, tip)
+	maxFee := new(big.Int).Mul(baseFee, new(big.Int).SetUint64(wm.Config.BaseFeeMultiplier))
+	maxFee.Div(maxFee, big.NewInt(100))
+	maxFee.Add(maxFee, tip)
+	tip, maxFee = wm.capDynamicFee(tip, maxFee)
+	if maxFee.Cmp(baseFee) < 0 {
+		return nil, nil, fmt.Errorf("maxFeePerGas: %s is lower than base fee: %s", maxFee.String(), baseFee.String())
+	}
+	return tip, maxFee, nil
+}
+
+//dynamicFeeTip 动态手续费交易的小费，手续费不是按动态手续费估算时(如通过txType或feeRate指定)，以gasPrice作为maxFeePerGas重新估算小费
+func (wm *WalletManager) dynamicFeeTip(fee *txFeeInfo) (*big.Int, error) {
+	tip := fee.GasTip
+	if tip == nil {
+		estimated, _, err := wm.GetDynamicFeeEstimated()
+		if err != nil {
+			return nil, err
+		}
+		tip = estimated
+	}
+	if tip.Cmp(fee.GasPrice) > 0 {
+		return new(big.Int).Set(fee.GasPrice), nil
+	}
+	return tip, nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestWalletManager_GetDynamicFeeEstimatedOffline(t *testing.T) {
+	gwei := func(v int64) *big.Int { return new(big.Int).Mul(big.NewInt(v), big.NewInt(1e9)) }
+
+	node := quorum_rpc.NewFakeNode(1001)
+	wm := testNewFakeWalletManager(node)
+
+	//Magma之前区块没有baseFeePerGas
+	if baseFee, err := wm.GetBaseFee(); err != nil || baseFee != nil {
+		t.Fatalf("base fee before magma should be nil, got %v, err: %v", baseFee, err)
+	}
+	if _, _, err := wm.GetDynamicFeeEstimated(); err == nil {
+		t.Errorf("dynamic fee should fail before magma")
+	}
+
+	//节点不支持maxPriorityFeePerGas时通过feeHistory估算小费
+	node.BaseFee = gwei(25)
+	node.AddBlock(&quorum_rpc.FakeTx{From: "0x3440f720862aa7dfd4f86ecc78542b3ded900c02", Gas: 21000, GasPrice: gwei(27)})
+	node.AddBlock(&quorum_rpc.FakeTx{From: "0x3440f720862aa7dfd4f86ecc78542b3ded900c02", Nonce: 1, Gas: 21000, GasPrice: gwei(27)})
+	tip, maxFee, err := wm.GetDynamicFeeEstimated()
+	if err != nil {
+		t.Fatalf("estimate dynamic fee failed: %v", err)
+	}
+	if tip.Cmp(gwei(2)) != 0 || maxFee.Cmp(gwei(52)) != 0 {
+		t.Errorf("tip = %v, maxFee = %v, want 2 gwei and 52 gwei", tip, maxFee)
+	}
+
+	//按配置的上限限制
+	node.GasTip = gwei(30)
+	wm.Config.MaxFeePerGas = gwei(40)
+	wm.Config.MaxPriorityFeePerGas = gwei(5)
+	tip, maxFee, _ = wm.GetDynamicFeeEstimated()
+	if tip.Cmp(gwei(5)) != 0 || maxFee.Cmp(gwei(40)) != 0 {
+		t.Errorf("tip = %v, maxFee = %v, want capped to 5 gwei and 40 gwei", tip, maxFee)
+	}
+	wm.Config.MaxFeePerGas = gwei(20)
+	if _, _, err := wm.GetDynamicFeeEstimated(); err == nil {
+		t.Errorf("maxFeePerGas cap below base fee should fail")
+	}
+
+	wm.Config.MaxFeePerGas = big.NewInt(0)
+	wm.Config.TxType = TxTypeEthereumDynamicFee
+	feeRate, unit, err := NewTransactionDecoder(wm).GetRawTransactionFeeRate()
+	if err != nil || unit != "MaxFeePerGas" || feeRate != "0.000000055" {
+		t.Errorf("fee rate = %s %s, err: %v", feeRate, unit, err)
+	}
+}
+
+func TestTransactionDecoder_DynamicFeeTxOffline(t *testing.T) {
+	gwei := func(v int64) *big.Int { return new(big.Int).Mul(big.NewInt(v), big.NewInt(1e9)) }
+
+	key, _ := crypto.GenerateKey()
+	var (
+		from = strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+		to   = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.BaseFee = gwei(25)
+	node.GasTip = gwei(1)
+	node.SetBalance(from, big.NewInt(1e18))
+
+	wm := testNewFakeWalletManager(node)
+	wm.Config.FixGasLimit = big.NewInt(0)
+	wm.Config.FixGasPrice = big.NewInt(0)
+	wm.Config.OffsetsGasPrice = big.NewInt(0)
+	wm.Config.TxType = TxTypeEthereumDynamicFee
+	decoder := NewTransactionDecoder(wm)
+	wrapper := &testTokenWrapper{addresses: []*openwallet.Address{{AccountID: "acc", Address: from}}}
+
+	rawTx := &openwallet.RawTransaction{
+		Coin:    openwallet.Coin{Symbol: "KLAY"},
+		Account: &openwallet.AssetsAccount{AccountID: "acc"},
+		To:      map[string]string{to: "0.5"},
+	}
+	if err := decoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("create dynamic fee transaction failed: %v", err)
+	}
+	tx, err := DecodeDynamicFeeTx(ethcom.FromHex(rawTx.RawHex))
+	if err != nil {
+		t.Fatalf("decode dynamic fee transaction failed: %v", err)
+	}
+	if tx.ChainID.Uint64() != 1001 || tx.GasTipCap.Cmp(gwei(1)) != 0 || tx.GasFeeCap.Cmp(gwei(51)) != 0 ||
+		!strings.EqualFold(tx.To.Hex(), to) || tx.Value.Cmp(big.NewInt(5e17)) != 0 {
+		t.Errorf("unexpected dynamic fee transaction: %+v", tx)
+	}
+
+	for _, keySignatures := range rawTx.Signatures {
+		for _, keySignature := range keySignatures {
+			sig, _ := crypto.Sign(ethcom.FromHex(keySignature.Message), key)
+			keySignature.Signature = hex.EncodeToString(sig)
+		}
+	}
+	if _, err := decoder.SubmitRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("submit dynamic fee transaction failed: %v", err)
+	}
+	sent := node.SentTransactions()
+	signed, err := DecodeDynamicFeeTx(ethcom.FromHex(sent[len(sent)-1]))
+	if err != nil {
+		t.Fatalf("decode signed transaction failed: %v", err)
+	}
+	sig := append(append(ethcom.LeftPadBytes(signed.R.Bytes(), 32), ethcom.LeftPadBytes(signed.S.Bytes(), 32)...), byte(signed.V.Uint64()))
+	hash := signed.SigHash()
+	pub, err := crypto.SigToPub(hash[:], sig)
+	if err != nil || !strings.EqualFold(crypto.PubkeyToAddress(*pub).Hex(), from) {
+		t.Errorf("signature should recover the sender, err: %v", err)
+	}
+	if txid, _ := signed.Hash(); txid.Hex() != rawTx.TxID {
+		t.Errorf("txid = %s, want %s", rawTx.TxID, txid.Hex())
+	}
+
+	//加速时maxFeePerGas和小费都按最低涨幅提高
+	speedUp, err := decoder.CreateSpeedUpRawTransaction(wrapper, rawTx, "")
+	if err != nil {
+		t.Fatalf("create speed up transaction failed: %v", err)
+	}
+	replaced, err := DecodeDynamicFeeTx(ethcom.FromHex(speedUp.RawHex))
+	if err != nil {
+		t.Fatalf("decode speed up transaction failed: %v", err)
+	}
+	if replaced.Nonce != signed.Nonce || replaced.GasFeeCap.Cmp(big.NewInt(56100000000)) != 0 || replaced.GasTipCap.Cmp(big.NewInt(1100000000)) != 0 {
+		t.Errorf("unexpected speed up transaction: %+v", replaced)
+	}
+}
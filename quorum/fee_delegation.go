@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/tidwall/gjson"
+)
+
+//feeDelegation 手续费代付设置，ExtParam: {"feePayer": "0x...", "feeRatio": 30}
+type feeDelegation struct {
+	Payer *openwallet.Address //代付地址，必须是钱包内的地址
+	Ratio uint8               //代付方承担手续费的百分比，0表示全额代付
+}
+
+//feeDelegationFromExtParam 读取扩展参数中的手续费代付设置，没有设置feePayer时返回nil
+func feeDelegationFromExtParam(wrapper openwallet.WalletDAI, extParam gjson.Result) (*feeDelegation, error) {
+	feePayer := extParam.Get("feePayer").String()
+	if len(feePayer) == 0 {
+		return nil, nil
+	}
+	addr, err := wrapper.GetAddress(feePayer)
+	if err != nil {
+		return nil, fmt.Errorf("can not find fee payer address: %s", feePayer)
+	}
+	fd := &feeDelegation{Payer: addr}
+	if ratio := extParam.Get("feeRatio"); ratio.Exists() {
+		if ratio.Uint() == 0 || ratio.Uint() > 99 {
+			return nil, fmt.Errorf("feeRatio should be 1 ~ 99")
+		}
+		fd.Ratio = uint8(ratio.Uint())
+	}
+	return fd, nil
+}
+
+//apply 把交易转为对应的手续费代付类型
+func (fd *feeDelegation) apply(wm *WalletManager, utx *unsignedTx) {
+	if fd == nil {
+		return
+	}
+	base := utx.Type.Base()
+	if base == TxTypeLegacy || base == TxTypeEthereumDynamicFee {
+		switch {
+		case utx.To == nil:
+			base = TxTypeSmartContractDeploy
+		case len(utx.Data) > 0:
+			base = TxTypeSmartContractExecution
+		default:
+			base = TxTypeValueTransfer
+		}
+	}
+	feePayer := ethcom.HexToAddress(wm.CustomAddressDecodeFunc(fd.Payer.Address))
+	utx.Type = base.FeeDelegated(fd.Ratio > 0)
+	utx.FeePayer = &feePayer
+	utx.FeeRatio = fd.Ratio
+}
+
+//senderFee 发送者需要支付的手续费
+func (fd *feeDelegation) senderFee(fee *big.Int) *big.Int {
+	if fd == nil {
+		return fee
+	}
+	if fd.Ratio == 0 {
+		return big.NewInt(0)
+	}
+	senderFee := new(big.Int).Mul(fee, big.NewInt(int64(100-fd.Ratio)))
+	return senderFee.Div(senderFee, big.NewInt(100))
+}
+
+//payerFee 代付方需要支付的手续费
+func (fd *feeDelegation) payerFee(fee *big.Int) *big.Int {
+	return new(big.Int).Sub(fee, fd.senderFee(fee))
+}
+
+//checkPayerBalance 检查代付方余额是否足够支付手续费
+func (fd *feeDelegation) checkPayerBalance(wm *WalletManager, fee *big.Int) *openwallet.Error {
+	if fd == nil {
+		return nil
+	}
+	balance, err := wm.GetAddrBalance(fd.Payer.Address, "latest")
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, err.Error())
+	}
+	if payerFee := fd.payerFee(fee); balance.Cmp(payerFee) < 0 {
+		return openwallet.Errorf(openwallet.ErrInsufficientFees, "the fee payer [%s] balance is not enough to pay fees", fd.Payer.Address)
+	}
+	return nil
+}
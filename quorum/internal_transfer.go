@@ -0,0 +1,133 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const (
+	transferGas = 21000 //普通转账的固有gas，没有执行合约代码
+)
+
+//InternalTransfer 合约执行过程中携带主币的内部调用
+type InternalTransfer struct {
+	From  string
+	To    string
+	Value *big.Int
+	Depth int //调用深度，交易本身为0
+}
+
+//callFrame callTracer返回的调用帧
+type callFrame struct {
+	Type  string       `json:"type"`
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	Value string       `json:"value"`
+	Error string       `json:"error"`
+	Calls []*callFrame `json:"calls"`
+}
+
+//GetInternalTransfers 通过debug_traceTransaction的callTracer获取交易的内部转账，不包括交易本身和被回滚的调用
+func (wm *WalletManager) GetInternalTransfers(txid string) ([]*InternalTransfer, error) {
+	return wm.GetInternalTransfersContext(context.Background(), txid)
+}
+
+//GetInternalTransfersContext 支持ctx超时和取消的GetInternalTransfers
+func (wm *WalletManager) GetInternalTransfersContext(ctx context.Context, txid string) ([]*InternalTransfer, error) {
+	params := []interface{}{
+		AppendOxToAddress(txid),
+		map[string]interface{}{"tracer": "callTracer"},
+	}
+	result, err := wm.WalletClient.CallContext(ctx, "debug_traceTransaction", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var root callFrame
+	if err := json.Unmarshal([]byte(result.Raw), &root); err != nil {
+		return nil, err
+	}
+
+	transfers := make([]*InternalTransfer, 0)
+	if len(root.Error) > 0 {
+		return transfers, nil
+	}
+	wm.collectInternalTransfers(root.Calls, 1, &transfers)
+	return transfers, nil
+}
+
+func (wm *WalletManager) collectInternalTransfers(frames []*callFrame, depth int, transfers *[]*InternalTransfer) {
+	for _, frame := range frames {
+		//被回滚的调用及其子调用都不生效
+		if len(frame.Error) > 0 {
+			continue
+		}
+		if strings.ToUpper(frame.Type) == "CALL" && len(frame.Value) > 0 {
+			value, err := hexutil.DecodeBig(frame.Value)
+			if err == nil && value.Sign() > 0 {
+				*transfers = append(*transfers, &InternalTransfer{
+					From:  wm.CustomAddressEncodeFunc(strings.ToLower(frame.From)),
+					To:    wm.CustomAddressEncodeFunc(strings.ToLower(frame.To)),
+					Value: value,
+					Depth: depth,
+				})
+			}
+		}
+		wm.collectInternalTransfers(frame.Calls, depth+1, transfers)
+	}
+}
+
+//UpdateTxInternalTransfers 执行成功的合约调用交易，配置了追踪内部转账时获取其内部转账
+func (bs *BlockScanner) UpdateTxInternalTransfers(tx *BlockTransaction) error {
+	if !bs.wm.Config.TraceInternalTransfers || tx.internalTxs != nil {
+		return nil
+	}
+	if tx.Status != 1 || len(tx.To) == 0 {
+		return nil
+	}
+	executed, err := bs.isContractExecution(tx)
+	if err != nil {
+		bs.wm.Log.Errorf("check contract of transaction: %s failed, err: %v", tx.Hash, err)
+		return err
+	}
+	if !executed {
+		return nil
+	}
+	transfers, err := bs.wm.GetInternalTransfers(tx.Hash)
+	if err != nil {
+		bs.wm.Log.Errorf("trace transaction: %s failed, err: %v", tx.Hash, err)
+		return err
+	}
+	tx.internalTxs = transfers
+	return nil
+}
+
+//isContractExecution 交易是否执行了合约代码。没有输入数据的转账也会执行合约的receive/fallback函数，不能按input判断：
+//回执的gas消耗不超过普通转账的21000时没有执行代码，有输入数据时是合约调用，否则查询接收地址是否合约
+func (bs *BlockScanner) isContractExecution(tx *BlockTransaction) (bool, error) {
+	if tx.receipt != nil && tx.receipt.ETHReceipt != nil && tx.receipt.ETHReceipt.GasUsed <= transferGas {
+		return false, nil
+	}
+	if len(strings.TrimPrefix(tx.Data, "0x")) > 0 {
+		return true, nil
+	}
+	return bs.wm.IsContract(tx.To)
+}
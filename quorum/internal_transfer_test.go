@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/tidwall/gjson"
+)
+
+func TestBlockScanner_InternalTransfersOffline(t *testing.T) {
+	var (
+		from     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to       = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		contract = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+		router   = "0x9a8c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.AddBlock()
+	call := &quorum_rpc.FakeTx{From: from, To: contract, Input: "0xabcdef01", Gas: 60000, GasUsed: 50000}
+	node.AddBlock(call)
+
+	//合约向to转账两次，其中一次在子调用中，被回滚的调用和不带金额的调用不提取
+	node.Handle("debug_traceTransaction", func(params gjson.Result) (interface{}, error) {
+		if params.Get("1.tracer").String() != "callTracer" {
+			t.Errorf("unexpected tracer: %s", params.Get("1").Raw)
+		}
+		return map[string]interface{}{
+			"type": "CALL", "from": from, "to": contract, "value": "0x0",
+			"calls": []interface{}{
+				map[string]interface{}{"type": "CALL", "from": contract, "to": to, "value": "0x5"},
+				map[string]interface{}{"type": "CALL", "from": contract, "to": to, "value": "0x0"},
+				map[string]interface{}{"type": "CALL", "from": contract, "to": router, "value": "0x0", "error": "execution reverted",
+					"calls": []interface{}{
+						map[string]interface{}{"type": "CALL", "from": router, "to": to, "value": "0x7"},
+					}},
+				map[string]interface{}{"type": "DELEGATECALL", "from": contract, "to": router,
+					"calls": []interface{}{
+						map[string]interface{}{"type": "CALL", "from": contract, "to": to, "value": "0x3"},
+					}},
+			},
+		}, nil
+	})
+
+	//未开启时不追踪
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.ScanBlockTask()
+	if len(observer.extracted) != 0 || node.RequestCount("debug_traceTransaction") != 0 {
+		t.Fatalf("internal transfers should not be traced by default")
+	}
+
+	bs, observer, _ = testNewFakeBlockScanner(node, 1, to)
+	bs.wm.Config.TraceInternalTransfers = true
+	bs.ScanBlockTask()
+	if len(observer.extracted) != 1 {
+		t.Fatalf("notifications = %d, want 1", len(observer.extracted))
+	}
+	outputs := observer.extracted[0].TxOutputs
+	if len(outputs) != 2 {
+		t.Fatalf("internal outputs = %d, want 2", len(outputs))
+	}
+	amounts := []string{"0.000000000000000005", "0.000000000000000003"}
+	for i, output := range outputs {
+		if output.Address != to || output.Amount != amounts[i] || output.TxID != call.Hash {
+			t.Errorf("unexpected output %d: %+v", i, output)
+		}
+	}
+	if outputs[0].Sid == outputs[1].Sid {
+		t.Errorf("internal outputs should have distinct sids")
+	}
+	//只收到内部转账，交易记录的发送方和金额取自内部转账而不是交易本身
+	record := observer.extracted[0].Transaction
+	wantFrom := []string{contract + ":0.000000000000000005", contract + ":0.000000000000000003"}
+	wantTo := []string{to + ":0.000000000000000005", to + ":0.000000000000000003"}
+	if record.Amount != "0.000000000000000008" || !reflect.DeepEqual(record.From, wantFrom) || !reflect.DeepEqual(record.To, wantTo) {
+		t.Errorf("unexpected internal transfer record: amount %s, from %v, to %v", record.Amount, record.From, record.To)
+	}
+}
+
+func TestBlockScanner_InternalTransfersWithoutInputOffline(t *testing.T) {
+	var (
+		from     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to       = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		contract = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetCode(contract, "0x6080")
+	node.AddBlock()
+	//没有输入数据的转账触发合约的receive函数转出，以及普通转账
+	receive := &quorum_rpc.FakeTx{From: from, To: contract, Value: big.NewInt(9), Gas: 60000, GasUsed: 35000}
+	transfer := &quorum_rpc.FakeTx{From: from, To: to, Nonce: 1, Value: big.NewInt(1), Gas: 21000, GasUsed: 21000}
+	node.AddBlock(receive, transfer)
+
+	traced := make([]string, 0)
+	node.Handle("debug_traceTransaction", func(params gjson.Result) (interface{}, error) {
+		traced = append(traced, params.Get("0").String())
+		return map[string]interface{}{
+			"type": "CALL", "from": from, "to": contract, "value": "0x9",
+			"calls": []interface{}{
+				map[string]interface{}{"type": "CALL", "from": contract, "to": to, "value": "0x4"},
+			},
+		}, nil
+	})
+
+	bs, observer, _ := testNewFakeBlockScanner(node, 1, to)
+	bs.wm.Config.TraceInternalTransfers = true
+	bs.ScanBlockTask()
+
+	//只有执行了合约代码的交易被追踪
+	if len(traced) != 1 || !strings.EqualFold(traced[0], receive.Hash) {
+		t.Fatalf("traced transactions = %v, want only %s", traced, receive.Hash)
+	}
+	found := false
+	for _, data := range observer.extracted {
+		for _, output := range data.TxOutputs {
+			if output.TxID == receive.Hash && output.Address == to && output.Amount == "0.000000000000000004" {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("internal transfer of the receive function should be notified")
+	}
+}
@@ -0,0 +1,663 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
+)
+
+//KlaytnTxType Klaytn交易类型
+type KlaytnTxType uint8
+
+const (
+	TxTypeLegacy                 KlaytnTxType = 0x00 //以太坊兼容交易
+	TxTypeValueTransfer          KlaytnTxType = 0x08 //主币转账
+	TxTypeValueTransferMemo      KlaytnTxType = 0x10 //带备注的主币转账
+	TxTypeAccountUpdate          KlaytnTxType = 0x20 //更新账户密钥
+	TxTypeSmartContractDeploy    KlaytnTxType = 0x28 //部署合约
+	TxTypeSmartContractExecution KlaytnTxType = 0x30 //调用合约
+	TxTypeCancel                 KlaytnTxType = 0x38 //取消交易池中相同nonce的交易
+	TxTypeEthereumDynamicFee     KlaytnTxType = 0x78 //以太坊EIP-1559交易，原始交易以0x7802开头，不支持手续费代付
+
+	//手续费代付类型 = 基础类型 + 1，按比例代付类型 = 基础类型 + 2
+	TxTypeFeeDelegatedValueTransfer                   = TxTypeValueTransfer + 1
+	TxTypeFeeDelegatedValueTransferWithRatio          = TxTypeValueTransfer + 2
+	TxTypeFeeDelegatedValueTransferMemo               = TxTypeValueTransferMemo + 1
+	TxTypeFeeDelegatedValueTransferMemoWithRatio      = TxTypeValueTransferMemo + 2
+	TxTypeFeeDelegatedAccountUpdate                   = TxTypeAccountUpdate + 1
+	TxTypeFeeDelegatedAccountUpdateWithRatio          = TxTypeAccountUpdate + 2
+	TxTypeFeeDelegatedSmartContractDeploy             = TxTypeSmartContractDeploy + 1
+	TxTypeFeeDelegatedSmartContractDeployWithRatio    = TxTypeSmartContractDeploy + 2
+	TxTypeFeeDelegatedSmartContractExecution          = TxTypeSmartContractExecution + 1
+	TxTypeFeeDelegatedSmartContractExecutionWithRatio = TxTypeSmartContractExecution + 2
+	TxTypeFeeDelegatedCancel                          = TxTypeCancel + 1
+	TxTypeFeeDelegatedCancelWithRatio                 = TxTypeCancel + 2
+
+	feeDelegationMask KlaytnTxType = 0x07
+)
+
+var txTypeNames = map[KlaytnTxType]string{
+	TxTypeLegacy:                 "Legacy",
+	TxTypeValueTransfer:          "ValueTransfer",
+	TxTypeValueTransferMemo:      "ValueTransferMemo",
+	TxTypeAccountUpdate:          "AccountUpdate",
+	TxTypeSmartContractDeploy:    "SmartContractDeploy",
+	TxTypeSmartContractExecution: "SmartContractExecution",
+	TxTypeCancel:                 "Cancel",
+	TxTypeEthereumDynamicFee:     "EthereumDynamicFee",
+
+	TxTypeFeeDelegatedValueTransfer:                   "FeeDelegatedValueTransfer",
+	TxTypeFeeDelegatedValueTransferWithRatio:          "FeeDelegatedValueTransferWithRatio",
+	TxTypeFeeDelegatedValueTransferMemo:               "FeeDelegatedValueTransferMemo",
+	TxTypeFeeDelegatedValueTransferMemoWithRatio:      "FeeDelegatedValueTransferMemoWithRatio",
+	TxTypeFeeDelegatedAccountUpdate:                   "FeeDelegatedAccountUpdate",
+	TxTypeFeeDelegatedAccountUpdateWithRatio:          "FeeDelegatedAccountUpdateWithRatio",
+	TxTypeFeeDelegatedSmartContractDeploy:             "FeeDelegatedSmartContractDeploy",
+	TxTypeFeeDelegatedSmartContractDeployWithRatio:    "FeeDelegatedSmartContractDeployWithRatio",
+	TxTypeFeeDelegatedSmartContractExecution:          "FeeDelegatedSmartContractExecution",
+	TxTypeFeeDelegatedSmartContractExecutionWithRatio: "FeeDelegatedSmartContractExecutionWithRatio",
+	TxTypeFeeDelegatedCancel:                          "FeeDelegatedCancel",
+	TxTypeFeeDelegatedCancelWithRatio:                 "FeeDelegatedCancelWithRatio",
+}
+
+func (t KlaytnTxType) String() string {
+	if name, ok := txTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TxType(0x%x)", uint8(t))
+}
+
+//IsSupported 是否支持的交易类型
+func (t KlaytnTxType) IsSupported() bool {
+	_, ok := txTypeNames[t]
+	return ok
+}
+
+//Base 去掉手续费代付后的基础类型
+func (t KlaytnTxType) Base() KlaytnTxType {
+	return t &^ feeDelegationMask
+}
+
+//IsFeeDelegated 是否手续费代付交易，需要发送者和代付方两个签名
+func (t KlaytnTxType) IsFeeDelegated() bool {
+	return t&feeDelegationMask != 0
+}
+
+//HasFeeRatio 是否按比例代付手续费
+func (t KlaytnTxType) HasFeeRatio() bool {
+	return t&feeDelegationMask == 2
+}
+
+//FeeDelegated 基础类型对应的手续费代付类型，withRatio为true时返回按比例代付类型
+func (t KlaytnTxType) FeeDelegated(withRatio bool) KlaytnTxType {
+	if t.Base() == TxTypeLegacy || t == TxTypeEthereumDynamicFee {
+		return t
+	}
+	if withRatio {
+		return t.Base() + 2
+	}
+	return t.Base() + 1
+}
+
+//ParseKlaytnTxType 解析交易类型，支持名称(不区分大小写，可带TxType前缀)和数字
+func ParseKlaytnTxType(s string) (KlaytnTxType, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return TxTypeLegacy, nil
+	}
+	name := strings.TrimPrefix(strings.ToLower(s), "txtype")
+	for t, n := range txTypeNames {
+		if strings.ToLower(n) == name {
+			return t, nil
+		}
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || !KlaytnTxType(v).IsSupported() {
+		return 0, fmt.Errorf("unsupported klaytn tx type: %s", s)
+	}
+	return KlaytnTxType(v), nil
+}
+
+//TxSignature Klaytn交易签名，V = recid + chainID * 2 + 35
+type TxSignature struct {
+	V *big.Int
+	R *big.Int
+	S *big.Int
+}
+
+//KlaytnTx Klaytn原生交易
+type KlaytnTx struct {
+	Type          KlaytnTxType
+	Nonce         uint64
+	GasPrice      *big.Int
+	Gas           uint64
+	To            *ethcom.Address //部署合约时为nil
+	Value         *big.Int
+	From          ethcom.Address
+	Input         []byte //合约数据或备注
+	HumanReadable bool   //部署合约使用，固定false
+	CodeFormat    uint8  //部署合约使用，0: EVM
+	AccountKey    []byte //更新账户使用，RLP编码的账户密钥
+	Signatures    []*TxSignature
+
+	FeeRatio           uint8          //按比例代付时代付方承担手续费的百分比，1~99
+	FeePayer           ethcom.Address //手续费代付地址
+	FeePayerSignatures []*TxSignature
+}
+
+//IsKlaytnTypedTx 原始交易是否Klaytn类型交易，以太坊兼容交易以RLP列表开头
+func IsKlaytnTypedTx(raw []byte) bool {
+	return len(raw) > 0 && raw[0] < 0xc0
+}
+
+//fields 按交易类型排列的RLP字段，不含类型和签名
+func (tx *KlaytnTx) fields() ([]interface{}, error) {
+	var to []byte
+	if tx.To != nil {
+		to = tx.To.Bytes()
+	}
+	value := tx.Value
+	if value == nil {
+		value = big.NewInt(0)
+	}
+	gasPrice := tx.GasPrice
+	if gasPrice == nil {
+		gasPrice = big.NewInt(0)
+	}
+	input := tx.Input
+	if input == nil {
+		input = []byte{}
+	}
+	if !tx.Type.IsSupported() {
+		return nil, fmt.Errorf("unsupported klaytn tx type: %v", tx.Type)
+	}
+	var fields []interface{}
+	switch tx.Type.Base() {
+	case TxTypeValueTransfer:
+		fields = []interface{}{tx.Nonce, gasPrice, tx.Gas, to, value, tx.From}
+	case TxTypeValueTransferMemo, TxTypeSmartContractExecution:
+		fields = []interface{}{tx.Nonce, gasPrice, tx.Gas, to, value, tx.From, input}
+	case TxTypeSmartContractDeploy:
+		fields = []interface{}{tx.Nonce, gasPrice, tx.Gas, to, value, tx.From, input, tx.HumanReadable, tx.CodeFormat}
+	case TxTypeAccountUpdate:
+		fields = []interface{}{tx.Nonce, gasPrice, tx.Gas, tx.From, tx.AccountKey}
+	case TxTypeCancel:
+		fields = []interface{}{tx.Nonce, gasPrice, tx.Gas, tx.From}
+	default:
+		return nil, fmt.Errorf("unsupported klaytn tx type: %v", tx.Type)
+	}
+	if tx.Type.HasFeeRatio() {
+		fields = withFeeRatio(tx.Type, fields, tx.FeeRatio)
+	}
+	return fields, nil
+}
+
+//withFeeRatio 按比例代付交易的feeRatio字段，部署合约时位于codeFormat之前，其他类型位于最后
+func withFeeRatio(txType KlaytnTxType, fields []interface{}, feeRatio interface{}) []interface{} {
+	if txType.Base() == TxTypeSmartContractDeploy {
+		last := len(fields) - 1
+		return append(append(fields[:last:last], feeRatio), fields[last])
+	}
+	return append(fields, feeRatio)
+}
+
+//SigHash 发送者签名的消息哈希，keccak256(rlp([rlp([type, fields...]), chainID, 0, 0]))
+func (tx *KlaytnTx) SigHash(chainID *big.Int) (ethcom.Hash, error) {
+	inner, err := tx.sigRLP()
+	if err != nil {
+		return ethcom.Hash{}, err
+	}
+	sigRLP, err := rlp.EncodeToBytes([]interface{}{inner, chainID, uint(0), uint(0)})
+	if err != nil {
+		return ethcom.Hash{}, err
+	}
+	return crypto.Keccak256Hash(sigRLP), nil
+}
+
+//FeePayerSigHash 手续费代付方签名的消息哈希，keccak256(rlp([rlp([type, fields...]), feePayer, chainID, 0, 0]))
+func (tx *KlaytnTx) FeePayerSigHash(chainID *big.Int) (ethcom.Hash, error) {
+	if !tx.Type.IsFeeDelegated() {
+		return ethcom.Hash{}, fmt.Errorf("%v is not a fee delegated transaction", tx.Type)
+	}
+	inner, err := tx.sigRLP()
+	if err != nil {
+		return ethcom.Hash{}, err
+	}
+	sigRLP, err := rlp.EncodeToBytes([]interface{}{inner, tx.FeePayer, chainID, uint(0), uint(0)})
+	if err != nil {
+		return ethcom.Hash{}, err
+	}
+	return crypto.Keccak256Hash(sigRLP), nil
+}
+
+func (tx *KlaytnTx) sigRLP() ([]byte, error) {
+	fields, err := tx.fields()
+	if err != nil {
+		return nil, err
+	}
+	return rlp.EncodeToBytes(append([]interface{}{tx.Type}, fields...))
+}
+
+//WithSignature 添加发送者签名，sig为65字节的r || s || recid
+func (tx *KlaytnTx) WithSignature(sig []byte, chainID *big.Int) error {
+	txSig, err := newTxSignature(sig, chainID)
+	if err != nil {
+		return err
+	}
+	tx.Signatures = append(tx.Signatures, txSig)
+	return nil
+}
+
+//WithFeePayerSignature 添加手续费代付方签名
+func (tx *KlaytnTx) WithFeePayerSignature(sig []byte, chainID *big.Int) error {
+	if !tx.Type.IsFeeDelegated() {
+		return fmt.Errorf("%v is not a fee delegated transaction", tx.Type)
+	}
+	txSig, err := newTxSignature(sig, chainID)
+	if err != nil {
+		return err
+	}
+	tx.FeePayerSignatures = append(tx.FeePayerSignatures, txSig)
+	return nil
+}
+
+func newTxSignature(sig []byte, chainID *big.Int) (*TxSignature, error) {
+	if len(sig) != 65 {
+		return nil, fmt.Errorf("wrong size for signature: got %d, want 65", len(sig))
+	}
+	v := new(big.Int).Mul(chainID, big.NewInt(2))
+	v.Add(v, big.NewInt(int64(sig[64])+35))
+	return &TxSignature{
+		V: v,
+		R: new(big.Int).SetBytes(sig[:32]),
+		S: new(big.Int).SetBytes(sig[32:64]),
+	}, nil
+}
+
+func encodeTxSignatures(sigs []*TxSignature) []interface{} {
+	list := make([]interface{}, 0, len(sigs))
+	for _, sig := range sigs {
+		list = append(list, []*big.Int{sig.V, sig.R, sig.S})
+	}
+	return list
+}
+
+func decodeTxSignatures(raw rlp.RawValue) ([]*TxSignature, error) {
+	var sigs [][]*big.Int
+	if err := rlp.DecodeBytes(raw, &sigs); err != nil {
+		return nil, err
+	}
+	list := make([]*TxSignature, 0, len(sigs))
+	for _, sig := range sigs {
+		if len(sig) != 3 {
+			return nil, fmt.Errorf("invalid klaytn tx signature")
+		}
+		list = append(list, &TxSignature{V: sig[0], R: sig[1], S: sig[2]})
+	}
+	return list, nil
+}
+
+//MarshalBinary 原始交易编码，type || rlp([fields..., [[v, r, s]...]])，
+//手续费代付交易在最后加上feePayer和代付方签名
+func (tx *KlaytnTx) MarshalBinary() ([]byte, error) {
+	fields, err := tx.fields()
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, encodeTxSignatures(tx.Signatures))
+	if tx.Type.IsFeeDelegated() {
+		fields = append(fields, tx.FeePayer, encodeTxSignatures(tx.FeePayerSignatures))
+	}
+	body, err := rlp.EncodeToBytes(fields)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(tx.Type)}, body...), nil
+}
+
+//Hash 交易哈希
+func (tx *KlaytnTx) Hash() (ethcom.Hash, error) {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return ethcom.Hash{}, err
+	}
+	return crypto.Keccak256Hash(raw), nil
+}
+
+//DecodeKlaytnTx 解码Klaytn类型交易
+func DecodeKlaytnTx(raw []byte) (*KlaytnTx, error) {
+	if !IsKlaytnTypedTx(raw) {
+		return nil, fmt.Errorf("not a klaytn typed transaction")
+	}
+	tx := &KlaytnTx{Type: KlaytnTxType(raw[0])}
+	var items []rlp.RawValue
+	if err := rlp.DecodeBytes(raw[1:], &items); err != nil {
+		return nil, err
+	}
+
+	if !tx.Type.IsSupported() {
+		return nil, fmt.Errorf("unsupported klaytn tx type: %v", tx.Type)
+	}
+
+	var to []byte
+	var targets []interface{}
+	switch tx.Type.Base() {
+	case TxTypeValueTransfer:
+		targets = []interface{}{&tx.Nonce, &tx.GasPrice, &tx.Gas, &to, &tx.Value, &tx.From}
+	case TxTypeValueTransferMemo, TxTypeSmartContractExecution:
+		targets = []interface{}{&tx.Nonce, &tx.GasPrice, &tx.Gas, &to, &tx.Value, &tx.From, &tx.Input}
+	case TxTypeSmartContractDeploy:
+		targets = []interface{}{&tx.Nonce, &tx.GasPrice, &tx.Gas, &to, &tx.Value, &tx.From, &tx.Input, &tx.HumanReadable, &tx.CodeFormat}
+	case TxTypeAccountUpdate:
+		targets = []interface{}{&tx.Nonce, &tx.GasPrice, &tx.Gas, &tx.From, &tx.AccountKey}
+	case TxTypeCancel:
+		targets = []interface{}{&tx.Nonce, &tx.GasPrice, &tx.Gas, &tx.From}
+	default:
+		return nil, fmt.Errorf("unsupported klaytn tx type: %v", tx.Type)
+	}
+
+	if tx.Type.HasFeeRatio() {
+		targets = withFeeRatio(tx.Type, targets, &tx.FeeRatio)
+	}
+
+	want := len(targets) + 1
+	if tx.Type.IsFeeDelegated() {
+		want += 2
+	}
+	if len(items) != want {
+		return nil, fmt.Errorf("klaytn tx %v has %d fields, want %d", tx.Type, len(items), want)
+	}
+	for i, target := range targets {
+		if err := rlp.DecodeBytes(items[i], target); err != nil {
+			return nil, fmt.Errorf("decode klaytn tx field %d failed, err: %v", i, err)
+		}
+	}
+	if len(to) > 0 {
+		addr := ethcom.BytesToAddress(to)
+		tx.To = &addr
+	}
+
+	sigs, err := decodeTxSignatures(items[len(targets)])
+	if err != nil {
+		return nil, fmt.Errorf("decode klaytn tx signatures failed, err: %v", err)
+	}
+	tx.Signatures = sigs
+
+	if tx.Type.IsFeeDelegated() {
+		if err := rlp.DecodeBytes(items[len(targets)+1], &tx.FeePayer); err != nil {
+			return nil, fmt.Errorf("decode klaytn tx fee payer failed, err: %v", err)
+		}
+		feePayerSigs, err := decodeTxSignatures(items[len(targets)+2])
+		if err != nil {
+			return nil, fmt.Errorf("decode klaytn tx fee payer signatures failed, err: %v", err)
+		}
+		tx.FeePayerSignatures = feePayerSigs
+	}
+	return tx, nil
+}
+
+//txTypeFromExtParam 从扩展参数的txType读取交易类型，没有设置时使用配置的默认类型
+func (wm *WalletManager) txTypeFromExtParam(extParam gjson.Result) (KlaytnTxType, error) {
+	if txType := extParam.Get("txType"); txType.Exists() {
+		return ParseKlaytnTxType(txType.String())
+	}
+	return wm.Config.TxType, nil
+}
+
+//unsignedTx 待签名的交易
+type unsignedTx struct {
+	Type     KlaytnTxType
+	Nonce    uint64
+	From     ethcom.Address
+	To       *ethcom.Address
+	Value    *big.Int
+	Gas      uint64
+	GasPrice *big.Int //动态手续费交易为maxFeePerGas
+	GasTip   *big.Int //动态手续费交易的maxPriorityFeePerGas
+	Data     []byte
+	FeePayer *ethcom.Address //手续费代付地址，手续费代付交易必填
+	FeeRatio uint8           //按比例代付时代付方承担的百分比
+	ExtParam gjson.Result    //类型相关的扩展参数，如memo、accountKey
+}
+
+//buildUnsignedTx 按交易类型构建未签名的原始交易和待签名的消息哈希
+func (wm *WalletManager) buildUnsignedTx(utx *unsignedTx) ([]byte, []byte, error) {
+	chainID := new(big.Int).SetUint64(wm.Config.ChainID)
+
+	if utx.Type == TxTypeLegacy {
+		var tx *types.Transaction
+		if utx.To == nil {
+			tx = types.NewContractCreation(utx.Nonce, utx.Value, utx.Gas, utx.GasPrice, utx.Data)
+		} else {
+			tx = types.NewTransaction(utx.Nonce, *utx.To, utx.Value, utx.Gas, utx.GasPrice, utx.Data)
+		}
+		raw, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg := types.NewEIP155Signer(chainID).Hash(tx)
+		return raw, msg[:], nil
+	}
+	if utx.Type == TxTypeEthereumDynamicFee {
+		return wm.buildDynamicFeeTx(utx)
+	}
+
+	tx := &KlaytnTx{
+		Type:     utx.Type,
+		Nonce:    utx.Nonce,
+		GasPrice: utx.GasPrice,
+		Gas:      utx.Gas,
+		To:       utx.To,
+		Value:    utx.Value,
+		From:     utx.From,
+		Input:    utx.Data,
+		FeeRatio: utx.FeeRatio,
+	}
+	if utx.Type.IsFeeDelegated() {
+		if utx.FeePayer == nil {
+			return nil, nil, fmt.Errorf("feePayer is required for %v", utx.Type)
+		}
+		tx.FeePayer = *utx.FeePayer
+	}
+	if utx.Type.HasFeeRatio() && (utx.FeeRatio == 0 || utx.FeeRatio > 99) {
+		return nil, nil, fmt.Errorf("feeRatio of %v should be 1 ~ 99", utx.Type)
+	}
+	switch utx.Type.Base() {
+	case TxTypeValueTransferMemo:
+		if memo := utx.ExtParam.Get("memo"); memo.Exists() {
+			tx.Input = []byte(memo.String())
+		}
+	case TxTypeAccountUpdate:
+		accountKey, err := accountKeyFromExtParam(utx.ExtParam.Get("accountKey"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid accountKey for %v, err: %v", utx.Type, err)
+		}
+		tx.AccountKey = accountKey
+	}
+	if base := utx.Type.Base(); tx.To == nil && base != TxTypeSmartContractDeploy && base != TxTypeAccountUpdate && base != TxTypeCancel {
+		return nil, nil, fmt.Errorf("recipient is required for %v", utx.Type)
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := tx.SigHash(chainID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, msg[:], nil
+}
+
+//txMessages 原始交易中发送者和手续费代付方待签名的消息哈希，不是手续费代付交易时feePayerMsg为nil
+func (wm *WalletManager) txMessages(raw []byte) ([]byte, []byte, error) {
+	chainID := new(big.Int).SetUint64(wm.Config.ChainID)
+
+	if !IsKlaytnTypedTx(raw) {
+		tx := &types.Transaction{}
+		if err := rlp.DecodeBytes(raw, tx); err != nil {
+			return nil, nil, err
+		}
+		msg := types.NewEIP155Signer(chainID).Hash(tx)
+		return msg[:], nil, nil
+	}
+	if IsDynamicFeeTx(raw) {
+		tx, err := DecodeDynamicFeeTx(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg := tx.SigHash()
+		return msg[:], nil, nil
+	}
+
+	tx, err := DecodeKlaytnTx(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := tx.SigHash(chainID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !tx.Type.IsFeeDelegated() {
+		return msg[:], nil, nil
+	}
+	feePayerMsg, err := tx.FeePayerSigHash(chainID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg[:], feePayerMsg[:], nil
+}
+
+//signRawTx 把签名加入未签名的原始交易，返回可广播的原始交易和交易nonce。
+//多签账户有多个签名，手续费代付交易需要同时提供代付方签名feePayerSigs
+func (wm *WalletManager) signRawTx(raw []byte, sigs [][]byte, feePayerSigs [][]byte) ([]byte, uint64, error) {
+	chainID := new(big.Int).SetUint64(wm.Config.ChainID)
+
+	if len(sigs) == 0 {
+		return nil, 0, fmt.Errorf("sender signature is required")
+	}
+
+	if IsDynamicFeeTx(raw) {
+		if len(sigs) != 1 {
+			return nil, 0, fmt.Errorf("ethereum dynamic fee transaction accepts only one signature")
+		}
+		tx, err := DecodeDynamicFeeTx(raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := tx.WithSignature(sigs[0]); err != nil {
+			return nil, 0, err
+		}
+		signed, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, 0, err
+		}
+		return signed, tx.Nonce, nil
+	}
+
+	if IsKlaytnTypedTx(raw) {
+		tx, err := DecodeKlaytnTx(raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, sig := range sigs {
+			if err := tx.WithSignature(sig, chainID); err != nil {
+				return nil, 0, err
+			}
+		}
+		if tx.Type.IsFeeDelegated() {
+			if len(feePayerSigs) == 0 {
+				return nil, 0, fmt.Errorf("fee payer signature is required for %v", tx.Type)
+			}
+			for _, sig := range feePayerSigs {
+				if err := tx.WithFeePayerSignature(sig, chainID); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+		signed, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, 0, err
+		}
+		return signed, tx.Nonce, nil
+	}
+
+	if len(sigs) != 1 {
+		return nil, 0, fmt.Errorf("legacy transaction accepts only one signature")
+	}
+	tx := &types.Transaction{}
+	if err := rlp.DecodeBytes(raw, tx); err != nil {
+		return nil, 0, err
+	}
+	tx, err := tx.WithSignature(types.NewEIP155Signer(chainID), sigs[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	signed, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return signed, tx.Nonce(), nil
+}
+
+//signRawTxWithKeySignatures 收集交易单中发送者和手续费代付方的签名加入原始交易，返回可广播的原始交易、发送地址和nonce
+func (wm *WalletManager) signRawTxWithKeySignatures(raw []byte, signatures map[string][]*openwallet.KeySignature) ([]byte, string, uint64, error) {
+	msg, feePayerMsg, err := wm.txMessages(raw)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	signed := collectSignatures(signatures, msg)
+	if len(signed) == 0 {
+		return nil, "", 0, fmt.Errorf("wallet signature not found")
+	}
+	var feePayerSigs [][]byte
+	if feePayerMsg != nil {
+		feePayerSigned := collectSignatures(signatures, feePayerMsg)
+		if len(feePayerSigned) == 0 {
+			return nil, "", 0, fmt.Errorf("fee payer signature not found")
+		}
+		feePayerSigs = signatureBytes(feePayerSigned)
+	}
+	if err := wm.checkSignatureThreshold(raw, signatures); err != nil {
+		return nil, "", 0, err
+	}
+	rawTx, nonce, err := wm.signRawTx(raw, signatureBytes(signed), feePayerSigs)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return rawTx, wm.txSender(raw, signed), nonce, nil
+}
+
+//txSender 原始交易的发送地址，以太坊兼容交易的发送地址不在原始交易中，使用签名的地址
+func (wm *WalletManager) txSender(raw []byte, signed []*openwallet.KeySignature) string {
+	if IsKlaytnTypedTx(raw) {
+		if tx, err := DecodeKlaytnTx(raw); err == nil {
+			return wm.CustomAddressEncodeFunc(strings.ToLower(tx.From.Hex()))
+		}
+	}
+	if len(signed) > 0 {
+		return signed[0].Address.Address
+	}
+	return ""
+}
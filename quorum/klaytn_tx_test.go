@@ -0,0 +1,343 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestParseKlaytnTxType(t *testing.T) {
+	tests := []struct {
+		s    string
+		want KlaytnTxType
+	}{
+		{"", TxTypeLegacy},
+		{"ValueTransfer", TxTypeValueTransfer},
+		{"TxTypeValueTransferMemo", TxTypeValueTransferMemo},
+		{"smartcontractexecution", TxTypeSmartContractExecution},
+		{"0x38", TxTypeCancel},
+		{"40", TxTypeSmartContractDeploy},
+		{"FeeDelegatedSmartContractExecutionWithRatio", TxTypeFeeDelegatedSmartContractExecutionWithRatio},
+		{"0x09", TxTypeFeeDelegatedValueTransfer},
+	}
+	for _, test := range tests {
+		got, err := ParseKlaytnTxType(test.s)
+		if err != nil {
+			t.Errorf("ParseKlaytnTxType(%q) failed, err: %v", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseKlaytnTxType(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+	if _, err := ParseKlaytnTxType("0x0b"); err == nil {
+		t.Errorf("ParseKlaytnTxType(0x0b) should fail")
+	}
+	if got := TxTypeValueTransferMemo.FeeDelegated(true); got != TxTypeFeeDelegatedValueTransferMemoWithRatio || got.Base() != TxTypeValueTransferMemo {
+		t.Errorf("FeeDelegated(true) = %v", got)
+	}
+}
+
+func TestKlaytnTx_SignAndDecode(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := ethcom.HexToAddress("0x8b1a3a9d6b2a6d0e0a3f9e5b2c7b7b1b7b7b7b7b")
+	chainID := big.NewInt(1001)
+
+	txs := []*KlaytnTx{
+		{Type: TxTypeValueTransfer, To: &to, Value: big.NewInt(100)},
+		{Type: TxTypeValueTransferMemo, To: &to, Value: big.NewInt(100), Input: []byte("hello")},
+		{Type: TxTypeSmartContractExecution, To: &to, Input: []byte{0xa9, 0x05, 0x9c, 0xbb}},
+		{Type: TxTypeSmartContractDeploy, Input: []byte{0x60, 0x80}},
+		{Type: TxTypeAccountUpdate, AccountKey: []byte{0x01, 0xc0}},
+		{Type: TxTypeCancel},
+	}
+	for _, tx := range txs {
+		tx.Nonce = 7
+		tx.GasPrice = big.NewInt(25000000000)
+		tx.Gas = 100000
+		tx.From = from
+
+		msg, err := tx.SigHash(chainID)
+		if err != nil {
+			t.Errorf("%v sig hash failed, err: %v", tx.Type, err)
+			continue
+		}
+		sig, _ := crypto.Sign(msg[:], key)
+		if err := tx.WithSignature(sig, chainID); err != nil {
+			t.Errorf("%v with signature failed, err: %v", tx.Type, err)
+			continue
+		}
+		wantV := int64(sig[64]) + chainID.Int64()*2 + 35
+		if tx.Signatures[0].V.Int64() != wantV {
+			t.Errorf("%v signature v = %v, want %d", tx.Type, tx.Signatures[0].V, wantV)
+		}
+
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			t.Errorf("%v marshal failed, err: %v", tx.Type, err)
+			continue
+		}
+		if raw[0] != byte(tx.Type) || !IsKlaytnTypedTx(raw) {
+			t.Errorf("%v raw tx should start with type byte", tx.Type)
+		}
+
+		decoded, err := DecodeKlaytnTx(raw)
+		if err != nil {
+			t.Errorf("%v decode failed, err: %v", tx.Type, err)
+			continue
+		}
+		reencoded, _ := decoded.MarshalBinary()
+		if !bytes.Equal(raw, reencoded) {
+			t.Errorf("%v round trip mismatch", tx.Type)
+		}
+		decodedMsg, _ := decoded.SigHash(chainID)
+		pub, err := crypto.SigToPub(decodedMsg[:], sig)
+		if err != nil || crypto.PubkeyToAddress(*pub) != from {
+			t.Errorf("%v sender should be recoverable from decoded tx", tx.Type)
+		}
+	}
+}
+
+func TestKlaytnTx_FeeDelegated(t *testing.T) {
+	sender, _ := crypto.GenerateKey()
+	payer, _ := crypto.GenerateKey()
+	to := ethcom.HexToAddress("0x8b1a3a9d6b2a6d0e0a3f9e5b2c7b7b1b7b7b7b7b")
+	chainID := big.NewInt(1001)
+
+	txs := []*KlaytnTx{
+		{Type: TxTypeFeeDelegatedValueTransfer, To: &to, Value: big.NewInt(100)},
+		{Type: TxTypeFeeDelegatedValueTransferWithRatio, To: &to, Value: big.NewInt(100), FeeRatio: 30},
+		{Type: TxTypeFeeDelegatedSmartContractExecution, To: &to, Input: []byte{0xa9, 0x05, 0x9c, 0xbb}},
+		{Type: TxTypeFeeDelegatedSmartContractDeployWithRatio, Input: []byte{0x60, 0x80}, FeeRatio: 50},
+	}
+	for _, tx := range txs {
+		tx.Nonce = 1
+		tx.GasPrice = big.NewInt(25000000000)
+		tx.Gas = 100000
+		tx.From = crypto.PubkeyToAddress(sender.PublicKey)
+		tx.FeePayer = crypto.PubkeyToAddress(payer.PublicKey)
+
+		msg, _ := tx.SigHash(chainID)
+		feePayerMsg, err := tx.FeePayerSigHash(chainID)
+		if err != nil {
+			t.Errorf("%v fee payer sig hash failed, err: %v", tx.Type, err)
+			continue
+		}
+		if msg == feePayerMsg {
+			t.Errorf("%v sender and fee payer should sign different messages", tx.Type)
+		}
+		sig, _ := crypto.Sign(msg[:], sender)
+		feePayerSig, _ := crypto.Sign(feePayerMsg[:], payer)
+		tx.WithSignature(sig, chainID)
+		tx.WithFeePayerSignature(feePayerSig, chainID)
+
+		raw, err := tx.MarshalBinary()
+		if err != nil {
+			t.Errorf("%v marshal failed, err: %v", tx.Type, err)
+			continue
+		}
+		decoded, err := DecodeKlaytnTx(raw)
+		if err != nil {
+			t.Errorf("%v decode failed, err: %v", tx.Type, err)
+			continue
+		}
+		if decoded.FeePayer != tx.FeePayer || decoded.FeeRatio != tx.FeeRatio || len(decoded.FeePayerSignatures) != 1 {
+			t.Errorf("%v fee payer fields mismatch", tx.Type)
+		}
+		reencoded, _ := decoded.MarshalBinary()
+		if !bytes.Equal(raw, reencoded) {
+			t.Errorf("%v round trip mismatch", tx.Type)
+		}
+		decodedMsg, _ := decoded.FeePayerSigHash(chainID)
+		pub, err := crypto.SigToPub(decodedMsg[:], feePayerSig)
+		if err != nil || crypto.PubkeyToAddress(*pub) != tx.FeePayer {
+			t.Errorf("%v fee payer should be recoverable from decoded tx", tx.Type)
+		}
+	}
+}
+
+func TestWalletManager_SignRawTxFeeDelegated(t *testing.T) {
+	wm := testNewFakeWalletManager(quorum_rpc.NewFakeNode(1001))
+	sender, _ := crypto.GenerateKey()
+	payer, _ := crypto.GenerateKey()
+	to := ethcom.HexToAddress("0x8b1a3a9d6b2a6d0e0a3f9e5b2c7b7b1b7b7b7b7b")
+
+	utx := &unsignedTx{
+		Type:     TxTypeSmartContractExecution,
+		Nonce:    5,
+		From:     crypto.PubkeyToAddress(sender.PublicKey),
+		To:       &to,
+		Value:    big.NewInt(0),
+		Gas:      60000,
+		GasPrice: big.NewInt(25000000000),
+		Data:     []byte{0xa9, 0x05, 0x9c, 0xbb},
+	}
+	fd := &feeDelegation{Payer: &openwallet.Address{AccountID: "payer", Address: crypto.PubkeyToAddress(payer.PublicKey).Hex()}}
+	fd.apply(wm, utx)
+	if utx.Type != TxTypeFeeDelegatedSmartContractExecution {
+		t.Fatalf("tx type = %v, want %v", utx.Type, TxTypeFeeDelegatedSmartContractExecution)
+	}
+
+	raw, msg, err := wm.buildUnsignedTx(utx)
+	if err != nil {
+		t.Fatalf("build failed, err: %v", err)
+	}
+	senderMsg, feePayerMsg, err := wm.txMessages(raw)
+	if err != nil || !bytes.Equal(senderMsg, msg) || feePayerMsg == nil {
+		t.Fatalf("tx messages failed, err: %v", err)
+	}
+
+	sig, _ := crypto.Sign(msg, sender)
+	senderSig := &openwallet.KeySignature{Message: ethcom.Bytes2Hex(msg), Signature: ethcom.Bytes2Hex(sig)}
+	payerSig := &openwallet.KeySignature{Message: ethcom.Bytes2Hex(feePayerMsg)}
+	signatures := map[string][]*openwallet.KeySignature{"sender": {senderSig}, "payer": {payerSig}}
+	if _, _, _, err := wm.signRawTxWithKeySignatures(raw, signatures); err == nil {
+		t.Errorf("fee delegated tx without fee payer signature should fail")
+	}
+	if _, _, err := wm.signRawTx(raw, [][]byte{sig}, nil); err == nil {
+		t.Errorf("fee delegated tx without fee payer signature should fail")
+	}
+
+	feePayerSig, _ := crypto.Sign(feePayerMsg, payer)
+	payerSig.Signature = ethcom.Bytes2Hex(feePayerSig)
+	signed, from, nonce, err := wm.signRawTxWithKeySignatures(raw, signatures)
+	if err != nil || nonce != 5 {
+		t.Fatalf("sign failed, nonce: %d, err: %v", nonce, err)
+	}
+	if from != strings.ToLower(utx.From.Hex()) {
+		t.Errorf("from = %s, want %s", from, strings.ToLower(utx.From.Hex()))
+	}
+	tx, _ := DecodeKlaytnTx(signed)
+	if len(tx.Signatures) != 1 || len(tx.FeePayerSignatures) != 1 {
+		t.Errorf("signed tx should have both signatures")
+	}
+
+	if _, _, err := wm.buildUnsignedTx(&unsignedTx{Type: TxTypeFeeDelegatedValueTransfer, To: &to}); err == nil {
+		t.Errorf("fee delegated tx without fee payer should fail")
+	}
+}
+
+func TestFeeDelegation_SenderFee(t *testing.T) {
+	var none *feeDelegation
+	fee := big.NewInt(1000)
+	if none.senderFee(fee).Int64() != 1000 {
+		t.Errorf("sender should pay all fees without fee delegation")
+	}
+	if (&feeDelegation{}).senderFee(fee).Int64() != 0 {
+		t.Errorf("sender should pay no fees with full fee delegation")
+	}
+	fd := &feeDelegation{Ratio: 30}
+	if fd.senderFee(fee).Int64() != 700 || fd.payerFee(fee).Int64() != 300 {
+		t.Errorf("fee ratio 30: sender %v, payer %v", fd.senderFee(fee), fd.payerFee(fee))
+	}
+}
+
+func TestWalletManager_SignRawTxKlaytnType(t *testing.T) {
+	wm := NewWalletManager()
+	wm.Config.ChainID = 1001
+	key, _ := crypto.GenerateKey()
+	to := ethcom.HexToAddress("0x8b1a3a9d6b2a6d0e0a3f9e5b2c7b7b1b7b7b7b7b")
+
+	for _, txType := range []KlaytnTxType{TxTypeLegacy, TxTypeValueTransfer} {
+		raw, msg, err := wm.buildUnsignedTx(&unsignedTx{
+			Type:     txType,
+			Nonce:    3,
+			From:     crypto.PubkeyToAddress(key.PublicKey),
+			To:       &to,
+			Value:    big.NewInt(1),
+			Gas:      21000,
+			GasPrice: big.NewInt(25000000000),
+		})
+		if err != nil {
+			t.Errorf("%v build failed, err: %v", txType, err)
+			continue
+		}
+		sig, _ := crypto.Sign(msg, key)
+		signed, nonce, err := wm.signRawTx(raw, [][]byte{sig}, nil)
+		if err != nil {
+			t.Errorf("%v sign failed, err: %v", txType, err)
+			continue
+		}
+		if nonce != 3 {
+			t.Errorf("%v nonce = %d, want 3", txType, nonce)
+		}
+		if IsKlaytnTypedTx(signed) != (txType != TxTypeLegacy) {
+			t.Errorf("%v signed tx has wrong format", txType)
+		}
+	}
+
+	if _, _, err := wm.buildUnsignedTx(&unsignedTx{Type: TxTypeValueTransfer, Value: big.NewInt(1)}); err == nil {
+		t.Errorf("value transfer without recipient should fail")
+	}
+}
+
+func TestBlockTransaction_GetMemo(t *testing.T) {
+	tx := &BlockTransaction{Type: "TxTypeValueTransferMemo", Data: "0x68656c6c6f"}
+	memo, ok := tx.GetMemo()
+	if !ok || memo != "hello" {
+		t.Errorf("memo = %q, want hello", memo)
+	}
+	if ext := tx.GetExtParam(); ext != `{"memo":"hello","txType":"ValueTransferMemo"}` {
+		t.Errorf("ext param = %s", ext)
+	}
+
+	legacy := &BlockTransaction{Data: "0x68656c6c6f"}
+	if _, ok := legacy.GetMemo(); ok {
+		t.Errorf("legacy tx should have no memo")
+	}
+	if ext := legacy.GetExtParam(); ext != "" {
+		t.Errorf("legacy tx should have no ext param, got %s", ext)
+	}
+}
+
+func TestLoadAssetsConfig_FeeDelegationOptInOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feedelegation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := "serverAPI = http://127.0.0.1:1\nchainID = 1001\ndataDir = " + dir + "\n"
+
+	//手续费代付需要显式开启
+	if NewConfig(Symbol).FeeDelegation {
+		t.Errorf("fee delegation should be disabled by default")
+	}
+	wm := NewWalletManager()
+	c, _ := config.NewConfigData("ini", []byte(base))
+	wm.LoadAssetsConfig(c)
+	if wm.Config.FeeDelegation {
+		t.Errorf("fee delegation should be disabled when feeDelegation is not set")
+	}
+
+	wm = NewWalletManager()
+	c, _ = config.NewConfigData("ini", []byte(base+"feeDelegation = true\n"))
+	wm.LoadAssetsConfig(c)
+	if !wm.Config.FeeDelegation {
+		t.Errorf("fee delegation should be enabled by feeDelegation = true")
+	}
+}
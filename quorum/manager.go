@@ -15,6 +15,7 @@
 package quorum
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -35,6 +36,8 @@ import (
 	//	"log"
 	"math/big"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type WalletManager struct {
@@ -43,14 +46,21 @@ type WalletManager struct {
 	RawClient               *ethclient.Client               //原生ETH客户端
 	WalletClient            *quorum_rpc.Client              // 节点客户端
 	BroadcastClient         *quorum_rpc.Client              // 节点客户端
+	WSClient                *quorum_rpc.WSClient            // websocket节点客户端
 	Config                  *WalletConfig                   //钱包管理配置
 	Blockscanner            openwallet.BlockScanner         //区块扫描器
 	Decoder                 openwallet.AddressDecoderV2     //地址编码器
 	TxDecoder               openwallet.TransactionDecoder   //交易单编码器
 	ContractDecoder         openwallet.SmartContractDecoder //智能合约解释器
+	TokenRegistry           *TokenRegistry                  //代币元数据缓存
+	NonceManager            *NonceManager                   //本地nonce管理
+	BroadcastTracker        *BroadcastTracker               //已广播交易的追踪器
 	Log                     *log.OWLogger                   //日志工具
 	CustomAddressEncodeFunc func(address string) string     //自定义地址转换算法
 	CustomAddressDecodeFunc func(address string) string     //自定义地址转换算法
+
+	blockReceiptsUnsupported int32 //节点不支持getBlockReceipts，改为逐笔获取交易回执
+	consensusInfoUnsupported int32 //节点不支持getBlockWithConsensusInfoByNumber，BFT模式只检查父区块hash
 }
 
 func NewWalletManager() *WalletManager {
@@ -60,6 +70,9 @@ func NewWalletManager() *WalletManager {
 	wm.Decoder = &quorum_addrdec.Default
 	wm.TxDecoder = NewTransactionDecoder(&wm)
 	wm.ContractDecoder = &EthContractDecoder{wm: &wm}
+	wm.TokenRegistry = NewTokenRegistry(&wm)
+	wm.NonceManager = NewNonceManager(&wm)
+	wm.BroadcastTracker = NewBroadcastTracker(&wm)
 	wm.Log = log.NewOWLogger(wm.Symbol())
 	wm.CustomAddressEncodeFunc = CustomAddressEncode
 	wm.CustomAddressDecodeFunc = CustomAddressDecode
@@ -68,17 +81,31 @@ func NewWalletManager() *WalletManager {
 }
 
 func (wm *WalletManager) GetTransactionCount(addr string) (uint64, error) {
+	return wm.GetTransactionCountContext(context.Background(), addr)
+}
+
+//GetTransactionCountContext 支持ctx超时和取消的GetTransactionCount
+func (wm *WalletManager) GetTransactionCountContext(ctx context.Context, addr string) (uint64, error) {
+	return wm.getTransactionCountContext(ctx, addr, "latest")
+}
+
+//GetPendingTransactionCount 包括交易池中交易的地址nonce
+func (wm *WalletManager) GetPendingTransactionCount(addr string) (uint64, error) {
+	return wm.getTransactionCountContext(context.Background(), addr, "pending")
+}
+
+func (wm *WalletManager) getTransactionCountContext(ctx context.Context, addr string, tag string) (uint64, error) {
 	addr = wm.CustomAddressDecodeFunc(addr)
 	params := []interface{}{
 		AppendOxToAddress(addr),
-		"latest",
+		tag,
 	}
 
 	if wm.WalletClient == nil {
 		return 0, fmt.Errorf("wallet client is not initialized")
 	}
 
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_getTransactionCount", params)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getTransactionCount", params)
 	if err != nil {
 		return 0, err
 	}
@@ -88,12 +115,17 @@ func (wm *WalletManager) GetTransactionCount(addr string) (uint64, error) {
 }
 
 func (wm *WalletManager) GetTransactionReceipt(transactionId string) (*TransactionReceipt, error) {
+	return wm.GetTransactionReceiptContext(context.Background(), transactionId)
+}
+
+//GetTransactionReceiptContext 支持ctx超时和取消的GetTransactionReceipt
+func (wm *WalletManager) GetTransactionReceiptContext(ctx context.Context, transactionId string) (*TransactionReceipt, error) {
 	params := []interface{}{
 		transactionId,
 	}
 
 	var ethReceipt *types.Receipt
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_getTransactionReceipt", params)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getTransactionReceipt", params)
 	if err != nil {
 		return nil, err
 	}
@@ -110,12 +142,17 @@ func (wm *WalletManager) GetTransactionReceipt(transactionId string) (*Transacti
 }
 
 func (wm *WalletManager) GetTransactionByHash(txid string) (*BlockTransaction, error) {
+	return wm.GetTransactionByHashContext(context.Background(), txid)
+}
+
+//GetTransactionByHashContext 支持ctx超时和取消的GetTransactionByHash
+func (wm *WalletManager) GetTransactionByHashContext(ctx context.Context, txid string) (*BlockTransaction, error) {
 	params := []interface{}{
 		AppendOxToAddress(txid),
 	}
 
 	var tx BlockTransaction
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_getTransactionByHash", params)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getTransactionByHash", params)
 	if err != nil {
 		return nil, err
 	}
@@ -135,13 +172,32 @@ func (wm *WalletManager) GetTransactionByHash(txid string) (*BlockTransaction, e
 }
 
 func (wm *WalletManager) GetBlockByNum(blockNum uint64, showTransactionSpec bool) (*EthBlock, error) {
+	return wm.GetBlockByNumContext(context.Background(), blockNum, showTransactionSpec)
+}
+
+//GetBlockByNumContext 支持ctx超时和取消的GetBlockByNum
+func (wm *WalletManager) GetBlockByNumContext(ctx context.Context, blockNum uint64, showTransactionSpec bool) (*EthBlock, error) {
+	return wm.getBlockContext(ctx, "_getBlockByNumber", hexutil.EncodeUint64(blockNum), showTransactionSpec)
+}
+
+//GetBlockByHash 按hash获取区块，包括已不在主链上的分叉区块
+func (wm *WalletManager) GetBlockByHash(blockHash string, showTransactionSpec bool) (*EthBlock, error) {
+	return wm.GetBlockByHashContext(context.Background(), blockHash, showTransactionSpec)
+}
+
+//GetBlockByHashContext 支持ctx超时和取消的GetBlockByHash
+func (wm *WalletManager) GetBlockByHashContext(ctx context.Context, blockHash string, showTransactionSpec bool) (*EthBlock, error) {
+	return wm.getBlockContext(ctx, "_getBlockByHash", blockHash, showTransactionSpec)
+}
+
+func (wm *WalletManager) getBlockContext(ctx context.Context, method string, block string, showTransactionSpec bool) (*EthBlock, error) {
 	params := []interface{}{
-		hexutil.EncodeUint64(blockNum),
+		block,
 		showTransactionSpec,
 	}
 	var ethBlock EthBlock
 
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_getBlockByNumber", params)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+method, params)
 	if err != nil {
 		return nil, err
 	}
@@ -158,6 +214,14 @@ func (wm *WalletManager) GetBlockByNum(blockNum uint64, showTransactionSpec bool
 	if err != nil {
 		return nil, err
 	}
+	ethBlock.BlockTime, err = hexutil.DecodeUint64(ethBlock.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	//区块内的交易使用区块时间作为确认时间
+	for _, tx := range ethBlock.Transactions {
+		tx.BlockTime = ethBlock.BlockTime
+	}
 	return &ethBlock, nil
 }
 
@@ -175,6 +239,11 @@ func (wm *WalletManager) RecoverUnscannedTransactions(unscannedTxs []*openwallet
 
 // ERC20GetAddressBalance
 func (wm *WalletManager) ERC20GetAddressBalance(address string, contractAddr string) (*big.Int, error) {
+	return wm.ERC20GetAddressBalanceContext(context.Background(), address, contractAddr)
+}
+
+//ERC20GetAddressBalanceContext 支持ctx超时和取消的ERC20GetAddressBalance
+func (wm *WalletManager) ERC20GetAddressBalanceContext(ctx context.Context, address string, contractAddr string) (*big.Int, error) {
 
 	address = wm.CustomAddressDecodeFunc(address)
 	contractAddr = wm.CustomAddressDecodeFunc(contractAddr)
@@ -195,7 +264,7 @@ func (wm *WalletManager) ERC20GetAddressBalance(address string, contractAddr str
 		Value: big.NewInt(0),
 	}
 
-	result, err := wm.EthCall(callMsg, "latest")
+	result, err := wm.EthCallContext(ctx, callMsg, "latest")
 	if err != nil {
 		return nil, err
 	}
@@ -212,14 +281,57 @@ func (wm *WalletManager) ERC20GetAddressBalance(address string, contractAddr str
 
 }
 
+// ERC20GetAllowance 查询owner授权spender转出的代币额度
+func (wm *WalletManager) ERC20GetAllowance(owner string, spender string, contractAddr string) (*big.Int, error) {
+	return wm.ERC20GetAllowanceContext(context.Background(), owner, spender, contractAddr)
+}
+
+//ERC20GetAllowanceContext 支持ctx超时和取消的ERC20GetAllowance
+func (wm *WalletManager) ERC20GetAllowanceContext(ctx context.Context, owner string, spender string, contractAddr string) (*big.Int, error) {
+	owner = AppendOxToAddress(wm.CustomAddressDecodeFunc(owner))
+	spender = AppendOxToAddress(wm.CustomAddressDecodeFunc(spender))
+	contractAddr = AppendOxToAddress(wm.CustomAddressDecodeFunc(contractAddr))
+
+	data, err := wm.EncodeABIParam(ERC20_ABI, "allowance", owner, spender)
+	if err != nil {
+		return nil, err
+	}
+	callMsg := CallMsg{
+		From:  ethcom.HexToAddress(owner),
+		To:    ethcom.HexToAddress(contractAddr),
+		Data:  data,
+		Value: big.NewInt(0),
+	}
+
+	result, err := wm.EthCallContext(ctx, callMsg, "latest")
+	if err != nil {
+		return nil, err
+	}
+
+	rMap, _, err := wm.DecodeABIResult(ERC20_ABI, "allowance", result)
+	if err != nil {
+		return nil, err
+	}
+	allowance, ok := rMap[""].(*big.Int)
+	if !ok {
+		return big.NewInt(0), fmt.Errorf("allowance type is not big.Int ")
+	}
+	return allowance, nil
+}
+
 // GetAddrBalance
 func (wm *WalletManager) GetAddrBalance(address string, sign string) (*big.Int, error) {
+	return wm.GetAddrBalanceContext(context.Background(), address, sign)
+}
+
+//GetAddrBalanceContext 支持ctx超时和取消的GetAddrBalance
+func (wm *WalletManager) GetAddrBalanceContext(ctx context.Context, address string, sign string) (*big.Int, error) {
 	address = wm.CustomAddressDecodeFunc(address)
 	params := []interface{}{
 		AppendOxToAddress(address),
 		sign,
 	}
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_getBalance", params)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getBalance", params)
 	if err != nil {
 		return big.NewInt(0), err
 	}
@@ -231,10 +343,267 @@ func (wm *WalletManager) GetAddrBalance(address string, sign string) (*big.Int,
 	return balance, nil
 }
 
+// GetAddrBalanceBatch 批量查询地址余额，一次请求合并所有地址
+func (wm *WalletManager) GetAddrBalanceBatch(sign string, address ...string) ([]*big.Int, error) {
+	return wm.GetAddrBalanceBatchContext(context.Background(), sign, address...)
+}
+
+//GetAddrBalanceBatchContext 支持ctx超时和取消的GetAddrBalanceBatch
+func (wm *WalletManager) GetAddrBalanceBatchContext(ctx context.Context, sign string, address ...string) ([]*big.Int, error) {
+	method := strings.ToLower(wm.Config.Symbol) + "_getBalance"
+	elems := make([]*quorum_rpc.BatchElem, 0, len(address))
+	for _, addr := range address {
+		elems = append(elems, &quorum_rpc.BatchElem{
+			Method: method,
+			Params: []interface{}{AppendOxToAddress(wm.CustomAddressDecodeFunc(addr)), sign},
+		})
+	}
+
+	err := wm.WalletClient.CallBatchContext(ctx, elems)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make([]*big.Int, 0, len(elems))
+	for i, elem := range elems {
+		if elem.Error != nil {
+			return nil, fmt.Errorf("get address[%s] balance failed, err: %v", address[i], elem.Error)
+		}
+		balance, err := hexutil.DecodeBig(elem.Result.String())
+		if err != nil {
+			return nil, fmt.Errorf("get address[%s] balance failed, err: %v", address[i], err)
+		}
+		balances = append(balances, balance)
+	}
+	return balances, nil
+}
+
+// ERC20GetAddressBalanceBatch 批量查询地址的代币余额，一次请求合并所有地址
+func (wm *WalletManager) ERC20GetAddressBalanceBatch(contractAddr string, address ...string) ([]*big.Int, error) {
+	return wm.ERC20GetAddressBalanceBatchContext(context.Background(), contractAddr, address...)
+}
+
+//ERC20GetAddressBalanceBatchContext 支持ctx超时和取消的ERC20GetAddressBalanceBatch
+func (wm *WalletManager) ERC20GetAddressBalanceBatchContext(ctx context.Context, contractAddr string, address ...string) ([]*big.Int, error) {
+	contractAddr = AppendOxToAddress(wm.CustomAddressDecodeFunc(contractAddr))
+	method := strings.ToLower(wm.Config.Symbol) + "_call"
+	elems := make([]*quorum_rpc.BatchElem, 0, len(address))
+	for _, addr := range address {
+		addr = AppendOxToAddress(wm.CustomAddressDecodeFunc(addr))
+		data, err := wm.EncodeABIParam(ERC20_ABI, "balanceOf", addr)
+		if err != nil {
+			return nil, err
+		}
+		callMsg := CallMsg{
+			From:  ethcom.HexToAddress(addr),
+			To:    ethcom.HexToAddress(contractAddr),
+			Data:  data,
+			Value: big.NewInt(0),
+		}
+		elems = append(elems, &quorum_rpc.BatchElem{
+			Method: method,
+			Params: []interface{}{callMsgParam(callMsg), "latest"},
+		})
+	}
+
+	err := wm.WalletClient.CallBatchContext(ctx, elems)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make([]*big.Int, 0, len(elems))
+	for i, elem := range elems {
+		if elem.Error != nil {
+			return nil, fmt.Errorf("get address[%s] token balance failed, err: %v", address[i], elem.Error)
+		}
+		rMap, _, err := wm.DecodeABIResult(ERC20_ABI, "balanceOf", elem.Result.String())
+		if err != nil {
+			return nil, err
+		}
+		balance, ok := rMap[""].(*big.Int)
+		if !ok {
+			return nil, fmt.Errorf("balance type is not big.Int ")
+		}
+		balances = append(balances, balance)
+	}
+	return balances, nil
+}
+
+// GetTransactionReceiptBatch 批量获取交易回执，返回成功获取的回执，失败的交易不在结果中
+func (wm *WalletManager) GetTransactionReceiptBatch(txids ...string) (map[string]*TransactionReceipt, error) {
+	return wm.GetTransactionReceiptBatchContext(context.Background(), txids...)
+}
+
+//GetTransactionReceiptBatchContext 支持ctx超时和取消的GetTransactionReceiptBatch
+func (wm *WalletManager) GetTransactionReceiptBatchContext(ctx context.Context, txids ...string) (map[string]*TransactionReceipt, error) {
+	method := strings.ToLower(wm.Config.Symbol) + "_getTransactionReceipt"
+	elems := make([]*quorum_rpc.BatchElem, 0, len(txids))
+	for _, txid := range txids {
+		elems = append(elems, &quorum_rpc.BatchElem{
+			Method: method,
+			Params: []interface{}{txid},
+		})
+	}
+
+	err := wm.WalletClient.CallBatchContext(ctx, elems)
+	if err != nil {
+		return nil, err
+	}
+
+	receipts := make(map[string]*TransactionReceipt, len(elems))
+	for i, elem := range elems {
+		if elem.Error != nil {
+			wm.Log.Debugf("get transaction[%s] receipt failed, err: %v", txids[i], elem.Error)
+			continue
+		}
+		ethReceipt, err := UnmarshalReceiptJSON([]byte(elem.Result.Raw))
+		if err != nil {
+			wm.Log.Debugf("decode transaction[%s] receipt failed, err: %v", txids[i], err)
+			continue
+		}
+		receipts[txids[i]] = &TransactionReceipt{ETHReceipt: ethReceipt, Raw: elem.Result.Raw}
+	}
+	return receipts, nil
+}
+
+//GetBlockReceipts 一次获取区块内所有交易回执，按小写的交易hash索引
+func (wm *WalletManager) GetBlockReceipts(blockHash string) (map[string]*TransactionReceipt, error) {
+	return wm.GetBlockReceiptsContext(context.Background(), blockHash)
+}
+
+//GetBlockReceiptsContext 支持ctx超时和取消的GetBlockReceipts
+func (wm *WalletManager) GetBlockReceiptsContext(ctx context.Context, blockHash string) (map[string]*TransactionReceipt, error) {
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getBlockReceipts", []interface{}{blockHash})
+	if err != nil {
+		return nil, err
+	}
+	if !result.IsArray() {
+		return nil, fmt.Errorf("block[%s] receipts not found", blockHash)
+	}
+
+	receipts := make(map[string]*TransactionReceipt)
+	for _, raw := range result.Array() {
+		ethReceipt, err := UnmarshalReceiptJSON([]byte(raw.Raw))
+		if err != nil {
+			return nil, err
+		}
+		txid := strings.ToLower(raw.Get("transactionHash").String())
+		receipts[txid] = &TransactionReceipt{ETHReceipt: ethReceipt, Raw: raw.Raw}
+	}
+	return receipts, nil
+}
+
+//supportBlockReceipts 节点是否支持getBlockReceipts
+func (wm *WalletManager) supportBlockReceipts() bool {
+	return atomic.LoadInt32(&wm.blockReceiptsUnsupported) == 0
+}
+
+// GetERC20TokenMetadata 获取代币的名称、符号和精度，三个调用合并为一次请求。
+// 扫块和交易单应使用TokenRegistry的缓存，避免重复查询
+func (wm *WalletManager) GetERC20TokenMetadata(contractAddr string) (name string, symbol string, decimals uint8, err error) {
+	return wm.GetERC20TokenMetadataContext(context.Background(), contractAddr)
+}
+
+//GetERC20TokenMetadataContext 支持ctx超时和取消的GetERC20TokenMetadata。
+//name、symbol调用失败时为空，decimals调用失败或无法解码时返回错误，避免按0位精度计算金额
+func (wm *WalletManager) GetERC20TokenMetadataContext(ctx context.Context, contractAddr string) (name string, symbol string, decimals uint8, err error) {
+	return wm.getTokenMetadataContext(ctx, contractAddr, true)
+}
+
+//getTokenMetadataContext 查询代币的名称、符号和精度，NFT合约没有decimals，requireDecimals为false时精度为0
+func (wm *WalletManager) getTokenMetadataContext(ctx context.Context, contractAddr string, requireDecimals bool) (name string, symbol string, decimals uint8, err error) {
+	contractAddr = AppendOxToAddress(wm.CustomAddressDecodeFunc(contractAddr))
+	method := strings.ToLower(wm.Config.Symbol) + "_call"
+	abiMethods := []string{"name", "symbol", "decimals"}
+	elems := make([]*quorum_rpc.BatchElem, 0, len(abiMethods))
+	for _, abiMethod := range abiMethods {
+		data, encErr := wm.EncodeABIParam(ERC20_ABI, abiMethod)
+		if encErr != nil {
+			return "", "", 0, encErr
+		}
+		callMsg := CallMsg{
+			To:    ethcom.HexToAddress(contractAddr),
+			Data:  data,
+			Value: big.NewInt(0),
+		}
+		elems = append(elems, &quorum_rpc.BatchElem{
+			Method: method,
+			Params: []interface{}{callMsgParam(callMsg), "latest"},
+		})
+	}
+
+	err = wm.WalletClient.CallBatchContext(ctx, elems)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	var (
+		failed      = 0
+		decimalsErr error
+	)
+	for i, elem := range elems {
+		if elem.Error != nil {
+			wm.Log.Debugf("token[%s] call %s failed, err: %v", contractAddr, abiMethods[i], elem.Error)
+			failed++
+			if abiMethods[i] == "decimals" {
+				decimalsErr = elem.Error
+			}
+			continue
+		}
+		switch abiMethods[i] {
+		case "name":
+			name = decodeTokenString(elem.Result.String())
+		case "symbol":
+			symbol = decodeTokenString(elem.Result.String())
+		case "decimals":
+			rMap, _, decErr := wm.DecodeABIResult(ERC20_ABI, abiMethods[i], elem.Result.String())
+			if decErr != nil {
+				wm.Log.Debugf("token[%s] decode %s failed, err: %v", contractAddr, abiMethods[i], decErr)
+				decimalsErr = decErr
+				continue
+			}
+			value, ok := rMap[""].(uint8)
+			if !ok {
+				decimalsErr = fmt.Errorf("unexpected decimals result: %s", elem.Result.String())
+				continue
+			}
+			decimals = value
+		}
+	}
+	if failed == len(elems) {
+		return "", "", 0, fmt.Errorf("token[%s] metadata calls all failed", contractAddr)
+	}
+	if requireDecimals && decimalsErr != nil {
+		return "", "", 0, fmt.Errorf("token[%s] decimals is not available, err: %v", contractAddr, decimalsErr)
+	}
+	return name, symbol, decimals, nil
+}
+
+//decodeTokenString 解码name、symbol的返回值，早期代币返回bytes32而不是string
+func decodeTokenString(result string) string {
+	data, _ := hexutil.Decode(result)
+	if len(data) == 0 {
+		return ""
+	}
+	var value string
+	if err := ERC20_ABI.Unpack(&value, "name", data); err == nil {
+		return value
+	}
+	if len(data) == 32 {
+		return strings.TrimRight(string(data), "\x00")
+	}
+	return ""
+}
+
 // GetBlockNumber
 func (wm *WalletManager) GetBlockNumber() (uint64, error) {
+	return wm.GetBlockNumberContext(context.Background())
+}
+
+//GetBlockNumberContext 支持ctx超时和取消的GetBlockNumber
+func (wm *WalletManager) GetBlockNumberContext(ctx context.Context) (uint64, error) {
 	param := make([]interface{}, 0)
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_blockNumber", param)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_blockNumber", param)
 	if err != nil {
 		return 0, err
 	}
@@ -260,6 +629,21 @@ func (wm *WalletManager) GetTransactionFeeEstimated(from string, to string, valu
 		}
 	}
 
+	if wm.dynamicFeeEnabled() {
+		//动态手续费交易，按maxFeePerGas计算手续费上限
+		gasTip, maxFee, err := wm.GetDynamicFeeEstimated()
+		if err != nil {
+			return nil, err
+		}
+		feeInfo := &txFeeInfo{
+			GasLimit: gasLimit,
+			GasPrice: maxFee,
+			GasTip:   gasTip,
+		}
+		feeInfo.CalcFee()
+		return feeInfo, nil
+	}
+
 	if wm.Config.FixGasPrice.Cmp(big.NewInt(0)) > 0 {
 		//配置设置固定gasLimit
 		gasPrice = wm.Config.FixGasPrice
@@ -287,6 +671,11 @@ func (wm *WalletManager) GetTransactionFeeEstimated(from string, to string, valu
 
 // GetGasEstimated
 func (wm *WalletManager) GetGasEstimated(from string, to string, value *big.Int, data []byte) (*big.Int, error) {
+	return wm.GetGasEstimatedContext(context.Background(), from, to, value, data)
+}
+
+//GetGasEstimatedContext 支持ctx超时和取消的GetGasEstimated
+func (wm *WalletManager) GetGasEstimatedContext(ctx context.Context, from string, to string, value *big.Int, data []byte) (*big.Int, error) {
 	//toAddr := ethcom.HexToAddress(to)
 	callMsg := map[string]interface{}{
 		"from": wm.CustomAddressDecodeFunc(from),
@@ -298,7 +687,7 @@ func (wm *WalletManager) GetGasEstimated(from string, to string, value *big.Int,
 		callMsg["value"] = hexutil.EncodeBig(value)
 	}
 
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_estimateGas", []interface{}{callMsg})
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_estimateGas", []interface{}{callMsg})
 	if err != nil {
 		return big.NewInt(0), err
 	}
@@ -315,8 +704,13 @@ func (wm *WalletManager) GetGasEstimated(from string, to string, value *big.Int,
 }
 
 func (wm *WalletManager) GetGasPrice() (*big.Int, error) {
+	return wm.GetGasPriceContext(context.Background())
+}
 
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_gasPrice", []interface{}{})
+//GetGasPriceContext 支持ctx超时和取消的GetGasPrice
+func (wm *WalletManager) GetGasPriceContext(ctx context.Context) (*big.Int, error) {
+
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_gasPrice", []interface{}{})
 	if err != nil {
 		return big.NewInt(0), err
 	}
@@ -329,8 +723,13 @@ func (wm *WalletManager) GetGasPrice() (*big.Int, error) {
 }
 
 func (wm *WalletManager) SetNetworkChainID() (uint64, error) {
+	return wm.SetNetworkChainIDContext(context.Background())
+}
+
+//SetNetworkChainIDContext 支持ctx超时和取消的SetNetworkChainID
+func (wm *WalletManager) SetNetworkChainIDContext(ctx context.Context) (uint64, error) {
 
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_chainId", nil)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_chainId", nil)
 	if err != nil {
 		return 0, err
 	}
@@ -425,41 +824,107 @@ func (wm *WalletManager) DecodeReceiptLogResult(abiInstance abi.ABI, log types.L
 }
 
 func (wm *WalletManager) EthCall(callMsg CallMsg, sign string) (string, error) {
-	param := map[string]interface{}{
+	return wm.EthCallContext(context.Background(), callMsg, sign)
+}
+
+//EthCallContext 支持ctx超时和取消的EthCall
+func (wm *WalletManager) EthCallContext(ctx context.Context, callMsg CallMsg, sign string) (string, error) {
+	param := callMsgParam(callMsg)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_call", []interface{}{param, sign})
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// callMsgParam 合约调用请求参数
+func callMsgParam(callMsg CallMsg) map[string]interface{} {
+	return map[string]interface{}{
 		"from":  callMsg.From.String(),
 		"to":    callMsg.To.String(),
 		"value": hexutil.EncodeBig(callMsg.Value),
 		"data":  hexutil.Encode(callMsg.Data),
 	}
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_call", []interface{}{param, sign})
-	if err != nil {
-		return "", err
-	}
-	return result.String(), nil
 }
 
 // SendRawTransaction
 func (wm *WalletManager) SendRawTransaction(signedTx string) (string, error) {
+	return wm.SendRawTransactionContext(context.Background(), signedTx)
+}
+
+//SendRawTransactionContext 广播交易，网络错误时不盲目重发，先确认节点是否已收到该交易
+func (wm *WalletManager) SendRawTransactionContext(ctx context.Context, signedTx string) (string, error) {
 	params := []interface{}{
 		signedTx,
 	}
 
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_sendRawTransaction", params)
+	rawBytes, err := hexutil.Decode(AppendOxToAddress(signedTx))
 	if err != nil {
 		return "", err
 	}
+	//以太坊类型交易的哈希不包含Klaytn的0x78前缀
+	hashBytes := rawBytes
+	if IsDynamicFeeTx(rawBytes) {
+		hashBytes = rawBytes[1:]
+	}
+	txid := hexutil.Encode(owcrypt.Hash(hashBytes, 0, owcrypt.HASH_ALG_KECCAK256))
 
-	return result.String(), nil
+	backoff := wm.WalletClient.InitialBackoff()
+	for attempt := 0; ; attempt++ {
+		result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_sendRawTransaction", params)
+		if err == nil {
+			return result.String(), nil
+		}
+
+		//节点已经有这笔交易，视为广播成功
+		if quorum_rpc.IsKnownTransactionError(err) {
+			return txid, nil
+		}
+
+		if !quorum_rpc.IsTransportError(err) || attempt >= wm.WalletClient.MaxRetries {
+			return "", err
+		}
+
+		//网络错误时，交易可能已经到达节点，先查询再决定是否重发
+		known, _ := wm.IsKnownTransactionContext(ctx, txid)
+		if known {
+			return txid, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(backoff):
+		}
+		backoff = quorum_rpc.NextBackoff(backoff)
+	}
+}
+
+//IsKnownTransactionContext 节点是否已收到该交易，包括交易池中的交易
+func (wm *WalletManager) IsKnownTransactionContext(ctx context.Context, txid string) (bool, error) {
+	params := []interface{}{
+		AppendOxToAddress(txid),
+	}
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getTransactionByHash", params)
+	if err != nil {
+		return false, err
+	}
+	return result.IsObject(), nil
 }
 
 // IsContract 是否合约
 func (wm *WalletManager) IsContract(address string) (bool, error) {
+	return wm.IsContractContext(context.Background(), address)
+}
+
+//IsContractContext 支持ctx超时和取消的IsContract
+func (wm *WalletManager) IsContractContext(ctx context.Context, address string) (bool, error) {
 	params := []interface{}{
 		wm.CustomAddressDecodeFunc(address),
 		"latest",
 	}
 
-	result, err := wm.WalletClient.Call(strings.ToLower(wm.Config.Symbol)+"_getCode", params)
+	result, err := wm.WalletClient.CallContext(ctx, strings.ToLower(wm.Config.Symbol)+"_getCode", params)
 	if err != nil {
 		return false, err
 	}
@@ -473,6 +938,7 @@ func (wm *WalletManager) IsContract(address string) (bool, error) {
 }
 
 // GetAddressNonce
+//Deprecated: 构建交易使用NonceManager.Reserve分配nonce
 func (wm *WalletManager) GetAddressNonce(wrapper openwallet.WalletDAI, address string) uint64 {
 	var (
 		key           = wm.Symbol() + "-nonce"
@@ -514,6 +980,7 @@ func (wm *WalletManager) GetAddressNonce(wrapper openwallet.WalletDAI, address s
 }
 
 // UpdateAddressNonce
+//Deprecated: 广播结果由NonceManager.MarkBroadcast/MarkFailed记录
 func (wm *WalletManager) UpdateAddressNonce(wrapper openwallet.WalletDAI, address string, nonce uint64) {
 	key := wm.Symbol() + "-nonce"
 	err := wrapper.SetAddressExtParam(address, key, nonce)
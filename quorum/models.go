@@ -19,7 +19,6 @@ import (
 	"fmt"
 	"github.com/blocktree/openwallet/v2/common"
 	"github.com/ethereum/go-ethereum/accounts/abi"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	ethcom "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -46,6 +45,7 @@ var (
 type EthBlock struct {
 	BlockHeader
 	Transactions []*BlockTransaction `json:"transactions"`
+	consensus    *BlockConsensusInfo //预取的BFT共识信息
 }
 
 func (block *EthBlock) CreateOpenWalletBlockHeader() *openwallet.BlockHeader {
@@ -53,7 +53,7 @@ func (block *EthBlock) CreateOpenWalletBlockHeader() *openwallet.BlockHeader {
 		Hash:              block.BlockHash,
 		Previousblockhash: block.PreviousHash,
 		Height:            block.BlockHeight,
-		Time:              uint64(time.Now().Unix()),
+		Time:              block.BlockTime,
 	}
 	return header
 }
@@ -82,6 +82,7 @@ type TransactionReceipt struct {
 
 type TransferEvent struct {
 	ContractAddress string
+	Protocol        string //代币标准：kip7，kip17，kip37
 	TokenName       string
 	TokenSymbol     string
 	TokenDecimals   uint8
@@ -89,45 +90,21 @@ type TransferEvent struct {
 	TokenTo         string
 	From            ethcom.Address
 	To              ethcom.Address
+	TokenID         *big.Int //KIP17、KIP37的tokenId，KIP7为nil
 	Value           *big.Int
 }
 
+//ParseTransferEvent 解析回执中KIP7、KIP17、KIP37的转账事件，按合约地址分组
 func (receipt *TransactionReceipt) ParseTransferEvent() map[string][]*TransferEvent {
 	var (
 		transferEvents = make(map[string][]*TransferEvent)
-		err            error
 	)
 
-	bc := bind.NewBoundContract(ethcom.HexToAddress("0x0"), ERC20_ABI, nil, nil, nil)
 	for _, log := range receipt.ETHReceipt.Logs {
-
-		if len(log.Topics) != 3 {
-			continue
-		}
-
-		event, _ := ERC20_ABI.EventByID(log.Topics[0])
-		if event == nil || event.Name != "Transfer" {
-			continue
+		for _, transfer := range parseTransferLog(log) {
+			address := transfer.ContractAddress
+			transferEvents[address] = append(transferEvents[address], transfer)
 		}
-
-		address := strings.ToLower(log.Address.String())
-
-		var transfer TransferEvent
-		err = bc.UnpackLog(&transfer, "Transfer", *log)
-		if err != nil {
-			continue
-		}
-
-		events := transferEvents[address]
-		if events == nil {
-			events = make([]*TransferEvent, 0)
-		}
-		transfer.ContractAddress = address
-		transfer.TokenFrom = strings.ToLower(transfer.From.String())
-		transfer.TokenTo = strings.ToLower(transfer.To.String())
-
-		events = append(events, &transfer)
-		transferEvents[address] = events
 	}
 
 	return transferEvents
@@ -173,13 +150,69 @@ type BlockTransaction struct {
 	GasPrice         string `json:"gasPrice"`
 	Value            string `json:"value"`
 	Data             string `json:"input"`
+	Nonce            string `json:"nonce"`
 	TransactionIndex string `json:"transactionIndex"`
 	Timestamp        string `json:"timestamp"`
+	Type             string `json:"type"`     //Klaytn交易类型名称，如TxTypeValueTransfer
+	TypeInt          uint64 `json:"typeInt"`  //Klaytn交易类型编码
+	FeePayer         string `json:"feePayer"` //手续费代付地址
+	FeeRatio         string `json:"feeRatio"` //按比例代付时代付方承担的百分比
+	GasTipCap        string `json:"maxPriorityFeePerGas"`
+	GasFeeCap        string `json:"maxFeePerGas"`
 	BlockHeight      uint64 //transaction scanning 的时候对其进行赋值
+	BlockTime        uint64 //区块时间戳，transaction scanning 的时候对其进行赋值
 	FilterFunc       openwallet.BlockScanTargetFuncV2
 	Status           uint64 `json:"-"`
 	receipt          *TransactionReceipt
 	decimal          int32
+	internalTxs      []*InternalTransfer //合约执行中的内部转账，配置了追踪内部转账时赋值
+}
+
+//KlaytnTxType 交易类型，节点没有返回类型时为以太坊兼容交易
+func (this *BlockTransaction) KlaytnTxType() KlaytnTxType {
+	if this.TypeInt == ethereumDynamicFeeTypeInt {
+		return TxTypeEthereumDynamicFee
+	}
+	if this.TypeInt > 0 {
+		return KlaytnTxType(this.TypeInt)
+	}
+	txType, _ := ParseKlaytnTxType(this.Type)
+	return txType
+}
+
+//GetMemo 带备注转账的备注内容
+func (this *BlockTransaction) GetMemo() (string, bool) {
+	if this.KlaytnTxType().Base() != TxTypeValueTransferMemo {
+		return "", false
+	}
+	memo, err := hexutil.Decode(this.Data)
+	if err != nil {
+		return "", false
+	}
+	return string(memo), true
+}
+
+//GetExtParam 交易的扩展参数，记录Klaytn交易类型和备注
+func (this *BlockTransaction) GetExtParam() string {
+	txType := this.KlaytnTxType()
+	if txType == TxTypeLegacy {
+		return ""
+	}
+	ext := map[string]interface{}{
+		"txType": txType.String(),
+	}
+	if memo, ok := this.GetMemo(); ok {
+		ext["memo"] = memo
+	}
+	if txType.IsFeeDelegated() {
+		ext["feePayer"] = this.FeePayer
+		if txType.HasFeeRatio() {
+			feeRatio, _ := hexutil.DecodeUint64(this.FeeRatio)
+			ext["feeRatio"] = feeRatio
+		}
+	}
+	raw, _ := json.Marshal(ext)
+	return string(raw)
 }
 
 func (this *BlockTransaction) GetAmountEthString() string {
@@ -206,12 +239,16 @@ type BlockHeader struct {
 	Difficulty      string `json:"difficulty"`
 	TotalDifficulty string `json:"totalDifficulty"`
 	PreviousHash    string `json:"parentHash"`
+	Timestamp       string `json:"timestamp"`
+	BaseFeePerGas   string `json:"baseFeePerGas"` //Magma硬分叉后的基础手续费单价
 	BlockHeight     uint64 //RecoverBlockHeader的时候进行初始化
+	BlockTime       uint64 //区块时间戳，GetBlockByNum的时候进行初始化
 }
 
 type txFeeInfo struct {
 	GasLimit *big.Int
-	GasPrice *big.Int
+	GasPrice *big.Int //动态手续费交易为maxFeePerGas
+	GasTip   *big.Int //动态手续费交易的maxPriorityFeePerGas，其他交易为nil
 	Fee      *big.Int
 }
 
@@ -0,0 +1,344 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+)
+
+//本地跟踪的nonce状态
+const (
+	NonceStatusBuilt     = "built"     //已分配给构建的交易，未广播
+	NonceStatusBroadcast = "broadcast" //已广播，等待打包
+)
+
+const (
+	//DefaultNonceReservationTTL 已构建未广播的nonce超过此时间后释放
+	DefaultNonceReservationTTL = 10 * time.Minute
+)
+
+//trackedNonce 本地跟踪的nonce，打包后不再跟踪
+type trackedNonce struct {
+	Status   string
+	TxID     string
+	Replaced []string //被TxID替换的同一nonce的交易，按广播顺序
+	UpdateAt time.Time
+}
+
+//nonceAccount 单个地址的nonce，所有操作都持有地址锁
+type nonceAccount struct {
+	mu       sync.Mutex
+	next     uint64                   //下一个新分配的nonce
+	mined    uint64                   //链上latest的交易数，小于此值的nonce已打包
+	pending  uint64                   //链上pending的交易数，包括交易池中连续的交易
+	nonces   map[uint64]*trackedNonce //已分配未打包的nonce
+	released map[uint64]bool          //放弃构建而释放的nonce，优先再次分配
+}
+
+//NonceStatus 地址的nonce状态
+type NonceStatus struct {
+	Address   string
+	Mined     uint64   //链上已打包的交易数
+	Pending   uint64   //节点交易池可接着打包的nonce
+	Next      uint64   //下一个新分配的nonce
+	Built     []uint64 //已构建未广播
+	Broadcast []uint64 //已广播未打包
+	Released  []uint64 //已释放待再次分配
+	Gaps      []uint64 //节点缺少的nonce，会阻塞之后已广播的交易
+}
+
+//NonceManager 本地nonce管理，按地址加锁，构建交易时分配nonce，跟踪构建、广播和打包的状态，
+//并以节点pending的nonce校准，同一地址并发构建的交易不会重复或跳过nonce
+type NonceManager struct {
+	wm       *WalletManager
+	mu       sync.Mutex
+	accounts map[string]*nonceAccount
+}
+
+func NewNonceManager(wm *WalletManager) *NonceManager {
+	return &NonceManager{
+		wm:       wm,
+		accounts: make(map[string]*nonceAccount),
+	}
+}
+
+func (m *NonceManager) account(address string) *nonceAccount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(AppendOxToAddress(m.wm.CustomAddressDecodeFunc(address)))
+	acc, ok := m.accounts[key]
+	if !ok {
+		acc = &nonceAccount{
+			nonces:   make(map[uint64]*trackedNonce),
+			released: make(map[uint64]bool),
+		}
+		m.accounts[key] = acc
+	}
+	return acc
+}
+
+//sync 以链上nonce校准，已打包的不再跟踪，外部发送的交易占用的nonce不再分配
+func (m *NonceManager) sync(address string, acc *nonceAccount) error {
+	mined, err := m.wm.GetTransactionCount(address)
+	if err != nil {
+		return err
+	}
+	pending, err := m.wm.GetPendingTransactionCount(address)
+	if err != nil {
+		return err
+	}
+	acc.mined, acc.pending = mined, pending
+
+	for nonce := range acc.nonces {
+		if nonce < mined {
+			delete(acc.nonces, nonce)
+		}
+	}
+	for nonce := range acc.released {
+		if nonce < pending {
+			delete(acc.released, nonce)
+		}
+	}
+	if acc.next < pending {
+		acc.next = pending
+	}
+
+	//构建后一直没有广播的交易，超时后释放nonce，从大到小释放以便回退下一个分配的nonce
+	if ttl := m.wm.Config.NonceReservationTTL; ttl > 0 {
+		nonces := sortedTrackedNonces(acc.nonces)
+		for i := len(nonces) - 1; i >= 0; i-- {
+			t := acc.nonces[nonces[i]]
+			if nonces[i] >= pending && t.Status == NonceStatusBuilt && time.Since(t.UpdateAt) > ttl {
+				m.wm.Log.Warningf("address: %s nonce: %d is not broadcast in %v, released", address, nonces[i], ttl)
+				m.release(address, acc, nonces[i])
+			}
+		}
+	}
+	return nil
+}
+
+//Reserve 为地址构建的交易分配nonce，优先使用释放的nonce以免留下空缺
+func (m *NonceManager) Reserve(address string) (uint64, error) {
+
+	//NonceComputeMode = 1时，直接使用链上latest的nonce，不做本地跟踪
+	if m.wm.Config.NonceComputeMode == 1 {
+		return m.wm.GetTransactionCount(address)
+	}
+
+	acc := m.account(address)
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	if err := m.sync(address, acc); err != nil {
+		m.wm.Log.Errorf("address: %s sync nonce failed, err: %v", address, err)
+		return 0, err
+	}
+
+	nonce := acc.next
+	if released := sortedNonces(acc.released); len(released) > 0 {
+		nonce = released[0]
+		delete(acc.released, nonce)
+	} else {
+		acc.next++
+	}
+	acc.nonces[nonce] = &trackedNonce{Status: NonceStatusBuilt, UpdateAt: time.Now()}
+	m.wm.Log.Debugf("address: %s reserve nonce: %d", address, nonce)
+	return nonce, nil
+}
+
+//Release 放弃构建的交易时释放nonce，已广播的nonce不能释放
+func (m *NonceManager) Release(address string, nonce uint64) {
+	acc := m.account(address)
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	m.release(address, acc, nonce)
+}
+
+//release 释放已构建未广播的nonce，调用者持有地址锁
+func (m *NonceManager) release(address string, acc *nonceAccount, nonce uint64) {
+	if t, ok := acc.nonces[nonce]; !ok || t.Status != NonceStatusBuilt {
+		return
+	}
+	delete(acc.nonces, nonce)
+	m.wm.Log.Debugf("address: %s release nonce: %d", address, nonce)
+
+	if nonce+1 == acc.next {
+		//释放的是最后一个nonce，直接回退，连带回退之前释放的
+		acc.next--
+		for acc.next > acc.pending && acc.released[acc.next-1] {
+			acc.next--
+			delete(acc.released, acc.next)
+		}
+		return
+	}
+	if nonce < acc.next {
+		acc.released[nonce] = true
+	}
+}
+
+//MarkBroadcast 交易已广播
+func (m *NonceManager) MarkBroadcast(address string, nonce uint64, txid string) {
+	acc := m.account(address)
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	t := &trackedNonce{Status: NonceStatusBroadcast, TxID: txid, UpdateAt: time.Now()}
+	if prev, ok := acc.nonces[nonce]; ok && prev.Status == NonceStatusBroadcast {
+		//同一nonce再次广播，是加速或取消的替换交易
+		t.Replaced = prev.Replaced
+		switch {
+		case len(txid) == 0:
+			t.TxID = prev.TxID
+		case len(prev.TxID) > 0 && !strings.EqualFold(prev.TxID, txid):
+			t.Replaced = append(append([]string{}, prev.Replaced...), prev.TxID)
+		}
+	}
+	acc.nonces[nonce] = t
+	delete(acc.released, nonce)
+	if nonce >= acc.next {
+		//外部指定nonce的交易
+		acc.next = nonce + 1
+	}
+}
+
+//MarkFailed 交易广播失败，交易已存在时视为已广播；nonce错误时本地状态已与链上不一致，
+//丢弃未广播的分配，下次分配时重新以链上nonce校准；节点因余额不足、手续费过低、签名错误等原因拒绝时，
+//交易不会进入交易池，释放nonce以免之后的交易留下空缺；网络错误时交易可能已到达节点，保留分配
+func (m *NonceManager) MarkFailed(address string, nonce uint64, err error) {
+	if quorum_rpc.IsKnownTransactionError(err) {
+		m.MarkBroadcast(address, nonce, "")
+		return
+	}
+	if !quorum_rpc.IsNonceError(err) {
+		if _, rejected := err.(*quorum_rpc.RPCError); rejected {
+			m.Release(address, nonce)
+		}
+		return
+	}
+
+	acc := m.account(address)
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	acc.next = 0
+	for n, t := range acc.nonces {
+		if t.Status != NonceStatusBroadcast || n == nonce {
+			delete(acc.nonces, n)
+			continue
+		}
+		if n >= acc.next {
+			acc.next = n + 1
+		}
+	}
+	acc.released = make(map[uint64]bool)
+	m.wm.Log.Warningf("address: %s nonce: %d is rejected, local nonces are reset, err: %v", address, nonce, err)
+}
+
+//Replacements 同一nonce已广播的交易，按广播顺序，最后一个是最新的替换交易
+func (m *NonceManager) Replacements(address string, nonce uint64) []string {
+	acc := m.account(address)
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	t, ok := acc.nonces[nonce]
+	if !ok || t.Status != NonceStatusBroadcast {
+		return nil
+	}
+	txids := append([]string{}, t.Replaced...)
+	if len(t.TxID) > 0 {
+		txids = append(txids, t.TxID)
+	}
+	return txids
+}
+
+//Status 查询地址的nonce状态，包括阻塞之后交易的空缺
+func (m *NonceManager) Status(address string) (*NonceStatus, error) {
+	acc := m.account(address)
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+
+	if err := m.sync(address, acc); err != nil {
+		return nil, err
+	}
+
+	status := &NonceStatus{
+		Address:   address,
+		Mined:     acc.mined,
+		Pending:   acc.pending,
+		Next:      acc.next,
+		Built:     make([]uint64, 0),
+		Broadcast: make([]uint64, 0),
+		Released:  sortedNonces(acc.released),
+		Gaps:      make([]uint64, 0),
+	}
+
+	var (
+		maxBroadcast uint64
+		hasBroadcast bool
+	)
+	for _, nonce := range sortedTrackedNonces(acc.nonces) {
+		switch acc.nonces[nonce].Status {
+		case NonceStatusBuilt:
+			status.Built = append(status.Built, nonce)
+		case NonceStatusBroadcast:
+			status.Broadcast = append(status.Broadcast, nonce)
+			maxBroadcast, hasBroadcast = nonce, true
+		}
+	}
+
+	//节点pending的nonce之后还有已广播的交易，pending的nonce必然缺失，之后未广播的也是空缺
+	if hasBroadcast && maxBroadcast > acc.pending {
+		for nonce := acc.pending; nonce < maxBroadcast; nonce++ {
+			t, ok := acc.nonces[nonce]
+			if nonce == acc.pending || !ok || t.Status != NonceStatusBroadcast {
+				status.Gaps = append(status.Gaps, nonce)
+			}
+		}
+	}
+	return status, nil
+}
+
+//Gaps 查询地址阻塞之后交易的nonce空缺
+func (m *NonceManager) Gaps(address string) ([]uint64, error) {
+	status, err := m.Status(address)
+	if err != nil {
+		return nil, err
+	}
+	return status.Gaps, nil
+}
+
+func sortedNonces(set map[uint64]bool) []uint64 {
+	list := make([]uint64, 0, len(set))
+	for nonce := range set {
+		list = append(list, nonce)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+func sortedTrackedNonces(nonces map[uint64]*trackedNonce) []uint64 {
+	list := make([]uint64, 0, len(nonces))
+	for nonce := range nonces {
+		list = append(list, nonce)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
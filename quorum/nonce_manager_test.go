@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+)
+
+func TestNonceManager_ReserveOffline(t *testing.T) {
+	address := "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetNonce(address, 5)
+	nm := testNewFakeWalletManager(node).NonceManager
+
+	//同一地址并发构建，nonce连续且不重复
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		nonces = make(map[uint64]bool)
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nonce, err := nm.Reserve(address)
+			if err != nil {
+				t.Errorf("reserve failed: %v", err)
+				return
+			}
+			mu.Lock()
+			nonces[nonce] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	for nonce := uint64(5); nonce < 25; nonce++ {
+		if !nonces[nonce] {
+			t.Fatalf("nonce %d is not reserved, got %v", nonce, nonces)
+		}
+	}
+
+	//释放中间的nonce优先再次分配，释放最后的nonce直接回退
+	nm.Release(address, 10)
+	nm.Release(address, 24)
+	if nonce, _ := nm.Reserve(address); nonce != 10 {
+		t.Errorf("released nonce should be reused, got %d", nonce)
+	}
+	if nonce, _ := nm.Reserve(address); nonce != 24 {
+		t.Errorf("next nonce = %d, want 24", nonce)
+	}
+
+	//外部发送的交易已打包，分配从链上nonce开始
+	node.SetNonce(address, 40)
+	if nonce, _ := nm.Reserve(address); nonce != 40 {
+		t.Errorf("nonce should follow the chain, got %d", nonce)
+	}
+}
+
+func TestNonceManager_GapsOffline(t *testing.T) {
+	address := "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetNonce(address, 5)
+	nm := testNewFakeWalletManager(node).NonceManager
+
+	for i := 0; i < 5; i++ {
+		nm.Reserve(address)
+	}
+	//5、6在交易池中，7已广播但被节点丢弃，8未广播，9已广播
+	for _, nonce := range []uint64{5, 6} {
+		node.AddPendingTx(&quorum_rpc.FakeTx{From: address, Nonce: nonce})
+	}
+	for _, nonce := range []uint64{5, 6, 7, 9} {
+		nm.MarkBroadcast(address, nonce, "")
+	}
+
+	status, err := nm.Status(address)
+	if err != nil {
+		t.Fatalf("get nonce status failed: %v", err)
+	}
+	if status.Pending != 7 || !reflect.DeepEqual(status.Built, []uint64{8}) || !reflect.DeepEqual(status.Broadcast, []uint64{5, 6, 7, 9}) {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if !reflect.DeepEqual(status.Gaps, []uint64{7, 8}) {
+		t.Errorf("gaps = %v, want [7 8]", status.Gaps)
+	}
+
+	//已广播的nonce不能释放
+	nm.Release(address, 9)
+	if gaps, _ := nm.Gaps(address); len(gaps) != 2 {
+		t.Errorf("broadcast nonce should not be released, gaps: %v", gaps)
+	}
+
+	//nonce错误时丢弃未广播的分配
+	nm.MarkFailed(address, 9, &quorum_rpc.RPCError{Code: -32000, Message: "nonce too low"})
+	status, _ = nm.Status(address)
+	if len(status.Built) != 0 || status.Next != 8 || len(status.Gaps) != 0 {
+		t.Errorf("unexpected status after nonce error: %+v", status)
+	}
+}
+
+func TestNonceManager_ReleaseRejectedOffline(t *testing.T) {
+	address := "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetNonce(address, 5)
+	nm := testNewFakeWalletManager(node).NonceManager
+
+	//节点拒绝的交易释放nonce，下次分配同一个
+	nonce, _ := nm.Reserve(address)
+	nm.MarkFailed(address, nonce, &quorum_rpc.RPCError{Code: -32000, Message: "insufficient funds for gas * price + value"})
+	if next, _ := nm.Reserve(address); next != nonce {
+		t.Fatalf("rejected nonce should be reserved again, got %d, want %d", next, nonce)
+	}
+
+	//网络错误时交易可能已到达节点，保留分配
+	nm.MarkFailed(address, nonce, &quorum_rpc.TransportError{URL: "fake", Err: io.ErrUnexpectedEOF})
+	if next, _ := nm.Reserve(address); next != nonce+1 {
+		t.Errorf("nonce should be kept on transport error, got %d, want %d", next, nonce+1)
+	}
+
+	//构建后超时未广播的nonce被释放
+	acc := nm.account(address)
+	acc.nonces[nonce].UpdateAt = time.Now().Add(-DefaultNonceReservationTTL - time.Minute)
+	if next, _ := nm.Reserve(address); next != nonce {
+		t.Errorf("expired nonce should be reserved again, got %d, want %d", next, nonce)
+	}
+}
@@ -15,12 +15,16 @@
 package quorum
 
 import (
+	"fmt"
 	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
 	"github.com/astaxie/beego/config"
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"math/big"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 //FullName 币种全名
@@ -58,12 +62,48 @@ func (wm *WalletManager) GetBlockScanner() openwallet.BlockScanner {
 	return wm.Blockscanner
 }
 
-//LoadAssetsConfig 加载外部配置
+//LoadAssetsConfig 加载外部配置，不启动后台任务，加载后调用Start启动
 func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
+	//重新加载配置前停止已启动的后台任务
+	wm.Stop()
+
 	wm.Config.ServerAPI = c.String("serverAPI")
 	wm.Config.BroadcastAPI = c.String("broadcastAPI")
-	client := &quorum_rpc.Client{BaseURL: wm.Config.ServerAPI, BroadcastURL: wm.Config.BroadcastAPI, Debug: false}
+	wm.Config.ServerAPIs = make([]string, 0)
+	apiSet := make(map[string]bool)
+	for _, api := range append([]string{wm.Config.ServerAPI}, c.Strings("serverAPIs")...) {
+		api = strings.TrimSpace(api)
+		if len(api) > 0 && !apiSet[api] {
+			apiSet[api] = true
+			wm.Config.ServerAPIs = append(wm.Config.ServerAPIs, api)
+		}
+	}
+	if len(wm.Config.ServerAPI) == 0 && len(wm.Config.ServerAPIs) > 0 {
+		wm.Config.ServerAPI = wm.Config.ServerAPIs[0]
+	}
+	nodeMaxBlockLag, _ := c.Int64("nodeMaxBlockLag")
+	wm.Config.NodeMaxBlockLag = uint64(nodeMaxBlockLag)
+	nodeHealthCheckInterval, _ := c.Int64("nodeHealthCheckInterval")
+	wm.Config.NodeHealthCheckInterval = time.Duration(nodeHealthCheckInterval) * time.Second
+	rpcTimeout := c.DefaultInt64("rpcTimeout", int64(quorum_rpc.DefaultTimeout/time.Second))
+	wm.Config.RPCTimeout = time.Duration(rpcTimeout) * time.Second
+	wm.Config.RPCMaxRetries = c.DefaultInt("rpcMaxRetries", quorum_rpc.DefaultMaxRetries)
+	rpcRetryBackoff := c.DefaultInt64("rpcRetryBackoff", int64(quorum_rpc.DefaultRetryBackoff/time.Millisecond))
+	wm.Config.RPCRetryBackoff = time.Duration(rpcRetryBackoff) * time.Millisecond
+	client := quorum_rpc.NewClient(wm.Config.ServerAPIs, wm.Config.BroadcastAPI, false)
+	client.Timeout = wm.Config.RPCTimeout
+	client.MaxRetries = wm.Config.RPCMaxRetries
+	client.RetryBackoff = wm.Config.RPCRetryBackoff
+	if client.Pool != nil {
+		if wm.Config.NodeMaxBlockLag > 0 {
+			client.Pool.MaxBlockLag = wm.Config.NodeMaxBlockLag
+		}
+	}
 	wm.WalletClient = client
+	wm.Config.ServerWS = c.String("serverWS")
+	if len(wm.Config.ServerWS) > 0 {
+		wm.WSClient = quorum_rpc.NewWSClient(wm.Config.ServerWS, strings.ToLower(wm.Config.Symbol))
+	}
 	wm.Config.DataDir = c.String("dataDir")
 	fixGasLimit := c.String("fixGasLimit")
 	wm.Config.FixGasLimit = new(big.Int)
@@ -75,10 +115,74 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	wm.Config.OffsetsGasPrice = new(big.Int)
 	wm.Config.OffsetsGasPrice.SetString(offsetsGasPrice, 10)
 	wm.Config.NonceComputeMode, _ = c.Int64("nonceComputeMode")
+	nonceReservationTTL := c.DefaultInt64("nonceReservationTTL", int64(DefaultNonceReservationTTL/time.Second))
+	wm.Config.NonceReservationTTL = time.Duration(nonceReservationTTL) * time.Second
+	wm.Config.TxPriceBump = uint64(c.DefaultInt64("txPriceBump", DefaultTxPriceBump))
+	txType, err := ParseKlaytnTxType(c.String("txType"))
+	if err != nil {
+		return err
+	}
+	wm.Config.TxType = txType
+	wm.Config.FeeDelegation = c.DefaultBool("feeDelegation", false)
+	maxFeePerGas := c.String("maxFeePerGas")
+	wm.Config.MaxFeePerGas = new(big.Int)
+	wm.Config.MaxFeePerGas.SetString(maxFeePerGas, 10)
+	maxPriorityFeePerGas := c.String("maxPriorityFeePerGas")
+	wm.Config.MaxPriorityFeePerGas = new(big.Int)
+	wm.Config.MaxPriorityFeePerGas.SetString(maxPriorityFeePerGas, 10)
+	wm.Config.BaseFeeMultiplier = uint64(c.DefaultInt64("baseFeeMultiplier", DefaultBaseFeeMultiplier))
+	wm.Config.BatchTransferContract = c.String("batchTransferContract")
+	tokenMetadataTTL := c.DefaultInt64("tokenMetadataTTL", int64(DefaultTokenMetadataTTL/time.Second))
+	wm.Config.TokenMetadataTTL = time.Duration(tokenMetadataTTL) * time.Second
+	wm.Config.CatchUpThreshold = uint64(c.DefaultInt64("catchUpThreshold", DefaultCatchUpThreshold))
+	wm.Config.CatchUpMaxWindow = c.DefaultInt("catchUpMaxWindow", DefaultCatchUpMaxWindow)
+	consensusMode, err := ParseConsensusMode(c.String("consensusMode"))
+	if err != nil {
+		return err
+	}
+	wm.Config.ConsensusMode = consensusMode
+	wm.Config.ScanMemPool = c.DefaultBool("scanMemPool", false)
+	if bs, ok := wm.Blockscanner.(*BlockScanner); ok {
+		bs.IsScanMemPool = wm.Config.ScanMemPool
+	}
+	wm.Config.TraceInternalTransfers = c.DefaultBool("traceInternalTransfers", false)
+	wm.Config.UnscanMaxAttempts = c.DefaultInt("unscanMaxAttempts", DefaultUnscanMaxAttempts)
+	unscanRetryInterval := c.DefaultInt64("unscanRetryInterval", int64(DefaultUnscanRetryInterval/time.Second))
+	wm.Config.UnscanRetryInterval = time.Duration(unscanRetryInterval) * time.Second
+	scanMode, err := ParseScanMode(c.String("scanMode"))
+	if err != nil {
+		return err
+	}
+	wm.Config.ScanMode = scanMode
+	wm.Config.LogScanContracts = splitConfigList(c.String("logScanContracts"))
+	wm.Config.LogScanAddresses = splitConfigList(c.String("logScanAddresses"))
+	if scanMode == ScanModeLogs && len(wm.Config.LogScanAddresses) == 0 {
+		return fmt.Errorf("scanMode = %s needs logScanAddresses", ScanModeLogs)
+	}
+	if bs, ok := wm.Blockscanner.(*BlockScanner); ok {
+		bs.SetLogScanAddresses(wm.Config.LogScanAddresses...)
+	}
+	wm.Config.LogScanRange = uint64(c.DefaultInt64("logScanRange", DefaultLogScanRange))
+	wm.Config.TrackBroadcasts = c.DefaultBool("trackBroadcasts", false)
+	wm.Config.BroadcastConfirmations = uint64(c.DefaultInt64("broadcastConfirmations", DefaultBroadcastConfirmations))
+	broadcastPollInterval := c.DefaultInt64("broadcastPollInterval", int64(DefaultBroadcastPollInterval/time.Second))
+	wm.Config.BroadcastPollInterval = time.Duration(broadcastPollInterval) * time.Second
+	wm.Config.BroadcastMaxRebroadcasts = c.DefaultInt("broadcastMaxRebroadcasts", DefaultBroadcastMaxRebroadcasts)
 
 	//数据文件夹
 	wm.Config.makeDataDir()
 
+	//代币元数据缓存保存在数据目录
+	wm.TokenRegistry.TTL = wm.Config.TokenMetadataTTL
+	if err := wm.TokenRegistry.Open(filepath.Join(wm.Config.DataDir, strings.ToLower(wm.Config.Symbol), "tokens.json")); err != nil {
+		return err
+	}
+
+	//已广播交易保存在数据目录，重启后继续追踪
+	if err := wm.BroadcastTracker.Open(filepath.Join(wm.Config.DataDir, strings.ToLower(wm.Config.Symbol), "broadcasts.json")); err != nil {
+		return err
+	}
+
 	chainID, err := c.Int64("chainID")
 	if err != nil {
 		//设置网络chainID
@@ -96,6 +200,35 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 
 }
 
+//Start 按配置启动后台任务，重复调用不会重复启动，不再使用时调用Stop停止
+func (wm *WalletManager) Start() {
+	if wm.WalletClient != nil {
+		wm.WalletClient.StartHealthCheck(strings.ToLower(wm.Config.Symbol)+"_blockNumber", wm.Config.NodeHealthCheckInterval)
+	}
+	if wm.Config.TrackBroadcasts {
+		wm.BroadcastTracker.Start()
+	}
+}
+
+//Stop 停止Start启动的后台任务
+func (wm *WalletManager) Stop() {
+	if wm.WalletClient != nil {
+		wm.WalletClient.StopHealthCheck()
+	}
+	wm.BroadcastTracker.Stop()
+}
+
+//splitConfigList 逗号分隔的配置项
+func splitConfigList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 //InitAssetsConfig 初始化默认配置
 func (wm *WalletManager) InitAssetsConfig() (config.Configer, error) {
 	return config.NewConfigData("ini", []byte(""))
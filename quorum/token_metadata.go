@@ -0,0 +1,211 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	//DefaultTokenMetadataTTL 代币元数据默认的刷新间隔
+	DefaultTokenMetadataTTL = 24 * time.Hour
+)
+
+//TokenMetadata 代币元数据
+type TokenMetadata struct {
+	Address   string `json:"address"`
+	Name      string `json:"name"`
+	Symbol    string `json:"symbol"`
+	Decimals  uint8  `json:"decimals"`
+	Manual    bool   `json:"manual"`    //手动设置的元数据，不会被刷新覆盖
+	UpdatedAt int64  `json:"updatedAt"` //最后一次从节点查询的时间
+}
+
+//TokenRegistry 代币元数据缓存，按合约地址索引，首次使用时从节点查询，超过TTL后刷新，持久化到数据目录
+type TokenRegistry struct {
+	Path string        //持久化文件，为空时只缓存在内存
+	TTL  time.Duration //刷新间隔，0表示不刷新
+
+	wm     *WalletManager
+	mu     sync.RWMutex
+	tokens map[string]*TokenMetadata
+}
+
+//NewTokenRegistry 创建内存中的代币元数据缓存
+func NewTokenRegistry(wm *WalletManager) *TokenRegistry {
+	return &TokenRegistry{
+		TTL:    DefaultTokenMetadataTTL,
+		wm:     wm,
+		tokens: make(map[string]*TokenMetadata),
+	}
+}
+
+//Open 从文件加载缓存，文件不存在时创建空缓存
+func (r *TokenRegistry) Open(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]*TokenMetadata)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+	for address, token := range tokens {
+		r.tokens[tokenRegistryKey(address)] = token
+	}
+	return nil
+}
+
+func tokenRegistryKey(contractAddr string) string {
+	return strings.ToLower(AppendOxToAddress(strings.TrimPrefix(contractAddr, "0x")))
+}
+
+//save 写入持久化文件，调用者需持有锁
+func (r *TokenRegistry) save() error {
+	if len(r.Path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.Path), os.ModePerm); err != nil {
+		return err
+	}
+	//先写临时文件再替换，避免进程中断时留下损坏的文件
+	tmp := r.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.Path)
+}
+
+//Get 获取代币元数据，缓存不存在或过期时从节点查询，查询失败时返回过期的缓存。
+//decimals查询失败时返回错误且不缓存，以免之后按0位精度计算金额
+func (r *TokenRegistry) Get(contractAddr string) (*TokenMetadata, error) {
+	return r.GetContext(context.Background(), contractAddr)
+}
+
+//GetContext 支持ctx超时和取消的Get
+func (r *TokenRegistry) GetContext(ctx context.Context, contractAddr string) (*TokenMetadata, error) {
+	return r.get(ctx, contractAddr, true)
+}
+
+//GetNFT 获取NFT合约的元数据，NFT没有decimals，只需要name、symbol
+func (r *TokenRegistry) GetNFT(contractAddr string) (*TokenMetadata, error) {
+	return r.get(context.Background(), contractAddr, false)
+}
+
+func (r *TokenRegistry) get(ctx context.Context, contractAddr string, requireDecimals bool) (*TokenMetadata, error) {
+	key := tokenRegistryKey(contractAddr)
+
+	r.mu.RLock()
+	cached, ok := r.tokens[key]
+	r.mu.RUnlock()
+	if ok && (cached.Manual || !r.expired(cached)) {
+		copied := *cached
+		return &copied, nil
+	}
+
+	name, symbol, decimals, err := r.wm.getTokenMetadataContext(ctx, contractAddr, requireDecimals)
+	if err != nil {
+		if ok {
+			r.wm.Log.Warningf("refresh token[%s] metadata failed, use cached, err: %v", contractAddr, err)
+			copied := *cached
+			return &copied, nil
+		}
+		return nil, err
+	}
+
+	token := &TokenMetadata{
+		Address:   key,
+		Name:      name,
+		Symbol:    symbol,
+		Decimals:  decimals,
+		UpdatedAt: time.Now().Unix(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	//查询期间可能被手动设置
+	if current, exist := r.tokens[key]; exist && current.Manual {
+		copied := *current
+		return &copied, nil
+	}
+	r.tokens[key] = token
+	if saveErr := r.save(); saveErr != nil {
+		r.wm.Log.Errorf("save token metadata failed, err: %v", saveErr)
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (r *TokenRegistry) expired(token *TokenMetadata) bool {
+	if r.TTL <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(token.UpdatedAt, 0)) > r.TTL
+}
+
+//Set 手动设置代币元数据，用于name()等调用不可用的合约，设置后不再从节点刷新
+func (r *TokenRegistry) Set(token *TokenMetadata) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	copied := *token
+	copied.Address = tokenRegistryKey(token.Address)
+	copied.Manual = true
+	copied.UpdatedAt = time.Now().Unix()
+	r.tokens[copied.Address] = &copied
+	return r.save()
+}
+
+//Delete 删除缓存的代币元数据，下次使用时重新查询
+func (r *TokenRegistry) Delete(contractAddr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.tokens, tokenRegistryKey(contractAddr))
+	return r.save()
+}
+
+//tokenDecimals 代币精度，合约没有设置精度时使用缓存的元数据，NFT没有精度
+func (wm *WalletManager) tokenDecimals(contract openwallet.SmartContract) int32 {
+	if contract.Decimals > 0 || isNFTProtocol(tokenProtocol(contract)) {
+		return int32(contract.Decimals)
+	}
+	token, err := wm.TokenRegistry.Get(contract.Address)
+	if err != nil {
+		wm.Log.Errorf("get token[%s] metadata failed, err: %v", contract.Address, err)
+		return 0
+	}
+	return int32(token.Decimals)
+}
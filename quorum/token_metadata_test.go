@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/tidwall/gjson"
+)
+
+//testTokenNode 统计klay_call次数的模拟节点，name()返回bytes32
+func testTokenNode(calls *int32, fail *int32) *quorum_rpc.FakeNode {
+	node := quorum_rpc.NewFakeNode(1001)
+	node.Handle("klay_call", func(params gjson.Result) (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		if atomic.LoadInt32(fail) > 0 {
+			return nil, &quorum_rpc.RPCError{Code: -32000, Message: "execution reverted"}
+		}
+		switch params.Get("0.data").String() {
+		case "0x06fdde03":
+			return "0x" + hex.EncodeToString([]byte("Maker")) + strings.Repeat("0", 54), nil
+		case "0x95d89b41":
+			return "0x" + abiWord("20") + abiWord("3") + hex.EncodeToString([]byte("MKR")) + strings.Repeat("0", 58), nil
+		case "0x313ce567":
+			return "0x" + abiWord("12"), nil
+		}
+		return nil, &quorum_rpc.RPCError{Code: -32000, Message: "execution reverted"}
+	})
+	return node
+}
+
+func TestTokenRegistry_Get(t *testing.T) {
+	var calls, fail int32
+	contract := "0x9f8f72aa9304c8b593d555f12ef6589cc3a579a2"
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "klay", "tokens.json")
+
+	wm := testNewFakeWalletManager(testTokenNode(&calls, &fail))
+	if err := wm.TokenRegistry.Open(path); err != nil {
+		t.Fatalf("open registry failed, err: %v", err)
+	}
+
+	token, err := wm.TokenRegistry.Get(contract)
+	if err != nil {
+		t.Fatalf("get token failed, err: %v", err)
+	}
+	if token.Name != "Maker" || token.Symbol != "MKR" || token.Decimals != 18 {
+		t.Errorf("unexpected token: %+v", token)
+	}
+	if _, err := wm.TokenRegistry.Get(strings.ToUpper(contract[2:])); err != nil || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("cached token should not call node again, calls: %d", calls)
+	}
+
+	//重新加载文件后不需要查询节点
+	reloaded := testNewFakeWalletManager(testTokenNode(&calls, &fail))
+	if err := reloaded.TokenRegistry.Open(path); err != nil {
+		t.Fatalf("reopen registry failed, err: %v", err)
+	}
+	if token, err := reloaded.TokenRegistry.Get(contract); err != nil || token.Symbol != "MKR" || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("persisted token should be loaded, calls: %d, err: %v", calls, err)
+	}
+
+	//过期后刷新，节点不可用时使用过期的缓存
+	reloaded.TokenRegistry.TTL = time.Nanosecond
+	atomic.StoreInt32(&fail, 1)
+	if token, err := reloaded.TokenRegistry.Get(contract); err != nil || token.Symbol != "MKR" || atomic.LoadInt32(&calls) != 6 {
+		t.Errorf("expired token should be refreshed and fall back to cache, calls: %d, err: %v", calls, err)
+	}
+	if _, err := reloaded.TokenRegistry.Get("0x0000000000000000000000000000000000000001"); err == nil {
+		t.Errorf("unknown token should fail when all calls fail")
+	}
+
+	//手动设置的元数据不会刷新
+	if err := reloaded.TokenRegistry.Set(&TokenMetadata{Address: contract, Name: "Maker Token", Symbol: "MKR", Decimals: 18}); err != nil {
+		t.Fatalf("set token failed, err: %v", err)
+	}
+	calls = 0
+	if token, err := reloaded.TokenRegistry.Get(contract); err != nil || token.Name != "Maker Token" || !token.Manual || calls != 0 {
+		t.Errorf("manual token should not be refreshed, token: %+v, calls: %d", token, calls)
+	}
+}
+
+func TestTokenRegistry_GetWithoutDecimals(t *testing.T) {
+	contract := "0x9f8f72aa9304c8b593d555f12ef6589cc3a579a2"
+	node := quorum_rpc.NewFakeNode(1001)
+	node.Handle("klay_call", func(params gjson.Result) (interface{}, error) {
+		switch params.Get("0.data").String() {
+		case "0x95d89b41":
+			return "0x" + abiWord("20") + abiWord("3") + hex.EncodeToString([]byte("NFT")) + strings.Repeat("0", 58), nil
+		case "0x313ce567":
+			return "0x", nil
+		}
+		return nil, &quorum_rpc.RPCError{Code: -32000, Message: "execution reverted"}
+	})
+	wm := testNewFakeWalletManager(node)
+
+	//decimals无法解码时不能按0位精度缓存
+	if _, err := wm.TokenRegistry.Get(contract); err == nil {
+		t.Fatalf("token without decimals should fail")
+	}
+	if _, err := wm.TokenRegistry.Get(contract); err == nil {
+		t.Errorf("token without decimals should not be cached")
+	}
+
+	//NFT只需要name、symbol
+	token, err := wm.TokenRegistry.GetNFT(contract)
+	if err != nil || token.Symbol != "NFT" || token.Decimals != 0 {
+		t.Errorf("unexpected nft token: %+v, err: %v", token, err)
+	}
+}
+
+func TestDecodeTokenString(t *testing.T) {
+	tests := map[string]string{
+		"0x" + abiWord("20") + abiWord("4") + "46555149" + strings.Repeat("0", 56): "FUQI",
+		"0x" + hex.EncodeToString([]byte("DAI")) + strings.Repeat("0", 58):         "DAI",
+		"0x": "",
+	}
+	for result, want := range tests {
+		if got := decodeTokenString(result); got != want {
+			t.Errorf("decodeTokenString(%s) = %q, want %q", result, got, want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/common"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+//Klaytn代币标准
+const (
+	ProtocolKIP7  = "kip7"  //同质化代币，兼容ERC20
+	ProtocolKIP17 = "kip17" //非同质化代币，兼容ERC721
+	ProtocolKIP37 = "kip37" //多代币，兼容ERC1155
+)
+
+const (
+	KIP17_ABI_JSON = `[{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":true,"name":"tokenId","type":"uint256"}],"name":"Transfer","type":"event"},{"constant":true,"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[],"name":"symbol","outputs":[{"name":"","type":"string"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[{"name":"owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[{"name":"tokenId","type":"uint256"}],"name":"ownerOf","outputs":[{"name":"","type":"address"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":false,"inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"tokenId","type":"uint256"}],"name":"safeTransferFrom","outputs":[],"payable":false,"stateMutability":"nonpayable","type":"function"}]`
+	KIP37_ABI_JSON = `[{"anonymous":false,"inputs":[{"indexed":true,"name":"operator","type":"address"},{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"id","type":"uint256"},{"indexed":false,"name":"value","type":"uint256"}],"name":"TransferSingle","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"name":"operator","type":"address"},{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"ids","type":"uint256[]"},{"indexed":false,"name":"values","type":"uint256[]"}],"name":"TransferBatch","type":"event"},{"constant":true,"inputs":[{"name":"account","type":"address"},{"name":"id","type":"uint256"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[{"name":"accounts","type":"address[]"},{"name":"ids","type":"uint256[]"}],"name":"balanceOfBatch","outputs":[{"name":"","type":"uint256[]"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":false,"inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"id","type":"uint256"},{"name":"amount","type":"uint256"},{"name":"data","type":"bytes"}],"name":"safeTransferFrom","outputs":[],"payable":false,"stateMutability":"nonpayable","type":"function"}]`
+)
+
+var (
+	KIP17_ABI, _ = abi.JSON(strings.NewReader(KIP17_ABI_JSON))
+	KIP37_ABI, _ = abi.JSON(strings.NewReader(KIP37_ABI_JSON))
+
+	transferEventID       = ERC20_ABI.Events["Transfer"].ID()
+	transferSingleEventID = KIP37_ABI.Events["TransferSingle"].ID()
+	transferBatchEventID  = KIP37_ABI.Events["TransferBatch"].ID()
+)
+
+//tokenProtocol 合约的代币标准，没有设置时按KIP7处理
+func tokenProtocol(contract openwallet.SmartContract) string {
+	switch strings.ToLower(contract.Protocol) {
+	case ProtocolKIP17, "erc721":
+		return ProtocolKIP17
+	case ProtocolKIP37, "erc1155":
+		return ProtocolKIP37
+	}
+	return ProtocolKIP7
+}
+
+//isNFTProtocol 代币是否有tokenId
+func isNFTProtocol(protocol string) bool {
+	return protocol == ProtocolKIP17 || protocol == ProtocolKIP37
+}
+
+//parseTransferLog 解析日志中的代币转账事件，KIP37批量转账会返回多个事件
+func parseTransferLog(log *types.Log) []*TransferEvent {
+	if len(log.Topics) == 0 {
+		return nil
+	}
+	address := strings.ToLower(log.Address.String())
+	topics := log.Topics
+
+	var events []*TransferEvent
+	switch {
+	case topics[0] == transferEventID && len(topics) == 3:
+		//KIP7: Transfer(address indexed from, address indexed to, uint256 value)
+		var transfer TransferEvent
+		bc := bind.NewBoundContract(ethcom.HexToAddress("0x0"), ERC20_ABI, nil, nil, nil)
+		if err := bc.UnpackLog(&transfer, "Transfer", *log); err != nil {
+			return nil
+		}
+		transfer.Protocol = ProtocolKIP7
+		events = append(events, &transfer)
+	case topics[0] == transferEventID && len(topics) == 4:
+		//KIP17: Transfer(address indexed from, address indexed to, uint256 indexed tokenId)
+		events = append(events, &TransferEvent{
+			Protocol: ProtocolKIP17,
+			From:     ethcom.BytesToAddress(topics[1].Bytes()),
+			To:       ethcom.BytesToAddress(topics[2].Bytes()),
+			TokenID:  topics[3].Big(),
+			Value:    big.NewInt(1),
+		})
+	case topics[0] == transferSingleEventID && len(topics) == 4:
+		var transfer struct {
+			Operator ethcom.Address
+			From     ethcom.Address
+			To       ethcom.Address
+			Id       *big.Int
+			Value    *big.Int
+		}
+		bc := bind.NewBoundContract(ethcom.HexToAddress("0x0"), KIP37_ABI, nil, nil, nil)
+		if err := bc.UnpackLog(&transfer, "TransferSingle", *log); err != nil {
+			return nil
+		}
+		events = append(events, &TransferEvent{
+			Protocol: ProtocolKIP37,
+			From:     transfer.From,
+			To:       transfer.To,
+			TokenID:  transfer.Id,
+			Value:    transfer.Value,
+		})
+	case topics[0] == transferBatchEventID && len(topics) == 4:
+		var transfer struct {
+			Operator ethcom.Address
+			From     ethcom.Address
+			To       ethcom.Address
+			Ids      []*big.Int
+			Values   []*big.Int
+		}
+		bc := bind.NewBoundContract(ethcom.HexToAddress("0x0"), KIP37_ABI, nil, nil, nil)
+		if err := bc.UnpackLog(&transfer, "TransferBatch", *log); err != nil || len(transfer.Ids) != len(transfer.Values) {
+			return nil
+		}
+		for i := range transfer.Ids {
+			events = append(events, &TransferEvent{
+				Protocol: ProtocolKIP37,
+				From:     transfer.From,
+				To:       transfer.To,
+				TokenID:  transfer.Ids[i],
+				Value:    transfer.Values[i],
+			})
+		}
+	}
+
+	for _, transfer := range events {
+		transfer.ContractAddress = address
+		transfer.TokenFrom = strings.ToLower(transfer.From.String())
+		transfer.TokenTo = strings.ToLower(transfer.To.String())
+	}
+	return events
+}
+
+// KIP17OwnerOf 查询NFT的持有地址
+func (wm *WalletManager) KIP17OwnerOf(contractAddr string, tokenID *big.Int) (string, error) {
+	data, err := KIP17_ABI.Pack("ownerOf", tokenID)
+	if err != nil {
+		return "", err
+	}
+	callMsg := CallMsg{
+		To:    ethcom.HexToAddress(AppendOxToAddress(wm.CustomAddressDecodeFunc(contractAddr))),
+		Data:  data,
+		Value: big.NewInt(0),
+	}
+	result, err := wm.EthCall(callMsg, "latest")
+	if err != nil {
+		return "", err
+	}
+	var owner ethcom.Address
+	if err := KIP17_ABI.Unpack(&owner, "ownerOf", ethcom.FromHex(result)); err != nil {
+		return "", err
+	}
+	return wm.CustomAddressEncodeFunc(strings.ToLower(owner.String())), nil
+}
+
+// KIP37BalanceOfBatch 查询多个地址持有tokenId的数量，一次调用balanceOfBatch
+func (wm *WalletManager) KIP37BalanceOfBatch(contractAddr string, tokenID *big.Int, address ...string) ([]*big.Int, error) {
+	accounts := make([]ethcom.Address, 0, len(address))
+	ids := make([]*big.Int, 0, len(address))
+	for _, addr := range address {
+		accounts = append(accounts, ethcom.HexToAddress(AppendOxToAddress(wm.CustomAddressDecodeFunc(addr))))
+		ids = append(ids, tokenID)
+	}
+	data, err := KIP37_ABI.Pack("balanceOfBatch", accounts, ids)
+	if err != nil {
+		return nil, err
+	}
+	callMsg := CallMsg{
+		To:    ethcom.HexToAddress(AppendOxToAddress(wm.CustomAddressDecodeFunc(contractAddr))),
+		Data:  data,
+		Value: big.NewInt(0),
+	}
+	result, err := wm.EthCall(callMsg, "latest")
+	if err != nil {
+		return nil, err
+	}
+	var balances []*big.Int
+	if err := KIP37_ABI.Unpack(&balances, "balanceOfBatch", ethcom.FromHex(result)); err != nil {
+		return nil, err
+	}
+	if len(balances) != len(address) {
+		return nil, fmt.Errorf("balanceOfBatch returns %d balances, except is: %d", len(balances), len(address))
+	}
+	return balances, nil
+}
+
+//nftTransferData NFT的safeTransferFrom调用数据
+func nftTransferData(protocol string, from, to ethcom.Address, tokenID, amount *big.Int) ([]byte, error) {
+	switch protocol {
+	case ProtocolKIP17:
+		return KIP17_ABI.Pack("safeTransferFrom", from, to, tokenID)
+	case ProtocolKIP37:
+		return KIP37_ABI.Pack("safeTransferFrom", from, to, tokenID, amount, []byte{})
+	}
+	return nil, fmt.Errorf("%s is not a NFT protocol", protocol)
+}
+
+//tokenIDFromExtParam 读取扩展参数中的tokenId，支持十进制和0x开头的十六进制
+func tokenIDFromExtParam(rawTx *openwallet.RawTransaction) (*big.Int, error) {
+	tokenID := rawTx.GetExtParam().Get("tokenId").String()
+	if len(tokenID) == 0 {
+		return nil, fmt.Errorf("tokenId is required")
+	}
+	id, ok := new(big.Int).SetString(tokenID, 0)
+	if !ok || id.Sign() < 0 {
+		return nil, fmt.Errorf("invalid tokenId: %s", tokenID)
+	}
+	return id, nil
+}
+
+//CreateNFTRawTransaction 创建KIP17、KIP37代币的safeTransferFrom交易单，ExtParam: {"tokenId": "1"}
+func (decoder *EthTransactionDecoder) CreateNFTRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+
+	var (
+		accountID       = rawTx.Account.AccountID
+		protocol        = tokenProtocol(rawTx.Coin.Contract)
+		contractAddress = rawTx.Coin.Contract.Address
+		findAddrBalance *AddrBalance
+		feeInfo         *txFeeInfo
+		callData        string
+		errBalance      string
+		amountStr, to   string
+	)
+
+	tokenID, err := tokenIDFromExtParam(rawTx)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+
+	if len(rawTx.To) != 1 {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "%s token transfer supports only one recipient", protocol)
+	}
+	for k, v := range rawTx.To {
+		to = k
+		amountStr = v
+		break
+	}
+
+	//NFT没有精度，KIP17每次只能转一个
+	amount := common.StringNumToBigIntWithExp(amountStr, 0)
+	if protocol == ProtocolKIP17 {
+		if amount.Sign() > 0 && amount.Cmp(big.NewInt(1)) != 0 {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "the amount of kip17 token should be 1")
+		}
+		amount = big.NewInt(1)
+		rawTx.To = map[string]string{to: "1"}
+	} else if amount.Sign() <= 0 {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "the amount of kip37 token should be greater than 0")
+	}
+
+	addresses, err := wrapper.GetAddressList(0, -1, "AccountID", accountID)
+	if err != nil {
+		return openwallet.NewError(openwallet.ErrAddressNotFound, err.Error())
+	}
+	if len(addresses) == 0 {
+		return openwallet.Errorf(openwallet.ErrAccountNotAddress, "[%s] have not addresses", accountID)
+	}
+
+	//找出持有tokenId的地址
+	holders := make(map[string]*big.Int)
+	switch protocol {
+	case ProtocolKIP17:
+		owner, ownerErr := decoder.wm.KIP17OwnerOf(contractAddress, tokenID)
+		if ownerErr != nil {
+			return openwallet.NewError(openwallet.ErrCallFullNodeAPIFailed, ownerErr.Error())
+		}
+		holders[owner] = big.NewInt(1)
+	case ProtocolKIP37:
+		searchAddrs := make([]string, 0, len(addresses))
+		for _, address := range addresses {
+			searchAddrs = append(searchAddrs, address.Address)
+		}
+		balances, balanceErr := decoder.wm.KIP37BalanceOfBatch(contractAddress, tokenID, searchAddrs...)
+		if balanceErr != nil {
+			return openwallet.NewError(openwallet.ErrCallFullNodeAPIFailed, balanceErr.Error())
+		}
+		for i, balance := range balances {
+			holders[strings.ToLower(searchAddrs[i])] = balance
+		}
+	}
+
+	fd, err := feeDelegationFromExtParam(wrapper, rawTx.GetExtParam())
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+
+	for _, address := range addresses {
+		tokenBalance, ok := holders[strings.ToLower(address.Address)]
+		if !ok || tokenBalance.Cmp(amount) < 0 {
+			continue
+		}
+
+		from := ethcom.HexToAddress(AppendOxToAddress(decoder.wm.CustomAddressDecodeFunc(address.Address)))
+		data, createErr := nftTransferData(protocol, from, ethcom.HexToAddress(AppendOxToAddress(decoder.wm.CustomAddressDecodeFunc(to))), tokenID, amount)
+		if createErr != nil {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, createErr.Error())
+		}
+
+		//计算手续费
+		fee, createErr := decoder.wm.GetTransactionFeeEstimated(address.Address, contractAddress, nil, data)
+		if createErr != nil {
+			return createErr
+		}
+
+		if rawTx.FeeRate != "" {
+			fee.GasPrice = common.StringNumToBigIntWithExp(rawTx.FeeRate, decoder.wm.Decimal())
+			fee.CalcFee()
+		}
+
+		coinBalance, err := decoder.wm.GetAddrBalance(address.Address, "latest")
+		if err != nil {
+			continue
+		}
+
+		if coinBalance.Cmp(fd.senderFee(fee.Fee)) < 0 {
+			coinBalance := common.BigIntToDecimals(coinBalance, decoder.wm.Decimal())
+			errBalance = fmt.Sprintf("the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance.String())
+			continue
+		}
+
+		findAddrBalance = &AddrBalance{Address: address.Address, Balance: coinBalance, TokenBalance: tokenBalance}
+		feeInfo = fee
+		callData = hex.EncodeToString(data)
+		break
+	}
+
+	if findAddrBalance == nil {
+		if len(errBalance) > 0 {
+			return openwallet.Errorf(openwallet.ErrInsufficientFees, errBalance)
+		}
+		return openwallet.Errorf(openwallet.ErrInsufficientTokenBalanceOfAddress, "the account does not hold enough token [%s]", tokenID.String())
+	}
+
+	//最后创建交易单
+	createTxErr := decoder.createRawTransaction(
+		wrapper,
+		rawTx,
+		findAddrBalance,
+		feeInfo,
+		callData,
+		nil)
+	if createTxErr != nil {
+		return createTxErr
+	}
+
+	return nil
+}
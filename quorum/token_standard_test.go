@@ -0,0 +1,252 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
+)
+
+//testTokenWrapper 只有一个账户的钱包
+type testTokenWrapper struct {
+	openwallet.WalletDAIBase
+	addresses []*openwallet.Address
+}
+
+func (w *testTokenWrapper) GetAddress(address string) (*openwallet.Address, error) {
+	for _, addr := range w.addresses {
+		if addr.Address == address {
+			return addr, nil
+		}
+	}
+	return nil, openwallet.Errorf(openwallet.ErrAddressNotFound, "address not found")
+}
+
+func (w *testTokenWrapper) GetAddressList(offset, limit int, cols ...interface{}) ([]*openwallet.Address, error) {
+	if len(cols) > 2 {
+		return nil, nil
+	}
+	return w.addresses, nil
+}
+
+func TestTransactionReceipt_ParseTransferEvent(t *testing.T) {
+	var (
+		from     = ethcom.HexToAddress("0x3440f720862aa7dfd4f86ecc78542b3ded900c02")
+		to       = ethcom.HexToAddress("0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9")
+		kip7     = ethcom.HexToAddress("0x1000000000000000000000000000000000000007")
+		kip17    = ethcom.HexToAddress("0x1000000000000000000000000000000000000017")
+		kip37    = ethcom.HexToAddress("0x1000000000000000000000000000000000000037")
+		operator = ethcom.HexToAddress("0x2000000000000000000000000000000000000000")
+	)
+	word := func(v int64) ethcom.Hash {
+		return ethcom.BigToHash(big.NewInt(v))
+	}
+	batchData, _ := KIP37_ABI.Events["TransferBatch"].Inputs.NonIndexed().Pack(
+		[]*big.Int{big.NewInt(1), big.NewInt(2)}, []*big.Int{big.NewInt(10), big.NewInt(20)})
+
+	receipt := &TransactionReceipt{ETHReceipt: &types.Receipt{Logs: []*types.Log{
+		{Address: kip7, Topics: []ethcom.Hash{transferEventID, from.Hash(), to.Hash()}, Data: word(100).Bytes()},
+		{Address: kip17, Topics: []ethcom.Hash{transferEventID, from.Hash(), to.Hash(), word(7)}},
+		{Address: kip37, Topics: []ethcom.Hash{transferSingleEventID, operator.Hash(), from.Hash(), to.Hash()},
+			Data: append(word(3).Bytes(), word(5).Bytes()...)},
+		{Address: kip37, Topics: []ethcom.Hash{transferBatchEventID, operator.Hash(), from.Hash(), to.Hash()}, Data: batchData},
+	}}}
+
+	events := receipt.ParseTransferEvent()
+	check := func(contract ethcom.Address, protocol string, tokenIDs []int64, values []int64) {
+		list := events[strings.ToLower(contract.String())]
+		if len(list) != len(values) {
+			t.Errorf("%s events = %d, want %d", protocol, len(list), len(values))
+			return
+		}
+		for i, te := range list {
+			if te.Protocol != protocol || te.TokenFrom != strings.ToLower(from.String()) || te.TokenTo != strings.ToLower(to.String()) {
+				t.Errorf("%s event %d mismatch: %+v", protocol, i, te)
+			}
+			if te.Value.Int64() != values[i] {
+				t.Errorf("%s event %d value = %v, want %d", protocol, i, te.Value, values[i])
+			}
+			if tokenIDs == nil {
+				if te.TokenID != nil {
+					t.Errorf("%s event %d should not have tokenId", protocol, i)
+				}
+			} else if te.TokenID == nil || te.TokenID.Int64() != tokenIDs[i] {
+				t.Errorf("%s event %d tokenId = %v, want %d", protocol, i, te.TokenID, tokenIDs[i])
+			}
+		}
+	}
+	check(kip7, ProtocolKIP7, nil, []int64{100})
+	check(kip17, ProtocolKIP17, []int64{7}, []int64{1})
+	check(kip37, ProtocolKIP37, []int64{3, 1, 2}, []int64{5, 10, 20})
+}
+
+func TestBlockScanner_ExtractNFTTransactionOffline(t *testing.T) {
+	var (
+		from     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to       = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		contract = "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b"
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	//name() = symbol() = "FUQI"，KIP17没有decimals()
+	node.SetCallResult(contract, "0x06fdde03", "0x"+abiWord("20")+abiWord("4")+"46555149"+strings.Repeat("0", 56))
+	node.SetCallResult(contract, "0x95d89b41", "0x"+abiWord("20")+abiWord("4")+"46555149"+strings.Repeat("0", 56))
+	block := node.AddBlock(&quorum_rpc.FakeTx{
+		From:     from,
+		To:       contract,
+		Gas:      100000,
+		GasPrice: big.NewInt(25000000000),
+		GasUsed:  50000,
+		Logs: []*quorum_rpc.FakeLog{{
+			Address: contract,
+			Topics: []string{
+				transferEventID.Hex(),
+				"0x" + abiWord(from[2:]),
+				"0x" + abiWord(to[2:]),
+				"0x" + abiWord("2a"),
+			},
+			Data: "0x",
+		}},
+	})
+	wm := testNewFakeWalletManager(node)
+
+	scanTargetFunc := func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		if target.ScanTarget == to {
+			return openwallet.ScanTargetResult{SourceKey: "receiver", Exist: true}
+		}
+		return openwallet.ScanTargetResult{}
+	}
+	result, _, err := wm.GetBlockScanner().ExtractTransactionAndReceiptData(block.Transactions[0].Hash, scanTargetFunc)
+	if err != nil {
+		t.Fatalf("ExtractTransactionAndReceiptData failed, err=%v", err)
+	}
+	data := result["receiver"]
+	if len(data) != 1 || len(data[0].TxOutputs) != 1 {
+		t.Fatalf("unexpected extract data: %+v", data)
+	}
+	if output := data[0].TxOutputs[0]; output.Amount != "1" || output.Address != to {
+		t.Errorf("unexpected output: %+v", output)
+	}
+	tx := data[0].Transaction
+	if tx.Coin.Contract.Protocol != ProtocolKIP17 || tx.Coin.Contract.Decimals != 0 {
+		t.Errorf("unexpected token: %+v", tx.Coin.Contract)
+	}
+	if tokenID := gjson.Get(tx.ExtParam, "tokenIds.0").String(); tokenID != "42" {
+		t.Errorf("tokenId = %s, want 42", tokenID)
+	}
+
+	//输出的代币信息与交易一致，tokenId按输出的Index对应
+	output := data[0].TxOutputs[0]
+	if output.Coin.Contract.Protocol != ProtocolKIP17 || output.Coin.Contract.Token != "FUQI" || output.Coin.Contract.Decimals != 0 {
+		t.Errorf("unexpected output token: %+v", output.Coin.Contract)
+	}
+	if tokenID := gjson.Get(tx.ExtParam, fmt.Sprintf("tokenIds.%d", output.Index)).String(); tokenID != "42" {
+		t.Errorf("tokenId of output = %s, want 42", tokenID)
+	}
+}
+
+func TestEthTransactionDecoder_CreateNFTRawTransaction(t *testing.T) {
+	var (
+		from     = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		other    = "0x7d3f9a5ea1fd0cfd4b4d6f8c3ad1cc3a3b3f7a11"
+		to       = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		contract = "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b"
+		tokenID  = big.NewInt(9)
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetBalance(from, big.NewInt(1e18))
+	node.SetBalance(other, big.NewInt(1e18))
+
+	//KIP17: ownerOf(9) = from
+	ownerOf, _ := KIP17_ABI.Pack("ownerOf", tokenID)
+	node.SetCallResult(contract, hexutil.Encode(ownerOf), "0x"+abiWord(from[2:]))
+
+	//KIP37: other持有2个，from持有5个
+	balanceOfBatch, _ := KIP37_ABI.Pack("balanceOfBatch",
+		[]ethcom.Address{ethcom.HexToAddress(other), ethcom.HexToAddress(from)}, []*big.Int{tokenID, tokenID})
+	balances, _ := KIP37_ABI.Methods["balanceOfBatch"].Outputs.Pack([]*big.Int{big.NewInt(2), big.NewInt(5)})
+	node.SetCallResult(contract, hexutil.Encode(balanceOfBatch), hexutil.Encode(balances))
+
+	wm := testNewFakeWalletManager(node)
+	wm.Config.FixGasLimit = big.NewInt(0)
+	wm.Config.FixGasPrice = big.NewInt(0)
+	wm.Config.OffsetsGasPrice = big.NewInt(0)
+	wrapper := &testTokenWrapper{addresses: []*openwallet.Address{
+		{AccountID: "nft", Address: other},
+		{AccountID: "nft", Address: from},
+	}}
+
+	tests := []struct {
+		protocol string
+		amount   string
+		method   string
+		abi      []byte
+	}{
+		{ProtocolKIP17, "1", "safeTransferFrom", KIP17_ABI.Methods["safeTransferFrom"].ID()},
+		{ProtocolKIP37, "3", "safeTransferFrom", KIP37_ABI.Methods["safeTransferFrom"].ID()},
+	}
+	for _, test := range tests {
+		rawTx := &openwallet.RawTransaction{
+			Coin: openwallet.Coin{
+				Symbol:     "KLAY",
+				IsContract: true,
+				Contract:   openwallet.SmartContract{Address: contract, Protocol: test.protocol},
+			},
+			Account:  &openwallet.AssetsAccount{AccountID: "nft"},
+			To:       map[string]string{to: test.amount},
+			ExtParam: `{"tokenId": "9"}`,
+		}
+		if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+			t.Errorf("%s create raw transaction failed, err: %v", test.protocol, err)
+			continue
+		}
+		if len(rawTx.TxFrom) != 1 || !strings.HasPrefix(rawTx.TxFrom[0], from+":") {
+			t.Errorf("%s should be sent from the token holder, got %v", test.protocol, rawTx.TxFrom)
+		}
+		tx := &types.Transaction{}
+		if err := rlp.DecodeBytes(ethcom.FromHex(rawTx.RawHex), tx); err != nil {
+			t.Errorf("%s decode raw tx failed, err: %v", test.protocol, err)
+			continue
+		}
+		if !bytes.HasPrefix(tx.Data(), test.abi) || !strings.EqualFold(tx.To().Hex(), contract) {
+			t.Errorf("%s should call %s on the contract", test.protocol, test.method)
+		}
+	}
+
+	rawTx := &openwallet.RawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     "KLAY",
+			IsContract: true,
+			Contract:   openwallet.SmartContract{Address: contract, Protocol: ProtocolKIP37},
+		},
+		Account:  &openwallet.AssetsAccount{AccountID: "nft"},
+		To:       map[string]string{to: "6"},
+		ExtParam: `{"tokenId": "9"}`,
+	}
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err == nil {
+		t.Errorf("kip37 amount more than holdings should fail")
+	}
+}
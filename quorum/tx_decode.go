@@ -23,15 +23,15 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
 	"github.com/blocktree/openwallet/v2/common"
+	"github.com/blocktree/openwallet/v2/hdkeystore"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/shopspring/decimal"
 
 	"github.com/blocktree/go-owcrypt"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	ethcom "github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/rlp"
 )
 
 type EthTransactionDecoder struct {
@@ -47,6 +47,17 @@ func NewTransactionDecoder(wm *WalletManager) *EthTransactionDecoder {
 }
 
 func (decoder *EthTransactionDecoder) GetRawTransactionFeeRate() (feeRate string, unit string, err error) {
+	//动态手续费交易返回估算的maxFeePerGas
+	if decoder.wm.dynamicFeeEnabled() {
+		_, maxFee, err := decoder.wm.GetDynamicFeeEstimated()
+		if err != nil {
+			decoder.wm.Log.Errorf("get dynamic fee failed, err=%v", err)
+			return "", "MaxFeePerGas", err
+		}
+		maxFeeDecimal := common.BigIntToDecimals(maxFee, decoder.wm.Decimal())
+		return maxFeeDecimal.String(), "MaxFeePerGas", nil
+	}
+
 	price, err := decoder.wm.GetGasPrice()
 	if err != nil {
 		decoder.wm.Log.Errorf("get gas price failed, err=%v", err)
@@ -58,6 +69,11 @@ func (decoder *EthTransactionDecoder) GetRawTransactionFeeRate() (feeRate string
 }
 
 func (decoder *EthTransactionDecoder) CreateSimpleRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, tmpNonce *uint64) error {
+	return decoder.createSimpleRawTransaction(wrapper, rawTx, tmpNonce, nil)
+}
+
+//createSimpleRawTransaction 创建主币交易单，逐笔构建批量转账时spent记录各地址已分配的余额
+func (decoder *EthTransactionDecoder) createSimpleRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, tmpNonce *uint64, spent *batchSpent) error {
 
 	var (
 		accountID       = rawTx.Account.AccountID
@@ -95,6 +111,21 @@ func (decoder *EthTransactionDecoder) CreateSimpleRawTransaction(wrapper openwal
 
 	amount := common.StringNumToBigIntWithExp(amountStr, decoder.wm.Decimal())
 
+	//多个接收地址时调用批量转账合约，金额为合计
+	var callData []byte
+	if len(rawTx.To) > 1 {
+		to, amount, callData, err = decoder.batchTransferCall(rawTx)
+		if err != nil {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+		}
+		amountStr = common.BigIntToDecimals(amount, decoder.wm.Decimal()).String()
+	}
+
+	fd, err := feeDelegationFromExtParam(wrapper, rawTx.GetExtParam())
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+
 	//地址余额从大到小排序
 	sort.Slice(addrBalanceArray, func(i int, j int) bool {
 		a_amount, _ := decimal.NewFromString(addrBalanceArray[i].Balance)
@@ -108,11 +139,11 @@ func (decoder *EthTransactionDecoder) CreateSimpleRawTransaction(wrapper openwal
 
 	for _, addrBalance := range addrBalanceArray {
 
-		//检查余额是否超过最低转账
-		addrBalance_BI := common.StringNumToBigIntWithExp(addrBalance.Balance, decoder.wm.Decimal())
+		//检查余额是否超过最低转账，扣除批量转账中已分配的部分
+		addrBalance_BI := spent.coinAvailable(addrBalance.Address, common.StringNumToBigIntWithExp(addrBalance.Balance, decoder.wm.Decimal()))
 
 		//计算手续费
-		feeInfo, err = decoder.wm.GetTransactionFeeEstimated(addrBalance.Address, to, amount, nil)
+		feeInfo, err = decoder.wm.GetTransactionFeeEstimated(addrBalance.Address, to, amount, callData)
 		if err != nil {
 			//decoder.wm.Log.Std.Error("GetTransactionFeeEstimated from[%v] -> to[%v] failed, err=%v", addrBalance.Address, to, err)
 			continue
@@ -123,9 +154,9 @@ func (decoder *EthTransactionDecoder) CreateSimpleRawTransaction(wrapper openwal
 			feeInfo.CalcFee()
 		}
 
-		//总消耗数量 = 转账数量 + 手续费
+		//总消耗数量 = 转账数量 + 手续费，手续费代付时只计算发送者承担的部分
 		totalAmount := new(big.Int)
-		totalAmount.Add(amount, feeInfo.Fee)
+		totalAmount.Add(amount, fd.senderFee(feeInfo.Fee))
 
 		if addrBalance_BI.Cmp(totalAmount) < 0 {
 			continue
@@ -140,22 +171,35 @@ func (decoder *EthTransactionDecoder) CreateSimpleRawTransaction(wrapper openwal
 		return openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "the balance: %s is not enough", amountStr)
 	}
 
+	if tmpNonce == nil {
+		tmpNonce, err = spent.nonce(decoder.wm, findAddrBalance.Address)
+		if err != nil {
+			return openwallet.Errorf(openwallet.ErrNonceInvaild, "get address nonce failed, err: %v", err)
+		}
+	}
+
 	//最后创建交易单
 	createTxErr := decoder.createRawTransaction(
 		wrapper,
 		rawTx,
 		findAddrBalance,
 		feeInfo,
-		"",
+		hex.EncodeToString(callData),
 		tmpNonce)
 	if createTxErr != nil {
 		return createTxErr
 	}
+	spent.add(findAddrBalance.Address, new(big.Int).Add(amount, fd.senderFee(feeInfo.Fee)), nil, tmpNonce)
 
 	return nil
 }
 
 func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	return decoder.createErc20TokenRawTransaction(wrapper, rawTx, nil)
+}
+
+//createErc20TokenRawTransaction 创建代币交易单，逐笔构建批量转账时spent记录各地址已分配的余额
+func (decoder *EthTransactionDecoder) createErc20TokenRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, spent *batchSpent) error {
 
 	var (
 		accountID       = rawTx.Account.AccountID
@@ -163,10 +207,11 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper ope
 		feeInfo         *txFeeInfo
 		errBalance      string
 		errTokenBalance string
+		errAllowance    string
 		callData        string
 	)
 
-	tokenDecimals := int32(rawTx.Coin.Contract.Decimals)
+	tokenDecimals := decoder.wm.tokenDecimals(rawTx.Coin.Contract)
 	contractAddress := rawTx.Coin.Contract.Address
 
 	//获取wallet
@@ -197,6 +242,17 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper ope
 		break
 	}
 
+	//多个接收地址时调用批量转账合约，金额为合计
+	var batchData []byte
+	if len(rawTx.To) > 1 {
+		var batchAmount *big.Int
+		contractAddress, batchAmount, batchData, err = decoder.batchTransferCall(rawTx)
+		if err != nil {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+		}
+		amountStr = common.BigIntToDecimals(batchAmount, tokenDecimals).String()
+	}
+
 	//地址余额从大到小排序
 	sort.Slice(addrBalanceArray, func(i int, j int) bool {
 		a_amount, _ := decimal.NewFromString(addrBalanceArray[i].Balance.Balance)
@@ -208,14 +264,20 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper ope
 		}
 	})
 
+	fd, err := feeDelegationFromExtParam(wrapper, rawTx.GetExtParam())
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+
 	tokenBalanceNotEnough := false
+	allowanceNotEnough := false
 	balanceNotEnough := false
 
 	for _, addrBalance := range addrBalanceArray {
 		callData = ""
 
-		//检查余额是否超过最低转账
-		addrBalance_BI := common.StringNumToBigIntWithExp(addrBalance.Balance.Balance, tokenDecimals)
+		//检查余额是否超过最低转账，扣除批量转账中已分配的部分
+		addrBalance_BI := spent.tokenAvailable(addrBalance.Balance.Address, common.StringNumToBigIntWithExp(addrBalance.Balance.Balance, tokenDecimals))
 
 		amount := common.StringNumToBigIntWithExp(amountStr, tokenDecimals)
 
@@ -225,9 +287,27 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper ope
 			continue
 		}
 
-		data, createErr := decoder.wm.EncodeABIParam(ERC20_ABI, "transfer", decoder.wm.CustomAddressDecodeFunc(to), amount.String())
-		if createErr != nil {
-			continue
+		//批量转账合约通过transferFrom转出代币，需要先approve足够的额度
+		if batchData != nil {
+			allowance, allowErr := decoder.wm.ERC20GetAllowance(addrBalance.Balance.Address, contractAddress, rawTx.Coin.Contract.Address)
+			if allowErr != nil {
+				return openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, allowErr.Error())
+			}
+			if allowance.Cmp(amount) < 0 {
+				errAllowance = fmt.Sprintf("the token allowance: %s of %s to batch transfer contract: %s is not enough, approve it first",
+					common.BigIntToDecimals(allowance, tokenDecimals).String(), addrBalance.Balance.Address, contractAddress)
+				allowanceNotEnough = true
+				continue
+			}
+		}
+
+		data := batchData
+		if data == nil {
+			var createErr error
+			data, createErr = decoder.wm.EncodeABIParam(ERC20_ABI, "transfer", decoder.wm.CustomAddressDecodeFunc(to), amount.String())
+			if createErr != nil {
+				continue
+			}
 		}
 
 		//decoder.wm.Log.Debug("sumAmount:", sumAmount)
@@ -247,8 +327,9 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper ope
 		if err != nil {
 			continue
 		}
+		coinBalance = spent.coinAvailable(addrBalance.Balance.Address, coinBalance)
 
-		if coinBalance.Cmp(fee.Fee) < 0 {
+		if coinBalance.Cmp(fd.senderFee(fee.Fee)) < 0 {
 			coinBalance := common.BigIntToDecimals(coinBalance, decoder.wm.Decimal())
 			errBalance = fmt.Sprintf("the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance.String())
 			balanceNotEnough = true
@@ -263,12 +344,21 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper ope
 	}
 
 	if findAddrBalance == nil {
+		if allowanceNotEnough {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, errAllowance)
+		}
 		if tokenBalanceNotEnough {
 			return openwallet.Errorf(openwallet.ErrInsufficientTokenBalanceOfAddress, errTokenBalance)
 		}
 		if balanceNotEnough {
 			return openwallet.Errorf(openwallet.ErrInsufficientFees, errBalance)
 		}
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "no address is available to send the token")
+	}
+
+	tmpNonce, err := spent.nonce(decoder.wm, findAddrBalance.Address)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrNonceInvaild, "get address nonce failed, err: %v", err)
 	}
 
 	//最后创建交易单
@@ -278,19 +368,26 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper ope
 		findAddrBalance,
 		feeInfo,
 		callData,
-		nil)
+		tmpNonce)
 	if createTxErr != nil {
 		return createTxErr
 	}
+	spent.add(findAddrBalance.Address, fd.senderFee(feeInfo.Fee), common.StringNumToBigIntWithExp(amountStr, tokenDecimals), tmpNonce)
 
 	return nil
 }
 
-//CreateRawTransaction 创建交易单
+//CreateRawTransaction 创建交易单，多个接收地址需要配置批量转账合约，否则返回错误，不再只转给第一个接收地址
 func (decoder *EthTransactionDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	if len(rawTx.To) > 1 && len(decoder.wm.Config.BatchTransferContract) == 0 {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, errMultipleRecipients)
+	}
 	if !rawTx.Coin.IsContract {
 		return decoder.CreateSimpleRawTransaction(wrapper, rawTx, nil)
 	}
+	if isNFTProtocol(tokenProtocol(rawTx.Coin.Contract)) {
+		return decoder.CreateNFTRawTransaction(wrapper, rawTx)
+	}
 	return decoder.CreateErc20TokenRawTransaction(wrapper, rawTx)
 }
 
@@ -308,108 +405,111 @@ func (decoder *EthTransactionDecoder) SignRawTransaction(wrapper openwallet.Wall
 		return err
 	}
 
-	if _, exist := rawTx.Signatures[rawTx.Account.AccountID]; !exist {
-		decoder.wm.Log.Std.Error("wallet[%v] signature not found ", rawTx.Account.AccountID)
-		return openwallet.Errorf(openwallet.ErrSignRawTransactionFailed, "wallet signature not found ")
+	//多签账户的各个公钥、手续费代付方可能属于不同钱包，只签名当前钱包能签的部分
+	signed := 0
+	for accountID, keySignatures := range rawTx.Signatures {
+		for _, signnode := range keySignatures {
+			ok, signErr := decoder.signKeySignature(key, signnode)
+			if signErr != nil {
+				decoder.wm.Log.Error("signature failed in account[%v], err: %v", accountID, signErr)
+				return openwallet.NewError(openwallet.ErrSignRawTransactionFailed, signErr.Error())
+			}
+			if ok {
+				signed++
+			}
+		}
 	}
 
-	if len(rawTx.Signatures[rawTx.Account.AccountID]) != 1 {
-		decoder.wm.Log.Error("signature failed in account[%v].", rawTx.Account.AccountID)
+	if signed == 0 {
+		decoder.wm.Log.Error("wallet can not sign any signature of transaction")
 		return openwallet.Errorf(openwallet.ErrSignRawTransactionFailed, "signature failed in account.")
 	}
 
-	signnode := rawTx.Signatures[rawTx.Account.AccountID][0]
+	return nil
+}
+
+//signKeySignature 用钱包密钥签名，签名不能通过地址公钥验证说明地址不属于该钱包，不写入签名
+func (decoder *EthTransactionDecoder) signKeySignature(key *hdkeystore.HDKey, signnode *openwallet.KeySignature) (bool, error) {
 	fromAddr := signnode.Address
 
-	childKey, _ := key.DerivedKeyWithPath(fromAddr.HDPath, owcrypt.ECC_CURVE_SECP256K1)
+	//没有衍生路径的公钥不在钱包内，由外部签名
+	if len(fromAddr.HDPath) == 0 {
+		return false, nil
+	}
+
+	childKey, err := key.DerivedKeyWithPath(fromAddr.HDPath, owcrypt.ECC_CURVE_SECP256K1)
+	if err != nil {
+		return false, err
+	}
 	keyBytes, err := childKey.GetPrivateKeyBytes()
 	if err != nil {
 		//decoder.wm.Log.Error("get private key bytes, err=", err)
-		return openwallet.NewError(openwallet.ErrSignRawTransactionFailed, err.Error())
+		return false, err
 	}
 	//prikeyStr := common.ToHex(keyBytes)
 	//decoder.wm.Log.Debugf("pri:%v", common.ToHex(keyBytes))
 
 	message, err := hex.DecodeString(signnode.Message)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	signature, v, sigErr := owcrypt.Signature(keyBytes, nil, message, decoder.wm.CurveType())
 	if sigErr != owcrypt.SUCCESS {
-		return fmt.Errorf("transaction hash sign failed")
+		return false, fmt.Errorf("transaction hash sign failed")
 	}
 	signature = append(signature, v)
 
+	if len(fromAddr.PublicKey) > 0 && verifySignature(fromAddr.PublicKey, signnode.Message, signature) != nil {
+		return false, nil
+	}
+
 	signnode.Signature = hex.EncodeToString(signature)
 
 	//decoder.wm.Log.Debug("** pri:", hex.EncodeToString(keyBytes))
 	//decoder.wm.Log.Debug("** message:", signnode.Message)
 	//decoder.wm.Log.Debug("** Signature:", signnode.Signature)
 
-	return nil
+	return true, nil
 }
 
 // SubmitRawTransaction 广播交易单
 func (decoder *EthTransactionDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
 
-	if len(rawTx.Signatures) != 1 {
-		decoder.wm.Log.Std.Error("len of signatures error. ")
-		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "len of signatures error. ")
-	}
-
-	if _, exist := rawTx.Signatures[rawTx.Account.AccountID]; !exist {
+	if len(rawTx.Signatures) == 0 {
 		decoder.wm.Log.Std.Error("wallet[%v] signature not found ", rawTx.Account.AccountID)
 		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "wallet signature not found ")
 	}
 
-	from := rawTx.Signatures[rawTx.Account.AccountID][0].Address.Address
-	sig := rawTx.Signatures[rawTx.Account.AccountID][0].Signature
-
 	//decoder.wm.Log.Debug("rawTx.ExtParam:", rawTx.ExtParam)
 
-	signer := types.NewEIP155Signer(big.NewInt(int64(decoder.wm.Config.ChainID)))
-
 	rawHex, err := hex.DecodeString(rawTx.RawHex)
 	if err != nil {
 		decoder.wm.Log.Error("rawTx.RawHex decode failed, err:", err)
 		return nil, err
 	}
 
-	tx := &types.Transaction{}
-	err = rlp.DecodeBytes(rawHex, tx)
-	if err != nil {
-		decoder.wm.Log.Error("transaction RLP decode failed, err:", err)
-		return nil, err
-	}
-
-	//tx := types.NewTransaction(nonceSigned, ethcom.HexToAddress(to),
-	//	amount, gaslimit.Uint64(), gasPrice, nil)
-	tx, err = tx.WithSignature(signer, ethcom.FromHex(sig))
+	//以太坊兼容交易和Klaytn类型交易都在这里加入签名，多签和手续费代付交易会有多个签名
+	rawTxPara, from, txNonce, err := decoder.wm.signRawTxWithKeySignatures(rawHex, rawTx.Signatures)
 	if err != nil {
 		decoder.wm.Log.Std.Error("tx with signature failed, err=%v ", err)
-		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "tx with signature failed. ")
-	}
-
-	//txstr, _ := json.MarshalIndent(tx, "", " ")
-	//decoder.wm.Log.Debug("**after signed txStr:", string(txstr))
-
-	rawTxPara, err := rlp.EncodeToBytes(tx)
-	if err != nil {
-		decoder.wm.Log.Std.Error("encode tx to rlp failed, err=%v ", err)
-		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "encode tx to rlp failed. ")
+		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "tx with signature failed. err: %v", err)
 	}
 
 	txid, err := decoder.wm.SendRawTransaction(hexutil.Encode(rawTxPara))
 	if err != nil {
 		decoder.wm.Log.Std.Error("sent raw tx faild, err=%v", err)
-		//交易失败重置地址nonce
-		decoder.wm.UpdateAddressNonce(wrapper, from, 0)
-		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "sent raw tx faild. unexpected error: %v", err)
+		//nonce错误时重置本地分配，节点拒绝时释放nonce，网络错误时保留分配；替换交易被拒绝时原交易仍在交易池，不影响本地分配
+		if !rawTx.GetExtParam().Get("replaceTxID").Exists() {
+			decoder.wm.NonceManager.MarkFailed(from, txNonce, err)
+		}
+		return nil, openwallet.Errorf(quorum_rpc.OpenwalletErrorCode(err, openwallet.ErrSubmitRawTransactionFailed), "sent raw tx faild. unexpected error: %v", err)
 	}
 
-	//交易成功，地址nonce+1并记录到缓存
-	decoder.wm.UpdateAddressNonce(wrapper, from, tx.Nonce()+1)
+	decoder.wm.NonceManager.MarkBroadcast(from, txNonce, txid)
+	if decoder.wm.Config.TrackBroadcasts {
+		decoder.wm.BroadcastTracker.Track(txid, from, txNonce, rawTxPara, rawTx.GetExtParam().Get("replaceTxID").String())
+	}
 
 	rawTx.TxID = txid
 	rawTx.IsSubmit = true
@@ -419,7 +519,7 @@ func (decoder *EthTransactionDecoder) SubmitRawTransaction(wrapper openwallet.Wa
 	decimals := int32(0)
 	fees := "0"
 	if rawTx.Coin.IsContract {
-		decimals = int32(rawTx.Coin.Contract.Decimals)
+		decimals = decoder.wm.tokenDecimals(rawTx.Coin.Contract)
 		fees = "0"
 	} else {
 		decimals = int32(decoder.wm.Decimal())
@@ -440,6 +540,12 @@ func (decoder *EthTransactionDecoder) SubmitRawTransaction(wrapper openwallet.Wa
 		TxType:     0,
 	}
 
+	//加速或取消的替换交易，记录被替换的原交易
+	if replaceTxID := rawTx.GetExtParam().Get("replaceTxID"); replaceTxID.Exists() {
+		owtx.SetExtParam("replaceTxID", replaceTxID.String())
+		owtx.SetExtParam("replaceMode", rawTx.GetExtParam().Get("replaceMode").String())
+	}
+
 	owtx.WxID = openwallet.GenTransactionWxID(owtx)
 
 	return owtx, nil
@@ -453,26 +559,44 @@ func (decoder *EthTransactionDecoder) VerifyRawTransaction(wrapper openwallet.Wa
 		return openwallet.Errorf(openwallet.ErrVerifyRawTransactionFailed, "transaction signature is empty")
 	}
 
-	accountSig, exist := rawTx.Signatures[rawTx.Account.AccountID]
-	if !exist {
-		decoder.wm.Log.Std.Error("wallet[%v] signature not found ", rawTx.Account.AccountID)
-		return errors.New("wallet signature not found ")
+	//验证全部已完成的签名，多签账户只需要达到门限的公钥签名
+	verified := 0
+	for _, keySignatures := range rawTx.Signatures {
+		for _, keySignature := range keySignatures {
+			sig := keySignature.Signature
+			msg := keySignature.Message
+			pubkey := keySignature.Address.PublicKey
+			if len(sig) == 0 {
+				continue
+			}
+
+			decoder.wm.Log.Debug("-- pubkey:", pubkey)
+			decoder.wm.Log.Debug("-- message:", msg)
+			decoder.wm.Log.Debug("-- Signature:", sig)
+			if err := verifySignature(pubkey, msg, ethcom.FromHex(sig)); err != nil {
+				return err
+			}
+			verified++
+		}
 	}
 
-	if len(accountSig) == 0 {
-		//decoder.wm.Log.Std.Error("len of signatures error. ")
+	if verified == 0 {
 		return openwallet.Errorf(openwallet.ErrVerifyRawTransactionFailed, "transaction signature is empty")
 	}
 
-	sig := accountSig[0].Signature
-	msg := accountSig[0].Message
-	pubkey := accountSig[0].Address.PublicKey
-	//curveType := rawTx.Signatures[rawTx.Account.AccountID][0].EccType
+	//多签账户的签名权重需要达到门限
+	if err := decoder.wm.checkSignatureThreshold(ethcom.FromHex(rawTx.RawHex), rawTx.Signatures); err != nil {
+		return openwallet.Errorf(openwallet.ErrVerifyRawTransactionFailed, "%v", err)
+	}
+
+	return nil
+}
 
-	decoder.wm.Log.Debug("-- pubkey:", pubkey)
-	decoder.wm.Log.Debug("-- message:", msg)
-	decoder.wm.Log.Debug("-- Signature:", sig)
-	signature := ethcom.FromHex(sig)
+//verifySignature 用地址公钥验证65字节的签名
+func verifySignature(pubkey, msg string, signature []byte) error {
+	if len(signature) != 65 {
+		return fmt.Errorf("verify error, signature length: %d", len(signature))
+	}
 	publickKey := owcrypt.PointDecompress(ethcom.FromHex(pubkey), owcrypt.ECC_CURVE_SECP256K1)
 	publickKey = publickKey[1:len(publickKey)]
 	ret := owcrypt.Verify(publickKey, nil, ethcom.FromHex(msg), signature[0:len(signature)-1], owcrypt.ECC_CURVE_SECP256K1)
@@ -481,7 +605,6 @@ func (decoder *EthTransactionDecoder) VerifyRawTransaction(wrapper openwallet.Wa
 		//fmt.Println(errinfo)
 		return errors.New(errinfo)
 	}
-
 	return nil
 }
 
@@ -625,9 +748,14 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrap
 		minTransfer        *big.Int
 		retainedBalance    *big.Int
 		feesSupportAccount *openwallet.AssetsAccount
-		tmpNonce           uint64
+		feesSupportAddress *openwallet.Address
 	)
 
+	//NFT需要指定tokenId，不支持汇总
+	if protocol := tokenProtocol(sumRawTx.Coin.Contract); isNFTProtocol(protocol) {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "%s token does not support summary", protocol)
+	}
+
 	// 如果有提供手续费账户，检查账户是否存在
 	if feesAcount := sumRawTx.FeesSupportAccount; feesAcount != nil {
 		account, supportErr := wrapper.GetAssetsAccountInfo(feesAcount.AccountID)
@@ -648,15 +776,10 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrap
 			return nil, openwallet.Errorf(openwallet.ErrAccountNotAddress, "fees support account have not addresses")
 		}
 
-		nonce := decoder.wm.GetAddressNonce(wrapper, feesAddresses[0].Address)
-		//nonce, feesSupportErr := decoder.wm.GetTransactionCount(feesAddresses[0].Address)
-		//if feesSupportErr != nil {
-		//	return nil, openwallet.NewError(openwallet.ErrNonceInvaild, "fees support account get nonce failed")
-		//}
-		tmpNonce = nonce
+		feesSupportAddress = feesAddresses[0]
 	}
 	//tokenCoin := sumRawTx.Coin.Contract.Token
-	tokenDecimals := int32(sumRawTx.Coin.Contract.Decimals)
+	tokenDecimals := decoder.wm.tokenDecimals(sumRawTx.Coin.Contract)
 	contractAddress := sumRawTx.Coin.Contract.Address
 	//coinDecimals := decoder.wm.Decimal()
 
@@ -729,10 +852,13 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrap
 		}
 
 		//判断主币余额是否够手续费
+		feePayer := ""
 		if coinBalance.Cmp(fee.Fee) < 0 {
 
-			//有手续费账户支持
-			if feesSupportAccount != nil {
+			//有手续费账户支持，开启手续费代付时由手续费账户直接支付手续费，不需要先转入
+			if feesSupportAccount != nil && decoder.wm.Config.FeeDelegation {
+				feePayer = feesSupportAddress.Address
+			} else if feesSupportAccount != nil {
 
 				//通过手续费账户创建交易单
 				supportAddress := addrBalance.Balance.Address
@@ -774,7 +900,8 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrap
 					Required: 1,
 				}
 
-				createTxErr := decoder.CreateSimpleRawTransaction(wrapper, rawTx, &tmpNonce)
+				//手续费支持账户的nonce由NonceManager连续分配，构建失败的会被释放
+				createTxErr := decoder.CreateSimpleRawTransaction(wrapper, rawTx, nil)
 				rawTxWithErr := &openwallet.RawTransactionWithError{
 					RawTx: rawTx,
 					Error: openwallet.ConvertError(createTxErr),
@@ -783,9 +910,6 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrap
 				//创建成功，添加到队列
 				rawTxArray = append(rawTxArray, rawTxWithErr)
 
-				//需要手续费支持的地址会有很多个，nonce要连续递增以保证交易广播生效
-				tmpNonce++
-
 				//汇总下一个
 				continue
 			}
@@ -804,6 +928,10 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrap
 			},
 			Required: 1,
 		}
+		if len(feePayer) > 0 {
+			decoder.wm.Log.Debugf("fee payer: %s", feePayer)
+			rawTx.SetExtParam("feePayer", feePayer)
+		}
 
 		createTxErr := decoder.createRawTransaction(
 			wrapper,
@@ -826,39 +954,43 @@ func (decoder *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrap
 }
 
 //createRawTransaction
-func (decoder *EthTransactionDecoder) createRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, addrBalance *AddrBalance, fee *txFeeInfo, callData string, tmpNonce *uint64) *openwallet.Error {
+func (decoder *EthTransactionDecoder) createRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, addrBalance *AddrBalance, fee *txFeeInfo, callData string, tmpNonce *uint64) (buildErr *openwallet.Error) {
 
 	var (
 		accountTotalSent = decimal.Zero
 		txFrom           = make([]string, 0)
 		txTo             = make([]string, 0)
-		keySignList      = make([]*openwallet.KeySignature, 0)
 		amountStr        string
 		destination      string
-		tx               *types.Transaction
 	)
 
 	isContract := rawTx.Coin.IsContract
 	//contractAddress := rawTx.Coin.Contract.Address
 	//tokenCoin := rawTx.Coin.Contract.Token
-	tokenDecimals := int32(rawTx.Coin.Contract.Decimals)
+	tokenDecimals := decoder.wm.tokenDecimals(rawTx.Coin.Contract)
 	//coinDecimals := decoder.wm.Decimal()
 
-	for k, v := range rawTx.To {
-		destination = k
-		amountStr = v
-		break
-	}
-
-	//计算账户的实际转账amount
-	accountTotalSentAddresses, findErr := wrapper.GetAddressList(0, -1, "AccountID", rawTx.Account.AccountID, "Address", destination)
-	if findErr != nil || len(accountTotalSentAddresses) == 0 {
+	//多个接收地址时由批量转账合约分发，发送金额为合计
+	totalAmount := decimal.Zero
+	for _, to := range sortedRecipients(rawTx.To) {
+		destination = to
+		amountStr = rawTx.To[to]
 		amountDec, _ := decimal.NewFromString(amountStr)
-		accountTotalSent = accountTotalSent.Add(amountDec)
+		totalAmount = totalAmount.Add(amountDec)
+
+		//计算账户的实际转账amount
+		accountTotalSentAddresses, findErr := wrapper.GetAddressList(0, -1, "AccountID", rawTx.Account.AccountID, "Address", destination)
+		if findErr != nil || len(accountTotalSentAddresses) == 0 {
+			accountTotalSent = accountTotalSent.Add(amountDec)
+		}
+		txTo = append(txTo, fmt.Sprintf("%s:%s", destination, amountStr))
+	}
+	isBatch := len(rawTx.To) > 1
+	if isBatch {
+		amountStr = totalAmount.String()
 	}
 
 	txFrom = []string{fmt.Sprintf("%s:%s", addrBalance.Address, amountStr)}
-	txTo = []string{fmt.Sprintf("%s:%s", destination, amountStr)}
 
 	gasprice := common.BigIntToDecimals(fee.GasPrice, decoder.wm.Decimal())
 	totalFeeDecimal := common.BigIntToDecimals(fee.Fee, decoder.wm.Decimal())
@@ -882,23 +1014,72 @@ func (decoder *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Wa
 	var nonce uint64
 	if tmpNonce == nil {
 		//使用外部传入的扩展字段填充nonce
-		if rawTx.GetExtParam().Exists() {
+		if rawTx.GetExtParam().Get("nonce").Exists() {
 			nonce = rawTx.GetExtParam().Get("nonce").Uint()
 		} else {
-			txNonce := decoder.wm.GetAddressNonce(wrapper, addrBalance.Address)
-			//decoder.wm.Log.Debugf("txNonce: %d", txNonce)
+			//分配nonce，构建失败时释放
+			txNonce, err := decoder.wm.NonceManager.Reserve(addrBalance.Address)
+			if err != nil {
+				return openwallet.Errorf(openwallet.ErrNonceInvaild, "get address nonce failed, err: %v", err)
+			}
 			nonce = txNonce
+			defer func() {
+				if buildErr != nil {
+					decoder.wm.NonceManager.Release(addrBalance.Address, txNonce)
+				}
+			}()
 		}
 	} else {
 		nonce = *tmpNonce
 	}
 
-	//decoder.wm.Log.Debug("chainID:", decoder.wm.GetConfig().ChainID)
-	signer := types.NewEIP155Signer(big.NewInt(int64(decoder.wm.Config.ChainID)))
+	txType, err := decoder.wm.txTypeFromExtParam(rawTx.GetExtParam())
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+
+	fd, err := feeDelegationFromExtParam(wrapper, rawTx.GetExtParam())
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
 
 	gasLimit := fee.GasLimit.Uint64()
+	utx := &unsignedTx{
+		Type:     txType,
+		Nonce:    nonce,
+		From:     ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(addrBalance.Address)),
+		Gas:      gasLimit,
+		GasPrice: fee.GasPrice,
+		ExtParam: rawTx.GetExtParam(),
+	}
+
+	if isBatch {
+		//构建批量转账合约交易，代币由合约通过transferFrom转出，主币随交易转入合约
+		if len(decoder.wm.Config.BatchTransferContract) == 0 || len(callData) == 0 {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "multiple recipients need batchTransferContract")
+		}
+		value := big.NewInt(0)
+		if isContract {
+			amount := common.StringNumToBigIntWithExp(amountStr, tokenDecimals)
+			if addrBalance.TokenBalance.Cmp(amount) < 0 {
+				return openwallet.Errorf(openwallet.ErrInsufficientTokenBalanceOfAddress, "the token balance: %s is not enough", amountStr)
+			}
+		} else {
+			value = common.StringNumToBigIntWithExp(amountStr, decoder.wm.Decimal())
+		}
+		if addrBalance.Balance.Cmp(new(big.Int).Add(value, fd.senderFee(fee.Fee))) < 0 {
+			coinBalance := common.BigIntToDecimals(addrBalance.Balance, decoder.wm.Decimal())
+			return openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s is not enough to call batch transfer contract", rawTx.Coin.Symbol, coinBalance)
+		}
 
-	if isContract {
+		if base := utx.Type.Base(); base == TxTypeValueTransfer || base == TxTypeValueTransferMemo {
+			utx.Type = TxTypeSmartContractExecution | utx.Type&feeDelegationMask
+		}
+		to := ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(decoder.wm.Config.BatchTransferContract))
+		utx.To = &to
+		utx.Value = value
+		utx.Data = ethcom.FromHex(callData)
+	} else if isContract {
 		//构建合约交易
 		amount := common.StringNumToBigIntWithExp(amountStr, tokenDecimals)
 		if addrBalance.TokenBalance.Cmp(amount) < 0 {
@@ -906,54 +1087,67 @@ func (decoder *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Wa
 			//return openwallet.Errorf("the token balance: %s is not enough", amountStr)
 		}
 
-		if addrBalance.Balance.Cmp(fee.Fee) < 0 {
+		if addrBalance.Balance.Cmp(fd.senderFee(fee.Fee)) < 0 {
 			coinBalance := common.BigIntToDecimals(addrBalance.Balance, decoder.wm.Decimal())
 			return openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance)
 			//return openwallet.Errorf("the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance)
 		}
 
-		tx = types.NewTransaction(nonce, ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(rawTx.Coin.Contract.Address)),
-			big.NewInt(0), gasLimit, fee.GasPrice, ethcom.FromHex(callData))
+		//代币转账使用合约调用类型
+		if base := utx.Type.Base(); base == TxTypeValueTransfer || base == TxTypeValueTransferMemo {
+			utx.Type = TxTypeSmartContractExecution | utx.Type&feeDelegationMask
+		}
+		to := ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(rawTx.Coin.Contract.Address))
+		utx.To = &to
+		utx.Value = big.NewInt(0)
+		utx.Data = ethcom.FromHex(callData)
 	} else {
 		//构建QUORUM交易
 		amount := common.StringNumToBigIntWithExp(amountStr, decoder.wm.Decimal())
 
 		totalAmount := new(big.Int)
-		totalAmount.Add(amount, fee.Fee)
+		totalAmount.Add(amount, fd.senderFee(fee.Fee))
 		if addrBalance.Balance.Cmp(totalAmount) < 0 {
 			return openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s is not enough", rawTx.Coin.Symbol, amountStr)
 			//return openwallet.Errorf("the [%s] balance: %s is not enough", rawTx.Coin.Symbol, amountStr)
 		}
 
-		tx = types.NewTransaction(nonce, ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(destination)),
-			amount, gasLimit, fee.GasPrice, []byte(""))
+		to := ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(destination))
+		utx.To = &to
+		utx.Value = amount
+		utx.Data = []byte("")
 	}
 
-	rawHex, err := rlp.EncodeToBytes(tx)
-	if err != nil {
-		decoder.wm.Log.Error("Transaction RLP encode failed, err:", err)
-		return openwallet.ConvertError(err)
+	//手续费代付交易，代付方余额需要足够支付其承担的手续费
+	fd.apply(decoder.wm, utx)
+	if payerErr := fd.checkPayerBalance(decoder.wm, fee.Fee); payerErr != nil {
+		return payerErr
 	}
 
-	//txstr, _ := json.MarshalIndent(tx, "", " ")
-	//decoder.wm.Log.Debug("**txStr:", string(txstr))
-	msg := signer.Hash(tx)
+	//动态手续费交易，gasPrice作为maxFeePerGas
+	if utx.Type == TxTypeEthereumDynamicFee {
+		gasTip, tipErr := decoder.wm.dynamicFeeTip(fee)
+		if tipErr != nil {
+			return openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, tipErr.Error())
+		}
+		utx.GasTip = gasTip
+	}
 
-	if rawTx.Signatures == nil {
-		rawTx.Signatures = make(map[string][]*openwallet.KeySignature)
+	rawHex, _, err := decoder.wm.buildUnsignedTx(utx)
+	if err != nil {
+		decoder.wm.Log.Error("Transaction RLP encode failed, err:", err)
+		return openwallet.ConvertError(err)
 	}
 
-	signature := openwallet.KeySignature{
-		EccType: decoder.wm.Config.CurveType,
-		Nonce:   "0x" + strconv.FormatUint(nonce, 16),
-		Address: addr,
-		Message: hex.EncodeToString(msg[:]),
-		RSV:     true,
+	//按链上账户密钥生成待签名信息，多签账户需要多个签名，手续费代付交易还需要代付方签名
+	keySignatures, err := decoder.wm.txKeySignatures(wrapper, addr, fd, utx.Type, rawHex, nonce)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
 	}
-	keySignList = append(keySignList, &signature)
 
+	rawTx.Signatures = make(map[string][]*openwallet.KeySignature)
+	mergeKeySignatures(rawTx.Signatures, keySignatures)
 	rawTx.RawHex = hex.EncodeToString(rawHex)
-	rawTx.Signatures[rawTx.Account.AccountID] = keySignList
 	rawTx.IsBuilt = true
 
 	return nil
@@ -0,0 +1,457 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/common"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
+)
+
+//替换交易的方式
+const (
+	ReplaceModeSpeedUp = "speedUp" //相同的交易内容，更高的gasPrice
+	ReplaceModeCancel  = "cancel"  //以太坊兼容交易0金额转给自己，Klaytn类型交易使用TxTypeCancel
+)
+
+const (
+	//DefaultTxPriceBump 替换交易池中相同nonce的交易时gasPrice的最低涨幅百分比，与节点交易池的默认值一致
+	DefaultTxPriceBump = 10
+
+	cancelGasLimit = 21000 //0金额转账和TxTypeCancel的gas
+
+	//Klaytn交易的固有gas附加项
+	feeDelegatedGas          = 10000 //手续费代付
+	feeDelegatedWithRatioGas = 15000 //按比例代付
+	validationGasPerKey      = 15000 //多签密钥每增加一个签名
+)
+
+//replaceTarget 被替换的原交易
+type replaceTarget struct {
+	TxID  string
+	utx   *unsignedTx
+	fd    *feeDelegation
+	rawTx *openwallet.RawTransaction //已提交的原交易单，通过txid查询时为nil
+}
+
+//CreateSpeedUpRawTransaction 以更高的gasPrice重新构建已提交的交易单，nonce和交易内容不变，广播后替换交易池中的原交易。
+//feeRate为新的gasPrice，为空时取节点gasPrice和最低涨幅中较高的
+func (decoder *EthTransactionDecoder) CreateSpeedUpRawTransaction(wrapper openwallet.WalletDAI, original *openwallet.RawTransaction, feeRate string) (*openwallet.RawTransaction, error) {
+	target, err := decoder.replaceTargetFromRawTx(wrapper, original)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.createReplaceRawTransaction(wrapper, original.Account, target, ReplaceModeSpeedUp, feeRate)
+}
+
+//CreateSpeedUpRawTransactionByTxID 从节点查询交易池中的交易，以更高的gasPrice重新构建
+func (decoder *EthTransactionDecoder) CreateSpeedUpRawTransactionByTxID(wrapper openwallet.WalletDAI, account *openwallet.AssetsAccount, txid string, feeRate string) (*openwallet.RawTransaction, error) {
+	target, err := decoder.replaceTargetFromTxID(wrapper, txid)
+	if err != nil {
+		return nil, err
+	}
+	if target.utx.Type.Base() == TxTypeAccountUpdate {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "speed up %v by txid is not supported, use the submitted raw transaction", target.utx.Type)
+	}
+	return decoder.createReplaceRawTransaction(wrapper, account, target, ReplaceModeSpeedUp, feeRate)
+}
+
+//CreateCancelRawTransaction 构建取消已提交交易单的交易，使用相同的nonce和更高的gasPrice
+func (decoder *EthTransactionDecoder) CreateCancelRawTransaction(wrapper openwallet.WalletDAI, original *openwallet.RawTransaction, feeRate string) (*openwallet.RawTransaction, error) {
+	target, err := decoder.replaceTargetFromRawTx(wrapper, original)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.createReplaceRawTransaction(wrapper, original.Account, target, ReplaceModeCancel, feeRate)
+}
+
+//CreateCancelRawTransactionByTxID 从节点查询交易池中的交易，构建取消它的交易
+func (decoder *EthTransactionDecoder) CreateCancelRawTransactionByTxID(wrapper openwallet.WalletDAI, account *openwallet.AssetsAccount, txid string, feeRate string) (*openwallet.RawTransaction, error) {
+	target, err := decoder.replaceTargetFromTxID(wrapper, txid)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.createReplaceRawTransaction(wrapper, account, target, ReplaceModeCancel, feeRate)
+}
+
+//replaceTargetFromRawTx 解析已提交的交易单
+func (decoder *EthTransactionDecoder) replaceTargetFromRawTx(wrapper openwallet.WalletDAI, original *openwallet.RawTransaction) (*replaceTarget, error) {
+	if original == nil || !original.IsSubmit || len(original.TxID) == 0 {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "original transaction is not submitted")
+	}
+	raw, err := hex.DecodeString(original.RawHex)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "original rawHex decode failed, err: %v", err)
+	}
+
+	var utx *unsignedTx
+	if IsDynamicFeeTx(raw) {
+		tx, err := DecodeDynamicFeeTx(raw)
+		if err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+		}
+		from, err := decoder.replaceSender(original, raw)
+		if err != nil {
+			return nil, err
+		}
+		utx = &unsignedTx{
+			Type:     TxTypeEthereumDynamicFee,
+			Nonce:    tx.Nonce,
+			From:     from,
+			To:       tx.To,
+			Value:    tx.Value,
+			Gas:      tx.Gas,
+			GasPrice: tx.GasFeeCap,
+			GasTip:   tx.GasTipCap,
+			Data:     tx.Data,
+		}
+	} else if IsKlaytnTypedTx(raw) {
+		tx, err := DecodeKlaytnTx(raw)
+		if err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+		}
+		utx = &unsignedTx{
+			Type:     tx.Type,
+			Nonce:    tx.Nonce,
+			From:     tx.From,
+			To:       tx.To,
+			Value:    tx.Value,
+			Gas:      tx.Gas,
+			GasPrice: tx.GasPrice,
+			Data:     tx.Input,
+			FeeRatio: tx.FeeRatio,
+		}
+		if tx.Type.IsFeeDelegated() {
+			feePayer := tx.FeePayer
+			utx.FeePayer = &feePayer
+		}
+		if tx.Type.Base() == TxTypeAccountUpdate {
+			utx.ExtParam = gjson.Parse(fmt.Sprintf(`{"accountKey":"%s"}`, hexutil.Encode(tx.AccountKey)))
+		}
+	} else {
+		tx := &types.Transaction{}
+		if err := rlp.DecodeBytes(raw, tx); err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+		}
+		from, err := decoder.replaceSender(original, raw)
+		if err != nil {
+			return nil, err
+		}
+		utx = &unsignedTx{
+			Type:     TxTypeLegacy,
+			Nonce:    tx.Nonce(),
+			From:     from,
+			To:       tx.To(),
+			Value:    tx.Value(),
+			Gas:      tx.Gas(),
+			GasPrice: tx.GasPrice(),
+			Data:     tx.Data(),
+		}
+	}
+
+	fd, err := decoder.replaceFeeDelegation(wrapper, utx)
+	if err != nil {
+		return nil, err
+	}
+	return &replaceTarget{TxID: original.TxID, utx: utx, fd: fd, rawTx: original}, nil
+}
+
+//replaceSender 以太坊类型交易的发送地址不在原始交易中，使用签名的地址
+func (decoder *EthTransactionDecoder) replaceSender(original *openwallet.RawTransaction, raw []byte) (ethcom.Address, error) {
+	msg, _, err := decoder.wm.txMessages(raw)
+	if err != nil {
+		return ethcom.Address{}, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+	sender := decoder.wm.txSender(raw, collectSignatures(original.Signatures, msg))
+	if len(sender) == 0 {
+		return ethcom.Address{}, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "sender of original transaction not found")
+	}
+	return ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(sender)), nil
+}
+
+//replaceTargetFromTxID 从节点查询未打包的交易
+func (decoder *EthTransactionDecoder) replaceTargetFromTxID(wrapper openwallet.WalletDAI, txid string) (*replaceTarget, error) {
+	tx, err := decoder.wm.GetTransactionByHash(txid)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, err.Error())
+	}
+	if len(tx.Hash) == 0 {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "transaction: %s not found", txid)
+	}
+	if tx.BlockHeight > 0 {
+		return nil, openwallet.Errorf(openwallet.ErrNonceInvaild, "transaction: %s is already mined at height: %d", txid, tx.BlockHeight)
+	}
+
+	utx := &unsignedTx{
+		Type: tx.KlaytnTxType(),
+		From: ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(tx.From)),
+		Data: ethcom.FromHex(tx.Data),
+	}
+	if utx.Nonce, err = hexutil.DecodeUint64(tx.Nonce); err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "invalid nonce of transaction: %s", txid)
+	}
+	if utx.Gas, err = hexutil.DecodeUint64(tx.Gas); err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "invalid gas of transaction: %s", txid)
+	}
+	if utx.GasPrice, err = hexutil.DecodeBig(tx.GasPrice); err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "invalid gasPrice of transaction: %s", txid)
+	}
+	if utx.Value, err = hexutil.DecodeBig(tx.Value); err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "invalid value of transaction: %s", txid)
+	}
+	if utx.Type == TxTypeEthereumDynamicFee {
+		if utx.GasPrice, err = hexutil.DecodeBig(tx.GasFeeCap); err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "invalid maxFeePerGas of transaction: %s", txid)
+		}
+		if utx.GasTip, err = hexutil.DecodeBig(tx.GasTipCap); err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "invalid maxPriorityFeePerGas of transaction: %s", txid)
+		}
+	}
+	if len(tx.To) > 0 {
+		to := ethcom.HexToAddress(decoder.wm.CustomAddressDecodeFunc(tx.To))
+		utx.To = &to
+	}
+	if utx.Type.IsFeeDelegated() {
+		feePayer := ethcom.HexToAddress(tx.FeePayer)
+		utx.FeePayer = &feePayer
+		if utx.Type.HasFeeRatio() {
+			ratio, err := hexutil.DecodeUint64(tx.FeeRatio)
+			if err != nil {
+				return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "invalid feeRatio of transaction: %s", txid)
+			}
+			utx.FeeRatio = uint8(ratio)
+		}
+	}
+
+	fd, err := decoder.replaceFeeDelegation(wrapper, utx)
+	if err != nil {
+		return nil, err
+	}
+	return &replaceTarget{TxID: tx.Hash, utx: utx, fd: fd}, nil
+}
+
+//replaceFeeDelegation 手续费代付的原交易，替换交易仍由原代付方签名
+func (decoder *EthTransactionDecoder) replaceFeeDelegation(wrapper openwallet.WalletDAI, utx *unsignedTx) (*feeDelegation, error) {
+	if utx.FeePayer == nil {
+		return nil, nil
+	}
+	feePayer := decoder.wm.CustomAddressEncodeFunc(strings.ToLower(utx.FeePayer.Hex()))
+	addr, err := wrapper.GetAddress(feePayer)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "can not find fee payer address: %s", feePayer)
+	}
+	return &feeDelegation{Payer: addr, Ratio: utx.FeeRatio}, nil
+}
+
+//replaceGasPrice 替换交易的gasPrice，不能低于原交易加上最低涨幅
+func (decoder *EthTransactionDecoder) replaceGasPrice(original *big.Int, feeRate string) (*big.Int, *openwallet.Error) {
+	minPrice := decoder.bumpPrice(original)
+
+	if len(feeRate) > 0 {
+		gasPrice := common.StringNumToBigIntWithExp(feeRate, decoder.wm.Decimal())
+		if gasPrice.Cmp(minPrice) < 0 {
+			return nil, openwallet.Errorf(openwallet.ErrInsufficientFees, "gas price: %s is lower than the replacement minimum: %s (+%d%%)",
+				feeRate, common.BigIntToDecimals(minPrice, decoder.wm.Decimal()).String(), decoder.wm.Config.TxPriceBump)
+		}
+		return gasPrice, nil
+	}
+
+	gasPrice, err := decoder.wm.GetGasPrice()
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, err.Error())
+	}
+	if gasPrice.Cmp(minPrice) < 0 {
+		gasPrice = minPrice
+	}
+	return gasPrice, nil
+}
+
+//cancelGas TxTypeCancel的固有gas，加上手续费代付和多签密钥验证的附加gas
+func (wm *WalletManager) cancelGas(utx *unsignedTx) (uint64, error) {
+	gas := uint64(cancelGasLimit)
+	switch {
+	case utx.Type.HasFeeRatio():
+		gas += feeDelegatedWithRatioGas
+	case utx.Type.IsFeeDelegated():
+		gas += feeDelegatedGas
+	}
+	validationGas, err := wm.keyValidationGas(utx.From, txRole(utx.Type))
+	if err != nil {
+		return 0, err
+	}
+	gas += validationGas
+	if utx.FeePayer != nil {
+		validationGas, err = wm.keyValidationGas(*utx.FeePayer, RoleFeePayer)
+		if err != nil {
+			return 0, err
+		}
+		gas += validationGas
+	}
+	return gas, nil
+}
+
+//keyValidationGas 角色密钥验证签名的附加gas，多签密钥按全部公钥都签名计算，节点不支持查询账户密钥时返回0
+func (wm *WalletManager) keyValidationGas(address ethcom.Address, role AccountKeyRole) (uint64, error) {
+	accountKey, err := wm.GetAccountKey(wm.CustomAddressEncodeFunc(strings.ToLower(address.Hex())))
+	if err != nil {
+		if quorum_rpc.IsMethodNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	_, keys := accountKey.RoleKey(role).SignerKeys()
+	if len(keys) <= 1 {
+		return 0, nil
+	}
+	return uint64(len(keys)-1) * validationGasPerKey, nil
+}
+
+//bumpPrice 原价格加上最低涨幅，向上取整
+func (decoder *EthTransactionDecoder) bumpPrice(original *big.Int) *big.Int {
+	minPrice := new(big.Int).Mul(original, big.NewInt(int64(100+decoder.wm.Config.TxPriceBump)))
+	minPrice.Add(minPrice, big.NewInt(99))
+	minPrice.Div(minPrice, big.NewInt(100))
+	return minPrice
+}
+
+//createReplaceRawTransaction 构建与原交易nonce相同的替换交易单，ExtParam记录被替换的交易
+func (decoder *EthTransactionDecoder) createReplaceRawTransaction(wrapper openwallet.WalletDAI, account *openwallet.AssetsAccount, target *replaceTarget, mode string, feeRate string) (*openwallet.RawTransaction, error) {
+	wm := decoder.wm
+	original := target.utx
+	from := wm.CustomAddressEncodeFunc(strings.ToLower(original.From.Hex()))
+
+	addr, err := wrapper.GetAddress(from)
+	if err != nil {
+		return nil, openwallet.NewError(openwallet.ErrAccountNotAddress, err.Error())
+	}
+
+	//原交易已打包时不能再替换
+	mined, err := wm.GetTransactionCount(from)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, err.Error())
+	}
+	if original.Nonce < mined {
+		return nil, openwallet.Errorf(openwallet.ErrNonceInvaild, "nonce: %d of transaction: %s is already mined", original.Nonce, target.TxID)
+	}
+
+	gasPrice, priceErr := decoder.replaceGasPrice(original.GasPrice, feeRate)
+	if priceErr != nil {
+		return nil, priceErr
+	}
+
+	utx := *original
+	utx.GasPrice = gasPrice
+	if original.GasTip != nil {
+		//动态手续费交易的小费也需要达到最低涨幅
+		utx.GasTip = decoder.bumpPrice(original.GasTip)
+		if utx.GasTip.Cmp(gasPrice) > 0 {
+			utx.GasTip = gasPrice
+		}
+	}
+	if mode == ReplaceModeCancel {
+		utx.Value = big.NewInt(0)
+		utx.Data = nil
+		utx.Gas = cancelGasLimit
+		utx.ExtParam = gjson.Result{}
+		if original.Type == TxTypeLegacy || original.Type == TxTypeEthereumDynamicFee {
+			utx.To = &utx.From
+		} else {
+			utx.Type = TxTypeCancel
+			if original.Type.IsFeeDelegated() {
+				utx.Type = TxTypeCancel.FeeDelegated(original.Type.HasFeeRatio())
+			}
+			utx.To = nil
+			utx.Gas, err = wm.cancelGas(&utx)
+			if err != nil {
+				return nil, openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, err.Error())
+			}
+		}
+	}
+
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(utx.Gas), gasPrice)
+	balance, err := wm.GetAddrBalance(from, "latest")
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCallFullNodeAPIFailed, err.Error())
+	}
+	if balance.Cmp(new(big.Int).Add(utx.Value, target.fd.senderFee(fee))) < 0 {
+		return nil, openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s is not enough to replace transaction: %s",
+			wm.Symbol(), common.BigIntToDecimals(balance, wm.Decimal()).String(), target.TxID)
+	}
+	if payerErr := target.fd.checkPayerBalance(wm, fee); payerErr != nil {
+		return nil, payerErr
+	}
+
+	raw, _, err := wm.buildUnsignedTx(&utx)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+	keySignatures, err := wm.txKeySignatures(wrapper, addr, target.fd, utx.Type, raw, utx.Nonce)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+	}
+
+	rawTx := &openwallet.RawTransaction{
+		Coin:       openwallet.Coin{Symbol: wm.Symbol()},
+		Account:    account,
+		RawHex:     hex.EncodeToString(raw),
+		FeeRate:    common.BigIntToDecimals(gasPrice, wm.Decimal()).String(),
+		Fees:       common.BigIntToDecimals(fee, wm.Decimal()).String(),
+		Signatures: make(map[string][]*openwallet.KeySignature),
+		IsBuilt:    true,
+	}
+	mergeKeySignatures(rawTx.Signatures, keySignatures)
+
+	if mode == ReplaceModeSpeedUp && target.rawTx != nil {
+		//交易内容不变，沿用原交易单的记录
+		rawTx.Coin = target.rawTx.Coin
+		rawTx.To = target.rawTx.To
+		rawTx.ExtParam = target.rawTx.ExtParam
+		rawTx.TxFrom = target.rawTx.TxFrom
+		rawTx.TxTo = target.rawTx.TxTo
+		rawTx.TxAmount = target.rawTx.TxAmount
+	} else {
+		amount := common.BigIntToDecimals(utx.Value, wm.Decimal())
+		rawTx.TxFrom = []string{fmt.Sprintf("%s:%s", from, amount.String())}
+		rawTx.TxTo = make([]string, 0)
+		if utx.To != nil {
+			rawTx.TxTo = append(rawTx.TxTo, fmt.Sprintf("%s:%s", wm.CustomAddressEncodeFunc(strings.ToLower(utx.To.Hex())), amount.String()))
+		}
+		rawTx.TxAmount = amount.Add(common.BigIntToDecimals(target.fd.senderFee(fee), wm.Decimal())).Neg().String()
+	}
+
+	//记录替换关系，广播后NonceManager把原交易记入同一nonce的替换历史
+	for key, value := range map[string]interface{}{
+		"nonce":       utx.Nonce,
+		"replaceTxID": target.TxID,
+		"replaceMode": mode,
+	} {
+		if err := rawTx.SetExtParam(key, value); err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, err.Error())
+		}
+	}
+
+	wm.Log.Infof("build %s transaction of nonce: %d to replace: %s, gas price: %s -> %s", mode, utx.Nonce, target.TxID, original.GasPrice.String(), gasPrice.String())
+	return rawTx, nil
+}
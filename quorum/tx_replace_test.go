@@ -0,0 +1,247 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/assetsadapterstore/klaytn-adapter/quorum_rpc"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	ethcom "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
+)
+
+func TestTransactionDecoder_SpeedUpByTxIDOffline(t *testing.T) {
+	var (
+		from    = "0x3440f720862aa7dfd4f86ecc78542b3ded900c02"
+		to      = "0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9"
+		account = &openwallet.AssetsAccount{AccountID: "acc"}
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetNonce(from, 3)
+	node.SetBalance(from, big.NewInt(1e18))
+	txid := node.AddPendingTx(&quorum_rpc.FakeTx{From: from, To: to, Value: big.NewInt(5), Nonce: 3, Gas: 21000, GasPrice: big.NewInt(25000000000)})
+
+	wm := testNewFakeWalletManager(node)
+	decoder := NewTransactionDecoder(wm)
+	wrapper := &testTokenWrapper{addresses: []*openwallet.Address{{AccountID: "acc", Address: from}}}
+
+	//没有指定gasPrice时按最低涨幅计算
+	rawTx, err := decoder.CreateSpeedUpRawTransactionByTxID(wrapper, account, txid, "")
+	if err != nil {
+		t.Fatalf("create speed up transaction failed: %v", err)
+	}
+	tx := &types.Transaction{}
+	if err := rlp.DecodeBytes(ethcom.FromHex(rawTx.RawHex), tx); err != nil {
+		t.Fatalf("decode replacement failed: %v", err)
+	}
+	if tx.Nonce() != 3 || tx.GasPrice().Cmp(big.NewInt(27500000000)) != 0 || tx.Value().Int64() != 5 || !strings.EqualFold(tx.To().Hex(), to) {
+		t.Errorf("unexpected replacement: nonce %d, gasPrice %v, value %v, to %v", tx.Nonce(), tx.GasPrice(), tx.Value(), tx.To().Hex())
+	}
+	if rawTx.GetExtParam().Get("replaceTxID").String() != txid || rawTx.GetExtParam().Get("replaceMode").String() != ReplaceModeSpeedUp {
+		t.Errorf("replacement is not linked to the original: %s", rawTx.ExtParam)
+	}
+
+	//gasPrice低于最低涨幅
+	if _, err := decoder.CreateSpeedUpRawTransactionByTxID(wrapper, account, txid, "0.000000027"); err == nil {
+		t.Errorf("gas price below the minimum bump should be rejected")
+	}
+
+	//以太坊兼容交易以0金额转给自己取消
+	rawTx, err = decoder.CreateCancelRawTransactionByTxID(wrapper, account, txid, "0.00000003")
+	if err != nil {
+		t.Fatalf("create cancel transaction failed: %v", err)
+	}
+	tx = &types.Transaction{}
+	rlp.DecodeBytes(ethcom.FromHex(rawTx.RawHex), tx)
+	if tx.Nonce() != 3 || tx.Value().Sign() != 0 || tx.Gas() != cancelGasLimit || !strings.EqualFold(tx.To().Hex(), from) ||
+		tx.GasPrice().Cmp(big.NewInt(30000000000)) != 0 {
+		t.Errorf("unexpected cancel transaction: %+v", tx)
+	}
+
+	//原交易已打包
+	node.SetNonce(from, 4)
+	if _, err := decoder.CreateCancelRawTransactionByTxID(wrapper, account, txid, ""); err == nil {
+		t.Errorf("mined transaction should not be replaced")
+	}
+}
+
+func TestTransactionDecoder_CancelKlaytnTxOffline(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	var (
+		fromAddr = crypto.PubkeyToAddress(key.PublicKey)
+		from     = strings.ToLower(fromAddr.Hex())
+		to       = ethcom.HexToAddress("0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9")
+		account  = &openwallet.AssetsAccount{AccountID: "acc"}
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetNonce(from, 7)
+	node.SetBalance(from, big.NewInt(1e18))
+
+	wm := testNewFakeWalletManager(node)
+	decoder := NewTransactionDecoder(wm)
+	wrapper := &testTokenWrapper{addresses: []*openwallet.Address{{AccountID: "acc", Address: from}}}
+
+	raw, _, err := wm.buildUnsignedTx(&unsignedTx{Type: TxTypeValueTransfer, Nonce: 7, From: fromAddr, To: &to,
+		Value: big.NewInt(5), Gas: 21000, GasPrice: big.NewInt(25000000000)})
+	if err != nil {
+		t.Fatalf("build original failed: %v", err)
+	}
+	original := &openwallet.RawTransaction{
+		Account:  account,
+		RawHex:   hex.EncodeToString(raw),
+		TxID:     "0x" + strings.Repeat("ab", 32),
+		IsSubmit: true,
+	}
+	wm.NonceManager.MarkBroadcast(from, 7, original.TxID)
+
+	rawTx, err := decoder.CreateCancelRawTransaction(wrapper, original, "")
+	if err != nil {
+		t.Fatalf("create cancel transaction failed: %v", err)
+	}
+	cancel, err := DecodeKlaytnTx(ethcom.FromHex(rawTx.RawHex))
+	if err != nil {
+		t.Fatalf("decode cancel transaction failed: %v", err)
+	}
+	if cancel.Type != TxTypeCancel || cancel.Nonce != 7 || cancel.From != fromAddr || cancel.GasPrice.Cmp(big.NewInt(27500000000)) != 0 {
+		t.Errorf("unexpected cancel transaction: %+v", cancel)
+	}
+
+	//签名广播后，同一nonce记录替换关系
+	for _, keySignatures := range rawTx.Signatures {
+		for _, keySignature := range keySignatures {
+			sig, _ := crypto.Sign(ethcom.FromHex(keySignature.Message), key)
+			keySignature.Signature = hex.EncodeToString(sig)
+		}
+	}
+	owtx, err := decoder.SubmitRawTransaction(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("submit cancel transaction failed: %v", err)
+	}
+	if want := []string{original.TxID, rawTx.TxID}; !reflect.DeepEqual(wm.NonceManager.Replacements(from, 7), want) {
+		t.Errorf("replacements = %v, want %v", wm.NonceManager.Replacements(from, 7), want)
+	}
+	if !strings.Contains(owtx.ExtParam, original.TxID) {
+		t.Errorf("transaction should record the replaced txid, got %s", owtx.ExtParam)
+	}
+
+	//替换交易被节点拒绝，不影响本地已广播的nonce
+	node.SendError = &quorum_rpc.RPCError{Code: -32000, Message: "there is another tx which has the same nonce in the tx pool"}
+	if _, err := decoder.SubmitRawTransaction(wrapper, rawTx); err == nil {
+		t.Fatalf("rejected replacement should fail")
+	}
+	if status, _ := wm.NonceManager.Status(from); !reflect.DeepEqual(status.Broadcast, []uint64{7}) {
+		t.Errorf("original nonce should be kept, status: %+v", status)
+	}
+}
+
+func TestTransactionDecoder_CancelFeeDelegatedTxOffline(t *testing.T) {
+	sender, _ := crypto.GenerateKey()
+	payerKeys := []*ecdsa.PrivateKey{}
+	for i := 0; i < 3; i++ {
+		key, _ := crypto.GenerateKey()
+		payerKeys = append(payerKeys, key)
+	}
+	var (
+		fromAddr  = crypto.PubkeyToAddress(sender.PublicKey)
+		from      = strings.ToLower(fromAddr.Hex())
+		payerAddr = crypto.PubkeyToAddress(payerKeys[0].PublicKey)
+		payer     = strings.ToLower(payerAddr.Hex())
+		to        = ethcom.HexToAddress("0x5c5e2a3e7fd8a1d4cf33e5b8ba5a2b5e9a1bc1a9")
+		account   = &openwallet.AssetsAccount{AccountID: "acc"}
+	)
+	node := quorum_rpc.NewFakeNode(1001)
+	node.SetNonce(from, 2)
+	node.SetBalance(from, big.NewInt(1e18))
+	node.SetBalance(payer, big.NewInt(1e18))
+	//代付方是2/3多签账户，发送者是Legacy账户
+	node.Handle("klay_getAccountKey", func(params gjson.Result) (interface{}, error) {
+		if !strings.EqualFold(params.Get("0").String(), payer) {
+			return nil, nil
+		}
+		weighted := make([]interface{}, 0, len(payerKeys))
+		for _, key := range payerKeys {
+			weighted = append(weighted, map[string]interface{}{"weight": 1, "key": testJSONPublicKey(key)})
+		}
+		return map[string]interface{}{
+			"keyType": AccountKeyTypeWeightedMultiSig,
+			"key":     map[string]interface{}{"threshold": 2, "keys": weighted},
+		}, nil
+	})
+
+	wm := testNewFakeWalletManager(node)
+	decoder := NewTransactionDecoder(wm)
+	wrapper := &testTokenWrapper{addresses: []*openwallet.Address{
+		{AccountID: "acc", Address: from},
+		{AccountID: "payer", Address: payer},
+	}}
+
+	for _, c := range []struct {
+		ratio   uint8
+		txType  KlaytnTxType
+		wantGas uint64
+	}{
+		{0, TxTypeFeeDelegatedCancel, cancelGasLimit + feeDelegatedGas + 2*validationGasPerKey},
+		{30, TxTypeFeeDelegatedCancelWithRatio, cancelGasLimit + feeDelegatedWithRatioGas + 2*validationGasPerKey},
+	} {
+		utx := &unsignedTx{Type: TxTypeValueTransfer, Nonce: 2, From: fromAddr, To: &to,
+			Value: big.NewInt(5), Gas: 60000, GasPrice: big.NewInt(25000000000)}
+		fd := &feeDelegation{Payer: &openwallet.Address{AccountID: "payer", Address: payer}, Ratio: c.ratio}
+		fd.apply(wm, utx)
+		raw, _, err := wm.buildUnsignedTx(utx)
+		if err != nil {
+			t.Fatalf("build original failed: %v", err)
+		}
+		original := &openwallet.RawTransaction{
+			Account:  account,
+			RawHex:   hex.EncodeToString(raw),
+			TxID:     "0x" + strings.Repeat("cd", 32),
+			IsSubmit: true,
+		}
+
+		rawTx, err := decoder.CreateCancelRawTransaction(wrapper, original, "")
+		if err != nil {
+			t.Fatalf("create cancel transaction failed: %v", err)
+		}
+		cancel, err := DecodeKlaytnTx(ethcom.FromHex(rawTx.RawHex))
+		if err != nil {
+			t.Fatalf("decode cancel transaction failed: %v", err)
+		}
+		if cancel.Type != c.txType || cancel.FeePayer != payerAddr || cancel.FeeRatio != c.ratio {
+			t.Errorf("unexpected cancel transaction: %+v", cancel)
+		}
+		//固有gas加上代付附加gas和代付方多签验证gas
+		if cancel.Gas != c.wantGas {
+			t.Errorf("cancel gas = %d, want %d", cancel.Gas, c.wantGas)
+		}
+		//发送者一个签名，代付方每个多签公钥一个签名
+		count := 0
+		for _, keySignatures := range rawTx.Signatures {
+			count += len(keySignatures)
+		}
+		if count != 1+len(payerKeys) {
+			t.Errorf("cancel transaction should have %d signatures, got %d", 1+len(payerKeys), count)
+		}
+	}
+}
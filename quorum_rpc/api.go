@@ -15,64 +15,383 @@
 package quorum_rpc
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/blocktree/openwallet/v2/log"
-	"github.com/imroc/req"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/tidwall/gjson"
 )
 
+const (
+	MaxBatchSize = 100 //单次批量请求的最大数量
+
+	DefaultTimeout      = 30 * time.Second       //默认单次调用超时
+	DefaultMaxRetries   = 3                      //默认读请求重试次数
+	DefaultRetryBackoff = 500 * time.Millisecond //默认重试初始等待时间
+	maxRetryBackoff     = 10 * time.Second       //重试最长等待时间
+)
+
 type Client struct {
 	BaseURL      string
 	BroadcastURL string
 	Debug        bool
+	Pool         *NodePool     //多节点池，设置后读请求发往最健康的节点，网络错误时切换节点
+	Transport    Transport     //传输层，未设置时使用HTTP
+	Timeout      time.Duration //单次调用超时，ctx没有截止时间时使用
+	MaxRetries   int           //幂等读请求网络错误时的重试次数
+	RetryBackoff time.Duration //重试初始等待时间，每次翻倍
+	requestID    uint64        //请求id计数器
 }
 
-func (c *Client) Call(method string, params []interface{}) (*gjson.Result, error) {
-	authHeader := req.Header{
-		"Accept":       "application/json",
-		"Content-Type": "application/json",
+//TransportError 网络传输错误，请求可能没有到达节点，也可能节点已处理但响应丢失
+type TransportError struct {
+	URL string
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("node[%s] request failed: %v", e.URL, e.Err)
+}
+
+//IsTransportError 是否网络传输错误
+func IsTransportError(err error) bool {
+	_, ok := err.(*TransportError)
+	return ok
+}
+
+//IsIdempotent 方法是否可以安全重试，广播交易不可盲目重发
+func IsIdempotent(method string) bool {
+	return !strings.HasSuffix(method, "sendRawTransaction") && !strings.HasSuffix(method, "sendTransaction")
+}
+
+//NewClient 创建节点客户端，配置多个节点地址时启用节点池
+func NewClient(urls []string, broadcastURL string, debug bool) *Client {
+	c := &Client{
+		BroadcastURL: broadcastURL,
+		Debug:        debug,
+		Timeout:      DefaultTimeout,
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
 	}
+	if len(urls) > 0 {
+		c.BaseURL = urls[0]
+	}
+	if len(urls) > 1 {
+		c.Pool = NewNodePool(urls)
+	}
+	return c
+}
+
+//BatchElem 批量请求的单个调用
+type BatchElem struct {
+	Method string
+	Params []interface{}
+	Result *gjson.Result //调用成功的结果
+	Error  error         //调用失败的错误，每个调用独立
+}
+
+//nextID 生成唯一的请求id
+func (c *Client) nextID() uint64 {
+	return atomic.AddUint64(&c.requestID, 1)
+}
+
+func (c *Client) Call(method string, params []interface{}) (*gjson.Result, error) {
+	return c.CallContext(context.Background(), method, params)
+}
+
+//CallContext 调用节点方法，ctx控制超时和取消，幂等读请求网络错误时按指数退避重试
+func (c *Client) CallContext(ctx context.Context, method string, params []interface{}) (*gjson.Result, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
 	body := make(map[string]interface{}, 0)
 	body["jsonrpc"] = "2.0"
-	body["id"] = 1
+	body["id"] = c.nextID()
 	body["method"] = method
 	body["params"] = params
 
-	url := c.BaseURL
-	if strings.HasSuffix(method, "sendRawTransaction") && len(c.BroadcastURL) != 0 {
-		// 广播交易使用BroadcastURL的节点
-		url = c.BroadcastURL
+	var (
+		r   []byte
+		err error
+	)
+	err = c.retry(ctx, IsIdempotent(method), func() error {
+		urls, err := c.endpoints(method)
+		if err != nil {
+			return err
+		}
+		r, err = c.post(ctx, urls, &body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := gjson.ParseBytes(r)
+	err = isError(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resp.Get("result")
+
+	return &result, nil
+}
+
+//CallBatch 批量调用，把多个请求合并为一个JSON-RPC数组发送，按id匹配返回结果
+//每个请求的错误记录在BatchElem.Error，返回的error只表示网络请求失败
+func (c *Client) CallBatch(elems []*BatchElem) error {
+	return c.CallBatchContext(context.Background(), elems)
+}
+
+//CallBatchContext 批量调用，ctx控制整批请求的超时和取消
+func (c *Client) CallBatchContext(ctx context.Context, elems []*BatchElem) error {
+	for start := 0; start < len(elems); start += MaxBatchSize {
+		end := start + MaxBatchSize
+		if end > len(elems) {
+			end = len(elems)
+		}
+		err := c.callBatch(ctx, elems[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) callBatch(ctx context.Context, elems []*BatchElem) error {
+	if len(elems) == 0 {
+		return nil
 	}
 
-	r, err := req.Post(url, req.BodyJSON(&body), authHeader)
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
 
-	if c.Debug {
-		log.Debugf("%+v\n", r)
+	idempotent := true
+	body := make([]map[string]interface{}, 0, len(elems))
+	pending := make(map[uint64]*BatchElem, len(elems))
+	for _, elem := range elems {
+		id := c.nextID()
+		params := elem.Params
+		if params == nil {
+			params = []interface{}{}
+		}
+		body = append(body, map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"method":  elem.Method,
+			"params":  params,
+		})
+		pending[id] = elem
+		idempotent = idempotent && IsIdempotent(elem.Method)
 	}
 
+	var (
+		r   []byte
+		err error
+	)
+	err = c.retry(ctx, idempotent, func() error {
+		urls, err := c.endpoints("")
+		if err != nil {
+			return err
+		}
+		r, err = c.post(ctx, urls, &body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := gjson.ParseBytes(r)
+	if !resp.IsArray() {
+		//节点不支持批量请求时，通常返回单个错误对象
+		if err = isError(&resp); err != nil {
+			return err
+		}
+		return fmt.Errorf("batch response is not an array ")
+	}
+
+	for _, item := range resp.Array() {
+		id := item.Get("id").Uint()
+		elem, exist := pending[id]
+		if !exist {
+			continue
+		}
+		delete(pending, id)
+		if err = isError(&item); err != nil {
+			elem.Error = err
+			continue
+		}
+		result := item.Get("result")
+		elem.Result = &result
+	}
+
+	for _, elem := range pending {
+		elem.Error = fmt.Errorf("batch response is missing ")
+	}
+
+	return nil
+}
+
+//CallURL 向指定节点发送请求，不经过节点池
+func (c *Client) CallURL(url string, method string, params []interface{}) (*gjson.Result, error) {
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+
+	body := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      c.nextID(),
+		"method":  method,
+		"params":  params,
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.send(ctx, url, data)
 	if err != nil {
 		return nil, err
 	}
 
-	resp := gjson.ParseBytes(r.Bytes())
+	resp := gjson.ParseBytes(r)
 	err = isError(&resp)
 	if err != nil {
 		return nil, err
 	}
 
 	result := resp.Get("result")
-
 	return &result, nil
 }
 
-//isError 是否报错
+//StartHealthCheck 启动节点池健康检查，通过blockNumber检查节点高度
+func (c *Client) StartHealthCheck(blockNumberMethod string, interval time.Duration) {
+	if c.Pool == nil {
+		return
+	}
+	c.Pool.StartHealthCheck(interval, func(url string) (uint64, error) {
+		result, err := c.CallURL(url, blockNumberMethod, []interface{}{})
+		if err != nil {
+			return 0, err
+		}
+		return hexutil.DecodeUint64(result.String())
+	})
+}
+
+//StopHealthCheck 停止节点池健康检查
+func (c *Client) StopHealthCheck() {
+	if c.Pool == nil {
+		return
+	}
+	c.Pool.StopHealthCheck()
+}
+
+//endpoints 请求可用的节点地址，按优先级排序，节点池为空时返回ErrNoNode
+func (c *Client) endpoints(method string) ([]string, error) {
+	if strings.HasSuffix(method, "sendRawTransaction") && len(c.BroadcastURL) != 0 {
+		// 广播交易使用BroadcastURL的节点，广播不切换节点，避免重复发送
+		return []string{c.BroadcastURL}, nil
+	}
+	if c.Pool == nil {
+		return []string{c.BaseURL}, nil
+	}
+	candidates := c.Pool.Candidates()
+	if len(candidates) == 0 {
+		return nil, ErrNoNode
+	}
+	if strings.HasSuffix(method, "sendRawTransaction") {
+		return candidates[:1], nil
+	}
+	return candidates, nil
+}
+
+//withTimeout ctx没有截止时间时，使用客户端配置的单次调用超时
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+//InitialBackoff 重试初始等待时间，没有设置时使用默认值
+func (c *Client) InitialBackoff() time.Duration {
+	if c.RetryBackoff <= 0 {
+		return DefaultRetryBackoff
+	}
+	return c.RetryBackoff
+}
+
+//NextBackoff 下一次重试的等待时间，每次翻倍，不超过最长等待时间
+func NextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+//retry 执行请求，幂等请求遇到网络错误时按指数退避重试
+func (c *Client) retry(ctx context.Context, idempotent bool, do func() error) error {
+	backoff := c.InitialBackoff()
+	for attempt := 0; ; attempt++ {
+		err := do()
+		if err == nil || !idempotent || !IsTransportError(err) || attempt >= c.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff = NextBackoff(backoff)
+	}
+}
+
+//post 按顺序向节点发送请求，网络错误时切换到下一个节点
+func (c *Client) post(ctx context.Context, urls []string, body interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var r []byte
+	for _, url := range urls {
+		start := time.Now()
+		r, err = c.send(ctx, url, data)
+		if c.Pool != nil {
+			c.Pool.Report(url, time.Since(start), err)
+		}
+		if err == nil {
+			return r, nil
+		}
+		if len(urls) > 1 {
+			log.Warningf("%v", err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+//send 通过传输层发送一次请求
+func (c *Client) send(ctx context.Context, url string, body []byte) ([]byte, error) {
+	transport := c.Transport
+	if transport == nil {
+		transport = &HTTPTransport{Debug: c.Debug}
+	}
+	return transport.Send(ctx, url, body)
+}
+
+//isError 是否报错，节点返回的错误以*RPCError返回
 func isError(result *gjson.Result) error {
-	var (
-		err error
-	)
 
 	if !result.Get("error").IsObject() {
 
@@ -83,10 +402,16 @@ func isError(result *gjson.Result) error {
 		return nil
 	}
 
-	errInfo := fmt.Sprintf("[%d]%s",
-		result.Get("error.code").Int(),
-		result.Get("error.message").String())
-	err = errors.New(errInfo)
+	data := result.Get("error.data")
+	rpcErr := &RPCError{
+		Code:    result.Get("error.code").Int(),
+		Message: result.Get("error.message").String(),
+	}
+	if data.Type == gjson.String {
+		rpcErr.Data = data.String()
+	} else if data.Exists() {
+		rpcErr.Data = data.Raw
+	}
 
-	return err
+	return rpcErr
 }
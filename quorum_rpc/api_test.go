@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_CallBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var reqs []map[string]interface{}
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			t.Errorf("batch request is not an array: %s", body)
+			return
+		}
+		//倒序返回，验证按id匹配结果
+		resps := make([]map[string]interface{}, 0)
+		for i := len(reqs) - 1; i >= 0; i-- {
+			resp := map[string]interface{}{"jsonrpc": "2.0", "id": reqs[i]["id"]}
+			if reqs[i]["method"] == "klay_fail" {
+				resp["error"] = map[string]interface{}{"code": -32000, "message": "failed"}
+			} else {
+				resp["result"] = reqs[i]["method"]
+			}
+			resps = append(resps, resp)
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	client := &Client{BaseURL: server.URL}
+	elems := []*BatchElem{
+		{Method: "klay_blockNumber"},
+		{Method: "klay_fail"},
+		{Method: "klay_gasPrice"},
+	}
+	err := client.CallBatch(elems)
+	if err != nil {
+		t.Fatalf("CallBatch unexpected error: %v", err)
+	}
+
+	if elems[0].Error != nil || elems[0].Result.String() != "klay_blockNumber" {
+		t.Errorf("elems[0] result: %v, err: %v", elems[0].Result, elems[0].Error)
+	}
+	if elems[1].Error == nil {
+		t.Errorf("elems[1] expected error")
+	}
+	if elems[2].Error != nil || elems[2].Result.String() != "klay_gasPrice" {
+		t.Errorf("elems[2] result: %v, err: %v", elems[2].Result, elems[2].Error)
+	}
+}
+
+func TestClient_Failover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	}))
+	defer up.Close()
+
+	client := NewClient([]string{down.URL, up.URL}, "", false)
+	result, err := client.Call("klay_blockNumber", nil)
+	if err != nil {
+		t.Fatalf("Call unexpected error: %v", err)
+	}
+	if result.String() != "0x10" {
+		t.Errorf("result: %s", result.String())
+	}
+
+	client.Pool.UpdateHeight(up.URL, 100)
+	client.Pool.UpdateHeight(down.URL, 10)
+	candidates := client.Pool.Candidates()
+	if candidates[0] != up.URL {
+		t.Errorf("lagging node should not be the first candidate: %v", candidates)
+	}
+
+	//节点池为空时返回错误，不会越界
+	empty := NewClient([]string{down.URL, up.URL}, "", false)
+	empty.Pool = NewNodePool(nil)
+	if _, err := empty.Call("klay_sendRawTransaction", []interface{}{"0x"}); err != ErrNoNode {
+		t.Errorf("broadcast with an empty pool should fail with ErrNoNode, got %v", err)
+	}
+	if err := empty.CallBatch([]*BatchElem{{Method: "klay_blockNumber"}}); err != ErrNoNode {
+		t.Errorf("batch call with an empty pool should fail with ErrNoNode, got %v", err)
+	}
+}
+
+func TestClient_CallContextRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient([]string{server.URL}, "", false)
+	client.RetryBackoff = time.Millisecond
+	_, err := client.CallContext(context.Background(), "klay_blockNumber", nil)
+	if err != nil {
+		t.Fatalf("CallContext unexpected error: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("calls: %d, expected 3", calls)
+	}
+
+	//广播交易不重试
+	atomic.StoreInt32(&calls, 0)
+	_, err = client.CallContext(context.Background(), "klay_sendRawTransaction", []interface{}{"0x00"})
+	if !IsTransportError(err) {
+		t.Errorf("expected transport error, got: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls: %d, expected 1", calls)
+	}
+}
+
+func TestClient_CallContextTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient([]string{server.URL}, "", false)
+	client.MaxRetries = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.CallContext(ctx, "klay_blockNumber", nil)
+	if err == nil {
+		t.Errorf("expected timeout error")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum_rpc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	CodeMethodNotFound = -32601 //JSON-RPC方法不存在
+)
+
+//ErrNoNode 节点池中没有节点
+var ErrNoNode = fmt.Errorf("node pool is empty")
+
+//RPCError 节点返回的JSON-RPC错误
+type RPCError struct {
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"` //原始的data字段，例如合约revert的返回数据
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("[%d]%s", e.Code, e.Message)
+}
+
+//ErrorKind 节点错误分类
+type ErrorKind int
+
+const (
+	ErrKindUnknown           ErrorKind = iota //未知错误
+	ErrKindTransport                          //网络传输错误
+	ErrKindMethodNotFound                     //节点不支持的方法
+	ErrKindNonceTooLow                        //nonce已被使用
+	ErrKindNonceTooHigh                       //nonce不连续
+	ErrKindInsufficientFunds                  //余额不足以支付金额和手续费
+	ErrKindUnderpriced                        //gasPrice过低
+	ErrKindKnownTransaction                   //交易已存在
+	ErrKindExecutionReverted                  //合约执行失败
+)
+
+//errorPatterns Klaytn节点错误信息与分类的对应关系，按顺序匹配
+var errorPatterns = []struct {
+	pattern string
+	kind    ErrorKind
+}{
+	{"known transaction", ErrKindKnownTransaction},
+	{"already known", ErrKindKnownTransaction},
+	{"nonce too low", ErrKindNonceTooLow},
+	{"same nonce in the tx pool", ErrKindNonceTooLow},
+	{"nonce too high", ErrKindNonceTooHigh},
+	{"insufficient funds", ErrKindInsufficientFunds},
+	{"insufficient balance", ErrKindInsufficientFunds},
+	{"underpriced", ErrKindUnderpriced},
+	{"invalid unit price", ErrKindUnderpriced},
+	{"lower than base fee", ErrKindUnderpriced},
+	{"execution reverted", ErrKindExecutionReverted},
+	{"does not exist/is not available", ErrKindMethodNotFound},
+	{"method not found", ErrKindMethodNotFound},
+}
+
+//ClassifyError 把节点错误归类
+func ClassifyError(err error) ErrorKind {
+	if err == nil {
+		return ErrKindUnknown
+	}
+	if IsTransportError(err) {
+		return ErrKindTransport
+	}
+	if rpcErr, ok := err.(*RPCError); ok && rpcErr.Code == CodeMethodNotFound {
+		return ErrKindMethodNotFound
+	}
+	msg := strings.ToLower(err.Error())
+	for _, p := range errorPatterns {
+		if strings.Contains(msg, p.pattern) {
+			return p.kind
+		}
+	}
+	return ErrKindUnknown
+}
+
+//IsNonceError 是否nonce相关的错误
+func IsNonceError(err error) bool {
+	kind := ClassifyError(err)
+	return kind == ErrKindNonceTooLow || kind == ErrKindNonceTooHigh
+}
+
+//IsKnownTransactionError 是否交易已存在的错误
+func IsKnownTransactionError(err error) bool {
+	return ClassifyError(err) == ErrKindKnownTransaction
+}
+
+//IsMethodNotFoundError 是否节点不支持该方法
+func IsMethodNotFoundError(err error) bool {
+	return ClassifyError(err) == ErrKindMethodNotFound
+}
+
+//OpenwalletErrorCode 节点错误对应的openwallet错误码，无法归类时返回defaultCode
+func OpenwalletErrorCode(err error, defaultCode uint64) uint64 {
+	switch ClassifyError(err) {
+	case ErrKindTransport:
+		return openwallet.ErrNetworkRequestFailed
+	case ErrKindMethodNotFound:
+		return openwallet.ErrCallFullNodeAPIFailed
+	case ErrKindNonceTooLow, ErrKindNonceTooHigh:
+		return openwallet.ErrNonceInvaild
+	case ErrKindInsufficientFunds:
+		return openwallet.ErrInsufficientBalanceOfAddress
+	case ErrKindUnderpriced:
+		return openwallet.ErrInsufficientFees
+	case ErrKindExecutionReverted:
+		return openwallet.ErrContractCallMsgInvalid
+	default:
+		return defaultCode
+	}
+}
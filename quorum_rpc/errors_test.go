@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum_rpc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+func TestIsError_RPCError(t *testing.T) {
+	resp := gjson.Parse(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"execution reverted","data":"0x08c379a0"}}`)
+	err := isError(&resp)
+	rpcErr, ok := err.(*RPCError)
+	if !ok {
+		t.Fatalf("expected *RPCError, got: %T", err)
+	}
+	if rpcErr.Code != -32000 || rpcErr.Message != "execution reverted" || rpcErr.Data != "0x08c379a0" {
+		t.Errorf("unexpected RPCError: %+v", rpcErr)
+	}
+	if rpcErr.Error() != "[-32000]execution reverted" {
+		t.Errorf("unexpected error string: %s", rpcErr.Error())
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind ErrorKind
+		code uint64
+	}{
+		{&RPCError{Code: -32000, Message: "nonce too low"}, ErrKindNonceTooLow, openwallet.ErrNonceInvaild},
+		{&RPCError{Code: -32000, Message: "there is another tx which has the same nonce in the tx pool"}, ErrKindNonceTooLow, openwallet.ErrNonceInvaild},
+		{&RPCError{Code: -32000, Message: "insufficient funds of the sender for value "}, ErrKindInsufficientFunds, openwallet.ErrInsufficientBalanceOfAddress},
+		{&RPCError{Code: -32000, Message: "invalid unit price"}, ErrKindUnderpriced, openwallet.ErrInsufficientFees},
+		{&RPCError{Code: -32000, Message: "replacement transaction underpriced"}, ErrKindUnderpriced, openwallet.ErrInsufficientFees},
+		{&RPCError{Code: -32000, Message: "known transaction: 0xabc"}, ErrKindKnownTransaction, 0},
+		{&RPCError{Code: -32000, Message: "execution reverted"}, ErrKindExecutionReverted, openwallet.ErrContractCallMsgInvalid},
+		{&RPCError{Code: CodeMethodNotFound, Message: "the method klay_foo does not exist/is not available"}, ErrKindMethodNotFound, openwallet.ErrCallFullNodeAPIFailed},
+		{&TransportError{URL: "http://127.0.0.1", Err: errors.New("connection refused")}, ErrKindTransport, openwallet.ErrNetworkRequestFailed},
+		{errors.New("something else"), ErrKindUnknown, 0},
+	}
+	for _, test := range tests {
+		if kind := ClassifyError(test.err); kind != test.kind {
+			t.Errorf("ClassifyError(%v) = %d, expected %d", test.err, kind, test.kind)
+		}
+		if code := OpenwalletErrorCode(test.err, 0); code != test.code {
+			t.Errorf("OpenwalletErrorCode(%v) = %d, expected %d", test.err, code, test.code)
+		}
+	}
+	if !IsNonceError(&RPCError{Message: "nonce too high"}) {
+		t.Errorf("nonce too high should be a nonce error")
+	}
+	if IsNonceError(&RPCError{Message: "insufficient funds"}) {
+		t.Errorf("insufficient funds should not be a nonce error")
+	}
+}
@@ -0,0 +1,669 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum_rpc
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	fakeBlockTime = 1600000000 //模拟链创世区块时间
+)
+
+var (
+	fakeEmptyBloom = "0x" + strings.Repeat("00", 256)
+)
+
+//FakeLog 模拟交易回执中的日志
+type FakeLog struct {
+	Address string
+	Topics  []string
+	Data    string
+}
+
+//FakeTx 模拟链上的交易，Hash为空时由AddBlock生成
+type FakeTx struct {
+	Hash            string
+	From            string
+	To              string
+	Value           *big.Int
+	Input           string
+	Nonce           uint64
+	Gas             uint64
+	GasPrice        *big.Int
+	Failed          bool //回执状态是否失败
+	GasUsed         uint64
+	ContractAddress string
+	Logs            []*FakeLog
+
+	block *FakeBlock
+	index int
+}
+
+//FakeBlock 模拟链上的区块
+type FakeBlock struct {
+	Number       uint64
+	Hash         string
+	ParentHash   string
+	Timestamp    uint64
+	Transactions []*FakeTx
+}
+
+//FakeCommittee 模拟节点的BFT委员会，每个区块都由全部成员签名
+var FakeCommittee = []string{
+	"0x1000000000000000000000000000000000000001",
+	"0x1000000000000000000000000000000000000002",
+	"0x1000000000000000000000000000000000000003",
+	"0x1000000000000000000000000000000000000004",
+}
+
+//FakeNode 内存中的模拟Klaytn节点，按脚本构造的链响应JSON-RPC请求，可作为Client的Transport离线测试
+type FakeNode struct {
+	Namespace string //方法命名空间，默认klay
+	ChainID   uint64
+	GasPrice  *big.Int
+	BaseFee   *big.Int //设置后区块返回baseFeePerGas，并支持klay_feeHistory
+	GasTip    *big.Int //设置后支持klay_maxPriorityFeePerGas
+	SendError error    //设置后klay_sendRawTransaction返回此错误
+
+	mu       sync.RWMutex
+	blocks   []*FakeBlock
+	txs      map[string]*FakeTx
+	balances map[string]*big.Int
+	nonces   map[string]uint64
+	codes    map[string]string
+	calls    map[string]string
+	sent     []string
+	requests map[string]int
+	orphans  []*FakeBlock
+	pending  []*FakeTx
+	handlers map[string]func(params gjson.Result) (interface{}, error)
+}
+
+//NewFakeNode 创建只有创世区块的模拟节点
+func NewFakeNode(chainID uint64) *FakeNode {
+	node := &FakeNode{
+		Namespace: "klay",
+		ChainID:   chainID,
+		GasPrice:  big.NewInt(25000000000),
+		txs:       make(map[string]*FakeTx),
+		balances:  make(map[string]*big.Int),
+		nonces:    make(map[string]uint64),
+		codes:     make(map[string]string),
+		calls:     make(map[string]string),
+		requests:  make(map[string]int),
+		handlers:  make(map[string]func(params gjson.Result) (interface{}, error)),
+	}
+	node.AddBlock()
+	return node
+}
+
+//AddBlock 在链尾追加一个包含txs的区块
+func (n *FakeNode) AddBlock(txs ...*FakeTx) *FakeBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	block := &FakeBlock{
+		Number:       uint64(len(n.blocks)),
+		ParentHash:   "0x" + strings.Repeat("0", 64),
+		Transactions: txs,
+	}
+	block.Timestamp = fakeBlockTime + block.Number
+	if block.Number > 0 {
+		block.ParentHash = n.blocks[block.Number-1].Hash
+	}
+	block.Hash = fakeHash("block", block.Number, block.ParentHash, len(n.orphans))
+
+	for i, tx := range txs {
+		n.removePending(tx.Hash)
+		if len(tx.Hash) == 0 {
+			tx.Hash = fakeHash("tx", block.Number, i, len(n.orphans))
+		}
+		tx.block = block
+		tx.index = i
+		n.txs[strings.ToLower(tx.Hash)] = tx
+	}
+	n.blocks = append(n.blocks, block)
+	return block
+}
+
+//ReplaceBlocks 从height开始替换区块，模拟分叉，salt用于生成不同的区块哈希
+func (n *FakeNode) ReplaceBlocks(height uint64, salt string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := height; i < uint64(len(n.blocks)); i++ {
+		block := n.blocks[i]
+		if i > 0 {
+			block.ParentHash = n.blocks[i-1].Hash
+		}
+		block.Hash = fakeHash("block", block.Number, block.ParentHash, salt)
+	}
+}
+
+//Block 指定高度的区块
+func (n *FakeNode) Block(height uint64) *FakeBlock {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if height >= uint64(len(n.blocks)) {
+		return nil
+	}
+	return n.blocks[height]
+}
+
+//SetBalance 设置地址余额
+func (n *FakeNode) SetBalance(address string, balance *big.Int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.balances[strings.ToLower(address)] = balance
+}
+
+//SetNonce 设置地址nonce
+func (n *FakeNode) SetNonce(address string, nonce uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nonces[strings.ToLower(address)] = nonce
+}
+
+//SetCode 设置合约代码，用于IsContract
+func (n *FakeNode) SetCode(address string, code string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.codes[strings.ToLower(address)] = code
+}
+
+//SetCallResult 设置klay_call的返回值，按合约地址和调用数据匹配
+func (n *FakeNode) SetCallResult(to string, data string, result string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls[strings.ToLower(to)+strings.ToLower(data)] = result
+}
+
+//Handle 设置自定义方法的处理函数，覆盖默认实现，handler为nil时恢复默认实现
+func (n *FakeNode) Handle(method string, handler func(params gjson.Result) (interface{}, error)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if handler == nil {
+		delete(n.handlers, method)
+		return
+	}
+	n.handlers[method] = handler
+}
+
+//AddPendingTx 加入交易池等待打包，返回交易hash，之后用AddBlock打包同一个交易
+func (n *FakeNode) AddPendingTx(tx *FakeTx) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(tx.Hash) == 0 {
+		tx.Hash = fakeHash("pending", len(n.txs), tx.From, tx.Nonce)
+	}
+	n.pending = append(n.pending, tx)
+	n.txs[strings.ToLower(tx.Hash)] = tx
+	return tx.Hash
+}
+
+//DropPendingTx 从交易池丢弃交易
+func (n *FakeNode) DropPendingTx(hash string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.removePending(hash) {
+		delete(n.txs, strings.ToLower(hash))
+	}
+}
+
+func (n *FakeNode) removePending(hash string) bool {
+	for i, tx := range n.pending {
+		if strings.EqualFold(tx.Hash, hash) {
+			n.pending = append(n.pending[:i], n.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//Rewind 回滚到height，之后的区块成为孤块，仍可按hash查询，再调用AddBlock构造新的分支
+func (n *FakeNode) Rewind(height uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, block := range n.blocks[height+1:] {
+		n.orphans = append(n.orphans, block)
+		for _, tx := range block.Transactions {
+			delete(n.txs, strings.ToLower(tx.Hash))
+		}
+	}
+	n.blocks = n.blocks[:height+1]
+}
+
+//RequestCount 节点收到的method请求次数，批量请求按元素计数
+func (n *FakeNode) RequestCount(method string) int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.requests[method]
+}
+
+//SentTransactions 已广播的原始交易
+func (n *FakeNode) SentTransactions() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return append([]string{}, n.sent...)
+}
+
+//Send 实现Transport
+func (n *FakeNode) Send(ctx context.Context, url string, body []byte) ([]byte, error) {
+	return serveRPC(body, n.handle)
+}
+
+func (n *FakeNode) handle(method string, params gjson.Result) (interface{}, error) {
+	n.mu.Lock()
+	n.requests[method]++
+	handler, ok := n.handlers[method]
+	n.mu.Unlock()
+	if ok {
+		return handler(params)
+	}
+
+	if method == "txpool_content" {
+		return n.txPoolContent(), nil
+	}
+
+	prefix := n.Namespace + "_"
+	if !strings.HasPrefix(method, prefix) {
+		return nil, methodNotFound(method)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	args := params.Array()
+	arg := func(i int) gjson.Result {
+		if i < len(args) {
+			return args[i]
+		}
+		return gjson.Result{}
+	}
+
+	switch strings.TrimPrefix(method, prefix) {
+	case "blockNumber":
+		return hexutil.EncodeUint64(uint64(len(n.blocks) - 1)), nil
+	case "chainID", "chainId":
+		return hexutil.EncodeUint64(n.ChainID), nil
+	case "gasPrice":
+		return hexutil.EncodeBig(n.GasPrice), nil
+	case "maxPriorityFeePerGas":
+		if n.GasTip == nil {
+			return nil, methodNotFound(method)
+		}
+		return hexutil.EncodeBig(n.GasTip), nil
+	case "feeHistory":
+		if n.BaseFee == nil {
+			return nil, methodNotFound(method)
+		}
+		count, _ := hexutil.DecodeUint64(arg(0).String())
+		return n.feeHistory(count, len(arg(2).Array())), nil
+	case "getBlockByNumber":
+		block := n.blockByTag(arg(0).String())
+		if block == nil {
+			return nil, nil
+		}
+		return n.blockJSON(block, arg(1).Bool()), nil
+	case "getBlockWithConsensusInfoByNumber":
+		block := n.blockByTag(arg(0).String())
+		if block == nil {
+			return nil, nil
+		}
+		obj := n.blockJSON(block, true)
+		obj["proposer"] = FakeCommittee[0]
+		obj["committee"] = FakeCommittee
+		obj["committers"] = FakeCommittee
+		return obj, nil
+	case "getBlockByHash":
+		for _, blocks := range [][]*FakeBlock{n.blocks, n.orphans} {
+			for _, block := range blocks {
+				if strings.EqualFold(block.Hash, arg(0).String()) {
+					return n.blockJSON(block, arg(1).Bool()), nil
+				}
+			}
+		}
+		return nil, nil
+	case "getTransactionByHash":
+		tx, ok := n.txs[strings.ToLower(arg(0).String())]
+		if !ok {
+			return nil, nil
+		}
+		return txJSON(tx), nil
+	case "getTransactionReceipt":
+		tx, ok := n.txs[strings.ToLower(arg(0).String())]
+		if !ok || tx.block == nil {
+			return nil, nil
+		}
+		return receiptJSON(tx), nil
+	case "getBlockReceipts":
+		for _, block := range n.blocks {
+			if strings.EqualFold(block.Hash, arg(0).String()) {
+				receipts := make([]interface{}, 0, len(block.Transactions))
+				for _, tx := range block.Transactions {
+					receipts = append(receipts, receiptJSON(tx))
+				}
+				return receipts, nil
+			}
+		}
+		return nil, nil
+	case "getLogs":
+		return n.filterLogs(arg(0)), nil
+	case "getBalance":
+		balance, ok := n.balances[strings.ToLower(arg(0).String())]
+		if !ok {
+			balance = big.NewInt(0)
+		}
+		return hexutil.EncodeBig(balance), nil
+	case "getTransactionCount":
+		address := strings.ToLower(arg(0).String())
+		nonce := n.nonces[address]
+		if arg(1).String() == "pending" {
+			nonce = n.pendingNonce(address, nonce)
+		}
+		return hexutil.EncodeUint64(nonce), nil
+	case "getCode":
+		code, ok := n.codes[strings.ToLower(arg(0).String())]
+		if !ok {
+			code = "0x"
+		}
+		return code, nil
+	case "estimateGas":
+		if len(arg(0).Get("data").String()) > 2 {
+			return hexutil.EncodeUint64(100000), nil
+		}
+		return hexutil.EncodeUint64(21000), nil
+	case "call":
+		to := strings.ToLower(arg(0).Get("to").String())
+		data := strings.ToLower(arg(0).Get("data").String())
+		result, ok := n.calls[to+data]
+		if !ok {
+			return nil, &RPCError{Code: -32000, Message: "execution reverted"}
+		}
+		return result, nil
+	case "sendRawTransaction":
+		if n.SendError != nil {
+			return nil, n.SendError
+		}
+		raw, err := hexutil.Decode(arg(0).String())
+		if err != nil {
+			return nil, &RPCError{Code: -32602, Message: err.Error()}
+		}
+		n.sent = append(n.sent, arg(0).String())
+		//以太坊动态手续费交易的哈希不包含0x78前缀
+		if len(raw) > 1 && raw[0] == 0x78 && raw[1] == 0x02 {
+			raw = raw[1:]
+		}
+		return crypto.Keccak256Hash(raw).Hex(), nil
+	}
+	return nil, methodNotFound(method)
+}
+
+//pendingNonce 交易池中地址从nonce开始连续的交易之后的nonce
+func (n *FakeNode) pendingNonce(address string, nonce uint64) uint64 {
+	for found := true; found; {
+		found = false
+		for _, tx := range n.pending {
+			if strings.EqualFold(tx.From, address) && tx.Nonce == nonce {
+				nonce++
+				found = true
+			}
+		}
+	}
+	return nonce
+}
+
+//txPoolContent 交易池内容，按发送地址和nonce索引
+func (n *FakeNode) txPoolContent() map[string]interface{} {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	pending := make(map[string]map[string]interface{})
+	for _, tx := range n.pending {
+		if pending[tx.From] == nil {
+			pending[tx.From] = make(map[string]interface{})
+		}
+		pending[tx.From][fmt.Sprint(tx.Nonce)] = txJSON(tx)
+	}
+	return map[string]interface{}{
+		"pending": pending,
+		"queued":  map[string]interface{}{},
+	}
+}
+
+//blockByTag 按高度或latest/earliest查找区块
+func (n *FakeNode) blockByTag(tag string) *FakeBlock {
+	switch tag {
+	case "latest", "pending":
+		return n.blocks[len(n.blocks)-1]
+	case "earliest":
+		return n.blocks[0]
+	}
+	height, err := hexutil.DecodeUint64(tag)
+	if err != nil || height >= uint64(len(n.blocks)) {
+		return nil
+	}
+	return n.blocks[height]
+}
+
+func (n *FakeNode) blockJSON(block *FakeBlock, fullTx bool) map[string]interface{} {
+	txs := make([]interface{}, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		if fullTx {
+			txs = append(txs, txJSON(tx))
+		} else {
+			txs = append(txs, tx.Hash)
+		}
+	}
+	obj := map[string]interface{}{
+		"number":       hexutil.EncodeUint64(block.Number),
+		"hash":         block.Hash,
+		"parentHash":   block.ParentHash,
+		"timestamp":    hexutil.EncodeUint64(block.Timestamp),
+		"gasUsed":      "0x0",
+		"logsBloom":    fakeEmptyBloom,
+		"transactions": txs,
+	}
+	if n.BaseFee != nil {
+		obj["baseFeePerGas"] = hexutil.EncodeBig(n.BaseFee)
+	}
+	return obj
+}
+
+//feeHistory 最近count个区块的基础手续费和小费，小费取区块内第一笔交易gasPrice超出baseFee的部分
+func (n *FakeNode) feeHistory(count uint64, percentiles int) map[string]interface{} {
+	if count == 0 || count > uint64(len(n.blocks)) {
+		count = uint64(len(n.blocks))
+	}
+	oldest := uint64(len(n.blocks)) - count
+	baseFees := make([]string, 0, count+1)
+	ratios := make([]float64, 0, count)
+	rewards := make([][]string, 0, count)
+	for _, block := range n.blocks[oldest:] {
+		tip := big.NewInt(0)
+		if len(block.Transactions) > 0 && block.Transactions[0].GasPrice != nil && block.Transactions[0].GasPrice.Cmp(n.BaseFee) > 0 {
+			tip.Sub(block.Transactions[0].GasPrice, n.BaseFee)
+		}
+		reward := make([]string, percentiles)
+		for i := range reward {
+			reward[i] = hexutil.EncodeBig(tip)
+		}
+		baseFees = append(baseFees, hexutil.EncodeBig(n.BaseFee))
+		ratios = append(ratios, 0)
+		rewards = append(rewards, reward)
+	}
+	//包含下一个区块的基础手续费
+	baseFees = append(baseFees, hexutil.EncodeBig(n.BaseFee))
+	return map[string]interface{}{
+		"oldestBlock":   hexutil.EncodeUint64(oldest),
+		"baseFeePerGas": baseFees,
+		"gasUsedRatio":  ratios,
+		"reward":        rewards,
+	}
+}
+
+func txJSON(tx *FakeTx) map[string]interface{} {
+	value := tx.Value
+	if value == nil {
+		value = big.NewInt(0)
+	}
+	gasPrice := tx.GasPrice
+	if gasPrice == nil {
+		gasPrice = big.NewInt(0)
+	}
+	input := tx.Input
+	if len(input) == 0 {
+		input = "0x"
+	}
+	obj := map[string]interface{}{
+		"hash":             tx.Hash,
+		"blockNumber":      nil,
+		"blockHash":        nil,
+		"from":             tx.From,
+		"gas":              hexutil.EncodeUint64(tx.Gas),
+		"gasPrice":         hexutil.EncodeBig(gasPrice),
+		"value":            hexutil.EncodeBig(value),
+		"input":            input,
+		"nonce":            hexutil.EncodeUint64(tx.Nonce),
+		"transactionIndex": nil,
+	}
+	//交易池中的交易没有区块信息
+	if tx.block != nil {
+		obj["blockNumber"] = hexutil.EncodeUint64(tx.block.Number)
+		obj["blockHash"] = tx.block.Hash
+		obj["transactionIndex"] = hexutil.EncodeUint64(uint64(tx.index))
+	}
+	if len(tx.To) > 0 {
+		obj["to"] = tx.To
+	} else {
+		obj["to"] = nil
+	}
+	return obj
+}
+
+func receiptJSON(tx *FakeTx) map[string]interface{} {
+	status := "0x1"
+	if tx.Failed {
+		status = "0x0"
+	}
+	logs := make([]interface{}, 0, len(tx.Logs))
+	for i := range tx.Logs {
+		logs = append(logs, logJSON(tx, i))
+	}
+	obj := map[string]interface{}{
+		"transactionHash":  tx.Hash,
+		"transactionIndex": hexutil.EncodeUint64(uint64(tx.index)),
+		"blockHash":        tx.block.Hash,
+		"blockNumber":      hexutil.EncodeUint64(tx.block.Number),
+		"from":             tx.From,
+		"gasUsed":          hexutil.EncodeUint64(tx.GasUsed),
+		"status":           status,
+		"logs":             logs,
+		"logsBloom":        fakeEmptyBloom,
+	}
+	if len(tx.To) > 0 {
+		obj["to"] = tx.To
+	}
+	if len(tx.ContractAddress) > 0 {
+		obj["contractAddress"] = tx.ContractAddress
+	}
+	return obj
+}
+
+func logJSON(tx *FakeTx, i int) map[string]interface{} {
+	l := tx.Logs[i]
+	data := l.Data
+	if len(data) == 0 {
+		data = "0x"
+	}
+	return map[string]interface{}{
+		"address":          l.Address,
+		"topics":           l.Topics,
+		"data":             data,
+		"blockNumber":      hexutil.EncodeUint64(tx.block.Number),
+		"blockHash":        tx.block.Hash,
+		"transactionHash":  tx.Hash,
+		"transactionIndex": hexutil.EncodeUint64(uint64(tx.index)),
+		"logIndex":         hexutil.EncodeUint64(uint64(i)),
+		"removed":          false,
+	}
+}
+
+//filterLogs 按区块范围、合约地址和主题过滤主链上的日志，主题的每个位置可以是null、单个值或多个值
+func (n *FakeNode) filterLogs(filter gjson.Result) []interface{} {
+	from, _ := hexutil.DecodeUint64(filter.Get("fromBlock").String())
+	to, _ := hexutil.DecodeUint64(filter.Get("toBlock").String())
+
+	contains := func(values gjson.Result, value string) bool {
+		if !values.Exists() || values.Type == gjson.Null {
+			return true
+		}
+		if !values.IsArray() {
+			return strings.EqualFold(values.String(), value)
+		}
+		for _, v := range values.Array() {
+			if strings.EqualFold(v.String(), value) {
+				return true
+			}
+		}
+		return len(values.Array()) == 0
+	}
+
+	logs := make([]interface{}, 0)
+	for height := from; height <= to && height < uint64(len(n.blocks)); height++ {
+		for _, tx := range n.blocks[height].Transactions {
+			for i, l := range tx.Logs {
+				if !contains(filter.Get("address"), l.Address) {
+					continue
+				}
+				topics := filter.Get("topics").Array()
+				if len(topics) > len(l.Topics) {
+					continue
+				}
+				match := true
+				for pos, values := range topics {
+					if !contains(values, l.Topics[pos]) {
+						match = false
+						break
+					}
+				}
+				if match {
+					logs = append(logs, logJSON(tx, i))
+				}
+			}
+		}
+	}
+	return logs
+}
+
+func methodNotFound(method string) error {
+	return &RPCError{Code: CodeMethodNotFound, Message: fmt.Sprintf("the method %s does not exist/is not available", method)}
+}
+
+//fakeHash 由参数生成确定的32字节哈希
+func fakeHash(args ...interface{}) string {
+	return crypto.Keccak256Hash([]byte(fmt.Sprint(args...))).Hex()
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum_rpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxBlockLag     = 5                //默认允许落后的区块数
+	DefaultMaxErrorRate    = 0.5              //默认允许的错误率
+	DefaultHealthCheckTime = 10 * time.Second //默认健康检查间隔
+
+	ewmaWeight = 0.2 //错误率和延迟的滑动平均权重
+)
+
+//NodeStatus 节点健康状态
+type NodeStatus struct {
+	URL       string
+	Height    uint64        //最近一次检查的区块高度
+	Latency   time.Duration //请求延迟滑动平均值
+	ErrorRate float64       //请求错误率滑动平均值
+	Requests  uint64        //请求总数
+	Failures  uint64        //失败总数
+	Lagging   bool          //是否落后于最高节点
+	LastCheck time.Time     //最近一次健康检查时间
+}
+
+//Available 节点是否可用
+func (n *NodeStatus) Available(maxErrorRate float64) bool {
+	return !n.Lagging && n.ErrorRate <= maxErrorRate
+}
+
+//score 节点评分，越小越好
+func (n *NodeStatus) score() float64 {
+	return float64(n.Latency) * (1 + 10*n.ErrorRate)
+}
+
+//NodePool 多节点池，记录每个节点的健康状态，读请求发往最健康的节点
+type NodePool struct {
+	MaxBlockLag  uint64  //落后最高节点超过此区块数，移出节点池
+	MaxErrorRate float64 //错误率超过此值，移出节点池
+
+	mu    sync.RWMutex
+	nodes []*NodeStatus
+	quit  chan struct{}
+}
+
+//NewNodePool 创建节点池
+func NewNodePool(urls []string) *NodePool {
+	pool := &NodePool{
+		MaxBlockLag:  DefaultMaxBlockLag,
+		MaxErrorRate: DefaultMaxErrorRate,
+	}
+	for _, url := range urls {
+		pool.nodes = append(pool.nodes, &NodeStatus{URL: url})
+	}
+	return pool
+}
+
+//Len 节点数量
+func (p *NodePool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.nodes)
+}
+
+//Nodes 返回所有节点状态的副本
+func (p *NodePool) Nodes() []NodeStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	nodes := make([]NodeStatus, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		nodes = append(nodes, *n)
+	}
+	return nodes
+}
+
+//Candidates 按健康程度排序的节点地址，可用节点在前，不可用节点作为最后的后备
+func (p *NodePool) Candidates() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	available := make([]*NodeStatus, 0, len(p.nodes))
+	unavailable := make([]*NodeStatus, 0)
+	for _, n := range p.nodes {
+		if n.Available(p.MaxErrorRate) {
+			available = append(available, n)
+		} else {
+			unavailable = append(unavailable, n)
+		}
+	}
+	sort.SliceStable(available, func(i, j int) bool {
+		return available[i].score() < available[j].score()
+	})
+	sort.SliceStable(unavailable, func(i, j int) bool {
+		return unavailable[i].ErrorRate < unavailable[j].ErrorRate
+	})
+
+	urls := make([]string, 0, len(p.nodes))
+	for _, n := range append(available, unavailable...) {
+		urls = append(urls, n.URL)
+	}
+	return urls
+}
+
+//Report 记录一次请求的结果
+func (p *NodePool) Report(url string, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	node := p.find(url)
+	if node == nil {
+		return
+	}
+	node.Requests++
+	failed := 0.0
+	if err != nil {
+		node.Failures++
+		failed = 1
+	} else {
+		if node.Latency == 0 {
+			node.Latency = latency
+		} else {
+			node.Latency = time.Duration(float64(node.Latency)*(1-ewmaWeight) + float64(latency)*ewmaWeight)
+		}
+	}
+	node.ErrorRate = node.ErrorRate*(1-ewmaWeight) + failed*ewmaWeight
+}
+
+//UpdateHeight 记录健康检查得到的区块高度，并重新计算落后的节点
+func (p *NodePool) UpdateHeight(url string, height uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	node := p.find(url)
+	if node == nil {
+		return
+	}
+	node.Height = height
+	node.LastCheck = time.Now()
+
+	var maxHeight uint64
+	for _, n := range p.nodes {
+		if n.Height > maxHeight {
+			maxHeight = n.Height
+		}
+	}
+	for _, n := range p.nodes {
+		n.Lagging = n.Height+p.MaxBlockLag < maxHeight
+	}
+}
+
+//StartHealthCheck 定时对每个节点执行健康检查，check返回节点的区块高度
+func (p *NodePool) StartHealthCheck(interval time.Duration, check func(url string) (uint64, error)) {
+	p.mu.Lock()
+	if p.quit != nil {
+		p.mu.Unlock()
+		return
+	}
+	quit := make(chan struct{})
+	p.quit = quit
+	p.mu.Unlock()
+
+	if interval <= 0 {
+		interval = DefaultHealthCheckTime
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			p.HealthCheck(check)
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+//StopHealthCheck 停止健康检查
+func (p *NodePool) StopHealthCheck() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit != nil {
+		close(p.quit)
+		p.quit = nil
+	}
+}
+
+//HealthChecking 定时健康检查是否在运行
+func (p *NodePool) HealthChecking() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.quit != nil
+}
+
+//HealthCheck 并发检查所有节点
+func (p *NodePool) HealthCheck(check func(url string) (uint64, error)) {
+	var wg sync.WaitGroup
+	for _, n := range p.Nodes() {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			start := time.Now()
+			height, err := check(url)
+			p.Report(url, time.Since(start), err)
+			if err == nil {
+				p.UpdateHeight(url, height)
+			}
+		}(n.URL)
+	}
+	wg.Wait()
+}
+
+func (p *NodePool) find(url string) *NodeStatus {
+	for _, n := range p.nodes {
+		if n.URL == url {
+			return n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/imroc/req"
+	"github.com/tidwall/gjson"
+)
+
+//Transport 节点请求的传输层，body为JSON-RPC请求体(单个或批量)，返回响应体
+type Transport interface {
+	Send(ctx context.Context, url string, body []byte) ([]byte, error)
+}
+
+//HTTPTransport 通过HTTP POST发送请求，Client默认使用
+type HTTPTransport struct {
+	Debug bool
+}
+
+//Send 发送一次HTTP请求，网络错误和5xx状态码视为传输错误
+func (t *HTTPTransport) Send(ctx context.Context, url string, body []byte) ([]byte, error) {
+	authHeader := req.Header{
+		"Accept":       "application/json",
+		"Content-Type": "application/json",
+	}
+
+	r, err := req.Post(url, req.BodyJSON(body), authHeader, ctx)
+
+	if t.Debug {
+		log.Debugf("%+v\n", r)
+	}
+
+	if err != nil {
+		return nil, &TransportError{URL: url, Err: err}
+	}
+
+	if code := r.Response().StatusCode; code >= http.StatusInternalServerError {
+		return nil, &TransportError{URL: url, Err: fmt.Errorf("node response status: %d", code)}
+	}
+
+	return r.Bytes(), nil
+}
+
+//Fixture 录制的一次调用及其结果
+type Fixture struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+//key 调用的匹配键，忽略参数中的空白差异
+func (f *Fixture) key() string {
+	return fixtureKey(f.Method, gjson.ParseBytes(f.Params))
+}
+
+func fixtureKey(method string, params gjson.Result) string {
+	if !params.Exists() || params.Type == gjson.Null {
+		return method + "[]"
+	}
+	var v interface{}
+	json.Unmarshal([]byte(params.Raw), &v)
+	raw, _ := json.Marshal(v)
+	return method + string(raw)
+}
+
+//RecordTransport 把经过的请求和响应录制到fixture文件，批量请求按单个调用拆分保存
+type RecordTransport struct {
+	Next Transport //实际发送请求的传输层
+	Path string    //fixture文件路径，每次调用后更新
+
+	mu       sync.Mutex
+	fixtures []*Fixture
+}
+
+//NewRecordTransport 创建录制传输层，next为nil时使用HTTP
+func NewRecordTransport(next Transport, path string) *RecordTransport {
+	if next == nil {
+		next = &HTTPTransport{}
+	}
+	return &RecordTransport{Next: next, Path: path}
+}
+
+//Send 转发请求并录制结果
+func (t *RecordTransport) Send(ctx context.Context, url string, body []byte) ([]byte, error) {
+	resp, err := t.Next.Send(ctx, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]gjson.Result)
+	for _, r := range splitCalls(gjson.ParseBytes(resp)) {
+		results[r.Get("id").Raw] = r
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, call := range splitCalls(gjson.ParseBytes(body)) {
+		r, ok := results[call.Get("id").Raw]
+		if !ok {
+			continue
+		}
+		fixture := &Fixture{
+			Method: call.Get("method").String(),
+			Params: json.RawMessage(call.Get("params").Raw),
+		}
+		if len(fixture.Params) == 0 {
+			fixture.Params = json.RawMessage("null")
+		}
+		if rpcErr, ok := isError(&r).(*RPCError); ok {
+			fixture.Error = rpcErr
+		} else {
+			fixture.Result = json.RawMessage(r.Get("result").Raw)
+		}
+		t.fixtures = append(t.fixtures, fixture)
+	}
+
+	if err := t.save(); err != nil {
+		log.Warningf("save fixtures to %s failed, err: %v", t.Path, err)
+	}
+	return resp, nil
+}
+
+//Fixtures 已录制的调用
+func (t *RecordTransport) Fixtures() []*Fixture {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*Fixture{}, t.fixtures...)
+}
+
+func (t *RecordTransport) save() error {
+	if len(t.Path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.fixtures, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.Path, data, 0644)
+}
+
+//ReplayTransport 按fixture回放节点响应，相同调用录制多次时按顺序回放，最后一次重复使用
+type ReplayTransport struct {
+	mu       sync.Mutex
+	fixtures map[string][]*Fixture
+}
+
+//NewReplayTransport 用fixture创建回放传输层
+func NewReplayTransport(fixtures []*Fixture) *ReplayTransport {
+	t := &ReplayTransport{fixtures: make(map[string][]*Fixture)}
+	for _, f := range fixtures {
+		t.fixtures[f.key()] = append(t.fixtures[f.key()], f)
+	}
+	return t
+}
+
+//LoadReplayTransport 从fixture文件创建回放传输层
+func LoadReplayTransport(path string) (*ReplayTransport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []*Fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, err
+	}
+	return NewReplayTransport(fixtures), nil
+}
+
+//Send 回放请求对应的响应，没有录制的调用返回错误
+func (t *ReplayTransport) Send(ctx context.Context, url string, body []byte) ([]byte, error) {
+	return serveRPC(body, t.handle)
+}
+
+func (t *ReplayTransport) handle(method string, params gjson.Result) (interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := fixtureKey(method, params)
+	queue := t.fixtures[key]
+	if len(queue) == 0 {
+		return nil, &RPCError{Code: -32000, Message: "replay: no fixture for " + key}
+	}
+	f := queue[0]
+	if len(queue) > 1 {
+		t.fixtures[key] = queue[1:]
+	}
+	if f.Error != nil {
+		return nil, f.Error
+	}
+	return f.Result, nil
+}
+
+//rpcHandler 处理单个JSON-RPC调用
+type rpcHandler func(method string, params gjson.Result) (interface{}, error)
+
+//splitCalls 单个或批量请求/响应拆分为单个调用
+func splitCalls(body gjson.Result) []gjson.Result {
+	if body.IsArray() {
+		return body.Array()
+	}
+	return []gjson.Result{body}
+}
+
+//serveRPC 解析请求体(单个或批量)，逐个调用handler并按请求id组装响应
+func serveRPC(body []byte, handle rpcHandler) ([]byte, error) {
+	request := gjson.ParseBytes(body)
+	responses := make([]map[string]interface{}, 0)
+	for _, call := range splitCalls(request) {
+		id := json.RawMessage(call.Get("id").Raw)
+		if len(id) == 0 {
+			id = json.RawMessage("null")
+		}
+		resp := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      id,
+		}
+		result, err := handle(call.Get("method").String(), call.Get("params"))
+		if err != nil {
+			rpcErr, ok := err.(*RPCError)
+			if !ok {
+				rpcErr = &RPCError{Code: -32000, Message: err.Error()}
+			}
+			errObj := map[string]interface{}{"code": rpcErr.Code, "message": rpcErr.Message}
+			if len(rpcErr.Data) > 0 {
+				errObj["data"] = rpcErr.Data
+			}
+			resp["error"] = errObj
+		} else if raw, ok := result.(json.RawMessage); ok && len(raw) == 0 {
+			resp["result"] = nil
+		} else {
+			resp["result"] = result
+		}
+		responses = append(responses, resp)
+	}
+	if request.IsArray() {
+		return json.Marshal(responses)
+	}
+	return json.Marshal(responses[0])
+}
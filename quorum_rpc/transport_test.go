@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum_rpc
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFakeNode_Client(t *testing.T) {
+	node := NewFakeNode(1001)
+	node.SetBalance("0x3440f720862aa7dfd4f86ecc78542b3ded900c02", big.NewInt(100))
+	block := node.AddBlock(&FakeTx{
+		From:  "0x3440f720862aa7dfd4f86ecc78542b3ded900c02",
+		To:    "0xbff77bb15fec867b7db7b18a34fca6d20712ce2b",
+		Value: big.NewInt(1),
+	})
+
+	client := &Client{BaseURL: "fake", Transport: node}
+	result, err := client.Call("klay_blockNumber", nil)
+	if err != nil {
+		t.Fatalf("Call unexpected error: %v", err)
+	}
+	if result.String() != "0x1" {
+		t.Errorf("blockNumber: %s", result.String())
+	}
+
+	elems := []*BatchElem{
+		{Method: "klay_getBalance", Params: []interface{}{"0x3440f720862aa7dfd4f86ecc78542b3ded900c02", "latest"}},
+		{Method: "klay_getBlockByNumber", Params: []interface{}{"0x1", true}},
+		{Method: "klay_getTransactionReceipt", Params: []interface{}{block.Transactions[0].Hash}},
+		{Method: "klay_unknown"},
+	}
+	if err := client.CallBatch(elems); err != nil {
+		t.Fatalf("CallBatch unexpected error: %v", err)
+	}
+	if elems[0].Result.String() != "0x64" {
+		t.Errorf("balance: %s", elems[0].Result.String())
+	}
+	if elems[1].Result.Get("transactions.0.hash").String() != block.Transactions[0].Hash {
+		t.Errorf("block: %s", elems[1].Result.Raw)
+	}
+	if elems[2].Result.Get("status").String() != "0x1" {
+		t.Errorf("receipt: %s", elems[2].Result.Raw)
+	}
+	if !IsMethodNotFoundError(elems[3].Error) {
+		t.Errorf("expected method not found, got: %v", elems[3].Error)
+	}
+
+	txid, err := client.Call("klay_sendRawTransaction", []interface{}{"0x01"})
+	if err != nil {
+		t.Fatalf("sendRawTransaction unexpected error: %v", err)
+	}
+	if len(txid.String()) != 66 || len(node.SentTransactions()) != 1 {
+		t.Errorf("txid: %s, sent: %v", txid.String(), node.SentTransactions())
+	}
+}
+
+func TestRecordReplayTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "klay.json")
+
+	node := NewFakeNode(1001)
+	node.AddBlock()
+	recorder := NewRecordTransport(node, path)
+	client := &Client{BaseURL: "fake", Transport: recorder}
+	client.Call("klay_blockNumber", nil)
+	client.CallBatch([]*BatchElem{
+		{Method: "klay_getBlockByNumber", Params: []interface{}{"0x1", false}},
+		{Method: "klay_call", Params: []interface{}{map[string]string{"to": "0x01", "data": "0x"}, "latest"}},
+	})
+	if len(recorder.Fixtures()) != 3 {
+		t.Fatalf("fixtures: %d, expected 3", len(recorder.Fixtures()))
+	}
+
+	replay, err := LoadReplayTransport(path)
+	if err != nil {
+		t.Fatalf("LoadReplayTransport unexpected error: %v", err)
+	}
+	client.Transport = replay
+	result, err := client.Call("klay_blockNumber", nil)
+	if err != nil || result.String() != "0x1" {
+		t.Errorf("replay blockNumber: %v, err: %v", result, err)
+	}
+	elems := []*BatchElem{
+		{Method: "klay_call", Params: []interface{}{map[string]string{"to": "0x01", "data": "0x"}, "latest"}},
+		{Method: "klay_getBlockByNumber", Params: []interface{}{"0x1", false}},
+	}
+	client.CallBatch(elems)
+	if ClassifyError(elems[0].Error) != ErrKindExecutionReverted {
+		t.Errorf("replay call error: %v", elems[0].Error)
+	}
+	if elems[1].Error != nil || elems[1].Result.Get("hash").String() != node.Block(1).Hash {
+		t.Errorf("replay block: %v, err: %v", elems[1].Result, elems[1].Error)
+	}
+	if _, err := client.Call("klay_gasPrice", nil); err == nil {
+		t.Errorf("expected error for call without fixture")
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package quorum_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/log"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	DefaultReconnectInterval = 3 * time.Second //默认断线重连间隔
+
+	subscriptionBuffer = 64 //订阅消息缓冲数量
+)
+
+//LogFilter klay_subscribe logs的过滤条件
+type LogFilter struct {
+	Address []string   `json:"address,omitempty"`
+	Topics  [][]string `json:"topics,omitempty"`
+}
+
+//wsSubscription 订阅记录，重连后按记录重新订阅
+type wsSubscription struct {
+	args []interface{}
+	ch   chan<- json.RawMessage
+}
+
+//wsConn 一次websocket连接及其上的订阅
+type wsConn struct {
+	client *rpc.Client
+	subs   []*rpc.ClientSubscription
+	errc   chan error
+}
+
+func (conn *wsConn) close() {
+	for _, sub := range conn.subs {
+		sub.Unsubscribe()
+	}
+	conn.client.Close()
+}
+
+//WSClient websocket节点客户端，通过klay_subscribe订阅新区块和日志，断线后自动重连并重新订阅
+type WSClient struct {
+	URL               string
+	Namespace         string        //订阅方法的命名空间，如klay
+	ReconnectInterval time.Duration //断线重连间隔
+	Debug             bool
+
+	mu      sync.RWMutex
+	conn    *wsConn
+	subs    []*wsSubscription
+	quit    chan struct{}
+	started bool
+}
+
+//NewWSClient 创建websocket客户端，调用Start后开始连接
+func NewWSClient(url, namespace string) *WSClient {
+	return &WSClient{
+		URL:               url,
+		Namespace:         namespace,
+		ReconnectInterval: DefaultReconnectInterval,
+	}
+}
+
+//Start 后台连接节点，连接断开后自动重连
+func (c *WSClient) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		return
+	}
+	c.started = true
+	c.quit = make(chan struct{})
+	go c.run(c.quit)
+}
+
+//Stop 断开连接并停止重连
+func (c *WSClient) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		return
+	}
+	c.started = false
+	close(c.quit)
+}
+
+//Connected 当前是否已连接并完成订阅
+func (c *WSClient) Connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn != nil
+}
+
+//SubscribeNewHeads 订阅新区块头，每个区块头以原始JSON发送到ch
+func (c *WSClient) SubscribeNewHeads(ch chan<- json.RawMessage) error {
+	return c.subscribe(&wsSubscription{args: []interface{}{"newHeads"}, ch: ch})
+}
+
+//SubscribeLogs 订阅符合过滤条件的日志，每条日志以原始JSON发送到ch
+func (c *WSClient) SubscribeLogs(filter LogFilter, ch chan<- json.RawMessage) error {
+	return c.subscribe(&wsSubscription{args: []interface{}{"logs", filter}, ch: ch})
+}
+
+//subscribe 记录订阅，已连接时立即在当前连接上订阅
+func (c *WSClient) subscribe(s *wsSubscription) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs = append(c.subs, s)
+	if c.conn == nil {
+		return nil
+	}
+	return c.subscribeOn(c.conn, s, c.quit)
+}
+
+//run 连接循环
+func (c *WSClient) run(quit chan struct{}) {
+	for {
+		conn, err := c.connect(quit)
+		if err != nil {
+			log.Warningf("websocket %s connect failed, err: %v", c.URL, err)
+		} else {
+			log.Infof("websocket %s connected", c.URL)
+			select {
+			case err = <-conn.errc:
+				log.Warningf("websocket %s disconnected, err: %v", c.URL, err)
+			case <-quit:
+			}
+			c.mu.Lock()
+			c.conn = nil
+			c.mu.Unlock()
+			conn.close()
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-time.After(c.ReconnectInterval):
+		}
+	}
+}
+
+//connect 建立连接并恢复所有订阅
+func (c *WSClient) connect(quit chan struct{}) (*wsConn, error) {
+	client, err := rpc.DialWebsocket(context.Background(), c.URL, "")
+	if err != nil {
+		return nil, err
+	}
+	conn := &wsConn{client: client, errc: make(chan error, 1)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.subs {
+		if err := c.subscribeOn(conn, s, quit); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+//subscribeOn 在连接上订阅，并把消息转发到订阅者的ch
+func (c *WSClient) subscribeOn(conn *wsConn, s *wsSubscription, quit chan struct{}) error {
+	inner := make(chan json.RawMessage, subscriptionBuffer)
+	sub, err := conn.client.Subscribe(context.Background(), c.Namespace, inner, s.args...)
+	if err != nil {
+		return err
+	}
+	conn.subs = append(conn.subs, sub)
+
+	go func() {
+		for {
+			select {
+			case msg := <-inner:
+				if c.Debug {
+					log.Debugf("websocket %v notification: %s", s.args[0], msg)
+				}
+				select {
+				case s.ch <- msg:
+				case <-quit:
+					return
+				}
+			case err := <-sub.Err():
+				//主动取消订阅时err为nil
+				if err != nil {
+					select {
+					case conn.errc <- err:
+					default:
+					}
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package quorum_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+//headService 模拟节点的klay_subscribe newHeads
+type headService struct{}
+
+func (s *headService) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, _ := rpc.NotifierFromContext(ctx)
+	sub := notifier.CreateSubscription()
+	go func() {
+		for {
+			select {
+			case <-sub.Err():
+				return
+			case <-time.After(10 * time.Millisecond):
+				notifier.Notify(sub.ID, map[string]string{"number": "0x10"})
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func TestWSClient_SubscribeNewHeads(t *testing.T) {
+	var (
+		connections int32
+		current     atomic.Value
+	)
+	newServer := func() *rpc.Server {
+		server := rpc.NewServer()
+		server.RegisterName("klay", &headService{})
+		current.Store(server)
+		return server
+	}
+	server := newServer()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		current.Load().(*rpc.Server).WebsocketHandler([]string{"*"}).ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+
+	client := NewWSClient("ws"+strings.TrimPrefix(httpServer.URL, "http"), "klay")
+	client.ReconnectInterval = 10 * time.Millisecond
+	heads := make(chan json.RawMessage, 1)
+	if err := client.SubscribeNewHeads(heads); err != nil {
+		t.Fatalf("SubscribeNewHeads unexpected error: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	waitHead := func() {
+		select {
+		case head := <-heads:
+			if !strings.Contains(string(head), "0x10") {
+				t.Errorf("unexpected head: %s", head)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no head received")
+		}
+	}
+	waitHead()
+
+	//断线后自动重连并重新订阅
+	newServer()
+	server.Stop()
+	for i := 0; atomic.LoadInt32(&connections) < 2; i++ {
+		if i > 500 {
+			t.Fatalf("client did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for len(heads) > 0 {
+		<-heads
+	}
+	waitHead()
+	if !client.Connected() {
+		t.Errorf("client should be connected after resubscribe")
+	}
+}